@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// statusRecorder is a ResponseWriter that remembers the status and size of
+// the response written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// Hijack lets websocket upgrades take over the connection through the
+// recorder, as they need to.
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type accessLogHandler struct {
+	geo  *geoIP
+	next http.Handler
+}
+
+func (h *accessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !logging(levelInfo) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	h.next.ServeHTTP(rec, r)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	// For websockets, the latency is how long the connection was open.
+	from := clientIP(r)
+	if country := h.geo.country(from); country != "" {
+		from += " (" + country + ")"
+	}
+	log.Printf("%s %s %s %d %d %s", from, r.Method, r.URL.RequestURI(),
+		rec.status, rec.size, time.Since(start))
+}
+
+// LogRequests wraps handler so that every request is logged, along with the
+// status and size of the response and how long it took, at the info log level.
+// With geo, the country each request came from is logged too.
+func LogRequests(geo *geoIP, handler http.Handler) http.Handler {
+	return &accessLogHandler{geo: geo, next: handler}
+}
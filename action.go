@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// People can say what they are doing, with /me, as on IRC: "/me waves" is
+// shown as "* Ada waves". Such messages are actions, and are recorded in the
+// room's history like any other message, still marked as actions.
+
+// meCommand is /me <action>, which sends an action message to the room.
+func meCommand(c *client, args string) error {
+	if args == "" {
+		return errUsage
+	}
+	c.post(&message{Message: args, Action: true})
+	return nil
+}
+
+// ircAction returns the text of the action if text is an IRC CTCP ACTION,
+// which is how IRC clients send /me.
+func ircAction(text string) (string, bool) {
+	if !strings.HasPrefix(text, "\x01ACTION ") {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01"), true
+}
+
+// actionText is how an action by the named person reads as plain text.
+func actionText(name, action string) string {
+	return "* " + name + " " + action
+}
+
+// post sends a message from the client to the room, once the room's
+// moderation, if any, has let it through.
+func (c *client) post(msg *message) {
+	msg.When = time.Now()
+	msg.Name = c.name()
+	msg.Avatar = c.avatar()
+	msg.from = c
+	if c.room.moderation != nil && !c.room.moderation.check(c, msg) {
+		return
+	}
+	c.room.forward <- msg
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// adminRoomsHandler serves the moderators' API for rooms, under
+// /api/admin/rooms/{name}/.
+type adminRoomsHandler struct {
+	rooms map[string]*room
+}
+
+func (h *adminRoomsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/admin/rooms/"), "/", 3)
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	room, ok := h.rooms[parts[0]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case parts[1] == "shadowbans":
+		if requireRoomPermission(w, r, room, permDeleteOthers) == "" {
+			return
+		}
+		account := ""
+		if len(parts) == 3 {
+			account = parts[2]
+		}
+		serveShadowBans(w, r, room, account)
+	case parts[1] == "export" && len(parts) == 2:
+		if requireRoomPermission(w, r, room, permOwnRoom) == "" {
+			return
+		}
+		serveExport(w, r, room)
+	case parts[1] == "retention" && len(parts) == 2:
+		if requireRoomPermission(w, r, room, permOwnRoom) == "" {
+			return
+		}
+		serveRetention(w, r, room)
+	default:
+		http.NotFound(w, r)
+	}
+}
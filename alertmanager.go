@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Alertmanager can send the alerts it fires, and their resolving, to a
+// webhook, which turns a room into a lightweight channel for whoever is on
+// call. Each alert is posted as a message from alertmanagerName, labelled
+// with its severity, or as resolved, for clients to colour it by.
+
+// alertmanagerName is the name alerts are posted to the room under.
+const alertmanagerName = "Alertmanager"
+
+// alertmanagerPayload is what Alertmanager sends its webhooks: the alerts in
+// a group, each firing or resolved.
+type alertmanagerPayload struct {
+	Status       string              `json:"status"`
+	Alerts       []alertmanagerAlert `json:"alerts"`
+	CommonLabels map[string]string   `json:"commonLabels"`
+	ExternalURL  string              `json:"externalURL"`
+}
+
+type alertmanagerAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+}
+
+// alertResolved is the Alert of messages about alerts that have resolved,
+// whatever their severity.
+const alertResolved = "resolved"
+
+// severity is the alert's severity label, or "warning" if it hasn't one.
+func (a *alertmanagerAlert) severity() string {
+	if s := a.Labels["severity"]; s != "" {
+		return strings.ToLower(s)
+	}
+	return "warning"
+}
+
+// text is the message saying what the alert is: whether it is firing or
+// resolved, its name and severity, its summary, and the labels that tell it
+// apart from the others.
+func (a *alertmanagerAlert) text() string {
+	var b strings.Builder
+	if a.Status == alertResolved {
+		b.WriteString("[RESOLVED] ")
+	} else {
+		b.WriteString("[FIRING] ")
+	}
+	name := a.Labels["alertname"]
+	if name == "" {
+		name = "Alert"
+	}
+	fmt.Fprintf(&b, "%s (%s)", name, a.severity())
+	summary := a.Annotations["summary"]
+	if summary == "" {
+		summary = a.Annotations["description"]
+	}
+	if summary != "" {
+		b.WriteString(": " + summary)
+	}
+	var labels []string
+	for k, v := range a.Labels {
+		if k != "alertname" && k != "severity" {
+			labels = append(labels, k+"="+v)
+		}
+	}
+	if len(labels) > 0 {
+		sort.Strings(labels)
+		b.WriteString(" [" + strings.Join(labels, " ") + "]")
+	}
+	if a.GeneratorURL != "" {
+		b.WriteString(" " + a.GeneratorURL)
+	}
+	return b.String()
+}
+
+// alertmanagerHandler serves POST /api/hooks/alertmanager?token=<token>, the
+// webhook Alertmanager sends alerts to, posting them to the room. The token
+// keeps anybody else from posting alerts.
+type alertmanagerHandler struct {
+	room  *room
+	token string
+}
+
+func (h *alertmanagerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(h.token)) != 1 {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+	var payload alertmanagerPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&payload); err != nil {
+		http.Error(w, "bad alerts: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range payload.Alerts {
+		a := &payload.Alerts[i]
+		alert := a.severity()
+		if a.Status == alertResolved {
+			alert = alertResolved
+		}
+		h.room.forward <- &message{Name: alertmanagerName, Message: a.text(), When: time.Now(), Alert: alert}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/stretchr/gomniauth/common"
+	"github.com/stretchr/objx"
+)
+
+// Sign in with Apple is OAuth2, mostly. It differs in three ways:
+//
+//   - there is no client secret; instead, each token request carries a short
+//     lived JWT signed with a private key downloaded from the Apple developer
+//     account;
+//   - when the name or email scopes are asked for, Apple posts the callback
+//     as a form, rather than redirecting with the code in the query string;
+//   - there is no profile endpoint. The user's ID and email are in the ID
+//     token returned with the access token, and their name is posted to the
+//     callback, the first time they sign in only.
+const (
+	appleAuthURL  = "https://appleid.apple.com/auth/authorize"
+	appleTokenURL = "https://appleid.apple.com/auth/token"
+	appleAudience = "https://appleid.apple.com"
+)
+
+// appleProvider is the gomniauth provider for Sign in with Apple. It reuses
+// oauthProvider for the parts that are plain OAuth2.
+type appleProvider struct {
+	*oauthProvider
+
+	// teamID and keyID identify the signing key, and key is the key itself.
+	teamID string
+	keyID  string
+	key    *ecdsa.PrivateKey
+
+	clientID    string
+	redirectURL string
+	httpClient  *http.Client
+}
+
+// newAppleProvider makes the Sign in with Apple provider for the services ID
+// clientID, reading the signing key from the .p8 file at keyFile.
+func newAppleProvider(teamID, keyID, keyFile, clientID, redirectURL string) (*appleProvider, error) {
+	key, err := loadAppleKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &appleProvider{
+		oauthProvider: newOAuthProvider("apple", "Apple",
+			appleAuthURL, appleTokenURL, "name email", "",
+			clientID, "", redirectURL, nil),
+		teamID:      teamID,
+		keyID:       keyID,
+		key:         key,
+		clientID:    clientID,
+		redirectURL: redirectURL,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// loadAppleKey reads the PKCS #8 encoded P-256 key Apple provides.
+func loadAppleKey(filename string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", filename)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ECDSA key", filename)
+	}
+	return ecKey, nil
+}
+
+// GetBeginAuthURL asks Apple to post the callback, which it insists on when
+// the user's name and email are asked for.
+func (p *appleProvider) GetBeginAuthURL(state *common.State, options objx.Map) (string, error) {
+	u, err := p.oauthProvider.GetBeginAuthURL(state, options)
+	if err != nil {
+		return "", err
+	}
+	return u + "&response_mode=form_post", nil
+}
+
+// postsCallback reports that Apple posts the callback, from its own site.
+func (p *appleProvider) postsCallback() bool { return true }
+
+// CompleteAuth exchanges the code posted to the callback for tokens.
+func (p *appleProvider) CompleteAuth(data objx.Map) (*common.Credentials, error) {
+	if msg := data.Get("error").Str(); msg != "" {
+		return nil, errors.New("apple: " + msg)
+	}
+	code := data.Get("code").Str()
+	if code == "" {
+		return nil, errors.New("apple: no code in callback")
+	}
+	secret, err := p.clientSecret(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.httpClient.PostForm(appleTokenURL, url.Values{
+		"client_id":     {p.clientID},
+		"client_secret": {secret},
+		"code":          {code},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {p.redirectURL},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		IDToken      string `json:"id_token"`
+		Error        string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	if tokens.Error != "" {
+		return nil, errors.New("apple: " + tokens.Error)
+	}
+	return &common.Credentials{Map: objx.MSI(
+		"access_token", tokens.AccessToken,
+		"refresh_token", tokens.RefreshToken,
+		"id_token", tokens.IDToken,
+		// The name only ever arrives here, so keep it for GetUser.
+		"user", data.Get("user").Str(),
+	)}, nil
+}
+
+// GetUser reads the user from the ID token, and the name posted with the
+// callback. The ID token came straight from Apple over TLS, so its signature
+// needn't be checked.
+func (p *appleProvider) GetUser(creds *common.Credentials) (common.User, error) {
+	claims, err := jwtClaims(creds.Get("id_token").Str())
+	if err != nil {
+		return nil, err
+	}
+	user := &oauthUser{
+		id:    claims.Get("sub").Str(),
+		email: claims.Get("email").Str(),
+		// email_verified is a boolean, but has been known to arrive as a
+		// string.
+		emailVerified: claims.Get("email_verified").Bool() || claims.Get("email_verified").Str() == "true",
+		provider:      p.name,
+		creds:         creds,
+		data:          claims,
+	}
+	var posted struct {
+		Name struct {
+			FirstName string `json:"firstName"`
+			LastName  string `json:"lastName"`
+		} `json:"name"`
+	}
+	if u := creds.Get("user").Str(); u != "" && json.Unmarshal([]byte(u), &posted) == nil {
+		user.name = strings.TrimSpace(posted.Name.FirstName + " " + posted.Name.LastName)
+		user.nickname = posted.Name.FirstName
+	}
+	if user.name == "" {
+		// Apple only tells us the name the first time; after that the best
+		// we have is the email, which may be a private relay address.
+		user.name = strings.SplitN(user.email, "@", 2)[0]
+	}
+	if user.id == "" {
+		return nil, errors.New("apple: ID token has no subject")
+	}
+	return user, nil
+}
+
+// clientSecret makes the JWT Apple accepts in place of a client secret.
+func (p *appleProvider) clientSecret(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": p.keyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": p.teamID,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+		"aud": appleAudience,
+		"sub": p.clientID,
+	})
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, p.key, sum[:])
+	if err != nil {
+		return "", err
+	}
+	// ES256 signatures are r and s as fixed size big endian numbers.
+	sig := make([]byte, 64)
+	fillBytes(r, sig[:32])
+	fillBytes(s, sig[32:])
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// fillBytes writes n into buf as a big endian number, padded with zeros.
+func fillBytes(n *big.Int, buf []byte) {
+	b := n.Bytes()
+	copy(buf[len(buf)-len(b):], b)
+}
+
+// jwtClaims decodes the claims of a JWT, without checking its signature.
+func jwtClaims(token string) (objx.Map, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return objx.FromJSON(string(payload))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// reasonArchived is the error clients are turned away with once a room is
+// archived.
+const reasonArchived = "archived"
+
+// An archived room is read only: nobody can connect to it or send messages to
+// it, but its history, pins and exports are still there for the asking, and
+// reactivating it opens it up again just as it was.
+
+// archive archives the room on behalf of the given account, or reactivates
+// it.
+func (r *room) archive(account string, archive bool) {
+	e := &roomEvent{Type: eventArchive, Account: account, When: time.Now()}
+	if !archive {
+		e.Type = eventReactivate
+	}
+	r.changes <- e
+}
+
+// archived reports whether the room is archived.
+func (r *room) archived() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state.Archived
+}
+
+// archiveNotice is the system message telling everybody that e archived or
+// reactivated the room.
+func archiveNotice(e *roomEvent) *message {
+	text := "This room has been archived, and is now read only"
+	if e.Type == eventReactivate {
+		text = "This room has been reactivated"
+	}
+	return &message{Message: text, When: e.When, System: true}
+}
+
+// serveArchive serves /api/rooms/{name}/archive: GET says whether the room is
+// archived, PUT archives it and DELETE reactivates it.
+func serveArchive(w http.ResponseWriter, r *http.Request, room *room) {
+	if r.Method == "GET" {
+		writeJSON(w, map[string]bool{"archived": room.archived()})
+		return
+	}
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	account := requireRoomPermission(w, r, room, permOwnRoom)
+	if account == "" {
+		return
+	}
+	room.archive(account, r.Method == "PUT")
+	w.WriteHeader(http.StatusNoContent)
+}
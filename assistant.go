@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// assistant is a bot that answers people who @mention it in the room, using
+// a large language model behind an OpenAI compatible chat completions API.
+// It is given the room's recent history along with the question, so it can
+// answer things like "@assistant summarize the last hour".
+type assistant struct {
+	room   *room
+	client *client
+
+	url    string
+	apiKey string
+	model  string
+	http   *http.Client
+
+	// requests are the messages waiting to be answered.
+	requests chan *message
+
+	// enabled is whether the bot answers at all, and budget the most tokens
+	// it may use in a day; used counts those used since day began.
+	mu      sync.Mutex
+	enabled bool
+	budget  int
+	used    int
+	day     time.Time
+}
+
+const (
+	// assistantName is the name the bot goes by in the room.
+	assistantName = "assistant"
+
+	// assistantHistory is how many recent messages the bot is shown.
+	assistantHistory = 50
+
+	// assistantMaxTokens is the longest answer the bot may give, in tokens.
+	assistantMaxTokens = 500
+
+	assistantTimeout = time.Minute
+)
+
+// newAssistant makes an assistant for r, using the model at url (e.g.
+// https://api.openai.com/v1), which may use up to budget tokens a day.
+func newAssistant(url, apiKey, model string, budget int, r *room) *assistant {
+	return &assistant{
+		room: r,
+		client: &client{
+			send:     make(chan *message, messageBufferSize),
+			room:     r,
+			userData: map[string]interface{}{"name": assistantName},
+		},
+		url:      strings.TrimSuffix(url, "/"),
+		apiKey:   apiKey,
+		model:    model,
+		http:     &http.Client{Timeout: assistantTimeout},
+		requests: make(chan *message, 4),
+		enabled:  true,
+		budget:   budget,
+	}
+}
+
+// run joins the room and answers questions. It never returns.
+func (a *assistant) run() {
+	a.room.join <- a.client
+	go a.relay()
+	for msg := range a.requests {
+		answer, err := a.answer(msg)
+		if err != nil {
+			log.Println("Assistant:", err)
+			answer = "Sorry, I can't answer that right now."
+		}
+		a.room.forward <- &message{
+			Name:    assistantName,
+			Message: answer,
+			When:    time.Now(),
+			from:    a.client,
+		}
+	}
+}
+
+// relay picks out the messages that mention the bot, and queues them to be
+// answered.
+func (a *assistant) relay() {
+	for msg := range a.client.send {
+		msg.release()
+		if msg.from == a.client || !contains(msg.Mentions, a.client.account()) || !a.isEnabled() {
+			continue
+		}
+		select {
+		case a.requests <- msg:
+		default:
+			a.room.forward <- &message{
+				Name:    assistantName,
+				Message: msg.Name + ", I'm busy; please ask again in a minute.",
+				When:    time.Now(),
+				from:    a.client,
+			}
+		}
+	}
+}
+
+func (a *assistant) isEnabled() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.enabled
+}
+
+// spend takes tokens from today's budget, reporting whether there were any
+// left to take.
+func (a *assistant) spend(tokens int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if today := time.Now().Truncate(24 * time.Hour); !today.Equal(a.day) {
+		a.day, a.used = today, 0
+	}
+	if a.budget > 0 && a.used >= a.budget {
+		return false
+	}
+	a.used += tokens
+	return true
+}
+
+// answer asks the model to answer msg.
+func (a *assistant) answer(msg *message) (string, error) {
+	if !a.spend(0) {
+		return "I've used up my budget for today; ask me again tomorrow.", nil
+	}
+	var history strings.Builder
+	a.room.mu.RLock()
+	recent := a.room.state.History
+	if len(recent) > assistantHistory {
+		recent = recent[len(recent)-assistantHistory:]
+	}
+	for _, m := range recent {
+		fmt.Fprintf(&history, "[%s] %s: %s\n", m.When.Format(time.RFC3339), m.Name, m.Message)
+	}
+	a.room.mu.RUnlock()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":      a.model,
+		"max_tokens": assistantMaxTokens,
+		"messages": []map[string]string{
+			{"role": "system", "content": "You are " + assistantName + ", a helpful assistant in the #" + a.room.name +
+				" chat room. Answer briefly, in plain text. This is the room's recent conversation:\n\n" + history.String()},
+			{"role": "user", "content": msg.Name + ": " + msg.Message},
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), assistantTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", a.url+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+a.apiKey)
+	}
+	resp, err := a.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.Error != nil {
+		return "", errors.New(result.Error.Message)
+	}
+	a.spend(result.Usage.TotalTokens)
+	if len(result.Choices) == 0 {
+		return "", errors.New("no answer")
+	}
+	return msg.Name + ", " + strings.TrimSpace(result.Choices[0].Message.Content), nil
+}
+
+// assistantCommand is /assistant, with which those who manage the room turn
+// the bot on or off in the room, or set its daily token budget.
+func assistantCommand(c *client, args string) error {
+	a := c.room.assistant
+	if a == nil {
+		return errors.New("there is no assistant in this room")
+	}
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		a.mu.Lock()
+		state := "off"
+		if a.enabled {
+			state = "on"
+		}
+		c.reply(fmt.Sprintf("The assistant is %s, and has used %d of its %d tokens today", state, a.used, a.budget))
+		a.mu.Unlock()
+		return nil
+	}
+	if !c.room.can(c, permManageRoom) {
+		return errNotAllowed(permManageRoom)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case len(fields) == 1 && fields[0] == "on":
+		a.enabled = true
+	case len(fields) == 1 && fields[0] == "off":
+		a.enabled = false
+	case len(fields) == 2 && fields[0] == "budget":
+		var budget int
+		if _, err := fmt.Sscan(fields[1], &budget); err != nil || budget < 0 {
+			return errUsage
+		}
+		a.budget = budget
+	default:
+		return errUsage
+	}
+	c.reply("OK")
+	return nil
+}
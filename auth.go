@@ -1,27 +1,144 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
-	"github.com/stretchr/gomniauth"
+	"github.com/stretchr/gomniauth/common"
 	"github.com/stretchr/objx"
 )
 
+// cookieKey is the key auth cookies are signed with, which main sets from
+// -secret. Everything about who somebody is comes from their auth cookie, so
+// it must be one we made: otherwise anybody could write themselves a cookie
+// with somebody else's account ID in it.
+var cookieKey []byte
+
+// errBadCookie is the error for an auth cookie that isn't one we signed.
+var errBadCookie = errors.New("auth cookie is not signed")
+
+// signCookie returns the value of an auth cookie holding data: the data, as
+// base64 encoded JSON, then a dot and its HMAC-SHA256 under cookieKey.
+func signCookie(data objx.Map) string {
+	value := data.MustBase64()
+	return value + "." + cookieSignature(value)
+}
+
+// cookieSignature is the signature of an auth cookie's data.
+func cookieSignature(value string) string {
+	mac := hmac.New(sha256.New, cookieKey)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// readCookie returns the data in an auth cookie's value, if we signed it.
+func readCookie(value string) (objx.Map, error) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 || !hmac.Equal([]byte(value[i+1:]), []byte(cookieSignature(value[:i]))) {
+		return nil, errBadCookie
+	}
+	return objx.FromBase64(value[:i])
+}
+
+// authCookie returns the data in the request's auth cookie, or an error if
+// it has none, or one we didn't sign.
+func authCookie(r *http.Request) (objx.Map, error) {
+	cookie, err := r.Cookie("auth")
+	if err != nil {
+		return nil, err
+	}
+	return readCookie(cookie.Value)
+}
+
+// linkStateLifetime is how long somebody has to sign in with a provider to
+// link it to their account, once they have set off to.
+const linkStateLifetime = 10 * time.Minute
+
+// linkCookie is the cookie holding the nonce that ties a link state to the
+// browser that set off to link an identity.
+const linkCookie = "link"
+
+// linkState is the state sent to a provider when the signed in account
+// with the given ID signs in with it too, so that the identity is linked to
+// the account when the provider sends them back. It is signed as auth
+// cookies are. The account can't be taken from the auth cookie on the way
+// back, as providers such as Apple post the callback from their own site,
+// which browsers don't send the cookie with.
+//
+// The state also holds the nonce, which is kept in the link cookie of the
+// browser that set off, so that the state only links an identity if it comes
+// back to the same browser. Otherwise somebody could set off from their own
+// account and have somebody else finish signing in with the provider's URL,
+// linking that person's identity to their account.
+func linkState(id, nonce string) string {
+	return signCookie(objx.New(map[string]interface{}{
+		"link":    id,
+		"nonce":   nonce,
+		"expires": time.Now().Add(linkStateLifetime).Unix(),
+	}))
+}
+
+// readLinkState returns the account a provider's callback is to link the
+// identity to, from the state it was sent back with and the nonce in the
+// link cookie, or the empty string if there is none, or the state isn't one
+// we signed, has expired, or was made for another browser.
+func readLinkState(state, nonce string) string {
+	data, err := readCookie(state)
+	if err != nil {
+		return ""
+	}
+	if time.Now().Unix() > int64(data.Get("expires").Float64()) {
+		return ""
+	}
+	if nonce == "" || !hmac.Equal([]byte(data.Get("nonce").Str()), []byte(nonce)) {
+		return ""
+	}
+	return data.Get("link").Str()
+}
+
+// newLinkNonce makes a random nonce for a link state.
+func newLinkNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// callbackPoster is implemented by providers that post the callback from
+// their own site, rather than redirecting back to it.
+type callbackPoster interface {
+	postsCallback() bool
+}
+
+// linkCookieSameSite is the SameSite the link cookie is set with for the
+// provider. Browsers only send Lax cookies with cross-site requests that are
+// navigations by GET, so providers that post the callback need None.
+func linkCookieSameSite(p common.Provider) http.SameSite {
+	if poster, ok := p.(callbackPoster); ok && poster.postsCallback() {
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
 type authHandler struct {
 	next http.Handler
 }
 
 func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if _, err := r.Cookie("auth"); err == http.ErrNoCookie {
-		// not authenticated
+	if _, err := authCookie(r); err != nil {
+		// not authenticated, or with a cookie we didn't make
 		w.Header().Set("Location", "/login")
 		w.WriteHeader(http.StatusTemporaryRedirect)
-	} else if err != nil {
-		// some other error
-		panic(err.Error())
 	} else {
 		// success - call the next handler
 		h.next.ServeHTTP(w, r)
@@ -34,30 +151,45 @@ func MustAuth(handler http.Handler) http.Handler {
 
 // loginHander handles the third-party login process.
 // format: /auth/{action}/{provider}
-// Our loginHandler is only a function and not an object that implements the
-// http. Handler interface. This is because, unlike other handlers, we don't
-// need it to store any state.
+// Our loginHandler holds the user store, so that whichever provider somebody
+// signs in with, they end up as the same account.
+type loginHandler struct {
+	users *userStore
+
+	// providers are the providers people may sign in with.
+	providers *loginProviders
+
+	// cookieDomain, if set, is the domain the auth cookie is set for, so
+	// that people stay signed in on its subdomains too.
+	cookieDomain string
+}
 
 // TODO: might want to consider using dedicated packages such as Goweb, Pat,
 // Routes, or mux. For extremely simple cases such as ours, the built-in
 // capabilities will do.
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
+func (h *loginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//break the path into segments using strings.Split before pulling out the
 	// values for action and provider. If the action value is known, we will run
 	// the specific code; otherwise, we will write out an error message and
 	// return an http.StatusNotFound status code (which in the language of HTTP
 	// status code, is a 404 code).
 	segs := strings.Split(r.URL.Path, "/")
+	if len(segs) < 4 {
+		http.NotFound(w, r)
+		return
+	}
 	action := segs[2]
 	provider := segs[3]
 	switch action {
 	case "login":
-		// use the gomniauth.Provider function to get the provider object that
-		// matches the object specified in the URL (such as google or github)
-		provider, err := gomniauth.Provider(provider)
+		// look up the provider object that matches the object specified in
+		// the URL (such as google or github)
+		provider, err := h.providers.provider(provider)
 		if err != nil {
-			log.Fatalln("Error when trying to get provider", provider, "-", err)
+			log.Println("Error when trying to get provider", provider, "-", err)
+			http.NotFound(w, r)
+			return
 		}
 
 		// use the GetBeginAuthURL method to get the location where we must send
@@ -82,7 +214,38 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		// to service.
 		loginUrl, err := provider.GetBeginAuthURL(nil, nil)
 		if err != nil {
-			log.Fatalln("Error when trying to GetBeginAuthURL for", provider, "-", err)
+			log.Println("Error when trying to GetBeginAuthURL for", provider, "-", err)
+			http.Error(w, "Failed to start login", http.StatusInternalServerError)
+			return
+		}
+
+		// Somebody already signed in is linking another identity to their
+		// account, which the provider is told in the state it sends back.
+		if id := currentAccountID(r); id != "" {
+			u, err := url.Parse(loginUrl)
+			if err != nil {
+				log.Println("Error when trying to parse the login URL for", provider, "-", err)
+				http.Error(w, "Failed to start login", http.StatusInternalServerError)
+				return
+			}
+			nonce, err := newLinkNonce()
+			if err != nil {
+				log.Println("Error when trying to make a link nonce for", provider, "-", err)
+				http.Error(w, "Failed to start login", http.StatusInternalServerError)
+				return
+			}
+			q := u.Query()
+			q.Set("state", linkState(id, nonce))
+			u.RawQuery = q.Encode()
+			loginUrl = u.String()
+			http.SetCookie(w, &http.Cookie{
+				Name:     linkCookie,
+				Value:    nonce,
+				Path:     "/auth/",
+				MaxAge:   int(linkStateLifetime.Seconds()),
+				HttpOnly: true,
+				Secure:   true,
+				SameSite: linkCookieSameSite(provider)})
 		}
 
 		// If our code gets no error from the GetBeginAuthURL call, we simply
@@ -93,33 +256,67 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		// When the authentication provider redirects the users back after they have
 		// granted permission, the URL specifies that it is a callback action
 	case "callback":
-		provider, err := gomniauth.Provider(provider)
+		provider, err := h.providers.provider(provider)
 		if err != nil {
-			log.Fatalln("Error when trying to get provider", provider, "-", err)
+			log.Println("Error when trying to get provider", provider, "-", err)
+			http.NotFound(w, r)
+			return
 		}
 
-		creds, err := provider.CompleteAuth(objx.MustFromURLQuery(r.URL.RawQuery))
+		// Most providers redirect back with the code in the query string, but
+		// some (such as Apple) post it as a form instead. r.Form holds both.
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Bad callback", http.StatusBadRequest)
+			return
+		}
+		creds, err := provider.CompleteAuth(objx.MustFromURLQuery(r.Form.Encode()))
 		if err != nil {
-			log.Fatalln("Error when trying to complete auth for", provider, "-", err)
+			log.Println("Error when trying to complete auth for", provider, "-", err)
+			http.Error(w, "Failed to complete login", http.StatusUnauthorized)
+			return
 		}
 
 		user, err := provider.GetUser(creds)
 		if err != nil {
-			log.Fatalln("Error when trying to get user from", provider, "-", err)
+			log.Println("Error when trying to get user from", provider, "-", err)
+			http.Error(w, "Failed to complete login", http.StatusUnauthorized)
+			return
+		}
+
+		// If somebody was signed in when they set off from this browser, the
+		// identity they have just signed in with is linked to their account.
+		var currentID string
+		if c, err := r.Cookie(linkCookie); err == nil {
+			currentID = readLinkState(r.Form.Get("state"), c.Value)
+			http.SetCookie(w, &http.Cookie{Name: linkCookie, Path: "/auth/", MaxAge: -1})
+		}
+		acct, err := h.users.login(currentID, provider.Name(), user.IDForProvider(provider.Name()),
+			verifiedEmail(provider.Name(), user), user.Name(), user.AvatarURL())
+		if err != nil {
+			log.Println("Error when trying to save account for", provider, "-", err)
+			http.Error(w, "Failed to complete login", http.StatusInternalServerError)
+			return
 		}
 
-		// TODO: Storing non-signed cookies like this is fine for incidental
-		// information such as a user's name, however, you should avoid storing
-		// any sensitive information using non-signed cookies, as it's easy for
-		// people to access and change the data.
-		authCookieValue := objx.New(map[string]interface{}{
-			"name": user.Name(),
-		}).MustBase64()
+		// The cookie is signed, so that nobody can change the account in it
+		// to somebody else's.
+		authCookieValue := signCookie(objx.New(map[string]interface{}{
+			"id":         acct.ID,
+			"name":       acct.Name,
+			"avatar_url": acct.AvatarURL,
+		}))
 
+		// Scripts have no need to read it, it is only ever sent over TLS, and
+		// other sites' pages can't send it with requests they make, other than
+		// by navigating to us.
 		http.SetCookie(w, &http.Cookie{
-			Name:  "auth",
-			Value: authCookieValue,
-			Path:  "/"})
+			Name:     "auth",
+			Value:    authCookieValue,
+			Path:     "/",
+			Domain:   h.cookieDomain,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode})
 
 		w.Header()["Location"] = []string{"/chat"}
 		w.WriteHeader(http.StatusTemporaryRedirect)
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/gomniauth/common"
+	"github.com/stretchr/objx"
+)
+
+// testProvider is a login provider that signs everybody in as the user
+// whose ID is the code in the callback.
+type testProvider struct {
+	common.Provider
+	posts bool
+}
+
+func (p *testProvider) Name() string        { return "test" }
+func (p *testProvider) postsCallback() bool { return p.posts }
+
+func (p *testProvider) GetBeginAuthURL(state *common.State, options objx.Map) (string, error) {
+	return "https://provider.example/authorize?client_id=chat", nil
+}
+
+func (p *testProvider) CompleteAuth(data objx.Map) (*common.Credentials, error) {
+	return &common.Credentials{Map: objx.New(map[string]interface{}{"code": data.Get("code").Str()})}, nil
+}
+
+func (p *testProvider) GetUser(creds *common.Credentials) (common.User, error) {
+	return &oauthUser{id: creds.Get("code").Str(), name: "Somebody", provider: "test"}, nil
+}
+
+// testProviders are the login providers, offering only p.
+func testProviders(p common.Provider) *loginProviders {
+	return &loginProviders{providers: map[string]common.Provider{"test": p}}
+}
+
+// TestLinkState checks that a provider's callback only links the identity
+// signed in with to an account when the state is one we made, for the
+// browser the callback comes back to, and hasn't expired.
+func TestLinkState(t *testing.T) {
+	cookieKey = []byte("test secret")
+	if got := readLinkState(linkState("ada", "nonce"), "nonce"); got != "ada" {
+		t.Errorf("the state links to %q, want ada", got)
+	}
+	expired := signCookie(objx.New(map[string]interface{}{"link": "ada", "nonce": "nonce", "expires": time.Now().Add(-time.Minute).Unix()}))
+	tests := map[string][2]string{
+		"expired":               {expired, "nonce"},
+		"forged":                {linkState("ada", "nonce") + "x", "nonce"},
+		"from another browser":  {linkState("ada", "nonce"), "other nonce"},
+		"without a link cookie": {linkState("ada", "nonce"), ""},
+		"without a state":       {"", "nonce"},
+	}
+	for name, test := range tests {
+		if got := readLinkState(test[0], test[1]); got != "" {
+			t.Errorf("%s state links to %q, want nobody", name, got)
+		}
+	}
+}
+
+// TestAuthCookieAttributes checks that the auth cookie set when somebody
+// signs in can't be read by scripts, sent in the clear, or sent with other
+// sites' requests.
+func TestAuthCookieAttributes(t *testing.T) {
+	cookieKey = []byte("test secret")
+	users, err := openUserStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &loginHandler{users: users, providers: testProviders(&testProvider{})}
+	r := httptest.NewRequest("GET", "/auth/callback/test?code=1", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var auth *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "auth" {
+			auth = c
+		}
+	}
+	if auth == nil {
+		t.Fatalf("no auth cookie was set: %d %s", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+	if !auth.HttpOnly || !auth.Secure || auth.SameSite != http.SameSiteLaxMode {
+		t.Errorf("auth cookie is HttpOnly %v, Secure %v, SameSite %v; want true, true, Lax", auth.HttpOnly, auth.Secure, auth.SameSite)
+	}
+}
+
+// TestLinkNeedsSameBrowser checks that an identity is only linked to the
+// account that set off to link it when the provider sends the same browser
+// back: somebody who sets off from their own account and has somebody else
+// finish signing in mustn't get that person's identity.
+func TestLinkNeedsSameBrowser(t *testing.T) {
+	cookieKey = []byte("test secret")
+	for _, posts := range []bool{false, true} {
+		users, err := openUserStore("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ada, err := users.login("", "other", "ada", "", "Ada", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := &loginHandler{users: users, providers: testProviders(&testProvider{posts: posts})}
+
+		r := httptest.NewRequest("GET", "/auth/login/test", nil)
+		r.AddCookie(&http.Cookie{Name: "auth", Value: signCookie(objx.New(map[string]interface{}{"id": ada.ID, "name": "Ada"}))})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		u, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := u.Query().Get("state")
+		var link *http.Cookie
+		for _, c := range w.Result().Cookies() {
+			if c.Name == linkCookie {
+				link = c
+			}
+		}
+		if state == "" || link == nil {
+			t.Fatalf("setting off to link gave state %q and link cookie %v", state, link)
+		}
+		wantSameSite := http.SameSiteLaxMode
+		if posts {
+			wantSameSite = http.SameSiteNoneMode
+		}
+		if !link.HttpOnly || !link.Secure || link.SameSite != wantSameSite {
+			t.Errorf("link cookie is HttpOnly %v, Secure %v, SameSite %v", link.HttpOnly, link.Secure, link.SameSite)
+		}
+
+		callback := func(code string, cookie *http.Cookie) string {
+			form := url.Values{"code": {code}, "state": {state}}
+			r := httptest.NewRequest("POST", "/auth/callback/test", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if cookie != nil {
+				r.AddCookie(cookie)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			return users.identities["test:"+code].ID
+		}
+		if id := callback("victim", nil); id == ada.ID {
+			t.Errorf("posts %v: another browser's identity was linked to the account that set off", posts)
+		}
+		if id := callback("ada", &http.Cookie{Name: linkCookie, Value: link.Value}); id != ada.ID {
+			t.Errorf("posts %v: the identity was not linked to the account that set off", posts)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// People without a picture of their own, from their login provider or their
+// profile, are shown with their initials instead, on a colour picked from
+// their name, so that each person always looks the same. The avatars are SVG,
+// served at /avatars/{name}.svg, so that browsers draw the letters in their
+// own fonts at whatever size they are shown. Every message says which avatar
+// to show its sender with.
+
+// avatarColors are the colours initials avatars are drawn on, all dark enough
+// for white letters to be read on them.
+var avatarColors = []string{
+	"#c0392b", "#d35400", "#b7950b", "#27ae60", "#16a085",
+	"#2980b9", "#8e44ad", "#2c3e50", "#7f8c8d", "#c2185b",
+}
+
+// maxCachedAvatars is how many drawn avatars are kept, so that busy rooms
+// don't have them drawn again for every message.
+const maxCachedAvatars = 10000
+
+// initialsAvatarURL is the URL of the initials avatar of somebody with the
+// given name.
+func initialsAvatarURL(name string) string {
+	return "/avatars/" + url.PathEscape(name) + ".svg"
+}
+
+// avatar returns the URL of the client's avatar: their own picture if they
+// have one, or else their initials.
+func (c *client) avatar() string {
+	if url := avatarURL(c.userData); url != "" {
+		return url
+	}
+	return initialsAvatarURL(c.name())
+}
+
+// initials returns the first letters of the first and last words of name, in
+// capitals, or a question mark if it has no letters.
+func initials(name string) string {
+	var letters []rune
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		letters = append(letters, unicode.ToUpper([]rune(word)[0]))
+	}
+	switch len(letters) {
+	case 0:
+		return "?"
+	case 1:
+		return string(letters)
+	}
+	return string([]rune{letters[0], letters[len(letters)-1]})
+}
+
+// avatarColor returns the colour of the initials avatar of somebody with the
+// given name.
+func avatarColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return avatarColors[h.Sum32()%uint32(len(avatarColors))]
+}
+
+// drawAvatar draws the initials avatar of somebody with the given name.
+func drawAvatar(name string) []byte {
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="64" height="64" viewBox="0 0 64 64">`+
+		`<circle cx="32" cy="32" r="32" fill="%s"/>`+
+		`<text x="32" y="32" dy=".35em" text-anchor="middle" fill="#fff" font-family="sans-serif" font-size="26">%s</text>`+
+		`</svg>`, avatarColor(name), html.EscapeString(initials(name))))
+}
+
+// avatarHandler serves /avatars/{name}.svg, the initials avatar of somebody
+// with that name.
+type avatarHandler struct {
+	mu    sync.Mutex
+	drawn map[string][]byte
+}
+
+func (h *avatarHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/avatars/")
+	if !strings.HasSuffix(name, ".svg") {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, ".svg")
+	h.mu.Lock()
+	svg, ok := h.drawn[name]
+	if !ok {
+		if h.drawn == nil || len(h.drawn) >= maxCachedAvatars {
+			h.drawn = make(map[string][]byte)
+		}
+		svg = drawAvatar(name)
+		h.drawn[name] = svg
+	}
+	h.mu.Unlock()
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// the avatar is only ever an image, never a page that runs scripts.
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	// somebody's avatar never changes, as it is drawn from their name.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(svg)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// A backup is a gzipped tar archive of everything in the -data directory:
+// the rooms' event logs and snapshots, the accounts, and the rest. Backups
+// may be taken while the server is running. Everything but the event log is
+// only ever replaced whole, by renaming a new version over the old, and the
+// event log is only ever appended to, so copying as much of it as there was
+// when the backup started gives a consistent copy.
+//
+// Backups made with a passphrase are encrypted with AES-GCM, using a key
+// derived from the passphrase with scrypt. The archive is encrypted in
+// chunks, so that neither making nor restoring a backup holds it all in
+// memory, and the last chunk is marked as such, so that a backup cut short
+// can't be mistaken for a whole one.
+
+// backupMagic starts every encrypted backup.
+const backupMagic = "CHATBAK\x01"
+
+// backupChunkSize is how much of the archive each encrypted chunk holds.
+const backupChunkSize = 64 * 1024
+
+// backupSubcommand is "chat backup", which backs up a -data directory.
+func backupSubcommand(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	dataDir := flags.String("data", "", "The directory to back up.")
+	out := flags.String("o", "", "The file to write the backup to.")
+	passphrase := flags.String("passphrase", os.Getenv("CHAT_BACKUP_PASSPHRASE"), "The passphrase to encrypt the backup with (or $CHAT_BACKUP_PASSPHRASE; not encrypted if empty).")
+	flags.Parse(args)
+	if *dataDir == "" || *out == "" {
+		return errors.New("-data and -o are required")
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bw := bufio.NewWriter(f)
+	var w io.WriteCloser = nopWriteCloser{bw}
+	if *passphrase != "" {
+		if w, err = newBackupSealer(bw, *passphrase); err != nil {
+			return err
+		}
+	}
+	n, err := writeBackup(w, *dataDir)
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %d files to %s\n", n, *out)
+	return f.Sync()
+}
+
+// writeBackup writes the archive of dir to w, returning how many files are
+// in it.
+func writeBackup(w io.Writer, dir string) (int, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	n := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// temporary files are halfway through being written.
+		if !info.Mode().IsRegular() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			// it was renamed away since we listed the directory.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer f.Close()
+		// the file may have grown since it was listed; take the size it is
+		// now, and copy no more than that.
+		info, err = f.Stat()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	if err := tw.Close(); err != nil {
+		return n, err
+	}
+	return n, gz.Close()
+}
+
+// restoreSubcommand is "chat restore", which restores a backup into an empty
+// -data directory. The server must not be using the directory.
+func restoreSubcommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dataDir := flags.String("data", "", "The directory to restore into, which must be empty.")
+	in := flags.String("i", "", "The backup to restore.")
+	passphrase := flags.String("passphrase", os.Getenv("CHAT_BACKUP_PASSPHRASE"), "The passphrase the backup was encrypted with (or $CHAT_BACKUP_PASSPHRASE).")
+	flags.Parse(args)
+	if *dataDir == "" || *in == "" {
+		return errors.New("-data and -i are required")
+	}
+	if files, err := ioutil.ReadDir(*dataDir); err == nil && len(files) > 0 {
+		return fmt.Errorf("%s is not empty", *dataDir)
+	}
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(len(backupMagic)); string(magic) == backupMagic {
+		if *passphrase == "" {
+			return errors.New("the backup is encrypted: give its -passphrase")
+		}
+		if r, err = newBackupOpener(br, *passphrase); err != nil {
+			return err
+		}
+	}
+	n, err := readBackup(r, *dataDir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %d files to %s\n", n, *dataDir)
+	return nil
+}
+
+// readBackup unpacks the archive read from r into dir, returning how many
+// files it held.
+func readBackup(r io.Reader, dir string) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gz)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return n, fmt.Errorf("the backup holds a file outside the directory: %s", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return n, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return n, err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// backupKey derives the key backups are encrypted with from a passphrase.
+func backupKey(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// backupNonce is the nonce of the nth chunk. Each chunk's additional data
+// says whether it is the last.
+func backupNonce(aead cipher.AEAD, n uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+var (
+	backupMoreChunks = []byte{0}
+	backupLastChunk  = []byte{1}
+)
+
+// backupSealer encrypts what is written to it, a chunk at a time.
+type backupSealer struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	n    uint64
+}
+
+func newBackupSealer(w io.Writer, passphrase string) (*backupSealer, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := backupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, backupMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	return &backupSealer{w: w, aead: aead, buf: make([]byte, 0, backupChunkSize)}, nil
+}
+
+func (s *backupSealer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more comes after it, since the
+		// last chunk has to be marked as the last.
+		if len(s.buf) == backupChunkSize {
+			if err := s.seal(backupMoreChunks); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):backupChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *backupSealer) seal(last []byte) error {
+	sealed := s.aead.Seal(nil, backupNonce(s.aead, s.n), s.buf, last)
+	s.n++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (s *backupSealer) Close() error {
+	if len(s.buf) == backupChunkSize {
+		if err := s.seal(backupMoreChunks); err != nil {
+			return err
+		}
+	}
+	return s.seal(backupLastChunk)
+}
+
+// backupOpener decrypts a backup encrypted by a backupSealer.
+type backupOpener struct {
+	r    io.Reader
+	aead cipher.AEAD
+	buf  []byte
+	n    uint64
+	done bool
+}
+
+func newBackupOpener(r io.Reader, passphrase string) (*backupOpener, error) {
+	header := make([]byte, len(backupMagic)+16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	aead, err := backupKey(passphrase, header[len(backupMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &backupOpener{r: r, aead: aead}, nil
+}
+
+func (o *backupOpener) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk. Only the last chunk is shorter
+// than a full one.
+func (o *backupOpener) open() error {
+	sealed := make([]byte, backupChunkSize+o.aead.Overhead())
+	n, err := io.ReadFull(o.r, sealed)
+	last := backupMoreChunks
+	if err == io.ErrUnexpectedEOF {
+		last, o.done = backupLastChunk, true
+	} else if err == io.EOF {
+		return errors.New("the backup is cut short")
+	} else if err != nil {
+		return err
+	}
+	plain, err := o.aead.Open(sealed[:0], backupNonce(o.aead, o.n), sealed[:n], last)
+	if err != nil {
+		return errors.New("the backup is damaged, or the passphrase is wrong")
+	}
+	o.n++
+	o.buf = plain
+	return nil
+}
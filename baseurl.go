@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// requestBaseURL returns the external base URL of the server, such as
+// https://chat.example.com. If base is set, it is used as is. Otherwise the
+// URL is worked out from the request: the scheme from the X-Forwarded-Proto
+// header set by a reverse proxy terminating TLS, or from the connection
+// itself, and the host from the Host header.
+func requestBaseURL(r *http.Request, base *url.URL) *url.URL {
+	if base != nil {
+		return base
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+	}
+	return &url.URL{Scheme: scheme, Host: r.Host}
+}
+
+// socketURL returns the URL of the websocket at path, for pages served by r:
+// wss:// if the page was served over https, and ws:// otherwise.
+func socketURL(r *http.Request, base *url.URL, path string) string {
+	u := *requestBaseURL(r, base)
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	return u.String()
+}
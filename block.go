@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// block blocks or unblocks whoever goes by name, so that their messages are
+// or aren't delivered to c. People who have signed in keep their block list
+// in their account, so it still applies the next time they connect.
+func (c *client) block(name string, block bool) error {
+	if name == "" {
+		return errUsage
+	}
+	other := c.room.accountNamed(name)
+	if other == "" && c.room.users != nil {
+		// They needn't be in the room to be blocked or unblocked.
+		if a := c.room.users.findByName(name); a != nil {
+			other = a.ID
+		}
+	}
+	if other == "" {
+		return fmt.Errorf("nobody is called %s", name)
+	}
+	if other == c.account() {
+		return errors.New("you can't block yourself")
+	}
+
+	blocked, _ := c.blocked.Load().(map[string]bool)
+	var accounts []string
+	for a := range blocked {
+		if a != other {
+			accounts = append(accounts, a)
+		}
+	}
+	if block {
+		accounts = append(accounts, other)
+	}
+	if id, _ := c.userData["id"].(string); id != "" && c.room.users != nil {
+		a, err := c.room.users.update(id, func(a *account) { a.Blocked = accounts })
+		if err != nil && err != errNoAccount {
+			return errors.New("failed to save your block list")
+		}
+		if a != nil {
+			accounts = a.Blocked
+		}
+	}
+	c.setBlocked(accounts)
+	if block {
+		c.replyf("You won't see messages from %s any more", name)
+	} else {
+		c.replyf("You will see messages from %s again", name)
+	}
+	return nil
+}
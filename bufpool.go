@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBufferSize is the capacity above which buffers are left to the
+// garbage collector rather than put back in the pool, so that one huge
+// message doesn't keep a huge buffer alive forever.
+const maxPooledBufferSize = 64 * 1024
+
+// bufferPool holds buffers for encoding and decoding messages, so that busy
+// rooms reuse a handful of buffers rather than allocating one per message.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer takes an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns buf to the pool. buf must not be used afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
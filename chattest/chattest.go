@@ -0,0 +1,261 @@
+// Package chattest helps write integration tests against the chat server: it
+// runs a server for a test, connects fake clients to its room, and checks
+// which of them messages were delivered to.
+//
+// The server is package main, so it can't be started in the test's own
+// process; Start runs a chat binary instead, built beforehand, for example
+// with
+//
+//	go build -o chat github.com/apackeer/chat
+//
+// A test then goes something like
+//
+//	s := chattest.Start(t, "./chat")
+//	alice, bob, eve := s.Connect(t, "alice"), s.Connect(t, "bob"), s.Connect(t, "eve")
+//	eve.Send(t, "/block alice")
+//	chattest.Delivered(t, "You won't see messages from alice any more", eve)
+//	alice.Send(t, "hello")
+//	chattest.Delivered(t, "hello", alice, bob)
+//	chattest.NotDelivered(t, "hello", eve)
+package chattest
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/objx"
+)
+
+var (
+	// Timeout is how long Start waits for the server to start, and
+	// Delivered for messages to arrive.
+	Timeout = 5 * time.Second
+
+	// Quiet is how long NotDelivered waits, to be sure nothing arrives.
+	Quiet = 500 * time.Millisecond
+)
+
+// secret is the -secret servers are started with, so that clients can sign
+// their own auth cookies.
+const secret = "chattest"
+
+// Server is a chat server run for a test.
+type Server struct {
+	// URL is the server's URL, such as http://127.0.0.1:43121.
+	URL string
+
+	cmd *exec.Cmd
+}
+
+// Start runs the chat binary at path, with args after its own, on a port of
+// its own on 127.0.0.1 and with a data directory of its own. The server is
+// stopped when the test ends.
+func Start(t testing.TB, path string, args ...string) *Server {
+	t.Helper()
+	args = append([]string{"-addr", "127.0.0.1:0", "-data", t.TempDir(), "-access-log=false", "-secret", secret,
+		// everybody connects from 127.0.0.1.
+		"-max-conns-per-ip", "0", "-max-upgrades-per-ip", "0"}, args...)
+	cmd := exec.Command(path, args...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("chattest: starting %s: %v", path, err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	// the server logs the address it listens on, which is how we learn
+	// which port it was given.
+	addrs := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "Starting web server on "); i >= 0 {
+				select {
+				case addrs <- strings.TrimPrefix(line[i:], "Starting web server on "):
+				default:
+				}
+			}
+			t.Log("chat: ", line)
+		}
+	}()
+	select {
+	case addr := <-addrs:
+		return &Server{URL: "http://" + addr, cmd: cmd}
+	case <-time.After(Timeout):
+		t.Fatalf("chattest: %s didn't start listening within %s", path, Timeout)
+		return nil
+	}
+}
+
+// Message is a message as clients are sent it.
+type Message struct {
+	ID       uint64
+	Name     string
+	Message  string
+	When     time.Time
+	Sender   string
+	System   bool
+	Mentions []string
+}
+
+// Client is a fake client connected to a server's room.
+type Client struct {
+	// Name is the client's name, which is also its account ID.
+	Name string
+
+	conn *websocket.Conn
+
+	// received are the messages the client has been sent, and arrived is
+	// signalled when another is.
+	mu       sync.Mutex
+	received []Message
+	arrived  *sync.Cond
+}
+
+// Connect connects a client called name to the server's room, signed in as
+// an account of the same name. It is disconnected when the test ends.
+func (s *Server) Connect(t testing.TB, name string) *Client {
+	t.Helper()
+	return s.ConnectPath(t, name, "/room")
+}
+
+// ConnectPath is Connect for the room whose websocket is at path, such as
+// /o/acme/room for an organization's room.
+func (s *Server) ConnectPath(t testing.TB, name, path string) *Client {
+	t.Helper()
+	header := http.Header{}
+	header.Set("Cookie", "auth="+authCookie(name))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+path, header)
+	if err != nil {
+		t.Fatalf("chattest: connecting %s: %v", name, err)
+	}
+	c := &Client{Name: name, conn: conn}
+	c.arrived = sync.NewCond(&c.mu)
+	go c.read()
+	t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+// authCookie is the auth cookie of the account called name, signed as the
+// server signs them: the data, then a dot and its HMAC-SHA256.
+func authCookie(name string) string {
+	data := objx.New(map[string]interface{}{"id": name, "name": name}).MustBase64()
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(data))
+	return data + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// read records what the client is sent, until it is disconnected.
+func (c *Client) read() {
+	for {
+		var msg Message
+		err := c.conn.ReadJSON(&msg)
+		c.mu.Lock()
+		if err == nil {
+			c.received = append(c.received, msg)
+		}
+		c.arrived.Broadcast()
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Send sends text to the room from the client.
+func (c *Client) Send(t testing.TB, text string) {
+	t.Helper()
+	if err := c.conn.WriteJSON(map[string]string{"Message": text}); err != nil {
+		t.Fatalf("chattest: %s sending %q: %v", c.Name, text, err)
+	}
+}
+
+// Received returns the messages the client has been sent so far.
+func (c *Client) Received() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Message(nil), c.received...)
+}
+
+// wait waits until the client has been sent a message with the given text,
+// returning it, or until timeout has passed.
+func (c *Client) wait(text string, timeout time.Duration) (Message, bool) {
+	timer := time.AfterFunc(timeout, func() {
+		c.mu.Lock()
+		c.arrived.Broadcast()
+		c.mu.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for _, msg := range c.received {
+			if msg.Message == text {
+				return msg, true
+			}
+		}
+		if !time.Now().Before(deadline) {
+			return Message{}, false
+		}
+		c.arrived.Wait()
+	}
+}
+
+// Delivered checks that a message with the given text is delivered to each
+// of the clients, waiting up to Timeout for it to be.
+func Delivered(t testing.TB, text string, clients ...*Client) {
+	t.Helper()
+	for _, c := range clients {
+		if _, ok := c.wait(text, Timeout); !ok {
+			t.Errorf("%q was not delivered to %s; it was sent:\n%s", text, c.Name, describe(c.Received()))
+		}
+	}
+}
+
+// NotDelivered checks that no message with the given text is delivered to
+// any of the clients, waiting Quiet to be sure. Checking Delivered first,
+// for the clients the message should reach, makes it likely it would have
+// reached these by then too, had it been going to.
+func NotDelivered(t testing.TB, text string, clients ...*Client) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			if msg, ok := c.wait(text, Quiet); ok {
+				t.Errorf("%q was delivered to %s, from %s", text, c.Name, msg.Name)
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+// describe lists messages, one per line, for test failures.
+func describe(msgs []Message) string {
+	if len(msgs) == 0 {
+		return "\t(nothing)"
+	}
+	var b strings.Builder
+	for _, msg := range msgs {
+		fmt.Fprintf(&b, "\t%s: %s\n", msg.Name, msg.Message)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
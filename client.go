@@ -1,6 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
 	"github.com/gorilla/websocket"
 )
 
@@ -10,21 +16,101 @@ type client struct {
 	socket *websocket.Conn
 
 	// send is the channel on which messages are sent to the client
-	send chan []byte
+	send chan *message
 
 	// room is the room this client is chatting in.
 	room *room
+
+	// userData holds information about the user, taken from the auth cookie.
+	userData map[string]interface{}
+
+	// country is the country the client connected from, if GeoIP is on.
+	country string
+
+	// locale is the language the server talks to the client in, or "" for
+	// English.
+	locale string
+
+	// wire is how messages are encoded down the client's websocket, picked
+	// when it connected. Clients that aren't websockets don't have one.
+	wire *wireFormat
+
+	// wake, if set, is called whenever a message is queued on send or send is
+	// closed. It is used by transports that don't keep a goroutine blocked
+	// reading from send for every client.
+	wake func()
+
+	// rejected is why the room turned the client away, if it did. It is set
+	// before the room closes send, so it is safe to read once send is closed.
+	rejected *closeReason
+
+	// caps holds the capabilities agreed with the client in the handshake,
+	// as a map[string]bool. Like blocked, it is only ever replaced.
+	caps atomic.Value
+
+	// blocked holds the accounts whose messages are not delivered to the
+	// client, as a map[string]bool. The fanout worker reads it for every
+	// message, so it is never changed, only replaced.
+	blocked atomic.Value
+}
+
+// notify tells the client's transport, if it asked to be told, that there is
+// something waiting on the send channel.
+func (c *client) notify() {
+	if c.wake != nil {
+		c.wake()
+	}
+}
+
+// name is the display name of the user.
+func (c *client) name() string {
+	name, _ := c.userData["name"].(string)
+	return name
+}
+
+// account identifies the person behind the client. It is their account ID
+// if they signed in, and otherwise their name.
+func (c *client) account() string {
+	if id, _ := c.userData["id"].(string); id != "" {
+		return id
+	}
+	return "name:" + c.name()
+}
+
+// blocks reports whether the client has blocked the account.
+func (c *client) blocks(account string) bool {
+	blocked, _ := c.blocked.Load().(map[string]bool)
+	return blocked[account]
+}
+
+// setBlocked replaces the accounts the client has blocked.
+func (c *client) setBlocked(accounts []string) {
+	blocked := make(map[string]bool, len(accounts))
+	for _, a := range accounts {
+		blocked[a] = true
+	}
+	c.blocked.Store(blocked)
+}
+
+// turnAway refuses the client entry to the room, closing its send channel
+// straight away. It is only called from the room's run loop, for clients
+// that have not been handed to a fanout worker.
+func (c *client) turnAway(reason closeReason) {
+	c.rejected = &reason
+	close(c.send)
+	c.notify()
 }
 
 // The read method allows our client to read from the socket via the
-// ReadMessage method, continually sending any received messages to the forward
+// readMessage method, continually sending any received messages to the forward
 // channel on the room type.
 func (c *client) read() {
 	for {
-		// Read a message from the websocket and put it in the room this client
-		// is chatting in's forwarding channel.
-		if _, msg, err := c.socket.ReadMessage(); err == nil {
-			c.room.forward <- msg
+		// Read a message from the websocket, stamp it with who sent it and
+		// when, and put it in the room this client is chatting in's forwarding
+		// channel.
+		if msg, err := c.readMessage(); err == nil {
+			c.receive(msg)
 		} else {
 			break
 		}
@@ -32,16 +118,134 @@ func (c *client) read() {
 	c.socket.Close()
 }
 
+// receive handles a message the client has sent, whichever transport it came
+// by.
+func (c *client) receive(msg *message) {
+	if msg.Read != 0 {
+		c.markRead(msg.Read)
+		return
+	}
+	if msg.Hello != nil {
+		c.greet(msg.Hello)
+		return
+	}
+	// slash commands are carried out rather than sent to the room.
+	if msg.Vote == nil && c.runCommand(msg.Message) {
+		return
+	}
+	if !c.room.can(c, permPost) {
+		c.reply(errNotAllowed(permPost).Error())
+		return
+	}
+	if msg.Vote != nil {
+		c.vote(msg.Vote)
+		return
+	}
+	if msg.Typing {
+		if c.has(capTyping) {
+			c.room.forward <- &message{Name: c.name(), Typing: true, When: time.Now(), from: c}
+		}
+		return
+	}
+	if msg.voiceUpload != "" {
+		if err := c.attachVoice(msg, msg.voiceUpload); err != nil {
+			c.reply(err.Error())
+			return
+		}
+	}
+	c.post(msg)
+}
+
+// errMessageTooBig is returned by readMessage when the client sends a
+// message larger than the room allows.
+var errMessageTooBig = errors.New("message too big")
+
+// closeReason is the structured reason sent in the close frame when we close
+// a client's connection because of something it did.
+type closeReason struct {
+	Error string `json:"error"`
+	Limit int64  `json:"limit,omitempty"`
+	Name  string `json:"name,omitempty"`
+}
+
+// reasonRestarting is the error clients are turned away with while the server
+// restarts, so that they know to connect again in a moment.
+const reasonRestarting = "restarting"
+
+// code is the websocket close code a client turned away for the reason is
+// sent.
+func (reason *closeReason) code() int {
+	if reason.Error == reasonRestarting {
+		return websocket.CloseServiceRestart
+	}
+	return websocket.ClosePolicyViolation
+}
+
+// readMessage reads the next message from the websocket. The message is read
+// into a pooled buffer, which goes straight back to the pool once decoded.
+//
+// No more than the room's maximum message size is ever read; if a message is
+// bigger than that, the connection is closed with a close frame explaining
+// why, rather than the message being buffered up for every other client.
+func (c *client) readMessage() (*message, error) {
+	_, r, err := c.socket.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	limit := c.room.maxMessageSize
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(buf.Len()) > limit {
+		c.close(websocket.CloseMessageTooBig, closeReason{Error: "message_too_big", Limit: limit})
+		return nil, errMessageTooBig
+	}
+	return c.wire.decode(buf.Bytes())
+}
+
+// close sends a close frame with the given code and structured reason.
+func (c *client) close(code int, reason closeReason) {
+	text, _ := json.Marshal(reason)
+	c.socket.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, string(text)), time.Now().Add(time.Second))
+}
+
 // The write method continually accepts messages from the send channel writing
-// everything out of the socket via the WriteMessage method. If writing to the
-// socket fails, the for loop is broken and the socket is closed.
+// everything out of the socket, via the WritePreparedMessage method if the
+// room has already prepared the message or the WriteJSON method if not.
+// Clients that asked for another wire format are sent that instead. If
+// writing to the socket fails, the for loop is broken and the socket is
+// closed.
 func (c *client) write() {
 	// Get all the messages out of the send channel and send them back through
 	// the websocket
 	for msg := range c.send {
-		if err := c.socket.WriteMessage(websocket.TextMessage, msg); err != nil {
+		var err error
+		switch {
+		case c.wire != jsonWire:
+			var frame *encodedFrame
+			if frame, err = msg.frame(c.wire); err == nil {
+				err = c.socket.WritePreparedMessage(frame.prepared)
+				frame.release()
+			}
+		case msg.prepared != nil:
+			err = c.socket.WritePreparedMessage(msg.prepared)
+		default:
+			err = c.socket.WriteJSON(msg.public())
+		}
+		c.welcomed(msg)
+		msg.release()
+		if err != nil {
 			break
 		}
 	}
+	if c.rejected != nil {
+		c.close(c.rejected.code(), *c.rejected)
+	}
 	c.socket.Close()
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// command is a slash command that people can type into the room, such as
+// /nick.
+type command struct {
+	// usage shows how the command is used.
+	usage string
+
+	// perm, if set, is the permission needed to run the command.
+	perm permission
+
+	// run carries out the command for c. args is everything typed after the
+	// command's name. If it returns an error, the error is sent back to c
+	// alone.
+	run func(c *client, args string) error
+}
+
+// commands holds every slash command, keyed by name.
+var commands = map[string]*command{
+	"nick": {
+		usage: "/nick <name>",
+		run: func(c *client, args string) error {
+			if args == "" {
+				return errUsage
+			}
+			if err := validName(args); err != nil {
+				return err
+			}
+			return c.room.rename(c, args)
+		},
+	},
+	"block": {
+		usage: "/block <name>",
+		run: func(c *client, args string) error {
+			return c.block(args, true)
+		},
+	},
+	"unblock": {
+		usage: "/unblock <name>",
+		run: func(c *client, args string) error {
+			return c.block(args, false)
+		},
+	},
+	"watch": {
+		usage: "/watch [keyword]",
+		run: func(c *client, args string) error {
+			return c.watch(args, true)
+		},
+	},
+	"unwatch": {
+		usage: "/unwatch <keyword>",
+		run: func(c *client, args string) error {
+			return c.watch(args, false)
+		},
+	},
+	"invite": {
+		usage: "/invite <email>",
+		perm:  permPost,
+		run:   inviteCommand,
+	},
+	"schedule": {
+		usage: "/schedule <in, e.g. 2h | at, e.g. 2006-01-02T15:04:05Z> <message>, /schedule, or /schedule cancel <id>",
+		perm:  permPost,
+		run:   scheduleCommand,
+	},
+	"remind": {
+		usage: "/remind me in <duration, e.g. 2h> to <something>, /remind list, or /remind cancel <id>",
+		run:   remindCommand,
+	},
+	"pin": {
+		usage: "/pin <message id>",
+		perm:  permManageRoom,
+		run:   pinCommand(true),
+	},
+	"unpin": {
+		usage: "/unpin <message id>",
+		perm:  permManageRoom,
+		run:   pinCommand(false),
+	},
+	"poll": {
+		usage: `/poll "<question>" <option> <option>..., or /poll close <id>`,
+		perm:  permPost,
+		run:   pollCommand,
+	},
+	"translate": {
+		usage: "/translate <message id> [language]",
+		run:   translateCommand,
+	},
+	"delete": {
+		usage: "/delete <message id>",
+		perm:  permPost,
+		run:   deleteCommand,
+	},
+	"edit": {
+		usage: "/edit <message id> <new text>",
+		perm:  permPost,
+		run:   editCommand,
+	},
+	"report": {
+		usage: "/report <message number> <reason>",
+		run:   reportCommand,
+	},
+	"held": {
+		usage: "/held",
+		perm:  permDeleteOthers,
+		run:   heldCommand,
+	},
+	"approve": {
+		usage: "/approve <number>",
+		perm:  permDeleteOthers,
+		run:   reviewCommand(true),
+	},
+	"reject": {
+		usage: "/reject <number>",
+		perm:  permDeleteOthers,
+		run:   reviewCommand(false),
+	},
+	"welcome": {
+		usage: "/welcome <message> | off",
+		perm:  permDeleteOthers,
+		run:   welcomeCommand(false),
+	},
+	"rules": {
+		usage: "/rules <rules> | off",
+		perm:  permDeleteOthers,
+		run:   welcomeCommand(true),
+	},
+	"presence": {
+		usage: "/presence on | off",
+		perm:  permManageRoom,
+		run:   presenceCommand,
+	},
+	"public": {
+		usage: "/public on | off",
+		perm:  permOwnRoom,
+		run:   publicCommand,
+	},
+	"disappear": {
+		usage: "/disappear <after, such as 30m or 24h> | off",
+		perm:  permManageRoom,
+		run:   disappearCommand,
+	},
+	"me": {
+		usage: "/me <action>",
+		perm:  permPost,
+		run:   meCommand,
+	},
+	"assistant": {
+		usage: "/assistant [on | off | budget <tokens a day>]",
+		run:   assistantCommand,
+	},
+}
+
+// errUsage is returned by commands that were given the wrong arguments.
+var errUsage = errors.New("usage")
+
+// runCommand carries out text as a slash command, if it is one, and reports
+// whether it was.
+func (c *client) runCommand(text string) bool {
+	if !strings.HasPrefix(text, "/") {
+		return false
+	}
+	name, args := text[1:], ""
+	if i := strings.IndexAny(name, " \t"); i >= 0 {
+		name, args = name[:i], strings.TrimSpace(name[i+1:])
+	}
+	cmd, ok := commands[strings.ToLower(name)]
+	if !ok {
+		c.replyf("Unknown command /%s", name)
+		return true
+	}
+	if cmd.perm != "" && !c.room.can(c, cmd.perm) {
+		c.replyf("/%s: %s", name, c.tr(errNotAllowed(cmd.perm).Error()))
+		return true
+	}
+	if err := cmd.run(c, args); err == errUsage {
+		c.replyf("Usage: %s", c.tr(cmd.usage))
+	} else if err != nil {
+		c.replyf("/%s: %s", name, c.tr(err.Error()))
+	}
+	return true
+}
+
+// reply sends text to the client alone, from the chat server, in the
+// client's language.
+func (c *client) reply(text string) {
+	c.room.forward <- &message{Message: c.tr(text), When: time.Now(), System: true, to: c}
+}
+
+// replyf sends the text made from format and args to the client alone, as
+// reply does, translating the format before the args are put in.
+func (c *client) replyf(format string, args ...interface{}) {
+	c.room.forward <- &message{Message: locales.sprintf(c.locale, format, args...), When: time.Now(), System: true, to: c}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// connLimiter caps the number of simultaneous connections, and the number of
+// connection attempts per window, from each source IP, so a single
+// misbehaving client can't exhaust the server's file descriptors.
+type connLimiter struct {
+	// maxConns is the most connections an IP may have open at once, and
+	// maxAttempts the most it may attempt per window. Zero means no limit.
+	maxConns    int
+	maxAttempts int
+	window      time.Duration
+
+	mu       sync.Mutex
+	conns    map[string]int
+	attempts map[string]*attemptCount
+}
+
+// attemptCount counts the attempts an IP has made in the current window.
+type attemptCount struct {
+	start time.Time
+	n     int
+}
+
+// newConnLimiter makes a connLimiter, and starts it forgetting attempts
+// once their window has passed.
+func newConnLimiter(maxConns, maxAttempts int, window time.Duration) *connLimiter {
+	l := &connLimiter{
+		maxConns:    maxConns,
+		maxAttempts: maxAttempts,
+		window:      window,
+		conns:       make(map[string]int),
+		attempts:    make(map[string]*attemptCount),
+	}
+	go l.sweep()
+	return l
+}
+
+// setLimits changes the limits, as newConnLimiter's arguments do. IPs already
+// over the new limits keep the connections they have, but can't make more.
+func (l *connLimiter) setLimits(maxConns, maxAttempts int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxConns = maxConns
+	l.maxAttempts = maxAttempts
+}
+
+// wait waits until every connection has closed, or ctx is done.
+func (l *connLimiter) wait(ctx context.Context) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		l.mu.Lock()
+		n := len(l.conns)
+		l.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// acquire records an attempt by ip to connect, and reports whether it may.
+// If it may, release must be called once the connection has closed.
+func (l *connLimiter) acquire(ip string) (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	a := l.attempts[ip]
+	if a == nil || now.Sub(a.start) >= l.window {
+		a = &attemptCount{start: now}
+		l.attempts[ip] = a
+	}
+	a.n++
+	if l.maxAttempts > 0 && a.n > l.maxAttempts {
+		return nil, false
+	}
+	if l.maxConns > 0 && l.conns[ip] >= l.maxConns {
+		return nil, false
+	}
+	l.conns[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.conns[ip]--; l.conns[ip] <= 0 {
+				delete(l.conns, ip)
+			}
+		})
+	}, true
+}
+
+// sweep periodically forgets attempt counts whose window has passed.
+func (l *connLimiter) sweep() {
+	for range time.Tick(l.window) {
+		l.mu.Lock()
+		for ip, a := range l.attempts {
+			if time.Since(a.start) >= l.window {
+				delete(l.attempts, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+type connLimitKey struct{}
+
+// connSlot is a connection's place in the limiter. Normally it is given back
+// when the handler returns; transports that keep connections open after the
+// handler has returned take it over with takeConnSlot.
+type connSlot struct {
+	release func()
+	taken   bool
+}
+
+type connLimitHandler struct {
+	limiter *connLimiter
+	next    http.Handler
+}
+
+func (h *connLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	release, ok := h.limiter.acquire(clientIP(r))
+	if !ok {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	slot := &connSlot{release: release}
+	h.next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), connLimitKey{}, slot)))
+	if !slot.taken {
+		release()
+	}
+}
+
+// LimitConnections wraps handler so that each source IP may only have a
+// limited number of connections to it at once, and may only attempt a
+// limited number of connections per window. Requests beyond the limits get a
+// 429 Too Many Requests response.
+func LimitConnections(limiter *connLimiter, handler http.Handler) http.Handler {
+	return &connLimitHandler{limiter: limiter, next: handler}
+}
+
+// takeConnSlot takes over the request's connection slot, returning the func
+// to release it with once the connection closes. The slot is then no longer
+// released when the handler returns.
+func takeConnSlot(r *http.Request) func() {
+	slot, ok := r.Context().Value(connLimitKey{}).(*connSlot)
+	if !ok {
+		return func() {}
+	}
+	slot.taken = true
+	return slot.release
+}
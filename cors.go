@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsConfig says which other origins may call the API from a browser, and
+// how.
+type corsConfig struct {
+	// origins are the origins allowed to make requests, such as
+	// "https://example.com", or "*" for any origin.
+	origins []string
+
+	// methods and headers are the methods and request headers allowed in
+	// requests from other origins.
+	methods []string
+	headers []string
+
+	// credentials allows requests from other origins to include cookies.
+	credentials bool
+
+	// maxAge is how long browsers may cache the answer to a preflight.
+	maxAge time.Duration
+}
+
+// allows reports whether requests from origin are allowed, and whether
+// that is only because any origin is.
+func (c *corsConfig) allows(origin string) (ok, wildcard bool) {
+	for _, o := range c.origins {
+		if strings.EqualFold(o, origin) {
+			return true, false
+		}
+		if o == "*" {
+			ok, wildcard = true, true
+		}
+	}
+	return ok, wildcard
+}
+
+type corsHandler struct {
+	config *corsConfig
+	next   http.Handler
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	ok, wildcard := h.config.allows(origin)
+	if origin == "" || !ok {
+		// Not a cross-origin request, or one we don't allow; without the
+		// headers below the browser won't let the page see the response.
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	// Any origin may call the API, but only without cookies: browsers refuse
+	// credentials with a wildcard, and echoing the origin instead would let
+	// every site on the web act as whoever visits it. Only origins named in
+	// the list get credentials.
+	if wildcard {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if h.config.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	// preflight. Before a request that isn't "simple", the browser asks
+	// whether it may make it with an OPTIONS request, which we answer here.
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(h.config.methods, ", "))
+		if len(h.config.headers) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(h.config.headers, ", "))
+		}
+		if h.config.maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(h.config.maxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// CORS wraps handler so that browsers allow pages on the configured origins
+// to call it.
+func CORS(config *corsConfig, handler http.Handler) http.Handler {
+	return &corsHandler{config: config, next: handler}
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
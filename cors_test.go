@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCORSOrigins checks which origins get to read API responses from a
+// browser, and which of them may send the visitor's cookies along.
+func TestCORSOrigins(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name        string
+		origins     []string
+		credentials bool
+		origin      string
+		wantOrigin  string
+		wantCreds   bool
+	}{
+		{"listed origin", []string{"https://a.example"}, false, "https://a.example", "https://a.example", false},
+		{"listed origin with credentials", []string{"https://a.example"}, true, "https://a.example", "https://a.example", true},
+		{"unlisted origin", []string{"https://a.example"}, true, "https://evil.example", "", false},
+		{"wildcard", []string{"*"}, false, "https://evil.example", "*", false},
+		{"wildcard never gets credentials", []string{"*"}, true, "https://evil.example", "*", false},
+		{"listed origin beside a wildcard", []string{"*", "https://a.example"}, true, "https://a.example", "https://a.example", true},
+		{"same origin", []string{"*"}, true, "", "", false},
+	}
+	for _, test := range tests {
+		h := CORS(&corsConfig{origins: test.origins, methods: []string{"GET"}, credentials: test.credentials}, ok)
+		r := httptest.NewRequest("GET", "/api/rooms", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.wantOrigin {
+			t.Errorf("%s: Access-Control-Allow-Origin is %q, want %q", test.name, got, test.wantOrigin)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != test.wantCreds {
+			t.Errorf("%s: credentials allowed is %v, want %v", test.name, got, test.wantCreds)
+		}
+	}
+}
+
+// TestCORSPreflight checks that preflights are answered without reaching
+// the API.
+func TestCORSPreflight(t *testing.T) {
+	reached := false
+	h := CORS(&corsConfig{origins: []string{"https://a.example"}, methods: []string{"GET", "POST"}, headers: []string{"Content-Type"}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	r := httptest.NewRequest("OPTIONS", "/api/rooms", nil)
+	r.Header.Set("Origin", "https://a.example")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if reached || w.Code != http.StatusNoContent {
+		t.Fatalf("preflight reached the API (%v) or got status %d", reached, w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+		t.Errorf("Access-Control-Allow-Methods is %q", got)
+	}
+}
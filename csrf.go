@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Browsers send the auth cookie with requests other sites' pages make to
+// us, so a page anywhere could post, or delete, on behalf of whoever visits
+// it while signed in. Requests that change things, and are signed in with
+// the cookie rather than a personal access token, which other sites don't
+// have, must therefore come from our own pages, or the pages of an origin
+// -cors-origins lets send cookies. Browsers say which page a request came
+// from with the Origin header, or failing that the Referer. Requests that
+// have neither must have an X-Requested-With header instead, which other
+// sites' pages can't send without asking first, as CORS has them do.
+
+type sameOriginHandler struct {
+	cors *corsConfig
+	next http.Handler
+}
+
+func (h *sameOriginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.allows(r) {
+		http.Error(w, "cross-site request refused", http.StatusForbidden)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// allows reports whether the request may go ahead.
+func (h *sameOriginHandler) allows(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	// signing in has its own check, the state the provider sends back.
+	if strings.HasPrefix(r.URL.Path, "/auth/") {
+		return true
+	}
+	if bearerToken(r) != "" {
+		return true
+	}
+	if _, err := r.Cookie("auth"); err != nil {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		if referer, err := url.Parse(r.Header.Get("Referer")); err == nil && referer.Host != "" {
+			origin = referer.Scheme + "://" + referer.Host
+		}
+	}
+	if origin == "" {
+		return r.Header.Get("X-Requested-With") != ""
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if h.cors != nil && h.cors.credentials {
+		if ok, wildcard := h.cors.allows(origin); ok && !wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// SameOriginOnly wraps handler so that requests signed in with the auth
+// cookie may only change things if they come from our own pages, or those of
+// an origin cors allows to send cookies.
+func SameOriginOnly(cors *corsConfig, handler http.Handler) http.Handler {
+	return &sameOriginHandler{cors: cors, next: handler}
+}
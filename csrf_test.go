@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestSameOriginOnly checks that requests signed in with the auth cookie
+// only change things when they come from our own pages, or an origin
+// allowed to send cookies.
+func TestSameOriginOnly(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := SameOriginOnly(&corsConfig{origins: []string{"*", "https://app.example"}, credentials: true}, ok)
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		cookie  bool
+		headers map[string]string
+		want    int
+	}{
+		{"our own page", "POST", "/api/me/scheduled", true, map[string]string{"Origin": "https://chat.example"}, http.StatusOK},
+		{"another site", "POST", "/api/me/scheduled", true, map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"a sandboxed page", "DELETE", "/api/uploads/1", true, map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"an origin allowed cookies", "POST", "/api/admin/reload", true, map[string]string{"Origin": "https://app.example"}, http.StatusOK},
+		{"another site's referer", "POST", "/api/admin/firewall", true, map[string]string{"Referer": "https://evil.example/page"}, http.StatusForbidden},
+		{"our own referer", "POST", "/api/admin/firewall", true, map[string]string{"Referer": "https://chat.example/chat"}, http.StatusOK},
+		{"neither, without X-Requested-With", "POST", "/api/admin/reload", true, nil, http.StatusForbidden},
+		{"neither, with X-Requested-With", "POST", "/api/admin/reload", true, map[string]string{"X-Requested-With": "fetch"}, http.StatusOK},
+		{"a token", "POST", "/api/admin/reload", true, map[string]string{"Origin": "https://evil.example", "Authorization": "Bearer chat_x_y"}, http.StatusOK},
+		{"nobody signed in", "POST", "/api/integrations/twilio/sms", false, map[string]string{"Origin": "https://evil.example"}, http.StatusOK},
+		{"reading", "GET", "/api/me/scheduled", true, map[string]string{"Origin": "https://evil.example"}, http.StatusOK},
+		{"signing in", "POST", "/auth/callback/apple", true, map[string]string{"Origin": "https://appleid.apple.com"}, http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "https://chat.example"+test.path, nil)
+		if test.cookie {
+			r.AddCookie(&http.Cookie{Name: "auth", Value: "x"})
+		}
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
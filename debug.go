@@ -0,0 +1,88 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+)
+
+// newDebugMux serves pprof's profiles under /debug/pprof/, and expvar's
+// variables, including how many people are in each of rooms and each room's
+// metrics, at /debug/vars.
+func newDebugMux(rooms []*room) *http.ServeMux {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("rooms", expvar.Func(func() interface{} {
+		clients := make(map[string]int)
+		for _, r := range rooms {
+			r.mu.RLock()
+			for _, claim := range r.names {
+				clients[r.key()] += claim.clients
+			}
+			r.mu.RUnlock()
+		}
+		return clients
+	}))
+	expvar.Publish("room_metrics", expvar.Func(func() interface{} {
+		metrics := make(map[string]roomMetrics)
+		for _, r := range rooms {
+			metrics[r.key()] = r.currentMetrics()
+		}
+		return metrics
+	}))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// debugHandler keeps the debug endpoints to those who manage the server, and
+// to when -debug is given. Importing pprof and expvar registers their
+// handlers with http.DefaultServeMux, which everything else is served from,
+// so every request for a /debug/ path, of the server or of an organization,
+// is handled here instead, and never reaches them.
+type debugHandler struct {
+	// debug serves the endpoints, or is nil if they are off.
+	debug http.Handler
+	roles *roles
+	next  http.Handler
+}
+
+func (h *debugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isDebugPath(r.URL.Path) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if h.debug == nil || strings.HasPrefix(r.URL.Path, "/o/") {
+		http.NotFound(w, r)
+		return
+	}
+	if requirePermission(w, r, h.roles, permManageServer) == "" {
+		return
+	}
+	h.debug.ServeHTTP(w, r)
+}
+
+// isDebugPath reports whether path is under /debug/, or an organization's
+// /o/<name>/debug/.
+func isDebugPath(path string) bool {
+	if strings.HasPrefix(path, "/o/") {
+		parts := strings.SplitN(path, "/", 4)
+		return len(parts) == 4 && strings.HasPrefix(parts[3], "debug/")
+	}
+	return strings.HasPrefix(path, "/debug/")
+}
+
+// Debug wraps handler so that the debug endpoints served by debug, which may
+// be nil to turn them off, are only served to people with rs's permission to
+// manage the server.
+func Debug(debug http.Handler, rs *roles, handler http.Handler) http.Handler {
+	return &debugHandler{debug: debug, roles: rs, next: handler}
+}
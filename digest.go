@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDigestItems is the most notifications kept for any one person's next
+// digest; beyond that, the digest just says how many more there were.
+const maxDigestItems = 50
+
+// digest is a notifier that collects the notifications for each person, and
+// every so often emails them a digest of everything they missed.
+type digest struct {
+	users    *userStore
+	mailer   *mailer
+	interval time.Duration
+
+	// baseURL is where the chat is, for linking to from the email.
+	baseURL string
+
+	mu      sync.Mutex
+	pending map[string]*digestItems
+}
+
+// digestItems are the notifications waiting to be sent to one person.
+type digestItems struct {
+	items   []*notification
+	dropped int
+}
+
+// newDigest makes a digest, which must be run to send anything.
+func newDigest(users *userStore, m *mailer, interval time.Duration, baseURL string) *digest {
+	return &digest{
+		users:    users,
+		mailer:   m,
+		interval: interval,
+		baseURL:  baseURL,
+		pending:  make(map[string]*digestItems),
+	}
+}
+
+// notify adds n to the next digest for its recipient.
+func (d *digest) notify(n *notification) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.pending[n.Account]
+	if !ok {
+		p = &digestItems{}
+		d.pending[n.Account] = p
+	}
+	if len(p.items) >= maxDigestItems {
+		p.dropped++
+		return
+	}
+	p.items = append(p.items, n)
+}
+
+// run sends the digests every interval. It never returns.
+func (d *digest) run() {
+	for range time.Tick(d.interval) {
+		d.send()
+	}
+}
+
+// send emails everybody their digest, if they have one.
+func (d *digest) send() {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = make(map[string]*digestItems)
+	d.mu.Unlock()
+
+	for account, p := range pending {
+		a := d.users.get(account)
+		if a == nil || a.Email == "" || a.Notify.NoDigest {
+			continue
+		}
+		if a.Notify.quiet(time.Now()) {
+			// Keep it for the first digest after their quiet hours.
+			for _, n := range p.items {
+				d.notify(n)
+			}
+			continue
+		}
+		// Leave out anything they have read since, having come back.
+		var items []*notification
+		for _, n := range p.items {
+			if n.ID > a.LastRead[n.Room] {
+				items = append(items, n)
+			}
+		}
+		if len(items) == 0 {
+			continue
+		}
+		subject := locales.translate(a.Language, "You missed a message in the chat")
+		if n := len(items) + p.dropped; n > 1 {
+			subject = locales.sprintf(a.Language, "You missed %d messages in the chat", n)
+		}
+		if err := d.mailer.send(a.Email, subject, d.body(a, items, p.dropped)); err != nil {
+			log.Println("Failed to send digest:", err)
+		}
+	}
+}
+
+// body is the text of a digest email, in the account's language.
+func (d *digest) body(a *account, items []*notification, dropped int) string {
+	sort.Slice(items, func(i, j int) bool { return items[i].When.Before(items[j].When) })
+	var b strings.Builder
+	b.WriteString(locales.sprintf(a.Language, "Hi %s,\n\nHere's what you missed while you were away:\n\n", a.Name))
+	for _, n := range items {
+		why := "mentioned you"
+		switch n.Kind {
+		case notifyKeyword:
+			why = "said one of your keywords"
+		case notifyMessage:
+			why = "said"
+		}
+		why = locales.translate(a.Language, why)
+		fmt.Fprintf(&b, "#%s, %s %s %s:\n    %s\n\n",
+			n.Room, n.When.Format("Jan 2 15:04 MST"), n.Name, why, n.Message)
+	}
+	if dropped > 0 {
+		b.WriteString(locales.sprintf(a.Language, "...and %d more.\n\n", dropped))
+	}
+	b.WriteString(locales.sprintf(a.Language, "Catch up at %s/chat\n\n", strings.TrimSuffix(d.baseURL, "/")))
+	b.WriteString(locales.translate(a.Language, "To stop these emails, turn off digests in your notification settings.\n"))
+	return b.String()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// A room can have its messages disappear a while after they are sent: each
+// message recorded while it does carries when it expires, and once it has,
+// the room deletes it, telling clients to stop showing it as it would if its
+// sender had, and then forgets it from its journal altogether.
+
+// disappearCommand is /disappear <after> | off, which has the room's
+// messages disappear after the given time from now on, or stop doing so.
+func disappearCommand(c *client, args string) error {
+	var after time.Duration
+	if args != "off" {
+		d, err := time.ParseDuration(args)
+		if err != nil || d < time.Minute {
+			return errUsage
+		}
+		after = d
+	}
+	c.room.changes <- &roomEvent{Type: eventDisappear, Name: c.name(), Account: c.account(), Disappear: after, When: time.Now()}
+	return nil
+}
+
+// disappearNotice is the system message telling everybody that e changed how
+// long messages last.
+func disappearNotice(e *roomEvent) *message {
+	text := fmt.Sprintf("%s turned off disappearing messages", e.Name)
+	if e.Disappear > 0 {
+		text = fmt.Sprintf("%s made messages disappear after %s", e.Name, e.Disappear)
+	}
+	return &message{Message: text, When: e.When, System: true}
+}
+
+// expire deletes the messages that have expired by now, and forgets them
+// from the journal. It must only be called from run.
+func (r *room) expire(now time.Time) {
+	var expired []uint64
+	for id, at := range r.state.Expiring {
+		if !at.After(now) {
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+	// the edits go too, so nothing the messages said is kept.
+	forgotten := append([]uint64(nil), expired...)
+	for _, id := range expired {
+		for _, e := range r.state.Edits[id] {
+			forgotten = append(forgotten, e.Seq)
+		}
+	}
+	for _, id := range expired {
+		r.record(&roomEvent{Type: eventDelete, Target: id, When: now})
+		r.deliver(&message{Deleted: id, When: now, System: true})
+	}
+	if r.journal != nil {
+		if err := r.journal.forget(forgotten); err != nil {
+			log.Println("Failed to forget expired messages:", err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/stretchr/objx"
+)
+
+// newDiscordProvider makes a login provider for Discord accounts.
+func newDiscordProvider(clientID, clientSecret, redirectURL string) *oauthProvider {
+	return newOAuthProvider("discord", "Discord",
+		"https://discord.com/api/oauth2/authorize",
+		"https://discord.com/api/oauth2/token",
+		"identify email",
+		"https://discord.com/api/users/@me",
+		clientID, clientSecret, redirectURL,
+		func(profile objx.Map) *oauthUser {
+			id := profile.Get("id").Str()
+			username := profile.Get("username").Str()
+			// global_name is the display name users pick for themselves; not
+			// everybody has one.
+			name := profile.Get("global_name").Str()
+			if name == "" {
+				name = username
+			}
+			return &oauthUser{
+				id:            id,
+				name:          name,
+				nickname:      username,
+				email:         profile.Get("email").Str(),
+				emailVerified: profile.Get("verified").Bool(),
+				avatarURL:     discordAvatarURL(id, profile.Get("avatar").Str()),
+			}
+		})
+}
+
+// discordAvatarURL is where the avatar with the given hash is served from.
+// Users without an avatar of their own get one of Discord's defaults, picked
+// from their ID.
+func discordAvatarURL(id, avatar string) string {
+	if avatar != "" {
+		return fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.png", id, avatar)
+	}
+	n, _ := strconv.ParseUint(id, 10, 64)
+	return fmt.Sprintf("https://cdn.discordapp.com/embed/avatars/%d.png", (n>>22)%6)
+}
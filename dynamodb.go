@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// dynamoDB keeps rooms and accounts in DynamoDB tables, for deployments on
+// AWS that would rather not run a database of their own. Credentials and the
+// region come from the environment, as for any AWS SDK.
+//
+// Rooms' events are kept in the <prefix>-messages table, partitioned by room
+// and sorted by sequence number, so restoring a room is a single query for
+// the events after its snapshot. The snapshot is kept in the same partition,
+// as sequence number 0, which no event has. Accounts are kept in the
+// <prefix>-accounts table, by ID. Each item holds what is kept as JSON, as it
+// would be in the -data directory.
+type dynamoDB struct {
+	client   *dynamodb.Client
+	messages string
+	accounts string
+}
+
+// dynamoTimeout is how long a request to DynamoDB, retries and all, may take.
+const dynamoTimeout = 30 * time.Second
+
+// openDynamoDB connects to DynamoDB, or the endpoint given, such as a local
+// DynamoDB for development, and creates the tables named with prefix if they
+// don't exist yet, billed per request.
+func openDynamoDB(prefix, endpoint string) (*dynamoDB, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*dynamoTimeout)
+	defer cancel()
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	d := &dynamoDB{client: client, messages: prefix + "-messages", accounts: prefix + "-accounts"}
+	if err := d.createTable(ctx, d.messages,
+		dynamoKey{"room", types.ScalarAttributeTypeS, types.KeyTypeHash},
+		dynamoKey{"seq", types.ScalarAttributeTypeN, types.KeyTypeRange},
+	); err != nil {
+		return nil, err
+	}
+	if err := d.createTable(ctx, d.accounts,
+		dynamoKey{"id", types.ScalarAttributeTypeS, types.KeyTypeHash},
+	); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// dynamoKey is an attribute of a table's key.
+type dynamoKey struct {
+	name string
+	typ  types.ScalarAttributeType
+	kind types.KeyType
+}
+
+// createTable creates the table called name, with the key given, unless it
+// already exists, and waits until it is ready.
+func (d *dynamoDB) createTable(ctx context.Context, name string, key ...dynamoKey) error {
+	_, err := d.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(name)})
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return err
+	}
+	input := &dynamodb.CreateTableInput{TableName: aws.String(name), BillingMode: types.BillingModePayPerRequest}
+	for _, k := range key {
+		input.KeySchema = append(input.KeySchema, types.KeySchemaElement{AttributeName: aws.String(k.name), KeyType: k.kind})
+		input.AttributeDefinitions = append(input.AttributeDefinitions, types.AttributeDefinition{AttributeName: aws.String(k.name), AttributeType: k.typ})
+	}
+	if _, err := d.client.CreateTable(ctx, input); err != nil {
+		return err
+	}
+	return dynamodb.NewTableExistsWaiter(d.client).Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(name)}, 5*time.Minute)
+}
+
+// openJournal returns the journal of the room with the given key, along with
+// the room's state restored from it.
+func (d *dynamoDB) openJournal(room string) (journal, *roomState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.messages),
+		Key:            dynamoEventKey(room, 0),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	state := newRoomState()
+	if v, ok := out.Item["state"].(*types.AttributeValueMemberS); ok {
+		if state, err = decodeSnapshot([]byte(v.Value)); err != nil {
+			return nil, nil, err
+		}
+	}
+	j := &dynamoJournal{d: d, room: room}
+	if err := j.eventsAfter(state.Seq, func(e *roomEvent) error {
+		state.apply(e)
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	return j, state, nil
+}
+
+// dynamoEventKey is the key of the item holding the room's event numbered
+// seq, or its snapshot if seq is 0.
+func dynamoEventKey(room string, seq uint64) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"room": &types.AttributeValueMemberS{Value: room},
+		"seq":  &types.AttributeValueMemberN{Value: strconv.FormatUint(seq, 10)},
+	}
+}
+
+// dynamoJournal is the journal of a room kept in DynamoDB.
+type dynamoJournal struct {
+	d    *dynamoDB
+	room string
+}
+
+func (j *dynamoJournal) append(e *roomEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	item := dynamoEventKey(j.room, e.Seq)
+	item["event"] = &types.AttributeValueMemberS{Value: string(b)}
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	_, err = j.d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(j.d.messages),
+		Item:      item,
+		// events are never overwritten, as by another instance that thinks
+		// it has the room.
+		ConditionExpression: aws.String("attribute_not_exists(seq)"),
+	})
+	return err
+}
+
+func (j *dynamoJournal) snapshot(state *roomState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	item := dynamoEventKey(j.room, 0)
+	item["state"] = &types.AttributeValueMemberS{Value: string(b)}
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	_, err = j.d.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(j.d.messages), Item: item})
+	return err
+}
+
+func (j *dynamoJournal) events(fn func(e *roomEvent) error) error {
+	return j.eventsAfter(0, fn)
+}
+
+// prune deletes the messages one by one, as DynamoDB can only delete items
+// by key.
+func (j *dynamoJournal) prune(before uint64) error {
+	var seqs []uint64
+	err := j.events(func(e *roomEvent) error {
+		if e.Seq >= before {
+			return errStopPruning
+		}
+		if e.Type == eventMessage || e.Type == eventEdit {
+			seqs = append(seqs, e.Seq)
+		}
+		return nil
+	})
+	if err != nil && err != errStopPruning {
+		return err
+	}
+	return j.forget(seqs)
+}
+
+func (j *dynamoJournal) forget(seqs []uint64) error {
+	for _, seq := range seqs {
+		ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+		_, err := j.d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(j.d.messages),
+			Key:       dynamoEventKey(j.room, seq),
+		})
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errStopPruning stops reading a room's events once past those being pruned.
+var errStopPruning = errors.New("stop pruning")
+
+// eventsAfter calls fn with every event logged after the one numbered seq.
+func (j *dynamoJournal) eventsAfter(seq uint64, fn func(e *roomEvent) error) error {
+	pages := dynamodb.NewQueryPaginator(j.d.client, &dynamodb.QueryInput{
+		TableName:              aws.String(j.d.messages),
+		KeyConditionExpression: aws.String("#room = :room AND #seq > :seq"),
+		ExpressionAttributeNames: map[string]string{
+			"#room": "room",
+			"#seq":  "seq",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":room": &types.AttributeValueMemberS{Value: j.room},
+			":seq":  &types.AttributeValueMemberN{Value: strconv.FormatUint(seq, 10)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for pages.HasMorePages() {
+		ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+		page, err := pages.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			v, ok := item["event"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			var e roomEvent
+			if err := json.Unmarshal([]byte(v.Value), &e); err != nil {
+				return err
+			}
+			if err := fn(&e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *dynamoDB) loadAccounts() ([]*account, error) {
+	var accounts []*account
+	pages := dynamodb.NewScanPaginator(d.client, &dynamodb.ScanInput{
+		TableName:      aws.String(d.accounts),
+		ConsistentRead: aws.Bool(true),
+	})
+	for pages.HasMorePages() {
+		ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+		page, err := pages.NextPage(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			v, ok := item["account"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			var a account
+			if err := json.Unmarshal([]byte(v.Value), &a); err != nil {
+				return nil, err
+			}
+			accounts = append(accounts, &a)
+		}
+	}
+	return accounts, nil
+}
+
+func (d *dynamoDB) saveAccount(a *account) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dynamoTimeout)
+	defer cancel()
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.accounts),
+		Item: map[string]types.AttributeValue{
+			"id":      &types.AttributeValueMemberS{Value: a.ID},
+			"account": &types.AttributeValueMemberS{Value: string(b)},
+		},
+	})
+	return err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// People can edit their own messages, which are then labelled as edited.
+// The room's journal keeps each message's earlier versions, so that
+// moderators, or the author, can see what it said before. Edits go through
+// the same checks as new messages: nothing can be edited in an archived room,
+// and the room's moderation sees the new text before anybody else does.
+
+// edit is an earlier version of a message: what it said from When, until the
+// edit with sequence number Seq replaced it.
+type edit struct {
+	Seq     uint64    `json:"seq"`
+	Message string    `json:"message"`
+	When    time.Time `json:"when"`
+}
+
+// editCommand is /edit <message id> <text>, which changes what one of the
+// user's own recent messages says.
+func editCommand(c *client, args string) error {
+	fields := strings.SplitN(args, " ", 2)
+	if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+		return errUsage
+	}
+	id, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return errUsage
+	}
+	c.room.mu.RLock()
+	msg := c.room.state.message(id)
+	c.room.mu.RUnlock()
+	switch {
+	case msg == nil || msg.System:
+		return fmt.Errorf("there is no recent message %d", id)
+	case msg.Sender == "" || msg.Sender != c.account():
+		return fmt.Errorf("you can only edit your own messages")
+	case c.room.archived():
+		return errors.New("This room is archived, and read only")
+	}
+	// the edit is checked as the message it makes, which moderation may
+	// hold for review like any other.
+	edited := time.Now()
+	change := &message{ID: id, Name: c.name(), Message: strings.TrimSpace(fields[1]), Edited: &edited, from: c}
+	if m := c.room.moderation; m != nil && !m.check(c, change) {
+		return nil
+	}
+	c.room.changes <- editEvent(change)
+	return nil
+}
+
+// editEvent is the event recording the edit msg makes: a message with the ID
+// of the one it changes, and Edited set to when.
+func editEvent(msg *message) *roomEvent {
+	return &roomEvent{Type: eventEdit, Name: msg.Name, Account: msg.sender(), Target: msg.ID, Message: msg.Message, When: *msg.Edited}
+}
+
+// editedMessage is the message telling clients that the message e edited
+// now says something else, or nil if the room no longer has it.
+func (r *room) editedMessage(e *roomEvent) *message {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	msg := r.state.message(e.Target)
+	if msg == nil {
+		return nil
+	}
+	return &message{ID: msg.ID, Name: msg.Name, Message: msg.Message, When: msg.When, Sender: msg.Sender, Edited: msg.Edited}
+}
+
+// version is one version of a message, as the API shows it.
+type version struct {
+	Message string    `json:"message"`
+	When    time.Time `json:"when"`
+}
+
+// versions returns every version of the message with the given ID, oldest
+// first, and who sent it, from the room's journal, which keeps them for as
+// long as the room keeps the message, well after it has left the recent
+// history. A room without a journal only has its recent history to go on.
+// It returns no versions if the message is gone.
+func (r *room) versions(id uint64) (sender string, versions []version, err error) {
+	if r.journal == nil {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		msg := r.state.message(id)
+		if msg == nil || msg.System {
+			return "", nil, nil
+		}
+		for _, e := range r.state.Edits[id] {
+			versions = append(versions, version{Message: e.Message, When: e.When})
+		}
+		when := msg.When
+		if msg.Edited != nil {
+			when = *msg.Edited
+		}
+		return msg.Sender, append(versions, version{Message: msg.Message, When: when}), nil
+	}
+	err = r.journal.events(func(e *roomEvent) error {
+		switch {
+		case e.Type == eventMessage && e.Seq == id:
+			sender = e.Account
+			versions = append(versions, version{Message: e.Message, When: e.When})
+		case e.Type == eventEdit && e.Target == id && versions != nil:
+			versions = append(versions, version{Message: e.Message, When: e.When})
+		case e.Type == eventDelete && e.Target == id:
+			versions = nil
+		}
+		return nil
+	})
+	return sender, versions, err
+}
+
+// messagesHandler serves GET /api/messages/{id}/history, every version of a
+// message, oldest first, to moderators and the message's author. On a server
+// with more than one room, the room is given by the room parameter.
+type messagesHandler struct {
+	rooms map[string]*room
+}
+
+func (h *messagesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/messages/"), "/")
+	if len(parts) != 2 || parts[1] != "history" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	room := h.rooms[r.URL.Query().Get("room")]
+	if room == nil && r.URL.Query().Get("room") == "" && len(h.rooms) == 1 {
+		for _, only := range h.rooms {
+			room = only
+		}
+	}
+	if room == nil {
+		http.Error(w, "no such room", http.StatusNotFound)
+		return
+	}
+	account := currentAccountID(r)
+	if account == "" {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return
+	}
+	sender, versions, err := room.versions(id)
+	if err != nil {
+		log.Println("Failed to read message history:", err)
+		http.Error(w, "failed to read the message's history", http.StatusInternalServerError)
+		return
+	}
+	if versions == nil {
+		http.Error(w, "no such message", http.StatusNotFound)
+		return
+	}
+	if sender != account && !room.allows(account, permDeleteOthers) {
+		http.Error(w, errNotAllowed(permDeleteOthers).Error(), http.StatusForbidden)
+		return
+	}
+	writeJSON(w, versions)
+}
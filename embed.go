@@ -0,0 +1,91 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"net/http"
+	"sort"
+)
+
+// The templates, assets and catalogs the server needs are built into the binary, so it
+// can be run from anywhere, on its own.
+//
+//go:embed templates assets locales
+var content embed.FS
+
+// embedded returns the embedded directory called dir.
+func embedded(dir string) fs.FS {
+	sub, err := fs.Sub(content, dir)
+	if err != nil {
+		// only if dir isn't a valid path, which it always is.
+		panic(err)
+	}
+	return sub
+}
+
+// overlay is a file system made of layers, such as a theme's files over the
+// embedded ones. A file in one layer takes precedence over the same file in
+// the layers after it, and directories have the files of every layer.
+type overlay []fs.FS
+
+func (o overlay) Open(name string) (fs.File, error) {
+	for _, layer := range o {
+		f, err := layer.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// ReadDir lists the files in every layer's directory called name, which is
+// how fs.Glob finds the partials of a theme as well as the embedded ones.
+func (o overlay) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	seen := make(map[string]bool)
+	found := false
+	for _, layer := range o {
+		layerEntries, err := fs.ReadDir(layer, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, e := range layerEntries {
+			if !seen[e.Name()] {
+				seen[e.Name()] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+type noCacheHandler struct {
+	next http.Handler
+}
+
+func (h *noCacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	// without these, the browser asks whether the file has changed, and is
+	// told it hasn't by its modification time, which isn't always right.
+	r.Header.Del("If-Modified-Since")
+	r.Header.Del("If-None-Match")
+	h.next.ServeHTTP(w, r)
+}
+
+// NoCache wraps handler so that browsers don't cache its responses, and
+// always fetch them afresh.
+func NoCache(handler http.Handler) http.Handler {
+	return &noCacheHandler{next: handler}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"time"
+)
+
+// Types of event that happen in a room.
+const (
+	eventJoin    = "join"
+	eventLeave   = "leave"
+	eventMessage = "message"
+	eventTopic   = "topic"
+	eventBan     = "ban"
+	eventNick    = "nick"
+	eventPin     = "pin"
+	eventUnpin   = "unpin"
+	eventPoll    = "poll"
+	eventVote    = "vote"
+	eventClose   = "close"
+	eventDelete  = "delete"
+	eventEdit    = "edit"
+
+	eventShadowBan   = "shadowban"
+	eventUnshadowBan = "unshadowban"
+
+	eventRetention = "retention"
+	eventPrune     = "prune"
+	eventDisappear = "disappear"
+
+	eventArchive    = "archive"
+	eventReactivate = "reactivate"
+
+	eventOwner     = "owner"
+	eventCoOwner   = "coowner"
+	eventUncoOwner = "uncoowner"
+
+	eventWelcome = "welcome"
+	eventRules   = "rules"
+
+	eventShowPresence = "showpresence"
+	eventHidePresence = "hidepresence"
+
+	eventPublic   = "public"
+	eventUnpublic = "unpublic"
+)
+
+// roomEvent is a structured record of a single change to a room: a client
+// joining or leaving, a message being sent, the topic being changed or a user
+// being banned. Every change to a room's state is made by applying an event,
+// so replaying the events rebuilds the state.
+//
+// Name is who the event is about: the user joining, leaving, sending the
+// message, setting the topic, welcome message or rules, being banned or shadow
+// banned, changing their name, pinning a message, or starting, voting in or
+// closing a poll. Account is the account of that user, where it matters.
+// Message holds the text of a message, the new topic, welcome message or
+// rules, the user's new name or a poll's question, and Options a poll's
+// options. Shadow bans are about the user with the given Account. Target is
+// the ID of the message being pinned, unpinned, deleted or edited, of the poll being
+// voted in or closed, or of the first message kept when older ones are pruned,
+// and Choice the option voted for, counting from 1. Retention is the room's
+// new retention policy, or nil if it follows the server's. Disappear is how
+// long messages now last for, or 0 if for ever, Expires when a message
+// disappears, if it does, and Voice the voice message a message is, if it is
+// one.
+type roomEvent struct {
+	Seq     uint64    `json:"seq"`
+	Type    string    `json:"type"`
+	Name    string    `json:"name"`
+	Account string    `json:"account,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Options []string  `json:"options,omitempty"`
+	Target  uint64    `json:"target,omitempty"`
+	Choice  int       `json:"choice,omitempty"`
+	When    time.Time `json:"when"`
+
+	Retention *retention    `json:"retention,omitempty"`
+	Disappear time.Duration `json:"disappear,omitempty"`
+	Expires   *time.Time    `json:"expires,omitempty"`
+	Voice     *voiceNote    `json:"voice,omitempty"`
+	Avatar    string        `json:"avatar,omitempty"`
+	Action    bool          `json:"action,omitempty"`
+}
+
+// eventSink receives every event that happens in a room. Like the tracer,
+// publish is called from inside the room's run loop, so it must not block.
+type eventSink interface {
+	publish(e *roomEvent)
+}
+
+type nilEventSink struct{}
+
+func (s nilEventSink) publish(e *roomEvent) {}
+
+// eventsOff is an eventSink that ignores all events.
+func eventsOff() eventSink {
+	return nilEventSink{}
+}
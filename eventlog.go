@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// journal is where a room's events are logged before they are applied, and
+// its state is snapshotted. The event log in the -data directory is one, and
+// a database may be another.
+type journal interface {
+	// append logs e after every event logged before it.
+	append(e *roomEvent) error
+
+	// snapshot saves state, so that the room can be restored from it and
+	// the events logged after it.
+	snapshot(state *roomState) error
+
+	// events calls fn with every event logged, in order, stopping at the
+	// first error fn returns.
+	events(fn func(e *roomEvent) error) error
+
+	// prune removes the messages, and edits to them, numbered before the
+	// given sequence number, which the room no longer keeps.
+	prune(before uint64) error
+
+	// forget removes the messages and edits with the given sequence
+	// numbers, which have disappeared.
+	forget(seqs []uint64) error
+}
+
+// database is a database rooms and accounts are kept in, instead of the -data
+// directory.
+type database interface {
+	accountDB
+
+	// openJournal returns the journal of the room with the given key, along
+	// with the room's state restored from it.
+	openJournal(room string) (journal, *roomState, error)
+}
+
+// eventLog is an append-only log of the events that happened in a room,
+// stored as one JSON object per line, together with an occasional snapshot
+// of the room's state.
+//
+// The state of the room can always be rebuilt by loading the latest
+// snapshot and replaying the events logged after it, which is what
+// openEventLog does when the server starts. Snapshots only make that quicker:
+// the log itself is never truncated, so it doubles as an audit trail, but for
+// the messages pruned by the room's retention policy.
+type eventLog struct {
+	dir string
+	f   *os.File
+}
+
+const (
+	eventLogFile = "events.log"
+	snapshotFile = "snapshot.json"
+)
+
+// openEventLog opens the event log kept in dir, creating it if necessary,
+// and returns it along with the room state rebuilt from it.
+func openEventLog(dir string) (*eventLog, *roomState, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+	state, err := loadSnapshot(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := replayEvents(&eventLog{dir: dir}, state); err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, eventLogFile), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Make sure a partial line left by a crash doesn't swallow the next event.
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			f.Write([]byte{'\n'})
+		}
+	}
+	return &eventLog{dir: dir, f: f}, state, nil
+}
+
+// append writes e to the end of the log.
+func (l *eventLog) append(e *roomEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = l.f.Write(append(b, '\n'))
+	return err
+}
+
+// snapshot saves state, so that future replays only need the events that
+// come after it. The snapshot is written to a temporary file first and then
+// renamed, so a crash part way through leaves the previous snapshot intact.
+func (l *eventLog) snapshot(state *roomState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(l.dir, snapshotFile+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(l.dir, snapshotFile))
+}
+
+// events calls fn with every event in the log.
+func (l *eventLog) events(fn func(e *roomEvent) error) error {
+	f, err := os.Open(filepath.Join(l.dir, eventLogFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e roomEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A crash while appending can leave a partial line behind.
+			continue
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (l *eventLog) prune(before uint64) error {
+	return l.rewrite(func(e *roomEvent) bool {
+		return (e.Type == eventMessage || e.Type == eventEdit) && e.Seq < before
+	})
+}
+
+func (l *eventLog) forget(seqs []uint64) error {
+	forgotten := make(map[uint64]bool, len(seqs))
+	for _, seq := range seqs {
+		forgotten[seq] = true
+	}
+	return l.rewrite(func(e *roomEvent) bool {
+		return (e.Type == eventMessage || e.Type == eventEdit) && forgotten[e.Seq]
+	})
+}
+
+// rewrite rewrites the log without the events drop returns true for, by way
+// of a temporary file, as for snapshots, which the log then carries on being
+// appended to.
+func (l *eventLog) rewrite(drop func(e *roomEvent) bool) error {
+	path := filepath.Join(l.dir, eventLogFile)
+	f, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = l.events(func(e *roomEvent) error {
+		if drop(e) {
+			return nil
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	l.f.Close()
+	l.f = f
+	return nil
+}
+
+// loadSnapshot reads the snapshot at path, or returns an empty state if
+// there is no snapshot yet.
+func loadSnapshot(path string) (*roomState, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return newRoomState(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeSnapshot(b)
+}
+
+// decodeSnapshot decodes a snapshot of a room's state from JSON.
+func decodeSnapshot(b []byte) (*roomState, error) {
+	state := newRoomState()
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	if state.Banned == nil {
+		state.Banned = make(map[string]bool)
+	}
+	// snapshots taken when bans were by name have them under banned.
+	var old struct {
+		Banned map[string]bool `json:"banned"`
+	}
+	if err := json.Unmarshal(b, &old); err != nil {
+		return nil, err
+	}
+	for name := range old.Banned {
+		state.Banned[state.accountNamed(name)] = true
+	}
+	if state.ShadowBanned == nil {
+		state.ShadowBanned = make(map[string]bool)
+	}
+	if state.Polls == nil {
+		state.Polls = make(map[uint64]*poll)
+	}
+	if state.Expiring == nil {
+		state.Expiring = make(map[uint64]time.Time)
+	}
+	if state.CoOwners == nil {
+		state.CoOwners = make(map[string]bool)
+	}
+	if state.Edits == nil {
+		state.Edits = make(map[uint64][]*edit)
+	}
+	return state, nil
+}
+
+// replayEvents applies the events in the journal that are newer than state
+// to it.
+func replayEvents(j journal, state *roomState) error {
+	return j.events(func(e *roomEvent) error {
+		if e.Seq > state.Seq {
+			state.apply(e)
+		}
+		return nil
+	})
+}
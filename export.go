@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The formats history can be exported in.
+const (
+	exportJSONL = "jsonl"
+	exportCSV   = "csv"
+	exportHTML  = "html"
+)
+
+// exportedMessage is a message as it is exported.
+type exportedMessage struct {
+	ID      uint64    `json:"id"`
+	When    time.Time `json:"when"`
+	Name    string    `json:"name"`
+	Message string    `json:"message"`
+	Action  bool      `json:"action,omitempty"`
+}
+
+// exportWriter writes exported messages in one of the formats.
+type exportWriter interface {
+	write(m *exportedMessage) error
+	close() error
+}
+
+// newExportWriter makes an exportWriter writing the history of the named
+// room to w in format.
+func newExportWriter(w io.Writer, format, room string) (exportWriter, error) {
+	switch format {
+	case exportJSONL:
+		return &jsonlExport{enc: json.NewEncoder(w)}, nil
+	case exportCSV:
+		c := csv.NewWriter(w)
+		return &csvExport{w: c}, c.Write([]string{"id", "when", "name", "message"})
+	case exportHTML:
+		h := &htmlExport{w: w}
+		return h, transcriptTemplate.ExecuteTemplate(w, "head", room)
+	default:
+		return nil, fmt.Errorf("unknown format %q: use jsonl, csv or html", format)
+	}
+}
+
+type jsonlExport struct {
+	enc *json.Encoder
+}
+
+func (e *jsonlExport) write(m *exportedMessage) error { return e.enc.Encode(m) }
+func (e *jsonlExport) close() error                   { return nil }
+
+type csvExport struct {
+	w *csv.Writer
+}
+
+func (e *csvExport) write(m *exportedMessage) error {
+	return e.w.Write([]string{strconv.FormatUint(m.ID, 10), m.When.Format(time.RFC3339), m.Name, m.Message})
+}
+
+func (e *csvExport) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type htmlExport struct {
+	w io.Writer
+}
+
+func (e *htmlExport) write(m *exportedMessage) error {
+	return transcriptTemplate.ExecuteTemplate(e.w, "message", m)
+}
+
+func (e *htmlExport) close() error {
+	return transcriptTemplate.ExecuteTemplate(e.w, "foot", nil)
+}
+
+// transcriptTemplate is a standalone HTML page of a room's history, written
+// a piece at a time so that the history never has to be held in memory.
+var transcriptTemplate = template.Must(template.New("transcript").Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>Transcript of #{{.}}</title>
+    <style>
+      body { font-family: sans-serif; }
+      time { color: #666; font-size: small; }
+    </style>
+  </head>
+  <body>
+    <h1>Transcript of #{{.}}</h1>
+    <ul>
+{{end}}
+{{define "message"}}      <li id="message-{{.ID}}"><time datetime="{{.When.Format "2006-01-02T15:04:05Z07:00"}}">{{.When.Format "2006-01-02 15:04:05"}}</time> {{if .Action}}<em>* <strong>{{.Name}}</strong> {{.Message}}</em>{{else}}<strong>{{.Name}}</strong>: {{.Message}}{{end}}</li>
+{{end}}
+{{define "foot"}}    </ul>
+  </body>
+</html>
+{{end}}`))
+
+// exportHistory streams the messages sent to a room between from and to from
+// its journal, to w. A zero from or to leaves that end open.
+func exportHistory(w exportWriter, j journal, from, to time.Time) error {
+	err := j.events(func(e *roomEvent) error {
+		if e.Type != eventMessage {
+			return nil
+		}
+		if (!from.IsZero() && e.When.Before(from)) || (!to.IsZero() && !e.When.Before(to)) {
+			return nil
+		}
+		return w.write(&exportedMessage{ID: e.Seq, When: e.When, Name: e.Name, Message: e.Message, Action: e.Action})
+	})
+	if err != nil {
+		return err
+	}
+	return w.close()
+}
+
+// exportSubcommand is "chat export", which exports a room's history from its
+// -data directory to a file or standard output.
+func exportSubcommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dataDir := flags.String("data", "", "The directory the room's event log is kept in.")
+	room := flags.String("room", "chat", "The room to export.")
+	format := flags.String("format", exportJSONL, "The format to export in: jsonl, csv or html.")
+	fromFlag := flags.String("from", "", "Export messages sent from this time or date on.")
+	toFlag := flags.String("to", "", "Export messages sent before this time or date.")
+	out := flags.String("o", "", "The file to export to (standard output if empty).")
+	flags.Parse(args)
+	if *dataDir == "" {
+		return errors.New("-data is required")
+	}
+	if *room != "chat" {
+		return fmt.Errorf("there is no room called %s", *room)
+	}
+	from, err := parseTime(*fromFlag)
+	if err != nil {
+		return err
+	}
+	to, err := parseTime(*toFlag)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	ew, err := newExportWriter(bw, *format, *room)
+	if err != nil {
+		return err
+	}
+	if err := exportHistory(ew, &eventLog{dir: *dataDir}, from, to); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// serveExport serves GET /api/admin/rooms/{name}/export, the room's history
+// as a download, in the ?format given (jsonl by default) and optionally only
+// ?from and ?to the times given.
+func serveExport(w http.ResponseWriter, r *http.Request, room *room) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if room.journal == nil {
+		http.Error(w, "the room's history is not kept", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = exportJSONL
+	}
+	from, err := parseTime(q.Get("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseTime(q.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	types := map[string]string{
+		exportJSONL: "application/x-ndjson",
+		exportCSV:   "text/csv; charset=utf-8",
+		exportHTML:  "text/html; charset=utf-8",
+	}
+	if types[format] == "" {
+		http.Error(w, "the format must be jsonl, csv or html", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", types[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", room.name+"."+format))
+	ew, _ := newExportWriter(w, format, room.name)
+	if err := exportHistory(ew, room.journal, from, to); err != nil {
+		// the headers have gone, so all we can do is stop.
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+// fanoutWorker delivers messages to one shard of a room's clients. A room
+// runs several workers so that delivering a message to thousands of clients
+// happens in parallel, rather than one client at a time in the room's run
+// loop, where a slow iteration would hold up everybody.
+//
+// The room still decides who is a member, in its run loop, and tells the
+// worker owning a client about it joining and leaving. Since the room sends
+// everything to a worker down a single channel, each worker sees joins,
+// leaves and messages in the same order the room did.
+//
+// Once a client has been handed to a worker, the worker owns its send
+// channel and is the only one that may close it.
+type fanoutWorker struct {
+	room    *room
+	ops     chan fanoutOp
+	clients map[*client]bool
+}
+
+// fanoutOp is a single instruction for a fanout worker: exactly one of add,
+// remove and msg is set.
+type fanoutOp struct {
+	add    *client
+	remove *client
+	msg    *message
+}
+
+// fanoutQueueSize is how many instructions can be queued up for a worker
+// before the room's run loop has to wait for it.
+const fanoutQueueSize = 256
+
+// newFanoutWorker makes and starts a worker delivering messages for r.
+func newFanoutWorker(r *room) *fanoutWorker {
+	w := &fanoutWorker{
+		room:    r,
+		ops:     make(chan fanoutOp, fanoutQueueSize),
+		clients: make(map[*client]bool),
+	}
+	go w.run()
+	return w
+}
+
+func (w *fanoutWorker) run() {
+	for op := range w.ops {
+		switch {
+		case op.add != nil:
+			w.clients[op.add] = true
+		case op.remove != nil:
+			if w.clients[op.remove] {
+				delete(w.clients, op.remove)
+				close(op.remove.send)
+				op.remove.notify()
+			}
+		case op.msg != nil:
+			w.deliver(op.msg)
+		}
+	}
+}
+
+// deliver sends msg to every client in the worker's shard. If we receive a
+// message, we iterate over all the clients and send the message down each
+// client's send channel. Then, the write method of our client type will pick
+// it up and send it down the socket to the browser.
+//
+// Every client the message is queued for holds a reference to it, which it
+// releases once it has written the message.
+func (w *fanoutWorker) deliver(msg *message) {
+	defer msg.release()
+	for client := range w.clients {
+		if msg.to != nil && msg.to != client {
+			continue
+		}
+		if msg.toAccount != "" && msg.toAccount != client.account() {
+			continue
+		}
+		if msg.shadow && msg.sender() != client.account() {
+			continue
+		}
+		// only clients that asked are told who is typing, and never about
+		// themselves.
+		if msg.Typing && (msg.from == client || !client.has(capTyping)) {
+			continue
+		}
+		// people never see messages from those they have blocked.
+		if sender := msg.sender(); sender != "" && client.blocks(sender) {
+			continue
+		}
+		msg.retain(1)
+		select {
+		case client.send <- msg:
+			// send the message by putting it in clients send queue
+			client.notify()
+			w.room.tracer.Trace(" -- sent to client")
+		default:
+			msg.release()
+			// failed to send. ie the client's send queue is full, so it is not
+			// keeping up. We remove the client and close its send channel, which
+			// makes its write method close the socket; the room finds out when
+			// the client leaves.
+			delete(w.clients, client)
+			close(client.send)
+			client.notify()
+			w.room.tracer.Trace(" -- failed to send, cleaned up client")
+		}
+	}
+}
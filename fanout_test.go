@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestFanout checks that a room's workers between them deliver every
+// message to every client, in the order the room sent them, and that a
+// client too slow to keep up is dropped rather than holding up the rest.
+func TestFanout(t *testing.T) {
+	r := newRoom(4)
+	go r.run()
+	r.changes <- &roomEvent{Type: eventHidePresence}
+
+	const clients, messages = 10, 50
+	var fast []*client
+	for i := 0; i < clients; i++ {
+		c := &client{send: make(chan *message, 2*messages), room: r, userData: map[string]interface{}{"id": fmt.Sprint("account", i), "name": fmt.Sprint("name", i)}}
+		r.join <- c
+		fast = append(fast, c)
+	}
+	slow := &client{send: make(chan *message, 1), room: r, userData: map[string]interface{}{"id": "slow", "name": "slow"}}
+	r.join <- slow
+	if n := len(r.workers); n != 4 {
+		t.Fatalf("the room has %d workers, want 4", n)
+	}
+
+	for i := 0; i < messages; i++ {
+		r.forward <- &message{Name: "ada", Message: fmt.Sprint(i), When: time.Now()}
+	}
+
+	for n, c := range fast {
+		next := 0
+		timeout := time.After(5 * time.Second)
+		for next < messages {
+			select {
+			case msg := <-c.send:
+				msg.release()
+				if msg.System || msg.Message == "" {
+					continue
+				}
+				if msg.Message != fmt.Sprint(next) {
+					t.Fatalf("client %d got %q, want %d", n, msg.Message, next)
+				}
+				next++
+			case <-timeout:
+				t.Fatalf("client %d only got %d of %d messages", n, next, messages)
+			}
+		}
+	}
+
+	// the slow client's send channel filled up, so it was closed.
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-slow.send:
+			if !ok {
+				return
+			}
+			msg.release()
+		case <-timeout:
+			t.Fatal("the client that didn't keep up was never dropped")
+		}
+	}
+}
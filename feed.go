@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Rooms can be made public, so that anybody can follow what is said in them,
+// such as announcements, with a feed reader, or show it on a website, without
+// signing in. A public room's recent messages are served as an Atom feed at
+// /rooms/{name}/feed.atom.
+
+// publicCommand is /public on | off, which makes the room's recent messages
+// readable by anybody, as a feed, or stops them being.
+func publicCommand(c *client, args string) error {
+	e := &roomEvent{Name: c.name(), Account: c.account(), When: time.Now()}
+	switch args {
+	case "on":
+		e.Type = eventPublic
+		c.reply("Anybody can now read the room's feed")
+	case "off":
+		e.Type = eventUnpublic
+		c.reply("The room's feed is no longer public")
+	default:
+		return errUsage
+	}
+	c.room.changes <- e
+	return nil
+}
+
+// atomFeed is an Atom feed, as RFC 4287 has it.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Author  atomAuthor `xml:"author"`
+	Content string     `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+// atomTitleLength is how much of a message an entry's title has.
+const atomTitleLength = 80
+
+// feedHandler serves GET /rooms/{name}/feed.atom, the recent messages of a
+// public room, newest first.
+type feedHandler struct {
+	rooms   map[string]*room
+	baseURL *url.URL
+}
+
+func (h *feedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/")
+	if len(parts) != 2 || parts[1] != "feed.atom" {
+		http.NotFound(w, r)
+		return
+	}
+	room, ok := h.rooms[parts[0]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	base := *requestBaseURL(r, h.baseURL)
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	self := base.String() + r.URL.Path
+	feed := &atomFeed{
+		ID:    self,
+		Title: room.name,
+		Link:  []atomLink{{Rel: "self", Href: self}, {Href: base.String() + "/chat"}},
+	}
+	room.mu.RLock()
+	public := room.state.Public
+	if topic := room.state.Topic; topic != "" {
+		feed.Title += ": " + topic
+	}
+	updated := time.Time{}
+	for i := len(room.state.History) - 1; i >= 0; i-- {
+		msg := room.state.History[i]
+		if msg.System {
+			continue
+		}
+		when := msg.When
+		if msg.Edited != nil {
+			when = *msg.Edited
+		}
+		if when.After(updated) {
+			updated = when
+		}
+		title := msg.Message
+		if len([]rune(title)) > atomTitleLength {
+			title = string([]rune(title)[:atomTitleLength]) + "…"
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      fmt.Sprintf("%s#%d", self, msg.ID),
+			Title:   title,
+			Updated: when.UTC().Format(time.RFC3339),
+			Author:  atomAuthor{Name: msg.Name},
+			Content: msg.Message,
+		})
+	}
+	room.mu.RUnlock()
+	if !public {
+		// rooms that aren't public have no feed, as far as anybody can
+		// tell.
+		http.NotFound(w, r)
+		return
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
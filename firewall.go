@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The firewall locks the server down to the networks it should be reached
+// from, such as a company's, by the addresses requests come from. Every
+// request, to any endpoint, from outside the allowed networks, or from inside
+// the denied ones, is turned away and logged. The networks are given with
+// -ip-allow and -ip-deny, and those who manage the server can change them
+// while it runs, at /api/admin/firewall; the changes are kept with the data,
+// and outlast restarts. Connections to the IRC gateway and the gRPC API are
+// checked the same way, as they are accepted. The Telegram and MQTT bridges
+// connect out to their servers, so there is nothing coming in for the
+// firewall to check. Requests over a unix domain socket, which have no
+// address, are always let in.
+
+// firewallFile is the file in the data directory the firewall's rules are
+// kept in, once they have been changed.
+const firewallFile = "firewall.json"
+
+// firewallRules are the networks requests may come from, if any are given,
+// and those they may not, as CIDRs.
+type firewallRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// firewall checks where requests come from against its rules.
+type firewall struct {
+	path string
+
+	mu    sync.RWMutex
+	rules firewallRules
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// openFirewall opens the firewall whose rules are kept in dir, or, if they
+// have never been changed there, given by the comma separated CIDRs in allow
+// and deny.
+func openFirewall(dir, allow, deny string) (*firewall, error) {
+	f := &firewall{}
+	rules := firewallRules{Allow: splitList(allow), Deny: splitList(deny)}
+	if dir != "" {
+		f.path = filepath.Join(dir, firewallFile)
+		b, err := ioutil.ReadFile(f.path)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(b, &rules); err != nil {
+				return nil, err
+			}
+			if allow != "" || deny != "" {
+				log.Println("Firewall: using the rules in", f.path, "rather than -ip-allow and -ip-deny")
+			}
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+	if err := f.set(rules); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// set puts the rules into effect.
+func (f *firewall) set(rules firewallRules) error {
+	allow, err := parseCIDRs(strings.Join(rules.Allow, ","))
+	if err != nil {
+		return err
+	}
+	deny, err := parseCIDRs(strings.Join(rules.Deny, ","))
+	if err != nil {
+		return err
+	}
+	if rules.Allow == nil {
+		rules.Allow = []string{}
+	}
+	if rules.Deny == nil {
+		rules.Deny = []string{}
+	}
+	f.mu.Lock()
+	f.rules, f.allow, f.deny = rules, allow, deny
+	f.mu.Unlock()
+	return nil
+}
+
+// allows reports whether requests may come from ip.
+func (f *firewall) allows(ip string) bool {
+	if net.ParseIP(ip) == nil {
+		return true
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if inNetworks(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || inNetworks(f.allow, ip)
+}
+
+type firewallHandler struct {
+	firewall *firewall
+	next     http.Handler
+}
+
+func (h *firewallHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ip := clientIP(r); !h.firewall.allows(ip) {
+		log.Println("Firewall: turned away", ip, r.Method, r.URL.Path)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// Firewall wraps handler so that only requests from the addresses the
+// firewall allows are served. Others get a 403 Forbidden response.
+func Firewall(f *firewall, handler http.Handler) http.Handler {
+	return &firewallHandler{firewall: f, next: handler}
+}
+
+// firewallListener is a listener, such as the IRC gateway's, that closes the
+// connections the firewall turns away as soon as it accepts them.
+type firewallListener struct {
+	net.Listener
+	firewall *firewall
+}
+
+func (l *firewallListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if l.firewall.allows(ip) {
+			return conn, nil
+		}
+		log.Println("Firewall: turned away a connection from", ip)
+		conn.Close()
+	}
+}
+
+// listener wraps l so that it only hands on connections from the addresses
+// the firewall allows.
+func (f *firewall) listener(l net.Listener) net.Listener {
+	return &firewallListener{Listener: l, firewall: f}
+}
+
+// firewallAdminHandler serves /api/admin/firewall, where those who manage the
+// server GET the firewall's rules, and PUT new ones. New rules that would
+// turn away the request changing them are refused, so that nobody locks
+// themselves out.
+type firewallAdminHandler struct {
+	firewall *firewall
+	roles    *roles
+}
+
+func (h *firewallAdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	account := requirePermission(w, r, h.roles, permManageServer)
+	if account == "" {
+		return
+	}
+	f := h.firewall
+	switch r.Method {
+	case "GET":
+		f.mu.RLock()
+		rules := f.rules
+		f.mu.RUnlock()
+		writeJSON(w, rules)
+	case "PUT":
+		var rules firewallRules
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, "bad rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		check := &firewall{}
+		if err := check.set(rules); err != nil {
+			http.Error(w, "bad rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !check.allows(clientIP(r)) {
+			http.Error(w, "those rules would turn you away", http.StatusConflict)
+			return
+		}
+		if f.path != "" {
+			if err := saveJSON(f.path, check.rules); err != nil {
+				log.Println("Failed to save firewall rules:", err)
+				http.Error(w, "failed to save the rules", http.StatusInternalServerError)
+				return
+			}
+		}
+		f.set(check.rules)
+		log.Println("Firewall: rules changed by", account)
+		writeJSON(w, check.rules)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
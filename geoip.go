@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// With a MaxMind GeoIP database, such as GeoLite2 Country, the server looks
+// up which country each connection comes from. The country goes in the access
+// log, and with the client into the room, and the server can be told which
+// countries people may connect from, or may not, before their websockets are
+// upgraded. Addresses the database doesn't know the country of, such as those
+// on the server's own network, are let in whatever the rules say.
+type geoIP struct {
+	db *maxminddb.Reader
+
+	// allow, if not empty, holds the only countries people may connect
+	// from, and deny those they may not, by ISO 3166 code, such as GB.
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// openGeoIP opens the GeoIP database at path, allowing connections from the
+// comma separated countries in allow, or from anywhere if it is empty, except
+// those in deny.
+func openGeoIP(path, allow, deny string) (*geoIP, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	g := &geoIP{db: db, allow: make(map[string]bool), deny: make(map[string]bool)}
+	for _, c := range splitList(allow) {
+		g.allow[strings.ToUpper(c)] = true
+	}
+	for _, c := range splitList(deny) {
+		g.deny[strings.ToUpper(c)] = true
+	}
+	return g, nil
+}
+
+// country returns the ISO 3166 code of the country ip is in, or "" if it
+// isn't known.
+func (g *geoIP) country(ip string) string {
+	parsed := net.ParseIP(ip)
+	if g == nil || parsed == nil {
+		return ""
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := g.db.Lookup(parsed, &record); err != nil {
+		log.Println("GeoIP:", err)
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+// allows reports whether people may connect from the country.
+func (g *geoIP) allows(country string) bool {
+	if g == nil || country == "" {
+		return true
+	}
+	if g.deny[country] {
+		return false
+	}
+	return len(g.allow) == 0 || g.allow[country]
+}
+
+// geoCountryKey is the context key of the country a request came from.
+type geoCountryKey struct{}
+
+// requestCountry returns the country the request came from, if it was looked
+// up.
+func requestCountry(r *http.Request) string {
+	country, _ := r.Context().Value(geoCountryKey{}).(string)
+	return country
+}
+
+type geoFenceHandler struct {
+	geo  *geoIP
+	next http.Handler
+}
+
+func (h *geoFenceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	country := h.geo.country(clientIP(r))
+	if !h.geo.allows(country) {
+		log.Println("GeoIP: turned away", clientIP(r), "from", country)
+		http.Error(w, "the chat isn't available where you are", http.StatusForbidden)
+		return
+	}
+	h.next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), geoCountryKey{}, country)))
+}
+
+// GeoFence wraps handler so that the country each request comes from is
+// looked up, for requestCountry to say, and requests from countries geo
+// doesn't allow get a 403 Forbidden response. With no geo, every request is
+// let through.
+func GeoFence(geo *geoIP, handler http.Handler) http.Handler {
+	if geo == nil {
+		return handler
+	}
+	return &geoFenceHandler{geo: geo, next: handler}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GitHub can send what happens in a repository to a webhook, which posts a
+// summary of each push, pull request, issue and release to the room the
+// webhook's token is mapped to. Every webhook is signed with a secret shared
+// with GitHub, so nobody else can post to the room through it.
+
+// githubName is the name summaries are posted to rooms under.
+const githubName = "GitHub"
+
+// githubEvent is the parts of GitHub's webhook payloads that summaries are
+// made from.
+type githubEvent struct {
+	Action     string `json:"action"`
+	Ref        string `json:"ref"`
+	Compare    string `json:"compare"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+	Commits []struct {
+		Message string `json:"message"`
+	} `json:"commits"`
+	PullRequest *struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+		Merged  bool   `json:"merged"`
+	} `json:"pull_request"`
+	Issue *struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+	} `json:"issue"`
+	Release *struct {
+		TagName string `json:"tag_name"`
+		Name    string `json:"name"`
+		HTMLURL string `json:"html_url"`
+	} `json:"release"`
+}
+
+// summary is the message saying what happened, for the kind of event given
+// by the X-GitHub-Event header, or the empty string if it isn't worth
+// saying.
+func (e *githubEvent) summary(kind string) string {
+	repo := e.Repository.FullName
+	switch {
+	case kind == "push" && len(e.Commits) > 0:
+		branch := strings.TrimPrefix(e.Ref, "refs/heads/")
+		commits := "commits"
+		if len(e.Commits) == 1 {
+			commits = "commit"
+		}
+		first, _, _ := strings.Cut(e.Commits[len(e.Commits)-1].Message, "\n")
+		return fmt.Sprintf("%s pushed %d %s to %s %s: %s %s", e.Sender.Login, len(e.Commits), commits, repo, branch, first, e.Compare)
+	case kind == "pull_request" && e.PullRequest != nil:
+		action := e.Action
+		switch {
+		case action == "closed" && e.PullRequest.Merged:
+			action = "merged"
+		case action != "opened" && action != "closed" && action != "reopened":
+			return ""
+		}
+		return fmt.Sprintf("%s %s pull request %s#%d: %s %s", e.Sender.Login, action, repo, e.PullRequest.Number, e.PullRequest.Title, e.PullRequest.HTMLURL)
+	case kind == "issues" && e.Issue != nil:
+		if e.Action != "opened" && e.Action != "closed" && e.Action != "reopened" {
+			return ""
+		}
+		return fmt.Sprintf("%s %s issue %s#%d: %s %s", e.Sender.Login, e.Action, repo, e.Issue.Number, e.Issue.Title, e.Issue.HTMLURL)
+	case kind == "release" && e.Release != nil:
+		if e.Action != "published" {
+			return ""
+		}
+		name := e.Release.Name
+		if name == "" {
+			name = e.Release.TagName
+		}
+		return fmt.Sprintf("%s released %s %s %s", e.Sender.Login, repo, name, e.Release.HTMLURL)
+	}
+	return ""
+}
+
+// githubHandler serves POST /api/integrations/github/{token}, the webhooks
+// GitHub sends, posting a summary of each to the room the token is mapped
+// to.
+type githubHandler struct {
+	// rooms maps each webhook's token to the room it posts to.
+	rooms  map[string]*room
+	secret []byte
+}
+
+func (h *githubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	room, ok := h.rooms[strings.TrimPrefix(r.URL.Path, "/api/integrations/github/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "webhook too big", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !githubSigned(body, r.Header.Get("X-Hub-Signature-256"), h.secret) {
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+	var e githubEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		http.Error(w, "bad webhook: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// GitHub pings a new webhook, and may send events nobody asked for;
+	// neither is said in the room.
+	if text := e.summary(r.Header.Get("X-GitHub-Event")); text != "" {
+		room.forward <- &message{Name: githubName, Message: text, When: time.Now()}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// githubSigned reports whether signature, sha256=<hex>, is body's HMAC with
+// secret.
+func githubSigned(body []byte, signature string, secret []byte) bool {
+	sum, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(sum, mac.Sum(nil))
+}
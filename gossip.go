@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// gossipCluster is a cluster of instances of the server that find each other
+// by gossip, with memberlist, rather than being told about each other. An
+// instance only needs the address of one other to join, such as a DNS name
+// that resolves to several of them, and from then on they keep track of who
+// is in the cluster between themselves. Each instance tells the others which
+// rooms it hosts, and is the backplane of those rooms, sending the messages
+// their clients send to the other instances hosting the same room.
+//
+// Each room can also have a home instance, picked by consistent hashing, that
+// the other instances pass its clients on to, so that only one instance runs
+// the room and puts its messages in order, while the rooms are spread across
+// the cluster. When instances join or leave, only the rooms whose home they
+// are, or were, move.
+type gossipCluster struct {
+	list *memberlist.Memberlist
+
+	// http is the address the other instances reach this one's HTTP
+	// server at, to pass clients of the rooms it is home to on to it.
+	http string
+
+	// rooms holds the rooms hosted by this instance, by key.
+	mu    sync.RWMutex
+	rooms map[string]*room
+
+	// outgoing holds the messages waiting to be sent to the other
+	// instances, in the order they were sent in.
+	outgoing chan *gossipEnvelope
+}
+
+// gossipEnvelope is a message sent to the instances hosting the room with the
+// given key.
+type gossipEnvelope struct {
+	Room    string   `json:"room"`
+	Message *message `json:"message"`
+}
+
+// gossipMeta is what an instance tells the others about itself: where its
+// HTTP server is, and the rooms it hosts, by key. An instance hosting too
+// many rooms to list says it hosts them All instead.
+type gossipMeta struct {
+	HTTP  string   `json:"http,omitempty"`
+	Rooms []string `json:"rooms,omitempty"`
+	All   bool     `json:"all,omitempty"`
+}
+
+// gossipPoints is how many points on the hash ring each instance has, so that
+// rooms are spread evenly between them.
+const gossipPoints = 64
+
+// gossipProxiedHeader is the header carrying the instance that passed a
+// client on to a room's home, so that the home never passes it on again.
+const gossipProxiedHeader = "Chat-Proxied-By"
+
+// gossipJoinInterval is how often an instance that hasn't found any others
+// yet tries again.
+const gossipJoinInterval = 10 * time.Second
+
+// newGossipCluster starts gossiping as the named instance, listening on bind,
+// and joins the cluster by way of whichever of join it can reach. The other
+// instances reach this one's HTTP server at httpAddr; if it has no host, at
+// the address they gossip with it on.
+func newGossipCluster(instance, bind, httpAddr string, join []string) (*gossipCluster, error) {
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		return nil, err
+	}
+	config := memberlist.DefaultLANConfig()
+	config.Name = instance
+	if host != "" {
+		config.BindAddr = host
+	}
+	if config.BindPort, err = strconv.Atoi(port); err != nil {
+		return nil, err
+	}
+	config.AdvertisePort = config.BindPort
+	g := &gossipCluster{
+		rooms:    make(map[string]*room),
+		outgoing: make(chan *gossipEnvelope, messageBufferSize),
+	}
+	config.Delegate = g
+	if g.list, err = memberlist.Create(config); err != nil {
+		return nil, err
+	}
+	if host, port, err := net.SplitHostPort(httpAddr); err == nil && host == "" {
+		httpAddr = net.JoinHostPort(g.list.LocalNode().Addr.String(), port)
+	}
+	g.http = httpAddr
+	if err := g.list.UpdateNode(time.Second); err != nil {
+		return nil, err
+	}
+	go g.join(join)
+	go g.send()
+	return g, nil
+}
+
+// join joins the cluster by way of whichever of the addresses it can reach,
+// trying again until it reaches one, as instances started together may not
+// all be listening yet.
+func (g *gossipCluster) join(addrs []string) {
+	if len(addrs) == 0 {
+		return
+	}
+	for {
+		n, err := g.list.Join(addrs)
+		if n > 0 {
+			log.Println("Gossip: joined the cluster by way of", n, "instances")
+			return
+		}
+		log.Println("Gossip: failed to join the cluster:", err)
+		time.Sleep(gossipJoinInterval)
+	}
+}
+
+// host has this instance host the rooms, being their backplane, and tells
+// the others so.
+func (g *gossipCluster) host(rooms ...*room) {
+	g.mu.Lock()
+	for _, r := range rooms {
+		g.rooms[r.key()] = r
+		r.backplane = &gossipRoom{cluster: g, key: r.key()}
+	}
+	g.mu.Unlock()
+	if err := g.list.UpdateNode(time.Second); err != nil {
+		log.Println("Gossip: failed to tell the cluster our rooms:", err)
+	}
+}
+
+// hosts reports whether the instance hosts the room with the given key.
+func hosts(node *memberlist.Node, key string) bool {
+	var meta gossipMeta
+	if err := json.Unmarshal(node.Meta, &meta); err != nil {
+		return false
+	}
+	if meta.All {
+		return true
+	}
+	for _, r := range meta.Rooms {
+		if r == key {
+			return true
+		}
+	}
+	return false
+}
+
+// home returns the home instance of the room with the given key, and the
+// address of its HTTP server: whichever of the instances hosting the room
+// comes first on the hash ring after the room's key.
+func (g *gossipCluster) home(key string) (name, addr string) {
+	type point struct {
+		hash uint32
+		name string
+		addr string
+	}
+	var ring []point
+	for _, node := range g.list.Members() {
+		var meta gossipMeta
+		if json.Unmarshal(node.Meta, &meta) != nil || meta.HTTP == "" || !hosts(node, key) {
+			continue
+		}
+		for i := 0; i < gossipPoints; i++ {
+			ring = append(ring, point{ringHash(fmt.Sprintf("%s#%d", node.Name, i)), node.Name, meta.HTTP})
+		}
+	}
+	if len(ring) == 0 {
+		return "", ""
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	h := ringHash(key)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].name, ring[i].addr
+}
+
+// ringHash is where s falls on the hash ring.
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// homeProxy returns a handler for the room's websocket that passes clients on
+// to the room's home instance, unless this is it, in which case next serves
+// them.
+func (g *gossipCluster) homeProxy(r *room, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name, addr := g.home(r.key())
+		if name == "" || name == g.list.LocalNode().Name || req.Header.Get(gossipProxiedHeader) != "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		// the request goes on as the client made it, before any prefix,
+		// such as an organization's, was stripped from its path.
+		path, _, _ := strings.Cut(req.RequestURI, "?")
+		proxy := &httputil.ReverseProxy{Director: func(out *http.Request) {
+			out.URL.Scheme = "http"
+			out.URL.Host = addr
+			out.URL.Opaque = path
+			out.Header.Set(gossipProxiedHeader, g.list.LocalNode().Name)
+		}}
+		proxy.ServeHTTP(w, req)
+	})
+}
+
+// send sends the outgoing messages to the other instances hosting their
+// rooms, one at a time so that they arrive in order.
+func (g *gossipCluster) send() {
+	for env := range g.outgoing {
+		b, err := json.Marshal(env)
+		if err != nil {
+			log.Println("Gossip marshal:", err)
+			continue
+		}
+		for _, node := range g.list.Members() {
+			if node.Name == g.list.LocalNode().Name || !hosts(node, env.Room) {
+				continue
+			}
+			if err := g.list.SendReliable(node, b); err != nil {
+				log.Println("Gossip: failed to send to", node.Name+":", err)
+			}
+		}
+	}
+}
+
+// NodeMeta is what this instance tells the others about itself.
+func (g *gossipCluster) NodeMeta(limit int) []byte {
+	meta := gossipMeta{HTTP: g.http}
+	g.mu.RLock()
+	for key := range g.rooms {
+		meta.Rooms = append(meta.Rooms, key)
+	}
+	g.mu.RUnlock()
+	b, _ := json.Marshal(meta)
+	if len(b) > limit {
+		meta.Rooms, meta.All = nil, true
+		b, _ = json.Marshal(meta)
+	}
+	return b
+}
+
+// NotifyMsg forwards a message sent by another instance to our room.
+func (g *gossipCluster) NotifyMsg(b []byte) {
+	var env gossipEnvelope
+	if err := json.Unmarshal(b, &env); err != nil || env.Message == nil {
+		log.Println("Gossip unmarshal:", err)
+		return
+	}
+	g.mu.RLock()
+	r, ok := g.rooms[env.Room]
+	g.mu.RUnlock()
+	if !ok {
+		return
+	}
+	env.Message.remote = true
+	r.forward <- env.Message
+}
+
+// The cluster has no state to gossip but the rooms each instance hosts.
+func (g *gossipCluster) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (g *gossipCluster) LocalState(join bool) []byte                { return nil }
+func (g *gossipCluster) MergeRemoteState(buf []byte, join bool)     {}
+
+// gossipRoom is the backplane of a room hosted by an instance in a gossip
+// cluster.
+type gossipRoom struct {
+	cluster *gossipCluster
+	key     string
+}
+
+// publish queues a message from one of our clients to be sent to the other
+// instances hosting the room. It is called from the room's run loop, so if
+// the queue is full, the message is dropped rather than the room waiting.
+func (b *gossipRoom) publish(msg *message) {
+	select {
+	case b.cluster.outgoing <- &gossipEnvelope{Room: b.key, Message: msg}:
+	default:
+		log.Println("Gossip: too many messages waiting to be sent; dropped one")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative chat.proto
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer serves the Chat service defined in chat.proto, letting backend
+// services and other clients join rooms without a websocket. People are who
+// their personal access token says they are, and the token's scopes limit
+// what they may do, just as they do over HTTP.
+type grpcServer struct {
+	UnimplementedChatServer
+
+	rooms  map[string]*room
+	users  *userStore
+	tokens *tokenStore
+
+	// terms, if set, are the terms of service people must have accepted
+	// to chat.
+	terms *terms
+}
+
+// newGRPCServer makes a gRPC server for the rooms.
+func newGRPCServer(rooms map[string]*room, users *userStore, tokens *tokenStore, tos *terms, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(opts...)
+	RegisterChatServer(s, &grpcServer{rooms: rooms, users: users, tokens: tokens, terms: tos})
+	return s
+}
+
+// authenticate returns the account whose token the call was made with, as
+// the user data a client of a room has, if the token has the scope.
+func (s *grpcServer) authenticate(ctx context.Context, scope string) (map[string]interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var t *apiToken
+	for _, auth := range md.Get("authorization") {
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+			t = s.tokens.check(auth[7:])
+		}
+	}
+	if t == nil {
+		return nil, status.Error(codes.Unauthenticated, "a valid token is needed")
+	}
+	if !contains(t.Scopes, scope) {
+		return nil, status.Errorf(codes.PermissionDenied, "the token doesn't have the %s scope", scope)
+	}
+	a := s.users.get(t.Account)
+	if a == nil {
+		return nil, status.Error(codes.Unauthenticated, "a valid token is needed")
+	}
+	if scope != scopeRead && s.terms != nil && !a.accepted(s.terms.version) {
+		return nil, status.Error(codes.PermissionDenied, "the terms of service must be accepted first, at /terms")
+	}
+	return map[string]interface{}{"id": a.ID, "name": a.Name, "avatar_url": a.AvatarURL}, nil
+}
+
+// room returns the named room, or a NotFound error.
+func (s *grpcServer) room(name string) (*room, error) {
+	r, ok := s.rooms[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "there is no room %q", name)
+	}
+	return r, nil
+}
+
+func (s *grpcServer) JoinRoom(stream Chat_JoinRoomServer) error {
+	userData, err := s.authenticate(stream.Context(), scopeChat)
+	if err != nil {
+		return err
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	r, err := s.room(first.Room)
+	if err != nil {
+		return err
+	}
+	client := &client{
+		send:     make(chan *message, messageBufferSize),
+		room:     r,
+		userData: userData,
+	}
+	r.join <- client
+	defer func() { r.leave <- client }()
+
+	// Everything the caller sends from now on is said in the room, until
+	// they stop sending; they may go on listening after that.
+	go func(req *JoinRoomRequest) {
+		for {
+			if req.Text != "" {
+				client.receive(&message{Message: req.Text})
+			}
+			var err error
+			if req, err = stream.Recv(); err != nil {
+				return
+			}
+		}
+	}(first)
+
+	for {
+		select {
+		case msg, ok := <-client.send:
+			if !ok {
+				if client.rejected != nil && client.rejected.Error == reasonRestarting {
+					return status.Error(codes.Unavailable, "the server is restarting")
+				}
+				if client.rejected != nil {
+					return status.Errorf(codes.PermissionDenied, "turned away from the room: %s", client.rejected.Error)
+				}
+				return nil
+			}
+			// gRPC doesn't use the prepared websocket frame.
+			msg.release()
+			if !msg.relayable() {
+				continue
+			}
+			out := chatMessage(msg)
+			if err := stream.Send(out); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (s *grpcServer) SendMessage(ctx context.Context, req *SendMessageRequest) (*SendMessageResponse, error) {
+	userData, err := s.authenticate(ctx, scopeWrite)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.room(req.Room)
+	if err != nil {
+		return nil, err
+	}
+	if req.Text == "" {
+		return nil, status.Error(codes.InvalidArgument, "there is no text to send")
+	}
+	// The client never joins the room, so the room has nowhere to send it
+	// replies, such as errors, to; what may be said is checked here.
+	client := &client{room: r, userData: userData}
+	if !r.can(client, permPost) {
+		return nil, status.Error(codes.PermissionDenied, errNotAllowed(permPost).Error())
+	}
+	if r.banned(client.account()) {
+		return nil, status.Error(codes.PermissionDenied, "you have been banned from the room")
+	}
+	client.receive(&message{Message: req.Text})
+	return &SendMessageResponse{}, nil
+}
+
+func (s *grpcServer) ListRooms(ctx context.Context, req *ListRoomsRequest) (*ListRoomsResponse, error) {
+	if _, err := s.authenticate(ctx, scopeRead); err != nil {
+		return nil, err
+	}
+	resp := &ListRoomsResponse{}
+	for name, r := range s.rooms {
+		resp.Rooms = append(resp.Rooms, &Room{Name: name, Topic: r.topic()})
+	}
+	sort.Slice(resp.Rooms, func(i, j int) bool { return resp.Rooms[i].Name < resp.Rooms[j].Name })
+	return resp, nil
+}
+
+func (s *grpcServer) History(ctx context.Context, req *HistoryRequest) (*HistoryResponse, error) {
+	if _, err := s.authenticate(ctx, scopeRead); err != nil {
+		return nil, err
+	}
+	r, err := s.room(req.Room)
+	if err != nil {
+		return nil, err
+	}
+	resp := &HistoryResponse{}
+	r.mu.RLock()
+	for _, msg := range r.state.History {
+		if req.Before == 0 || msg.ID < req.Before {
+			resp.Messages = append(resp.Messages, chatMessage(msg))
+		}
+	}
+	r.mu.RUnlock()
+	if n := int(req.Limit); n > 0 && len(resp.Messages) > n {
+		resp.Messages = resp.Messages[len(resp.Messages)-n:]
+	}
+	return resp, nil
+}
+
+// chatMessage converts msg to its gRPC form.
+func chatMessage(msg *message) *ChatMessage {
+	return &ChatMessage{
+		Id:       msg.ID,
+		Name:     msg.Name,
+		Text:     msg.Message,
+		When:     timestamppb.New(msg.When),
+		Sender:   msg.Sender,
+		System:   msg.System,
+		Mentions: msg.Mentions,
+		Flagged:  msg.Flagged,
+		Deleted:  msg.Deleted,
+		Edited:   timestamp(msg.Edited),
+		Expires:  timestamp(msg.Expires),
+		Voice:    voiceProto(msg.Voice),
+		Action:   msg.Action,
+		Presence: msg.Presence,
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import "fmt"
+
+// The version of the protocol spoken over the websocket, and the oldest
+// version we still speak. Clients say which version they speak in their
+// hello; clients that never send one are taken to speak version 1.
+const (
+	protocolVersion    = 1
+	minProtocolVersion = 1
+)
+
+// The capabilities a client can ask for in its hello. They are things that
+// would confuse clients that didn't ask for them, so each is only used with
+// clients that have.
+const (
+	// capCompression is compressing messages sent to the client, when the
+	// websocket negotiated permessage-deflate.
+	capCompression = "compression"
+
+	// capAck is acknowledging each message the client sends with a nonce,
+	// once the room has recorded it, with the message's ID.
+	capAck = "ack"
+
+	// capTyping is being told when other people are typing, and telling
+	// them when we are.
+	capTyping = "typing"
+)
+
+// capabilities are the capabilities the server has, in the order they are
+// listed in welcomes.
+var capabilities = []string{capCompression, capAck, capTyping}
+
+// hello is what a client sends, as the first thing it sends, to say which
+// version of the protocol it speaks and which capabilities it would like.
+// The server's welcome, in reply, has the version both will speak and the
+// capabilities it agreed to.
+type hello struct {
+	Version      int
+	Capabilities []string `json:",omitempty"`
+}
+
+// clientMessage holds the fields of a message clients may set. Everything
+// else about a message is for the server to say.
+type clientMessage struct {
+	Message string
+	Read    uint64
+	Vote    *pollVote
+	Hello   *hello
+	Typing  bool
+
+	// Nonce is the client's own ID for the message, which comes back in
+	// the ack if the client asked for acks.
+	Nonce string
+
+	// Voice is the ID of an upload to send as a voice message.
+	Voice string
+}
+
+func (in *clientMessage) message() *message {
+	return &message{Message: in.Message, Read: in.Read, Vote: in.Vote, Hello: in.Hello, Typing: in.Typing, nonce: in.Nonce, voiceUpload: in.Voice}
+}
+
+// has reports whether the client has the capability.
+func (c *client) has(capability string) bool {
+	caps, _ := c.caps.Load().(map[string]bool)
+	return caps[capability]
+}
+
+// greet answers a client's hello with a welcome, agreeing to the
+// capabilities it asked for that we have.
+func (c *client) greet(h *hello) {
+	version := h.Version
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+	if version < minProtocolVersion {
+		c.reply(fmt.Sprintf("This server speaks version %d to %d of the protocol, not %d", minProtocolVersion, protocolVersion, h.Version))
+		return
+	}
+	asked := make(map[string]bool)
+	for _, capability := range h.Capabilities {
+		asked[capability] = true
+	}
+	caps := make(map[string]bool)
+	welcome := &hello{Version: version}
+	for _, capability := range capabilities {
+		// only gorilla's transport can compress.
+		if asked[capability] && (capability != capCompression || c.socket != nil) {
+			caps[capability] = true
+			welcome.Capabilities = append(welcome.Capabilities, capability)
+		}
+	}
+	c.caps.Store(caps)
+	c.room.forward <- &message{Welcome: welcome, to: c}
+}
+
+// welcomed is called by the client's write method once it has written a
+// message, so that anything the welcome agreed to that changes how later
+// messages are written is only done from then on, by the goroutine writing.
+func (c *client) welcomed(msg *message) {
+	if msg.Welcome == nil || c.socket == nil {
+		return
+	}
+	for _, capability := range msg.Welcome.Capabilities {
+		if capability == capCompression {
+			c.socket.EnableWriteCompression(true)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Tools such as Jenkins, GitLab CI and CircleCI can send what they are doing
+// to a webhook, each in JSON of its own. Rather than the server knowing every
+// tool's JSON, whoever deploys it writes, for each webhook, a Go template
+// that turns the tool's JSON into the message posted to the room. A file of
+// webhooks, given with -hooks, looks like:
+//
+//	[
+//	  {
+//	    "name": "Jenkins",
+//	    "token": "a-long-random-string",
+//	    "room": "chat",
+//	    "template": "{{.name}} build {{.build.number}}: {{.build.status}} {{.build.full_url}}"
+//	  }
+//	]
+//
+// and Jenkins is pointed at /api/integrations/hooks/a-long-random-string. The
+// template is given the webhook's JSON; if it says nothing, nothing is
+// posted, so templates can leave out what isn't worth saying with {{if}}.
+
+// hookConfig is a webhook, as given in the file of them.
+type hookConfig struct {
+	// Name is who the messages are posted to the room as.
+	Name string `json:"name"`
+
+	// Token is the secret part of the webhook's URL.
+	Token string `json:"token"`
+
+	// Room is the room the messages are posted to, such as chat, or
+	// acme/ops for an organization's.
+	Room string `json:"room"`
+
+	// Template makes the message from the webhook's JSON.
+	Template string `json:"template"`
+}
+
+// hook is a webhook, ready to post to its room.
+type hook struct {
+	name     string
+	room     *room
+	template *template.Template
+}
+
+// loadHooks loads the file of webhooks at path, whose rooms are found in
+// rooms, by key. It returns them by token.
+func loadHooks(path string, rooms map[string]*room) (map[string]*hook, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []hookConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, err
+	}
+	hooks := make(map[string]*hook)
+	for _, c := range configs {
+		switch {
+		case c.Name == "" || c.Token == "":
+			return nil, fmt.Errorf("every webhook needs a name and a token")
+		case hooks[c.Token] != nil:
+			return nil, fmt.Errorf("%s: token already used", c.Name)
+		case rooms[c.Room] == nil:
+			return nil, fmt.Errorf("%s: no room %q", c.Name, c.Room)
+		}
+		t, err := template.New(c.Name).Parse(c.Template)
+		if err != nil {
+			return nil, err
+		}
+		hooks[c.Token] = &hook{name: c.Name, room: rooms[c.Room], template: t}
+	}
+	return hooks, nil
+}
+
+// hooksHandler serves POST /api/integrations/hooks/{token}, posting the
+// message the webhook's template makes of the JSON sent to the webhook's
+// room.
+type hooksHandler struct {
+	hooks map[string]*hook
+}
+
+func (h *hooksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hook, ok := h.hooks[strings.TrimPrefix(r.URL.Path, "/api/integrations/hooks/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload interface{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&payload); err != nil {
+		http.Error(w, "bad webhook: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var text bytes.Buffer
+	if err := hook.template.Execute(&text, payload); err != nil {
+		http.Error(w, "the webhook's template failed: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if s := strings.TrimSpace(text.String()); s != "" {
+		hook.room.forward <- &message{Name: hook.name, Message: s, When: time.Now()}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// What the server says itself, such as its replies to commands, its pages and
+// its emails, is written in English, and translated into each person's
+// language where there is a catalog for it. The catalogs are JSON files in
+// locales/, one for each language, named after its code, such as es.json,
+// mapping English text to its translation. Text with values in it, such as
+// "Unknown command /%s", is looked up by its format, before the values are
+// put in. People's language is the one on their profile, or else the first
+// their browser asks for, with Accept-Language, that there is a catalog for.
+// Messages to everybody in a room, such as somebody joining, are sent to all
+// of them at once, so stay in English.
+
+// catalogs holds the translations into each language, keyed by the English.
+type catalogs map[string]map[string]string
+
+// locales are the catalogs the server translates with. They are the built in
+// ones unless main loads others over them.
+var locales = mustLoadCatalogs(embedded("locales"))
+
+// loadCatalogs loads the catalogs in fsys.
+func loadCatalogs(fsys fs.FS) (catalogs, error) {
+	names, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+	cs := make(catalogs)
+	for _, name := range names {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(b, &catalog); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		cs[strings.ToLower(strings.TrimSuffix(path.Base(name), ".json"))] = catalog
+	}
+	return cs, nil
+}
+
+func mustLoadCatalogs(fsys fs.FS) catalogs {
+	cs, err := loadCatalogs(fsys)
+	if err != nil {
+		panic(err)
+	}
+	return cs
+}
+
+// catalog returns the catalog for lang, such as pt-BR, or failing that for
+// its language, pt, or nil if there is neither.
+func (cs catalogs) catalog(lang string) map[string]string {
+	lang = strings.ToLower(lang)
+	if c, ok := cs[lang]; ok {
+		return c
+	}
+	base, _, _ := strings.Cut(lang, "-")
+	return cs[base]
+}
+
+// translate returns text in lang, or as it is if it hasn't been translated.
+func (cs catalogs) translate(lang, text string) string {
+	if t, ok := cs.catalog(lang)[text]; ok && t != "" {
+		return t
+	}
+	return text
+}
+
+// sprintf formats the translation of format into lang with args.
+func (cs catalogs) sprintf(lang, format string, args ...interface{}) string {
+	return fmt.Sprintf(cs.translate(lang, format), args...)
+}
+
+// match returns the language to use for somebody who prefers lang, if there
+// is a catalog for it, or else the one they like best of those they accept,
+// given as an Accept-Language header, that there is one for. It returns ""
+// for English, or if there is no catalog for any of them.
+func (cs catalogs) match(lang, accept string) string {
+	if lang != "" && cs.catalog(lang) != nil {
+		return lang
+	}
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(accept, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if tag != "" && tag != "*" && q > 0 {
+			choices = append(choices, choice{tag, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	for _, c := range choices {
+		if strings.HasPrefix(strings.ToLower(c.lang), "en") {
+			return ""
+		}
+		if cs.catalog(c.lang) != nil {
+			return c.lang
+		}
+	}
+	return ""
+}
+
+// requestLocale returns the language to answer the request in, from its
+// Accept-Language header.
+func requestLocale(r *http.Request) string {
+	return locales.match("", r.Header.Get("Accept-Language"))
+}
+
+// clientLocale returns the language to talk to somebody connecting with the
+// request in: the one on their profile, or else one their browser accepts.
+func clientLocale(r *http.Request, userData map[string]interface{}) string {
+	lang, _ := userData["language"].(string)
+	return locales.match(lang, r.Header.Get("Accept-Language"))
+}
+
+// tr returns text in the client's language.
+func (c *client) tr(text string) string {
+	return locales.translate(c.locale, text)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// People can post to a room by emailing it, at the room's name, such as
+// chat@chat.example.com, or acme.ops@chat.example.com for an organization's
+// room, with its organization's name first. The email is received by
+// Mailgun, whose route for the domain forwards it to a webhook, which posts
+// the email's subject and its body, without the quoted reply or signature,
+// to the room. Only emails from the verified addresses of people's accounts
+// are posted, as them.
+
+// maxEmailLength is the most of an email's body that is posted.
+const maxEmailLength = 2000
+
+// mailgunMaxAge is how old a webhook's timestamp may be, so that one that
+// has been seen can't be replayed later.
+const mailgunMaxAge = 5 * time.Minute
+
+// mailgunHandler serves POST /api/integrations/mailgun, the webhook Mailgun
+// forwards emails to rooms to.
+type mailgunHandler struct {
+	// rooms are the rooms of the whole server, by key, and domain the
+	// domain they are emailed at.
+	rooms  map[string]*room
+	domain string
+
+	// key is the key Mailgun signs its webhooks with.
+	key   []byte
+	users *userStore
+}
+
+func (h *mailgunHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		http.Error(w, "bad email: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !mailgunSigned(r.FormValue("timestamp"), r.FormValue("token"), r.FormValue("signature"), h.key) {
+		http.Error(w, "bad signature", http.StatusNotAcceptable)
+		return
+	}
+	// Mailgun retries emails it gets an error for, but there is no point
+	// retrying those that can't be posted, so they are turned down with
+	// 406, which it doesn't retry.
+	local, domain, _ := strings.Cut(strings.ToLower(r.FormValue("recipient")), "@")
+	room := h.rooms[strings.Replace(local, ".", "/", 1)]
+	if room == nil || domain != h.domain {
+		http.Error(w, "no such room", http.StatusNotAcceptable)
+		return
+	}
+	from, err := mail.ParseAddress(r.FormValue("from"))
+	if err != nil {
+		http.Error(w, "bad sender", http.StatusNotAcceptable)
+		return
+	}
+	a := h.users.findByEmail(from.Address)
+	if a == nil {
+		log.Println("Email to", room.key(), "from unknown sender", from.Address, "dropped")
+		http.Error(w, "unknown sender", http.StatusNotAcceptable)
+		return
+	}
+	room.forward <- &message{Name: a.Name, Message: emailMessage(r.FormValue("subject"), r), When: time.Now(), account: a.ID}
+	w.WriteHeader(http.StatusOK)
+}
+
+// emailMessage is the message an email is posted as: its subject, and then
+// its body, without anything Mailgun could tell was quoted or a signature,
+// cut short if it is long.
+func emailMessage(subject string, r *http.Request) string {
+	body := r.FormValue("stripped-text")
+	if body == "" {
+		body = r.FormValue("body-plain")
+	}
+	body = strings.TrimSpace(body)
+	if b := []rune(body); len(b) > maxEmailLength {
+		body = string(b[:maxEmailLength]) + "…"
+	}
+	if subject = strings.TrimSpace(subject); subject == "" {
+		return body
+	}
+	if body == "" {
+		return subject
+	}
+	return subject + "\n\n" + body
+}
+
+// mailgunSigned reports whether signature is Mailgun's signature of the
+// recent timestamp and token: their HMAC-SHA256 with key, in hex.
+func mailgunSigned(timestamp, token, signature string, key []byte) bool {
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(secs, 0)) > mailgunMaxAge {
+		return false
+	}
+	sum, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + token))
+	return hmac.Equal(sum, mac.Sum(nil))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// inviteLifetime is how long an invitation link works for.
+const inviteLifetime = 7 * 24 * time.Hour
+
+// inviter emails people invitations to rooms. An invitation is a link back
+// to the server, signed so that only the server can have made it.
+type inviter struct {
+	mailer  *mailer
+	key     []byte
+	baseURL string
+}
+
+// newInviter makes an inviter that signs its links with key.
+func newInviter(m *mailer, key []byte, baseURL string) *inviter {
+	return &inviter{mailer: m, key: key, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// sign returns the signature of an invitation to room for email, expiring
+// at expires.
+func (i *inviter) sign(room, email string, expires int64) string {
+	mac := hmac.New(sha256.New, i.key)
+	fmt.Fprintf(mac, "invite\n%s\n%s\n%d", room, strings.ToLower(email), expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// link makes the link inviting email to room.
+func (i *inviter) link(room, email string) string {
+	expires := time.Now().Add(inviteLifetime).Unix()
+	return i.baseURL + "/invite?" + url.Values{
+		"room":    {room},
+		"email":   {email},
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {i.sign(room, email, expires)},
+	}.Encode()
+}
+
+// invite emails email an invitation to room from the named user, in their
+// language, lang.
+func (i *inviter) invite(from, room, email, lang string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return fmt.Errorf("%q is not an email address", email)
+	}
+	body := locales.sprintf(lang, "%s has invited you to chat in #%s.\n\nJoin them at %s\n\nThe link works for a week.\n",
+		from, room, i.link(room, addr.Address))
+	return i.mailer.send(addr.Address, locales.sprintf(lang, "%s invited you to #%s", from, room), body)
+}
+
+// ServeHTTP handles /invite links: if the invitation is good, the invitee is
+// sent to the room, by way of signing in if they haven't yet. Signing in
+// creates their account, so nobody needs to register before accepting.
+func (i *inviter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	room, email := q.Get("room"), q.Get("email")
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(q.Get("sig")), []byte(i.sign(room, email, expires))) {
+		http.Error(w, locales.translate(requestLocale(r), "This invitation link is not valid."), http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, locales.translate(requestLocale(r), "This invitation has expired; ask for another."), http.StatusGone)
+		return
+	}
+	w.Header().Set("Location", "/chat")
+	w.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+// inviteCommand is /invite, which emails somebody an invitation to the
+// room.
+func inviteCommand(c *client, args string) error {
+	if args == "" {
+		return errUsage
+	}
+	if c.room.invites == nil {
+		return errors.New("invitations can't be sent, as email isn't set up")
+	}
+	if id, _ := c.userData["id"].(string); id == "" {
+		return errors.New("you need to sign in to invite people")
+	}
+	if err := c.room.invites.invite(c.name(), c.room.name, args, c.locale); err != nil {
+		log.Println("Failed to send invitation:", err)
+		return errors.New("the invitation couldn't be sent")
+	}
+	c.replyf("Invited %s to #%s", args, c.room.name)
+	return nil
+}
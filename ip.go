@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies is a list of networks whose addresses belong to reverse
+// proxies or load balancers in front of the server, whose X-Forwarded-For
+// and X-Real-IP headers can be believed.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma separated list of CIDRs, as parseCIDRs
+// does.
+func parseTrustedProxies(s string) (trustedProxies, error) {
+	return parseCIDRs(s)
+}
+
+// parseCIDRs parses a comma separated list of CIDRs, such as
+// "10.0.0.0/8,127.0.0.1/32". A plain IP address is taken to be a network of
+// just that address.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// inNetworks reports whether ip is in any of the networks.
+func inNetworks(networks []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// trusts reports whether ip belongs to a trusted proxy.
+func (t trustedProxies) trusts(ip string) bool {
+	return inNetworks(t, ip)
+}
+
+// realIP returns the address of the client that made the request. If the
+// request came through trusted proxies, X-Forwarded-For is followed back
+// from the right, each proxy having appended the address it saw, to the
+// first address that isn't a trusted proxy. Anything to the left of that was
+// supplied by the client and can't be believed.
+func (t trustedProxies) realIP(r *http.Request) string {
+	ip := clientIP(r)
+	if !t.trusts(ip) {
+		return ip
+	}
+	// a proxy may add a header of its own rather than append to the
+	// client's, so every header is followed, the last one last.
+	if xff := strings.Join(r.Header.Values("X-Forwarded-For"), ","); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip = strings.TrimSpace(hops[i])
+			if !t.trusts(ip) {
+				return ip
+			}
+		}
+		return ip
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+	return ip
+}
+
+type realIPHandler struct {
+	proxies trustedProxies
+	next    http.Handler
+}
+
+func (h *realIPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ip := h.proxies.realIP(r); ip != clientIP(r) {
+		_, port, _ := net.SplitHostPort(r.RemoteAddr)
+		r.RemoteAddr = net.JoinHostPort(ip, port)
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// RealIP wraps handler so that, for requests that came through one of the
+// trusted proxies, r.RemoteAddr holds the address of the real client rather
+// than that of the proxy. Everything downstream, such as the per-IP limits,
+// then sees the real address.
+func RealIP(proxies trustedProxies, handler http.Handler) http.Handler {
+	return &realIPHandler{proxies: proxies, next: handler}
+}
+
+// clientIP returns the IP address a request came from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
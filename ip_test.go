@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRealIP checks that the client's address is only taken from the
+// headers proxies set when the request came through a trusted proxy, and
+// that nothing a client puts in them itself is believed.
+func TestRealIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		realIP     string
+		want       string
+	}{
+		{"straight from the client", "203.0.113.7:1234", nil, "", "203.0.113.7"},
+		{"untrusted, claiming to be another", "203.0.113.7:1234", []string{"198.51.100.1"}, "198.51.100.1", "203.0.113.7"},
+		{"through a proxy", "10.0.0.2:1234", []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"through two proxies", "10.0.0.2:1234", []string{"203.0.113.7, 192.168.1.1"}, "", "203.0.113.7"},
+		{"spoofed on the left", "10.0.0.2:1234", []string{"198.51.100.1, 203.0.113.7"}, "", "203.0.113.7"},
+		{"spoofed in a header of its own", "10.0.0.2:1234", []string{"198.51.100.1", "203.0.113.7"}, "", "203.0.113.7"},
+		{"X-Real-IP from a proxy", "192.168.1.1:1234", nil, "203.0.113.7", "203.0.113.7"},
+		{"nothing but proxies", "10.0.0.2:1234", []string{"10.0.0.3"}, "", "10.0.0.3"},
+		{"IPv6", "[2001:db8::1]:1234", []string{"203.0.113.7"}, "", "2001:db8::1"},
+	}
+	for _, test := range tests {
+		var got string
+		h := RealIP(proxies, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = clientIP(r)
+		}))
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, xff := range test.xff {
+			r.Header.Add("X-Forwarded-For", xff)
+		}
+		if test.realIP != "" {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
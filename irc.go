@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ircServer is a gateway that exposes chat rooms as IRC channels, so that
+// people with existing IRC clients can take part in the chat. The "chat"
+// room, for example, is available as the "#chat" channel.
+//
+// Only the small part of the IRC protocol needed to chat is supported:
+// registration (PASS/NICK/USER), JOIN, PART, PRIVMSG, TOPIC, PING and QUIT.
+// JOIN, PART and PRIVMSG map directly onto the join, leave and forward
+// channels of the room, so IRC users look just like any other client to the
+// room.
+//
+// IRC users sign in with a personal access token with the chat scope, given
+// as the server password with PASS, and chat as the account it belongs to,
+// with the same roles, bans and terms of service as on the web.
+type ircServer struct {
+	// name is the server name used as the prefix of server replies.
+	name string
+
+	// rooms holds the rooms that can be joined, keyed by channel name
+	// without the leading '#'.
+	rooms map[string]*room
+
+	// tokens and users are where the accounts IRC users sign in as come
+	// from, and terms, if set, the terms they must have accepted.
+	tokens *tokenStore
+	users  *userStore
+	terms  *terms
+
+	// created is when the gateway was made, reported to clients on welcome.
+	created time.Time
+}
+
+// newIRCServer makes a new IRC gateway for the given rooms, which people sign
+// in to with tokens from the store.
+func newIRCServer(name string, rooms map[string]*room, tokens *tokenStore, users *userStore, tos *terms) *ircServer {
+	return &ircServer{
+		name:    name,
+		rooms:   rooms,
+		tokens:  tokens,
+		users:   users,
+		terms:   tos,
+		created: time.Now(),
+	}
+}
+
+// serve accepts IRC connections from l, handling each one in its own
+// goroutine, until l fails.
+func (s *ircServer) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// ircConn is a single connection from an IRC client.
+type ircConn struct {
+	server *ircServer
+	conn   net.Conn
+
+	// mu serialises writes to conn, which happen both from the read loop
+	// (replies) and from the writers of each joined room (messages).
+	mu sync.Mutex
+
+	nick string
+	user string
+
+	// pass is the token given with PASS, and userData the account it
+	// signed the client in as, once registered.
+	pass     string
+	userData map[string]interface{}
+
+	// channels holds the client we have joined to each room, keyed by
+	// channel name without the leading '#'.
+	channels map[string]*client
+}
+
+// handle reads commands from conn until the client quits or the connection
+// fails, then leaves every room the client had joined.
+func (s *ircServer) handle(conn net.Conn) {
+	c := &ircConn{
+		server:   s,
+		conn:     conn,
+		channels: make(map[string]*client),
+	}
+	defer func() {
+		for name := range c.channels {
+			c.part(name)
+		}
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		cmd, params := parseIRCLine(scanner.Text())
+		if cmd == "" {
+			continue
+		}
+		if !c.dispatch(cmd, params) {
+			return
+		}
+	}
+}
+
+// dispatch runs a single command and reports whether the connection should
+// be kept open.
+func (c *ircConn) dispatch(cmd string, params []string) bool {
+	switch cmd {
+	case "CAP", "MODE", "WHO":
+		// Accepted, but there is nothing for us to do.
+	case "PASS":
+		if len(params) < 1 {
+			c.reply("461", "PASS :Not enough parameters")
+			return true
+		}
+		if c.registered() {
+			c.reply("462", ":You may not reregister")
+			return true
+		}
+		c.pass = params[0]
+	case "NICK":
+		if len(params) < 1 {
+			c.reply("431", ":No nickname given")
+			return true
+		}
+		if c.registered() {
+			c.rename(ircNick(params[0]))
+			return true
+		}
+		c.nick = ircNick(params[0])
+		if c.user != "" {
+			return c.register()
+		}
+	case "USER":
+		if len(params) < 1 {
+			c.reply("461", "USER :Not enough parameters")
+			return true
+		}
+		if c.user != "" {
+			c.reply("462", ":You may not reregister")
+			return true
+		}
+		c.user = params[0]
+		if c.nick != "" {
+			return c.register()
+		}
+	case "TOPIC":
+		if !c.registered() {
+			c.reply("451", ":You have not registered")
+			return true
+		}
+		if len(params) < 1 {
+			c.reply("461", "TOPIC :Not enough parameters")
+			return true
+		}
+		name := strings.TrimPrefix(params[0], "#")
+		r, ok := c.server.rooms[name]
+		if !ok {
+			c.reply("403", params[0]+" :No such channel")
+			return true
+		}
+		if len(params) < 2 {
+			c.topic(name)
+			return true
+		}
+		client, ok := c.channels[name]
+		if !ok {
+			c.reply("442", params[0]+" :You're not on that channel")
+			return true
+		}
+		if !r.can(client, permManageRoom) {
+			c.reply("482", params[0]+" :You're not channel operator")
+			return true
+		}
+		r.setTopic(client.name(), params[1])
+		c.writeLine(":%s TOPIC #%s :%s", c.prefix(), name, ircText(params[1]))
+	case "PING":
+		c.writeLine(":%s PONG %s :%s", c.server.name, c.server.name, strings.Join(params, " "))
+	case "QUIT":
+		return false
+	case "JOIN", "PART", "PRIVMSG":
+		if !c.registered() {
+			c.reply("451", ":You have not registered")
+			return true
+		}
+		if len(params) < 1 {
+			c.reply("461", cmd+" :Not enough parameters")
+			return true
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			name := strings.TrimPrefix(channel, "#")
+			if _, ok := c.server.rooms[name]; !ok {
+				c.reply("403", channel+" :No such channel")
+				continue
+			}
+			switch cmd {
+			case "JOIN":
+				c.join(name)
+			case "PART":
+				if _, ok := c.channels[name]; !ok {
+					c.reply("442", channel+" :You're not on that channel")
+					continue
+				}
+				c.part(name)
+			case "PRIVMSG":
+				if len(params) < 2 {
+					c.reply("412", ":No text to send")
+					return true
+				}
+				c.privmsg(name, params[1])
+			}
+		}
+	default:
+		c.reply("421", cmd+" :Unknown command")
+	}
+	return true
+}
+
+// join adds the IRC user to the named room, starting a goroutine that
+// relays messages from the room back down the connection.
+func (c *ircConn) join(name string) {
+	if _, ok := c.channels[name]; ok {
+		return
+	}
+	r := c.server.rooms[name]
+	// each room's client has its own copy of who the user is, as the room
+	// changes its name when they change their nick.
+	userData := make(map[string]interface{}, len(c.userData))
+	for k, v := range c.userData {
+		userData[k] = v
+	}
+	client := &client{
+		send:     make(chan *message, messageBufferSize),
+		room:     r,
+		userData: userData,
+	}
+	c.channels[name] = client
+	r.join <- client
+	go c.relay(name, client, client.name())
+
+	c.writeLine(":%s JOIN #%s", c.prefix(), name)
+	c.topic(name)
+	c.reply("353", "= #"+name+" :"+c.nick)
+	c.reply("366", "#"+name+" :End of /NAMES list")
+}
+
+// topic tells the client the topic of the named room.
+func (c *ircConn) topic(name string) {
+	if topic := c.server.rooms[name].topic(); topic != "" {
+		c.reply("332", "#"+name+" :"+ircText(topic))
+	} else {
+		c.reply("331", "#"+name+" :No topic is set")
+	}
+}
+
+// part removes the IRC user from the named room.
+func (c *ircConn) part(name string) {
+	client := c.channels[name]
+	delete(c.channels, name)
+	client.room.leave <- client
+	c.writeLine(":%s PART #%s", c.prefix(), name)
+}
+
+// privmsg sends text to the named room on behalf of the IRC user, just as
+// if they had sent it over the websocket: it is held to the room's maximum
+// message size, may be a slash command, and passes through the room's
+// moderation.
+func (c *ircConn) privmsg(name, text string) {
+	client, ok := c.channels[name]
+	if !ok {
+		c.reply("404", "#"+name+" :Cannot send to channel")
+		return
+	}
+	if !client.room.can(client, permPost) {
+		c.reply("404", "#"+name+" :Cannot send to channel")
+		return
+	}
+	if limit := client.room.maxMessageSize; limit > 0 && int64(len(text)) > limit {
+		c.reply("404", "#"+name+" :Message too long")
+		return
+	}
+	msg := &message{Message: text}
+	if action, ok := ircAction(text); ok {
+		msg.Message, msg.Action = action, true
+	}
+	client.receive(msg)
+}
+
+// rename changes the IRC user's nick, and the name they go by in every room
+// they have joined, as /nick does. If the name can't be had in one of them,
+// they keep their old name in all of them.
+func (c *ircConn) rename(nick string) {
+	if err := validName(nick); err != nil {
+		c.reply("432", nick+" :Erroneous nickname")
+		return
+	}
+	old, _ := c.userData["name"].(string)
+	var renamed []*client
+	for _, client := range c.channels {
+		if err := client.room.rename(client, nick); err != nil {
+			for _, client := range renamed {
+				client.room.rename(client, old)
+			}
+			c.reply("433", nick+" :Nickname is already in use")
+			return
+		}
+		renamed = append(renamed, client)
+	}
+	c.userData["name"] = nick
+	prefix := c.prefix()
+	c.nick = nick
+	c.writeLine(":%s NICK %s", prefix, c.nick)
+}
+
+// relay writes every message the room sends to client down the connection
+// as a PRIVMSG, or a JOIN or PART for people joining and leaving, until the
+// room closes the client's send channel. IRC clients do not expect their own
+// messages to be echoed back, so those are skipped, nor to be told they
+// joined the room by the name joinedAs. That is passed in rather than read
+// from the client, as the room changes it when they change nick.
+func (c *ircConn) relay(name string, client *client, joinedAs string) {
+	for msg := range client.send {
+		// IRC doesn't use the prepared websocket frame.
+		msg.release()
+		if msg.from == client || !msg.relayable() {
+			continue
+		}
+		// people joining and leaving are told as IRC would, except for the
+		// client itself, which has already been told it joined.
+		if msg.Presence != "" {
+			if msg.Name != joinedAs {
+				verb := "JOIN"
+				if msg.Presence == presenceLeft {
+					verb = "PART"
+				}
+				c.writeLine(":%s!%s@%s %s #%s", ircNick(msg.Name), "chat", c.server.name, verb, name)
+			}
+			continue
+		}
+		for _, line := range strings.Split(msg.Message, "\n") {
+			line = ircText(line)
+			if msg.Action {
+				line = "\x01ACTION " + line + "\x01"
+			}
+			c.writeLine(":%s!%s@%s PRIVMSG #%s :%s",
+				ircNick(msg.Name), "chat", c.server.name, name, line)
+		}
+	}
+	switch {
+	case client.rejected == nil:
+	case client.rejected.Error == "name_taken":
+		c.reply("437", "#"+name+" :Nick is in use in this channel")
+	case client.rejected.Error == reasonRestarting:
+		c.writeLine("ERROR :Server restarting")
+	default:
+		c.reply("474", "#"+name+" :Cannot join channel (+b)")
+	}
+}
+
+// welcome sends the replies an IRC client expects once it has registered.
+func (c *ircConn) welcome() {
+	c.reply("001", ":Welcome to the chat, "+c.prefix())
+	c.reply("002", ":Your host is "+c.server.name)
+	c.reply("003", ":This server was created "+c.server.created.Format(time.RFC1123))
+	c.reply("004", c.server.name+" chat o o")
+	c.reply("422", ":MOTD File is missing")
+}
+
+// register signs the client in with the token it gave with PASS, once it has
+// given NICK and USER, and welcomes it. It reports whether the connection
+// should be kept open: clients without a token, or whose account hasn't
+// accepted the terms of service, are turned away.
+func (c *ircConn) register() bool {
+	var a *account
+	if t := c.server.tokens.check(c.pass); t != nil && contains(t.Scopes, scopeChat) {
+		a = c.server.users.get(t.Account)
+	}
+	if a == nil {
+		c.reply("464", ":Password incorrect: give a personal access token with the chat scope with PASS")
+		c.writeLine("ERROR :Closing link (bad password)")
+		return false
+	}
+	if c.server.terms != nil && !a.accepted(c.server.terms.version) {
+		c.writeLine("ERROR :Closing link (accept the terms of service on the web first)")
+		return false
+	}
+	c.userData = map[string]interface{}{"id": a.ID, "name": a.Name, "avatar_url": a.AvatarURL, "language": a.Language}
+	c.welcome()
+	return true
+}
+
+// registered reports whether the client has given NICK and USER, and signed
+// in with PASS.
+func (c *ircConn) registered() bool {
+	return c.userData != nil
+}
+
+// prefix is the nick!user@host prefix identifying this client.
+func (c *ircConn) prefix() string {
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	return c.nick + "!" + c.user + "@" + host
+}
+
+// reply sends a numeric reply addressed to this client.
+func (c *ircConn) reply(code, text string) {
+	nick := c.nick
+	if nick == "" {
+		nick = "*"
+	}
+	c.writeLine(":%s %s %s %s", c.server.name, code, nick, text)
+}
+
+// writeLine writes a single, CRLF terminated, line to the connection.
+func (c *ircConn) writeLine(format string, a ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(c.conn, format+"\r\n", a...); err != nil {
+		log.Println("IRC write failed:", err)
+	}
+}
+
+// parseIRCLine splits a raw IRC line into its command and parameters. Any
+// prefix is discarded, and a trailing parameter (introduced by ':') is
+// returned as the last parameter with its spaces intact.
+func parseIRCLine(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		i := strings.Index(line, " ")
+		if i < 0 {
+			return "", nil
+		}
+		line = line[i+1:]
+	}
+	var trailing string
+	hasTrailing := false
+	if i := strings.Index(line, " :"); i >= 0 {
+		trailing = line[i+2:]
+		hasTrailing = true
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	params := fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return strings.ToUpper(fields[0]), params
+}
+
+// ircText makes text safe to send as the last parameter of an IRC line: a
+// carriage return or line feed in it would end the line, and let whoever
+// wrote it send commands of their own.
+func ircText(text string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(text)
+}
+
+// ircNick turns a display name into something usable as an IRC nick, which
+// cannot contain spaces.
+func ircNick(name string) string {
+	return strings.Join(strings.Fields(name), "_")
+}
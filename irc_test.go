@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ircTestServer starts an IRC gateway to a room, with accounts for each of
+// names, returning the room and a function that connects as one of them and
+// joins #chat.
+func ircTestServer(t *testing.T, names ...string) (*room, func(name string) (net.Conn, *bufio.Reader)) {
+	r := newRoom(1)
+	go r.run()
+	users, err := openUserStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := openTokenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwords := make(map[string]string)
+	for _, name := range names {
+		a, err := users.login("", "github", name, "", name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, passwords[name], err = tokens.create(a.ID, "irc", []string{scopeChat}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go newIRCServer("chat", map[string]*room{"chat": r}, tokens, users, nil).serve(l)
+	return r, func(name string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		fmt.Fprintf(conn, "PASS %s\r\nNICK %s\r\nUSER %s 0 * :%s\r\nJOIN #chat\r\n", passwords[name], name, name, name)
+		return conn, bufio.NewReader(conn)
+	}
+}
+
+// readUntil reads lines from the IRC connection until one contains want.
+func readUntil(t *testing.T, conn net.Conn, r *bufio.Reader, want string) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("never got %q: %v", want, err)
+		}
+		if strings.Contains(line, want) {
+			return line
+		}
+	}
+}
+
+// TestIRCPostsAsWebsocket checks that what IRC users send goes the way
+// websocket clients' messages do: held to the room's maximum size, and
+// carried out if it is a slash command.
+func TestIRCPostsAsWebsocket(t *testing.T) {
+	r, dial := ircTestServer(t, "ada")
+	r.maxMessageSize = 20
+	conn, lines := dial("ada")
+	readUntil(t, conn, lines, "JOIN #chat")
+
+	fmt.Fprintf(conn, "PRIVMSG #chat :%s\r\n", strings.Repeat("x", 21))
+	readUntil(t, conn, lines, " 404 ")
+
+	fmt.Fprintf(conn, "PRIVMSG #chat :/nick Lovelace\r\n")
+	readUntil(t, conn, lines, "is now known as Lovelace")
+	if r.accountNamed("Lovelace") == "" {
+		t.Error("/nick didn't rename the IRC user in the room")
+	}
+}
+
+// TestIRCNick checks that changing nick once registered changes the name
+// the user goes by in the room, as /nick does, and can't take somebody
+// else's.
+func TestIRCNick(t *testing.T) {
+	r, dial := ircTestServer(t, "ada", "bob")
+	ada, adaLines := dial("ada")
+	readUntil(t, ada, adaLines, "JOIN #chat")
+	bob, bobLines := dial("bob")
+	readUntil(t, bob, bobLines, "JOIN #chat")
+	account := r.accountNamed("bob")
+
+	fmt.Fprintf(bob, "NICK ada\r\n")
+	readUntil(t, bob, bobLines, " 433 ")
+	if r.accountNamed("ada") == account {
+		t.Fatal("bob took ada's name")
+	}
+
+	fmt.Fprintf(bob, "NICK robert\r\n")
+	readUntil(t, bob, bobLines, "NICK robert")
+	if r.accountNamed("robert") != account || r.accountNamed("bob") != "" {
+		t.Errorf("robert is %q and bob %q in the room, want %q and nobody", r.accountNamed("robert"), r.accountNamed("bob"), account)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaSink is an eventSink that exports every room event, as JSON, to a
+// Kafka topic so that analytics and compliance pipelines can consume chat
+// activity.
+type kafkaSink struct {
+	w *kafka.Writer
+}
+
+// newKafkaSink makes an eventSink producing to topic on the given brokers.
+func newKafkaSink(brokers []string, topic string) *kafkaSink {
+	return &kafkaSink{
+		w: &kafka.Writer{
+			Addr:     kafka.TCP(brokers...),
+			Topic:    topic,
+			Balancer: &kafka.LeastBytes{},
+			// Writes are batched in the background so that publish never
+			// holds up the room.
+			Async: true,
+			Completion: func(msgs []kafka.Message, err error) {
+				if err != nil {
+					log.Println("Kafka: failed to export", len(msgs), "events:", err)
+				}
+			},
+		},
+	}
+}
+
+func (s *kafkaSink) publish(e *roomEvent) {
+	value, err := json.Marshal(e)
+	if err != nil {
+		log.Println("Kafka marshal:", err)
+		return
+	}
+	if err := s.w.WriteMessages(context.Background(), kafka.Message{Value: value}); err != nil {
+		log.Println("Kafka:", err)
+	}
+}
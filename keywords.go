@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// maxKeywords is the most keywords anybody may watch for.
+const maxKeywords = 20
+
+// words splits text into the lowercase words keywords are matched against.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_' && r != '-'
+	})
+}
+
+// watchers returns the accounts watching for any of the words in text, each
+// once.
+func (s *userStore) watchers(text string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	var accounts []string
+	for _, w := range words(text) {
+		for account := range s.keywords[w] {
+			if !seen[account] {
+				seen[account] = true
+				accounts = append(accounts, account)
+			}
+		}
+	}
+	return accounts
+}
+
+// watch adds or removes a keyword the client's user is alerted to, or lists
+// them if keyword is empty.
+func (c *client) watch(keyword string, watch bool) error {
+	id, _ := c.userData["id"].(string)
+	if id == "" || c.room.users == nil {
+		return errors.New("you need to sign in to watch for keywords")
+	}
+	if keyword == "" {
+		if !watch {
+			return errUsage
+		}
+		a := c.room.users.get(id)
+		if a == nil || len(a.Keywords) == 0 {
+			c.reply("You aren't watching for any keywords")
+		} else {
+			c.replyf("You are watching for %s", strings.Join(a.Keywords, ", "))
+		}
+		return nil
+	}
+	keyword = strings.ToLower(keyword)
+	if w := words(keyword); len(w) != 1 || w[0] != keyword {
+		return errors.New("a keyword must be a single word")
+	}
+	var err error
+	_, uerr := c.room.users.update(id, func(a *account) {
+		var keywords []string
+		for _, k := range a.Keywords {
+			if k != keyword {
+				keywords = append(keywords, k)
+			}
+		}
+		if watch {
+			if len(keywords) >= maxKeywords {
+				err = fmt.Errorf("you can't watch for more than %d keywords", maxKeywords)
+				return
+			}
+			keywords = append(keywords, keyword)
+			sort.Strings(keywords)
+		}
+		a.Keywords = keywords
+	})
+	if err != nil {
+		return err
+	} else if uerr != nil {
+		return errors.New("failed to save your keywords")
+	}
+	if watch {
+		c.replyf("You will be alerted whenever somebody says %s", keyword)
+	} else {
+		c.replyf("You won't be alerted about %s any more", keyword)
+	}
+	return nil
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
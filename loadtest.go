@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/objx"
+)
+
+// loadtestPrefix starts the messages the simulated clients send, which are
+// "loadtest <seq> <unix nanoseconds sent>", so that whoever receives one can
+// tell how long it took to arrive.
+const loadtestPrefix = "loadtest "
+
+// loadtestSubcommand is "chat loadtest", which connects many simulated
+// clients to a room on a running server, has them chat, and reports how
+// many could connect, how long their messages took to be delivered to
+// everybody, and how many were never delivered. What they say is recorded in
+// the room's history like anything else, so it is best run against a server
+// kept for testing.
+func loadtestSubcommand(args []string) error {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	server := flags.String("server", "http://localhost:8080", "The URL of the server to test.")
+	roomName := flags.String("room", "chat", "The room to chat in: chat, or <org>/chat for an organization's.")
+	clients := flags.Int("clients", 100, "How many clients to connect.")
+	connectRate := flags.String("connect-rate", "100/s", "How fast clients connect, as a number per second (/s) or minute (/m).")
+	rate := flags.String("rate", "10/s", "How many messages the clients send, between them, per second (/s) or minute (/m).")
+	duration := flags.Duration("duration", 30*time.Second, "How long the clients chat for, once connected.")
+	wait := flags.Duration("wait", 5*time.Second, "How long to wait, once they stop, for the last messages to be delivered.")
+	token := flags.String("token", os.Getenv("CHAT_TOKEN"), "A personal access token with the chat scope for every client to connect with (or $CHAT_TOKEN); if empty, each is a made up user, which servers hosting organizations turn away.")
+	secret := flags.String("secret", os.Getenv("CHAT_SECRET"), "The server's -secret (or $CHAT_SECRET), to sign the made up users' auth cookies with when there is no -token.")
+	flags.Parse(args)
+	if *token == "" && *secret == "" {
+		return fmt.Errorf("either -token or -secret is needed for the clients to connect")
+	}
+	cookieKey = []byte(*secret)
+
+	socketURL, err := loadtestURL(*server, *roomName)
+	if err != nil {
+		return err
+	}
+	connectEvery, err := parseRate(*connectRate)
+	if err != nil {
+		return fmt.Errorf("-connect-rate: %v", err)
+	}
+	sendEvery, err := parseRate(*rate)
+	if err != nil {
+		return fmt.Errorf("-rate: %v", err)
+	}
+	t := &loadtest{url: socketURL, token: *token, failures: make(map[string]int)}
+
+	fmt.Printf("Connecting %d clients to %s\n", *clients, socketURL)
+	var wg sync.WaitGroup
+	tick := time.NewTicker(connectEvery)
+	for n := 0; n < *clients; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			t.connect(n)
+		}(n)
+		<-tick.C
+	}
+	tick.Stop()
+	wg.Wait()
+	if len(t.conns) == 0 {
+		t.report(os.Stdout, *clients)
+		return errors.New("no clients could connect")
+	}
+
+	fmt.Printf("Sending %s messages for %s\n", *rate, *duration)
+	tick = time.NewTicker(sendEvery)
+	for end, n := time.Now().Add(*duration), 0; time.Now().Before(end); n++ {
+		t.send(t.conns[n%len(t.conns)])
+		<-tick.C
+	}
+	tick.Stop()
+	time.Sleep(*wait)
+	atomic.StoreInt32(&t.done, 1)
+	for _, c := range t.conns {
+		c.Close()
+	}
+	t.report(os.Stdout, *clients)
+	return nil
+}
+
+// loadtest is a load test under way.
+type loadtest struct {
+	url   string
+	token string
+
+	// done is set once the test is over, so that connections closing are
+	// no longer counted as clients being disconnected.
+	done int32
+
+	// connected is how many clients are connected, and disconnected how many
+	// were disconnected during the test.
+	connected    int64
+	disconnected int64
+
+	// sent is how many messages have been sent, expected how many times
+	// they should have been delivered, between every client connected when
+	// each was sent, and received how many times they were.
+	seq      int64
+	sent     int64
+	expected int64
+	received int64
+
+	// conns are the clients' connections, failures why those that couldn't
+	// connect couldn't, and latencies how long each message delivered took
+	// to arrive.
+	mu        sync.Mutex
+	conns     []*websocket.Conn
+	failures  map[string]int
+	latencies []time.Duration
+}
+
+// loadtestURL returns the URL of the websocket of the room called name on the
+// server at serverURL. Each server, and each organization it hosts, has a
+// room called chat.
+func loadtestURL(serverURL, name string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("-server %s is not an http or https URL", serverURL)
+	}
+	switch org, room, ok := strings.Cut(name, "/"); {
+	case name == "chat":
+		u.Path = "/room"
+	case ok && room == "chat" && org != "":
+		u.Path = "/o/" + org + "/room"
+	default:
+		return "", fmt.Errorf("no room called %q: rooms are called chat, or <org>/chat", name)
+	}
+	return u.String(), nil
+}
+
+// parseRate parses a rate such as 10/s or 600/m, or 10 meaning 10/s, into how
+// often things happen at that rate.
+func parseRate(s string) (time.Duration, error) {
+	per := time.Second
+	if n, unit, ok := strings.Cut(s, "/"); ok {
+		switch unit {
+		case "s":
+		case "m":
+			per = time.Minute
+		default:
+			return 0, fmt.Errorf("%q is not per second (/s) or per minute (/m)", s)
+		}
+		s = n
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a rate, such as 10/s", s)
+	}
+	every := time.Duration(float64(per) / n)
+	if every <= 0 {
+		every = 1
+	}
+	return every, nil
+}
+
+// connect connects the nth client, and reads what it is sent until it is
+// disconnected.
+func (t *loadtest) connect(n int) {
+	header := http.Header{}
+	if t.token != "" {
+		header.Set("Authorization", "Bearer "+t.token)
+	} else {
+		name := fmt.Sprintf("loadtest-%d", n)
+		cookie := signCookie(objx.New(map[string]interface{}{"id": name, "name": name}))
+		header.Set("Cookie", "auth="+cookie)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(t.url, header)
+	if err != nil {
+		why := err.Error()
+		if resp != nil {
+			why = resp.Status
+		}
+		t.mu.Lock()
+		t.failures[why]++
+		t.mu.Unlock()
+		return
+	}
+	atomic.AddInt64(&t.connected, 1)
+	t.mu.Lock()
+	t.conns = append(t.conns, conn)
+	t.mu.Unlock()
+	go t.read(conn)
+}
+
+// read reads what a client is sent, timing the test's messages.
+func (t *loadtest) read(conn *websocket.Conn) {
+	defer func() {
+		atomic.AddInt64(&t.connected, -1)
+		if atomic.LoadInt32(&t.done) == 0 {
+			atomic.AddInt64(&t.disconnected, 1)
+		}
+	}()
+	for {
+		var msg struct{ Message string }
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if !strings.HasPrefix(msg.Message, loadtestPrefix) {
+			continue
+		}
+		fields := strings.Fields(msg.Message)
+		if len(fields) != 3 {
+			continue
+		}
+		nanos, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		latency := time.Since(time.Unix(0, nanos))
+		atomic.AddInt64(&t.received, 1)
+		t.mu.Lock()
+		t.latencies = append(t.latencies, latency)
+		t.mu.Unlock()
+	}
+}
+
+// send has the client on conn send a message, which every client connected
+// should be delivered. It is only called by one goroutine at once.
+func (t *loadtest) send(conn *websocket.Conn) {
+	seq := atomic.AddInt64(&t.seq, 1)
+	text := fmt.Sprintf("%s%d %d", loadtestPrefix, seq, time.Now().UnixNano())
+	if err := conn.WriteJSON(map[string]string{"Message": text}); err != nil {
+		return
+	}
+	atomic.AddInt64(&t.sent, 1)
+	atomic.AddInt64(&t.expected, atomic.LoadInt64(&t.connected))
+}
+
+// report writes out how the test went.
+func (t *loadtest) report(w io.Writer, clients int) {
+	// readers may still be finishing, so the counts are loaded atomically.
+	sent, expected, received := atomic.LoadInt64(&t.sent), atomic.LoadInt64(&t.expected), atomic.LoadInt64(&t.received)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(w, "Connected %d of %d clients (%.1f%%); %d disconnected during the test\n",
+		len(t.conns), clients, 100*float64(len(t.conns))/float64(clients), atomic.LoadInt64(&t.disconnected))
+	for why, n := range t.failures {
+		fmt.Fprintf(w, "  %d failed to connect: %s\n", n, why)
+		if strings.HasPrefix(why, strconv.Itoa(http.StatusTooManyRequests)) {
+			fmt.Fprintln(w, "  (the server limits connections per IP; raise its -max-conns-per-ip and -max-upgrades-per-ip)")
+		}
+	}
+	if sent == 0 {
+		return
+	}
+	dropped := expected - received
+	if dropped < 0 {
+		dropped = 0
+	}
+	fmt.Fprintf(w, "Sent %d messages; %d of %d deliveries arrived, %d dropped (%.2f%%)\n",
+		sent, received, expected, dropped, 100*float64(dropped)/float64(expected))
+	if len(t.latencies) == 0 {
+		return
+	}
+	sort.Slice(t.latencies, func(i, j int) bool { return t.latencies[i] < t.latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return t.latencies[int(p*float64(len(t.latencies)-1))].Round(time.Microsecond)
+	}
+	fmt.Fprintf(w, "Latency: p50 %s, p90 %s, p99 %s, max %s\n",
+		percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/apackeer/trace"
+)
+
+// Log levels, from the most logged to the least. Warnings and errors are
+// always logged; the levels say what else is.
+const (
+	// levelInfo logs every request, and traces what goes on in rooms.
+	levelInfo int32 = iota
+	// levelWarn logs only what goes wrong.
+	levelWarn
+)
+
+// logLevel is the current log level, which can change while the server runs
+// when its configuration is reloaded.
+var logLevel int32 = levelInfo
+
+// setLogLevel sets the log level from its name, info or warn.
+func setLogLevel(name string) error {
+	switch name {
+	case "info":
+		atomic.StoreInt32(&logLevel, levelInfo)
+	case "warn":
+		atomic.StoreInt32(&logLevel, levelWarn)
+	default:
+		return fmt.Errorf("unknown log level %q: use info or warn", name)
+	}
+	return nil
+}
+
+// logging reports whether things logged at level are being logged.
+func logging(level int32) bool {
+	return level >= atomic.LoadInt32(&logLevel)
+}
+
+// levelTracer is a tracer that only traces at the info log level.
+type levelTracer struct {
+	trace.Tracer
+}
+
+func (t levelTracer) Trace(a ...interface{}) {
+	if logging(levelInfo) {
+		t.Tracer.Trace(a...)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// mailer sends email through an SMTP server.
+type mailer struct {
+	// addr is the server's host:port, and from the address mail is sent
+	// from.
+	addr string
+	from string
+
+	// auth is how we log in to the server, or nil if we don't.
+	auth smtp.Auth
+}
+
+// newMailer makes a mailer for the SMTP server at addr. If user is not
+// empty, the mailer logs in as user with password; net/smtp only does so
+// over TLS, or to localhost.
+func newMailer(addr, from, user, password string) *mailer {
+	m := &mailer{addr: addr, from: from}
+	if user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return m
+}
+
+// send emails a plain text message to the given address.
+func (m *mailer) send(to, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, msg.Bytes())
+}
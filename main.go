@@ -1,21 +1,35 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
+	"html/template"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
-	"text/template"
+	"syscall"
+	"time"
 
 	"github.com/apackeer/trace"
+	"github.com/quic-go/webtransport-go"
 	"github.com/stretchr/gomniauth"
+	"github.com/stretchr/gomniauth/common"
 	"github.com/stretchr/gomniauth/providers/facebook"
 	"github.com/stretchr/gomniauth/providers/github"
 	"github.com/stretchr/gomniauth/providers/google"
-	"github.com/stretchr/objx"
 	"github.com/stretchr/signature"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // templ represents a single template
@@ -27,67 +41,1021 @@ type templateHandler struct {
 	once     sync.Once
 	filename string
 	templ    *template.Template
+
+	// templates is where the template is read from, along with the layout
+	// and partials it is parsed with (see parsePage).
+	templates fs.FS
+
+	// dev, in development, has the template parsed again for every
+	// request, so that edits to it show without a restart.
+	dev bool
+
+	// data is extra data, the same for every request, for the template.
+	data map[string]interface{}
+
+	// baseURL is the external URL of the server, or nil to work it out from
+	// each request.
+	baseURL *url.URL
+
+	// socketPath is the path of the room's websocket, "/room" by default.
+	socketPath string
 }
 
 // ServeHTTP handles the HTTP request
 func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	t.once.Do(func() {
-		t.templ = template.Must(template.ParseFiles(filepath.Join("templates", t.filename)))
-	})
+	templ := t.parse()
 
+	socketPath := t.socketPath
+	if socketPath == "" {
+		socketPath = "/room"
+	}
 	data := map[string]interface{}{
-		"Host": r.Host,
+		"Host":      r.Host,
+		"SocketURL": socketURL(r, t.baseURL, socketPath),
+		"Lang":      requestLocale(r),
 	}
-	if authCookie, err := r.Cookie("auth"); err == nil {
-		data["UserData"] = objx.MustFromBase64(authCookie.Value)
+	for k, v := range t.data {
+		data[k] = v
+	}
+	if userData, err := authCookie(r); err == nil {
+		data["UserData"] = userData
 	}
 	// This tells the template to render itself using data that can be extracted
 	// from http.Request, which happens to include the host address that we need.
 	// Also added User data to a data map that holds this host and user info
 	// from authentication
-	t.templ.Execute(w, data)
+	templ.Execute(w, data)
+}
+
+// parse returns the template, parsing it the first time, or every time in
+// development.
+func (t *templateHandler) parse() *template.Template {
+	if t.dev {
+		return template.Must(parsePage(t.templates, t.filename))
+	}
+	t.once.Do(func() {
+		t.templ = template.Must(parsePage(t.templates, t.filename))
+	})
+	return t.templ
+}
+
+// hostname returns the host name of the machine, used as the default name of
+// this instance.
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "chat"
+	}
+	return name
 }
 
 func main() {
-	var addr = flag.String("addr", ":8080", "The addr of the application.")
+	// chat export and the like are subcommands, rather than the server.
+	if runSubcommand(os.Args[1:]) {
+		return
+	}
+
+	var templatesDir = flag.String("templates-dir", "", "A directory to read the page templates from, instead of those built in, to customize them.")
+	var localesDir = flag.String("locales", "", "A directory of catalogs, such as es.json, translating what the server says into other languages, over the built in ones.")
+	var dev = flag.Bool("dev", false, "Development mode: templates are parsed again for every request, and assets aren't cached, both read from ./templates and ./assets unless -templates-dir is given.")
+	var themeDir = flag.String("theme", "", "A directory of templates/ and assets/ that take the place of the built in ones of the same names, to brand the chat; assets/css/theme.css is on every page.")
+	var alertmanagerToken = flag.String("alertmanager-token", "", "The token Alertmanager must give, as ?token=, to post alerts to /api/hooks/alertmanager (disabled if empty).")
+	var alertmanagerRoom = flag.String("alertmanager-room", "chat", "The room alerts from Alertmanager are posted to, such as chat, or acme/ops for an organization's.")
+	var githubHooks = flag.String("github-hooks", "", "Comma separated token=room pairs mapping each GitHub webhook, at /api/integrations/github/{token}, to the room it posts to (disabled if empty).")
+	var githubSecret = flag.String("github-secret", os.Getenv("GITHUB_WEBHOOK_SECRET"), "The secret GitHub signs webhooks with (or $GITHUB_WEBHOOK_SECRET).")
+	var hooksFile = flag.String("hooks", "", "A JSON file of webhooks, for CI/CD tools and the like, each with a template turning what is posted to it into a message (none if empty).")
+	var twilioSID = flag.String("twilio-sid", "", "The Twilio account SID to bridge a room and SMS with (disabled if empty).")
+	var twilioToken = flag.String("twilio-token", os.Getenv("TWILIO_AUTH_TOKEN"), "The Twilio account's auth token (or $TWILIO_AUTH_TOKEN).")
+	var twilioFrom = flag.String("twilio-from", "", "The Twilio phone number texts are sent from, such as +15557654321.")
+	var twilioNumbers = flag.String("twilio-numbers", "", "Comma separated phone=account pairs registering the numbers whose texts are posted to the room, and who are texted when mentioned.")
+	var twilioRoom = flag.String("twilio-room", "chat", "The room texts are posted to, such as chat, or acme/oncall for an organization's.")
+	var mailDomain = flag.String("mail-domain", "", "The domain rooms are emailed at, through Mailgun, such as chat.example.com for chat@chat.example.com (disabled if empty).")
+	var mailgunKey = flag.String("mailgun-key", os.Getenv("MAILGUN_SIGNING_KEY"), "The key Mailgun signs the emails it forwards to /api/integrations/mailgun with (or $MAILGUN_SIGNING_KEY).")
+	var statsdAddr = flag.String("statsd", "", "The StatsD server, or Datadog agent, to push metrics to, host:port (disabled if empty).")
+	var statsdPrefix = flag.String("statsd-prefix", "chat.", "What the name of every metric pushed to StatsD starts with.")
+	var statsdTags = flag.String("statsd-tags", "", "Comma separated key:value tags to add to every metric pushed to StatsD, such as env:prod.")
+	var debugEndpoints = flag.Bool("debug", false, "Serve pprof profiles at /debug/pprof/ and runtime statistics at /debug/vars, to those who manage the server.")
+	var addr = flag.String("addr", ":8080", "The addr of the application (not listened on if empty, or if systemd passes us listeners).")
+	var unixSocket = flag.String("unix", "", "The path of a unix domain socket to also listen on, e.g. for a reverse proxy on the same machine.")
+	var unixMode = flag.Uint("unix-mode", 0660, "The permissions the -unix socket is made with.")
+	var microsoftTenant = flag.String("microsoft-tenant", "common", "The Azure AD tenant Microsoft users sign in from: a tenant ID or domain, organizations, consumers or common.")
+	var appleTeam = flag.String("apple-team", "", "The Apple developer team ID used for Sign in with Apple.")
+	var appleKeyID = flag.String("apple-key-id", "", "The ID of the key used for Sign in with Apple.")
+	var baseURLFlag = flag.String("base-url", "", "The external URL of the application, e.g. https://chat.example.com (default http://localhost<addr>).")
+	var ircAddr = flag.String("irc", "", "The addr of the IRC gateway, e.g. :6667, which people sign in to with a personal access token with the chat scope as the server password (disabled if empty).")
+	var ircsAddr = flag.String("ircs", "", "The addr of the IRC gateway over TLS, e.g. :6697 (disabled if empty).")
+	var ircCert = flag.String("irc-cert", "", "The TLS certificate file for the -ircs gateway.")
+	var ircKey = flag.String("irc-key", "", "The TLS key file for the -ircs gateway.")
+	var http3Addr = flag.String("http3", "", "The UDP addr to serve HTTP/3 and WebTransport on, e.g. :443 (disabled if empty).")
+	var http3Cert = flag.String("http3-cert", "", "The TLS certificate file for HTTP/3.")
+	var http3Key = flag.String("http3-key", "", "The TLS key file for HTTP/3.")
+	var grpcAddr = flag.String("grpc", "", "The addr of the gRPC API, e.g. :9090 (disabled if empty).")
+	var grpcCert = flag.String("grpc-cert", "", "The TLS certificate file for the gRPC API (plain text if empty).")
+	var grpcKey = flag.String("grpc-key", "", "The TLS key file for the gRPC API.")
+	var telegramToken = flag.String("telegram-token", "", "The Telegram bot token used to bridge the room (disabled if empty).")
+	var telegramChat = flag.Int64("telegram-chat", 0, "The ID of the Telegram group to bridge the room with.")
+	var mqttBroker = flag.String("mqtt-broker", "", "The MQTT broker to bridge the room with, e.g. tcp://localhost:1883 (disabled if empty).")
+	var mqttTopics = flag.String("mqtt-topics", "", "Comma separated MQTT topics whose payloads are posted to the room.")
+	var mqttPublish = flag.String("mqtt-publish", "", "The MQTT topic room messages are published to (not published if empty).")
+	var kafkaBrokers = flag.String("kafka-brokers", "", "Comma separated Kafka brokers to export chat activity to (disabled if empty).")
+	var kafkaTopic = flag.String("kafka-topic", "chat-events", "The Kafka topic chat activity is exported to.")
+	var natsURL = flag.String("nats", "", "The NATS server used as a backplane between instances, e.g. nats://localhost:4222 (disabled if empty).")
+	var natsStream = flag.String("nats-stream", "CHAT", "The JetStream stream used by the NATS backplane.")
+	var natsSubject = flag.String("nats-subject", "chat.room", "The subject room messages are published to on the NATS backplane.")
+	var instance = flag.String("instance", hostname(), "The name of this instance, unique within the cluster.")
+	var redisURL = flag.String("redis", os.Getenv("REDIS_URL"), "The Redis server that keeps track of who is in each room across instances, e.g. redis://localhost:6379/0 (or $REDIS_URL; each instance only knows its own if empty).")
+	var gossipBind = flag.String("gossip", "", "The address to gossip with other instances on, finding them and sharing their rooms' messages, e.g. :7946 (disabled if empty).")
+	var gossipJoin = flag.String("gossip-join", "", "Comma separated addresses of instances to join the gossip cluster by way of, e.g. chat.internal:7946, which may resolve to several.")
+	var gossipHome = flag.Bool("gossip-home", false, "Whether to give each room a home instance in the gossip cluster, by consistent hashing, which the others pass its clients on to.")
+	var gossipHTTP = flag.String("gossip-http", "", "The address other instances reach this one's HTTP server at, for -gossip-home (its gossip address, on -addr's port, if empty).")
+	var dataDir = flag.String("data", "", "The directory the room's event log is kept in (the room is not persisted if empty).")
+	var migrate = flag.Bool("migrate", true, "Migrate the -data directory to the latest version at startup.")
+	var orgNames = flag.String("orgs", "", "Comma separated names of organizations to host, each with rooms of its own (none if empty).")
+	var orgDomain = flag.String("org-domain", "", "The domain organizations are subdomains of, e.g. chat.example.com for acme.chat.example.com (picked by /o/<name>/ path prefix if empty).")
+	var fanout = flag.Int("fanout-workers", runtime.NumCPU(), "The number of workers delivering messages to the room's clients.")
+	var maxMessageSize = flag.Int64("max-message-size", defaultMaxMessageSize, "The largest message, in bytes, a client may send (no limit if 0).")
+	var netpoll = flag.Bool("netpoll", false, "Serve websockets with the epoll based transport, for very many idle connections (requires -tags netpoll).")
+	var maxConnsPerIP = flag.Int("max-conns-per-ip", 50, "The most websocket connections a single IP may have open at once (no limit if 0).")
+	var maxUpgradesPerIP = flag.Int("max-upgrades-per-ip", 60, "The most websocket connections a single IP may attempt per minute (no limit if 0).")
+	var geoIPPath = flag.String("geoip", "", "The MaxMind GeoIP database, such as GeoLite2-Country.mmdb, connections' countries are looked up in (disabled if empty).")
+	var geoIPAllow = flag.String("geoip-allow", "", "Comma separated countries, such as GB,IE, people may only connect from (anywhere if empty).")
+	var geoIPDeny = flag.String("geoip-deny", "", "Comma separated countries people may not connect from.")
+	var ipAllow = flag.String("ip-allow", "", "Comma separated CIDRs, such as 10.0.0.0/8, the only addresses requests, over HTTP, IRC and gRPC, may come from (any if empty).")
+	var ipDeny = flag.String("ip-deny", "", "Comma separated CIDRs requests, over HTTP, IRC and gRPC, may not come from.")
+	var termsVersion = flag.String("terms-version", "", "The version of the terms of service people must accept before they chat, such as 2024-06 (none if empty).")
+	var termsURL = flag.String("terms-url", "", "Where the terms of service are published, linked to from the page asking people to accept them.")
+	var trustedProxyList = flag.String("trusted-proxies", "", "Comma separated CIDRs of reverse proxies whose X-Forwarded-For and X-Real-IP headers are trusted.")
+	var corsOrigins = flag.String("cors-origins", "", "Comma separated origins allowed to call the API from a browser, or * for any.")
+	var corsMethods = flag.String("cors-methods", "GET,POST,PUT,DELETE", "Comma separated methods allowed in cross-origin API requests.")
+	var corsHeaders = flag.String("cors-headers", "Content-Type,Authorization", "Comma separated headers allowed in cross-origin API requests.")
+	var corsCredentials = flag.Bool("cors-credentials", false, "Allow cross-origin API requests from the origins listed in -cors-origins to include cookies; never from *.")
+	var accessLog = flag.Bool("access-log", true, "Log every HTTP request.")
+	var loginAttempts = flag.Int("login-attempts", 10, "The login attempts an IP may make before it has to back off.")
+	var loginBackoff = flag.Duration("login-backoff", time.Second, "How long an IP first has to back off for, doubling with each further attempt.")
+	var loginLockout = flag.Duration("login-lockout", 15*time.Minute, "The longest an IP is ever locked out of logging in for.")
+	var secret = flag.String("secret", os.Getenv("CHAT_SECRET"), "The key links sent by the server, and auth cookies, are signed with (or $CHAT_SECRET; random if empty, which signs everybody out when the server restarts).")
+	var owners = flag.String("owners", "", "Comma separated IDs of the accounts that own the server.")
+	var admins = flag.String("admins", "", "Comma separated IDs of the accounts that administer the rooms.")
+	var moderators = flag.String("moderators", "", "Comma separated IDs of the accounts that moderate the rooms.")
+	var defaultRole = flag.String("default-role", roleMember, "The role of everybody else: member, or guest to let them only read.")
+	var translateURL = flag.String("translate-url", "", "The LibreTranslate server used to translate messages, e.g. https://libretranslate.com (disabled if empty).")
+	var translateKey = flag.String("translate-key", os.Getenv("TRANSLATE_KEY"), "The API key for the translation server (or $TRANSLATE_KEY).")
+	var perspectiveKey = flag.String("perspective-key", os.Getenv("PERSPECTIVE_KEY"), "The Perspective API key used to score how toxic messages are (or $PERSPECTIVE_KEY; disabled if empty).")
+	var toxicityThreshold = flag.Float64("toxicity-threshold", 0.8, "The toxicity score, from 0 to 1, over which messages are moderated.")
+	var toxicityAction = flag.String("toxicity-action", moderationHold, "What to do with toxic messages: hold them for review, flag them or drop them.")
+	var maxUpload = flag.Int64("max-upload", 10<<20, "The largest file, in bytes, people may upload.")
+	var ffmpegPath = flag.String("ffmpeg", "", "The ffmpeg binary voice messages are transcoded with, e.g. ffmpeg (voice messages are off if empty).")
+	var maxVoice = flag.Duration("max-voice", 2*time.Minute, "The longest voice message people may send.")
+	var sttURL = flag.String("stt-url", "", "The OpenAI compatible speech to text API voice messages are transcribed with, e.g. https://api.openai.com/v1 (disabled if empty).")
+	var sttKey = flag.String("stt-key", os.Getenv("STT_KEY"), "The API key for the speech to text API (or $STT_KEY).")
+	var sttModel = flag.String("stt-model", "whisper-1", "The model voice messages are transcribed with.")
+	var signedUploads = flag.Duration("signed-uploads", 0, "How long the signed URLs uploads are served at work for, e.g. 15m (uploads are served to anybody with their links if 0).")
+	var maxDailyUpload = flag.Int64("max-daily-upload", 0, "The most, in bytes, each person may upload in a day (no limit if 0).")
+	var uploadTypes = flag.String("upload-types", "", "Comma separated types of file that may be uploaded, judged by their contents, such as image/*,application/pdf (any if empty).")
+	var uploadDenyTypes = flag.String("upload-deny-types", "", "Comma separated types of file that may not be uploaded, such as application/x-msdownload.")
+	var uploadDenyExtensions = flag.String("upload-deny-extensions", "", "Comma separated extensions of files that may not be uploaded, whatever they turn out to be, such as .exe,.bat.")
+	var clamdAddr = flag.String("clamd", "", "The address of a clamd daemon uploads are scanned for viruses with, e.g. localhost:3310 (disabled if empty).")
+	var nsfwURL = flag.String("nsfw-url", "", "The URL of a classification service uploaded images are POSTed to, to check they are safe for work (disabled if empty).")
+	var nsfwThreshold = flag.Float64("nsfw-threshold", 0.8, "The score, from 0 to 1, over which images are quarantined as not safe for work.")
+	var assistantURL = flag.String("assistant-url", "", "The OpenAI compatible API the assistant bot uses, e.g. https://api.openai.com/v1 (disabled if empty).")
+	var assistantKey = flag.String("assistant-key", os.Getenv("ASSISTANT_KEY"), "The API key for the assistant's API (or $ASSISTANT_KEY).")
+	var assistantModel = flag.String("assistant-model", "gpt-4o-mini", "The model the assistant bot uses.")
+	var assistantBudget = flag.Int("assistant-budget", 100000, "The most tokens the assistant may use in the room a day (no limit if 0).")
+	var smtpAddr = flag.String("smtp", "", "The SMTP server, as host:port, used to email digests of missed messages (disabled if empty).")
+	var smtpFrom = flag.String("smtp-from", "chat@localhost", "The address email is sent from.")
+	var smtpUser = flag.String("smtp-user", "", "The user to log in to the SMTP server as, if any.")
+	var smtpPassword = flag.String("smtp-password", os.Getenv("SMTP_PASSWORD"), "The password to log in to the SMTP server with (or $SMTP_PASSWORD).")
+	var digestInterval = flag.Duration("digest-interval", time.Hour, "How often digests of missed messages are emailed.")
+	var configFile = flag.String("config", "", "A file of flags, one name = value per line; some take effect on SIGHUP or POST /api/admin/reload (none if empty).")
+	var logLevelName = flag.String("log-level", "info", "What is logged: info for requests and room activity too, or warn for only what goes wrong.")
+	var restartTimeout = flag.Duration("restart-timeout", 30*time.Second, "How long, when restarting on SIGUSR2, the new process has to start, and then the old one's connections have to close.")
+	var snapshotInterval = flag.Duration("snapshot-interval", 5*time.Minute, "How often the room's state is snapshotted to the -data directory or database.")
+	var retentionDays = flag.Int("retention-days", 0, "How many days rooms keep messages for, unless they have a retention policy of their own (for ever if 0).")
+	var retentionMessages = flag.Int("retention-messages", 0, "How many of the latest messages rooms keep, unless they have a retention policy of their own (all if 0).")
+	var retentionInterval = flag.Duration("retention-interval", time.Hour, "How often messages rooms no longer keep are pruned.")
+	var postgresURL = flag.String("postgres", os.Getenv("DATABASE_URL"), "The PostgreSQL database rooms and accounts are kept in instead of -data, e.g. postgres://chat@localhost/chat (or $DATABASE_URL; not used if empty).")
+	var postgresConns = flag.Int("postgres-max-conns", 10, "The most connections to the PostgreSQL database kept open at once.")
+	var dynamoPrefix = flag.String("dynamodb", "", "The prefix of the DynamoDB tables rooms and accounts are kept in instead of -data, e.g. chat for chat-messages and chat-accounts (not used if empty).")
+	var dynamoEndpoint = flag.String("dynamodb-endpoint", "", "The DynamoDB endpoint to use instead of AWS's, e.g. http://localhost:8000 for DynamoDB local.")
+	var mongoURI = flag.String("mongodb", os.Getenv("MONGODB_URI"), "The MongoDB server rooms and accounts are kept in instead of -data, e.g. mongodb://localhost:27017 (or $MONGODB_URI; not used if empty).")
+	var mongoDatabase = flag.String("mongodb-database", "chat", "The MongoDB database rooms and accounts are kept in.")
+	var mongoCappedSize = flag.Int64("mongodb-capped-size", 0, "The bytes of recent events MongoDB keeps, in a capped collection made when it is first used (not capped if 0).")
+	var mongoRetention = flag.Duration("mongodb-retention", 0, "How long MongoDB keeps events for before they expire (kept for ever if 0).")
+	var raftID = flag.String("raft-id", "", "This server's ID in the Raft cluster its rooms are replicated across, e.g. chat1 (not replicated if empty).")
+	var raftPeers = flag.String("raft-peers", "", "Every server in the Raft cluster, this one included, as comma separated id=host:port, e.g. chat1=10.0.0.1:7000,chat2=10.0.0.2:7000,chat3=10.0.0.3:7000.")
+	var raftBind = flag.String("raft-bind", ":7000", "The address to listen for the rest of the Raft cluster on.")
+	var raftDir = flag.String("raft-dir", "", "The directory the Raft cluster's log and this server's copy of the rooms are kept in (raft in -data if empty).")
+	// The login providers we support. Each has flags for its credentials, and
+	// is only offered if they are set.
+	allProviders := []*loginProvider{
+		newLoginProvider("facebook", "Facebook", func(key, secret, callback string) (common.Provider, error) {
+			return facebook.New(key, secret, callback), nil
+		}),
+		newLoginProvider("github", "GitHub", func(key, secret, callback string) (common.Provider, error) {
+			return github.New(key, secret, callback), nil
+		}),
+		newLoginProvider("google", "Google", func(key, secret, callback string) (common.Provider, error) {
+			return google.New(key, secret, callback), nil
+		}),
+		newLoginProvider("microsoft", "Microsoft", func(key, secret, callback string) (common.Provider, error) {
+			return newMicrosoftProvider(*microsoftTenant, key, secret, callback), nil
+		}),
+		newLoginProvider("discord", "Discord", func(key, secret, callback string) (common.Provider, error) {
+			return newDiscordProvider(key, secret, callback), nil
+		}),
+		// Apple has no client secret; -apple-secret is the .p8 key file
+		// client secrets are signed with instead.
+		newLoginProvider("apple", "Apple", func(key, secret, callback string) (common.Provider, error) {
+			p, err := newAppleProvider(*appleTeam, *appleKeyID, secret, key, callback)
+			if err != nil {
+				return nil, err
+			}
+			return p, nil
+		}),
+	}
+	flag.Lookup("apple-secret").Usage = "The .p8 file holding the key Sign in with Apple client secrets are signed with (or $APPLE_SECRET)."
 	flag.Parse() // parse the flags
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal("Failed to load -config:", err)
+	}
+	if err := setLogLevel(*logLevelName); err != nil {
+		log.Fatal("-log-level: ", err)
+	}
+	// If we were started by a restarting server, it handed us its
+	// listeners.
+	ls := inheritListeners()
+	// stops are how each server is stopped, when we hand over to a new
+	// process.
+	var stops []func(ctx context.Context)
 
 	// set up gomniauth
-	gomniauth.SetSecurityKey(signature.RandomKey(64))
-	gomniauth.WithProviders(
-		facebook.New("key", "secret",
-			"http://localhost:8080/auth/callback/facebook"),
-		github.New("key", "secret",
-			"http://localhost:8080/auth/callback/github"),
-		google.New("211449155586-sdq8ij7tdjb464b8cs0umlacn31pjt9i.apps.googleusercontent.com", "MgTwJgOSRml4SW0j-imlTWq9",
-			"http://localhost:8080/auth/callback/google"),
-	)
-
-	// Create a new room instance.
-	r := newRoom()
-	r.tracer = trace.New(os.Stdout)
-
-	http.Handle("/assets/", http.StripPrefix("/assets", http.FileServer(http.Dir("./assets"))))
-
-	// Give the Hanlde function an templateHander object that has the ServeHTTP
-	// function defined as per the http.Handler interface which specifies only
-	// the ServeHTTP method need to be present in order for a type (class) to be
-	// used to serve HTTP requests by net/http
-	http.Handle("/chat", MustAuth(&templateHandler{filename: "chat.html"}))
-
-	http.Handle("/login", &templateHandler{filename: "login.html"})
-	http.HandleFunc("/auth/", loginHandler)
-
-	// r (Room instance) has ServeHTTP function, which creates a client and then
-	// passes it to the join channel of the room.
-	http.Handle("/room", r)
+	var baseURL *url.URL
+	if *baseURLFlag != "" {
+		var err error
+		if baseURL, err = url.Parse(*baseURLFlag); err != nil {
+			log.Fatal("Bad -base-url:", err)
+		}
+	}
+	callbackBase := *baseURLFlag
+	if callbackBase == "" {
+		callbackBase = "http://localhost" + *addr
+	}
+	logins := &loginProviders{}
+	if n, err := logins.configure(allProviders, callbackBase); err != nil {
+		log.Fatal("Login providers:", err)
+	} else if n == 0 {
+		log.Println("No login providers are configured; see -help")
+	}
+	if *secret == "" {
+		// Without a secret of our own, links we send stop working when we
+		// restart.
+		*secret = signature.RandomKey(64)
+	}
+	gomniauth.SetSecurityKey(*secret)
+	cookieKey = []byte(*secret)
+	// The providers' credentials can be reloaded, for when they are
+	// rotated.
+	providerFlags := []string{"microsoft-tenant", "apple-team", "apple-key-id"}
+	for _, p := range allProviders {
+		providerFlags = append(providerFlags, p.flagNames()...)
+	}
+	config.onReload(func() error {
+		n, err := logins.configure(allProviders, callbackBase)
+		if err != nil {
+			return fmt.Errorf("login providers: %v", err)
+		}
+		log.Println("Reload:", n, "login providers configured")
+		return nil
+	}, providerFlags...)
+	config.onReload(func() error {
+		return setLogLevel(*logLevelName)
+	}, "log-level")
+
+	// Bring the data kept by older releases up to date, or make sure it
+	// already is.
+	if *dataDir != "" {
+		if *migrate {
+			if err := migrateTo(*dataDir, latestSchema(), log.Printf); err != nil {
+				log.Fatal("Failed to migrate data:", err)
+			}
+		} else if v, err := currentSchema(*dataDir); err != nil {
+			log.Fatal("Failed to read data version:", err)
+		} else if v != latestSchema() {
+			log.Fatalf("%s is at version %d, not %d: run chat migrate up", *dataDir, v, latestSchema())
+		}
+	}
+
+	// Rooms and accounts may be kept in a database instead, for production;
+	// everything else is still kept in the -data directory.
+	var db database
+	databases := 0
+	for _, set := range []string{*postgresURL, *dynamoPrefix, *mongoURI} {
+		if set != "" {
+			databases++
+		}
+	}
+	switch {
+	case databases > 1:
+		log.Fatal("Only one of -postgres, -dynamodb and -mongodb may be used")
+	case *postgresURL != "":
+		pg, err := openPostgres(*postgresURL, *postgresConns)
+		if err != nil {
+			log.Fatal("PostgreSQL:", err)
+		}
+		db = pg
+		log.Println("Keeping rooms and accounts in PostgreSQL")
+	case *dynamoPrefix != "":
+		dynamo, err := openDynamoDB(*dynamoPrefix, *dynamoEndpoint)
+		if err != nil {
+			log.Fatal("DynamoDB:", err)
+		}
+		db = dynamo
+		log.Println("Keeping rooms and accounts in DynamoDB tables", *dynamoPrefix+"-*")
+	case *mongoURI != "":
+		mongo, err := openMongoDB(*mongoURI, *mongoDatabase, *mongoCappedSize, *mongoRetention)
+		if err != nil {
+			log.Fatal("MongoDB:", err)
+		}
+		db = mongo
+		log.Println("Keeping rooms and accounts in MongoDB database", *mongoDatabase)
+	}
+
+	// Rooms may be replicated across a cluster of servers instead, only the
+	// leader of which serves them, so this one waits until it leads.
+	var cluster *raftCluster
+	if *raftID != "" {
+		if db != nil {
+			log.Fatal("Rooms replicated with -raft-id can't also be kept in a database")
+		}
+		dir := *raftDir
+		if dir == "" {
+			if *dataDir == "" {
+				log.Fatal("-raft-id needs -raft-dir or -data")
+			}
+			dir = filepath.Join(*dataDir, "raft")
+		}
+		cluster, err = openRaftCluster(*raftID, *raftBind, *raftPeers, dir)
+		if err != nil {
+			log.Fatal("Raft:", err)
+		}
+		log.Println("Waiting to lead the Raft cluster")
+		if err := cluster.lead(); err != nil {
+			log.Fatal("Raft:", err)
+		}
+		log.Println("Leading the Raft cluster; serving its rooms")
+	}
+
+	// Instances may find each other by gossip, sharing their rooms'
+	// messages, and each room may have a home instance the others send its
+	// clients to.
+	var gossip *gossipCluster
+	if *gossipBind != "" {
+		if *natsURL != "" {
+			log.Fatal("Only one of -nats and -gossip may be used")
+		}
+		var join []string
+		if *gossipJoin != "" {
+			join = strings.Split(*gossipJoin, ",")
+		}
+		advertise := *gossipHTTP
+		if advertise == "" {
+			if _, port, err := net.SplitHostPort(*addr); err == nil {
+				advertise = ":" + port
+			}
+		}
+		gossip, err = newGossipCluster(*instance, *gossipBind, advertise, join)
+		if err != nil {
+			log.Fatal("Gossip:", err)
+		}
+		log.Println("Gossiping on", *gossipBind, "as instance", *instance)
+	} else if *gossipHome {
+		log.Fatal("-gossip-home needs -gossip")
+	}
+
+	// Everyone who signs in has an account, kept with the room's data.
+	var users *userStore
+	if db != nil {
+		users, err = openUserDB(db)
+	} else {
+		users, err = openUserStore(*dataDir)
+	}
+	if err != nil {
+		log.Fatal("Failed to load users:", err)
+	}
+	// People can make personal access tokens, for scripts to use the API
+	// and websocket with.
+	tokens, err := openTokenStore(*dataDir)
+	if err != nil {
+		log.Fatal("Failed to load tokens:", err)
+	}
+
+	// Emails, such as digests of missed messages and invitations, are sent
+	// if there is an SMTP server to send them through.
+	notifier := withPreferences(users, notifyOff())
+	var invites *inviter
+	if *smtpAddr != "" {
+		m := newMailer(*smtpAddr, *smtpFrom, *smtpUser, *smtpPassword)
+		invites = newInviter(m, []byte(*secret), callbackBase)
+		http.Handle("/invite", invites)
+		d := newDigest(users, m, *digestInterval, callbackBase)
+		go d.run()
+		notifier = withPreferences(users, d)
+		log.Println("Emailing digests through", *smtpAddr, "every", *digestInterval)
+	}
+	// People with registered phone numbers can be texted, and text the
+	// room, if there is a Twilio account to do it with.
+	var twilio *twilioGateway
+	if *twilioSID != "" {
+		if *twilioToken == "" {
+			log.Fatal("-twilio-sid needs -twilio-token, to check the texts Twilio sends are from Twilio")
+		}
+		twilio, err = newTwilioGateway(*twilioSID, *twilioToken, *twilioFrom, *twilioNumbers, users, baseURL)
+		if err != nil {
+			log.Fatal("-twilio-numbers: ", err)
+		}
+		notifier = notifiers{notifier, withPreferences(users, twilio)}
+	}
+	var messageTranslator translator
+	if *translateURL != "" {
+		messageTranslator = newLibreTranslate(*translateURL, *translateKey)
+	}
+	var uploadScanner scanner
+	if *clamdAddr != "" || *nsfwURL != "" {
+		var ss scanners
+		if *clamdAddr != "" {
+			ss = append(ss, &clamAV{addr: *clamdAddr})
+		}
+		if *nsfwURL != "" {
+			ss = append(ss, newNSFWClassifier(*nsfwURL, *nsfwThreshold))
+		}
+		uploadScanner = ss
+	}
+	uploadPolicy := &uploadPolicy{
+		allow:          splitList(*uploadTypes),
+		deny:           splitList(*uploadDenyTypes),
+		denyExtensions: splitList(*uploadDenyExtensions),
+		daily:          *maxDailyUpload,
+	}
+	var voice *voiceProcessor
+	if *ffmpegPath != "" {
+		voice = &voiceProcessor{ffmpeg: *ffmpegPath, maxDuration: *maxVoice}
+		if *sttURL != "" {
+			voice.transcriber = newWhisper(*sttURL, *sttKey, *sttModel)
+		}
+	}
+
+	// Pages are made from the built in templates, unless we are given
+	// others.
+	templates, assets := embedded("templates"), embedded("assets")
+	if *dev {
+		// in development, edit the files themselves.
+		templates, assets = os.DirFS("templates"), os.DirFS("assets")
+	}
+	if *templatesDir != "" {
+		templates = os.DirFS(*templatesDir)
+	}
+	if *localesDir != "" {
+		if locales, err = loadCatalogs(overlay{os.DirFS(*localesDir), embedded("locales")}); err != nil {
+			log.Fatal("Failed to load catalogs:", err)
+		}
+	}
+	if *themeDir != "" {
+		templates = overlay{os.DirFS(filepath.Join(*themeDir, "templates")), templates}
+		assets = overlay{os.DirFS(filepath.Join(*themeDir, "assets")), assets}
+	}
+	var assetHandler http.Handler = http.FileServer(http.FS(assets))
+	if *dev {
+		assetHandler = NoCache(assetHandler)
+	}
+	http.Handle("/assets/", http.StripPrefix("/assets", assetHandler))
+	http.Handle("/avatars/", &avatarHandler{})
+
+	http.Handle("/login", &templateHandler{filename: "login.html", templates: templates, dev: *dev, baseURL: baseURL,
+		data: map[string]interface{}{"Providers": logins}})
+
+	// With terms of service, people accept them before they chat.
+	var tos *terms
+	if *termsVersion != "" {
+		tos = &terms{version: *termsVersion, users: users}
+		http.Handle("/terms", &termsHandler{terms: tos, page: MustAuth(&templateHandler{filename: "terms.html", templates: templates, dev: *dev, baseURL: baseURL,
+			data: map[string]interface{}{"TermsVersion": *termsVersion, "TermsURL": *termsURL}})})
+	}
+
+	// The REST API lives under /api/, and may be called by pages on the
+	// origins allowed by the -cors flags.
+	cors := &corsConfig{
+		origins:     splitList(*corsOrigins),
+		methods:     splitList(*corsMethods),
+		headers:     splitList(*corsHeaders),
+		credentials: *corsCredentials,
+		maxAge:      10 * time.Minute,
+	}
+	api := http.NewServeMux()
+	http.Handle("/api/", CORS(cors, api))
+	// Everything to do with people's accounts is the same whichever
+	// organization they are in.
+	serveAccounts := func(api *http.ServeMux) {
+		api.Handle("/api/me/profile", &myProfileHandler{users: users})
+		api.Handle("/api/profiles/", &profilesHandler{users: users})
+		api.Handle("/api/me/notifications", &notifyPrefsHandler{users: users})
+		api.Handle("/api/me/tokens", &tokensHandler{tokens: tokens})
+		api.Handle("/api/me/tokens/", &tokensHandler{tokens: tokens})
+	}
+	serveAccounts(api)
+
+	throttle := newLoginThrottle(*loginAttempts, *loginBackoff, *loginLockout)
+	http.Handle("/auth/", ThrottleLogins(throttle, &loginHandler{users: users, providers: logins, cookieDomain: *orgDomain}))
+
+	limiter := newConnLimiter(*maxConnsPerIP, *maxUpgradesPerIP, time.Minute)
+	config.onReload(func() error {
+		throttle.setLimits(*loginAttempts, *loginBackoff, *loginLockout)
+		limiter.setLimits(*maxConnsPerIP, *maxUpgradesPerIP)
+		return nil
+	}, "login-attempts", "login-backoff", "login-lockout", "max-conns-per-ip", "max-upgrades-per-ip")
+	var geo *geoIP
+	if *geoIPPath != "" {
+		if geo, err = openGeoIP(*geoIPPath, *geoIPAllow, *geoIPDeny); err != nil {
+			log.Fatal("GeoIP:", err)
+		}
+	}
+
+	// HTTP/3 serves everything HTTP does, over QUIC, and WebTransport as an
+	// alternative to websockets for mobile networks that lose packets.
+	var h3 *webtransport.Server
+	var h3Conn net.PacketConn
+	if *http3Addr != "" {
+		cert, err := tls.LoadX509KeyPair(*http3Cert, *http3Key)
+		if err != nil {
+			log.Fatal("HTTP/3 LoadX509KeyPair:", err)
+		}
+		h3 = newHTTP3Server(*http3Addr, cert, nil)
+		if h3Conn, err = ls.listenPacket("http3", *http3Addr); err != nil {
+			log.Fatal("HTTP/3 Listen:", err)
+		}
+	}
+
+	// allRooms holds the rooms of every organization, to be started once
+	// they are all set up.
+	var allRooms []*room
+
+	// Every room checks messages for abuse before they are sent, with the
+	// same classifier.
+	var toxicity classifier
+	if *perspectiveKey != "" {
+		toxicity = newPerspective(*perspectiveKey)
+	}
+
+	// serveRooms sets up the rooms of an organization, or the server's own
+	// rooms if o is nil, keeping their data in dir, and serves them from mux
+	// and api, giving people the roles in rs. Pages served from mux open their
+	// websocket at socketBase.
+	serveRooms := func(o *org, dir string, rs *roles, mux, api *http.ServeMux, socketBase *url.URL, socketPath string) map[string]*room {
+		// Create a new room instance.
+		r := newRoom(*fanout)
+		r.name = "chat"
+		r.org = o
+		r.maxMessageSize = *maxMessageSize
+		r.users = users
+		r.translator = messageTranslator
+		r.roles = rs
+		r.notifier = notifier
+		if o == nil {
+			r.invites = invites
+		}
+		r.tracer = levelTracer{trace.New(os.Stdout)}
+		if toxicity != nil {
+			m, err := newModeration(r, toxicity, *toxicityThreshold, *toxicityAction)
+			if err != nil {
+				log.Fatal(err)
+			}
+			r.moderation = m
+			config.onReload(func() error {
+				return m.setPolicy(*toxicityThreshold, *toxicityAction)
+			}, "toxicity-threshold", "toxicity-action")
+		}
+		// Let people ask the assistant bot things.
+		if *assistantURL != "" {
+			r.assistant = newAssistant(*assistantURL, *assistantKey, *assistantModel, *assistantBudget, r)
+		}
+		if db != nil || cluster != nil || dir != "" {
+			var j journal
+			var state *roomState
+			var err error
+			if db != nil {
+				j, state, err = db.openJournal(r.key())
+			} else if cluster != nil {
+				j, state, err = cluster.openJournal(r.key())
+			} else {
+				j, state, err = openEventLog(dir)
+			}
+			if err != nil {
+				log.Fatal("Failed to restore room:", err)
+			}
+			r.restore(j, state, *snapshotInterval)
+		}
+		// rooms holds every room, by name.
+		rooms := map[string]*room{r.name: r}
+		scheduler, err := openScheduler(dir, rooms)
+		if err != nil {
+			log.Fatal("Failed to load scheduled messages:", err)
+		}
+		r.scheduler = scheduler
+		reports, err := openReportStore(dir)
+		if err != nil {
+			log.Fatal("Failed to load reports:", err)
+		}
+		r.reports = reports
+
+		// Give the Hanlde function an templateHander object that has the ServeHTTP
+		// function defined as per the http.Handler interface which specifies only
+		// the ServeHTTP method need to be present in order for a type (class) to be
+		// used to serve HTTP requests by net/http
+		mux.Handle("/chat", MustAuth(RequireTerms(tos, &templateHandler{filename: "chat.html", templates: templates, dev: *dev, baseURL: socketBase, socketPath: socketPath})))
+
+		api.Handle("/api/me/unread", &unreadHandler{users: users, rooms: rooms})
+		api.Handle("/api/me/scheduled", RefuseWithoutTerms(tos, &scheduleHandler{users: users, scheduler: scheduler}))
+		api.Handle("/api/me/scheduled/", RefuseWithoutTerms(tos, &scheduleHandler{users: users, scheduler: scheduler}))
+		api.Handle("/api/rooms/", &roomsHandler{rooms: rooms})
+		mux.Handle("/rooms/", &feedHandler{rooms: rooms, baseURL: socketBase})
+		api.Handle("/api/messages/", &messagesHandler{rooms: rooms})
+		api.Handle("/api/admin/reports", &reportsHandler{reports: reports, roles: rs})
+		api.Handle("/api/admin/reports/", &reportsHandler{reports: reports, roles: rs})
+		api.Handle("/api/admin/rooms/", &adminRoomsHandler{rooms: rooms})
+
+		// People can upload files to share, which are kept with the room's data
+		// and scanned before anybody can download them.
+		if dir != "" {
+			uploads, err := openUploadStore(filepath.Join(dir, "uploads"), *maxUpload, uploadPolicy)
+			if err != nil {
+				log.Fatal("Failed to open uploads:", err)
+			}
+			uploads.scanner = uploadScanner
+			uploads.alert = r.alertModerators
+			uploads.voice = voice
+			r.uploads = uploads
+			api.Handle("/api/uploads", RefuseWithoutTerms(tos, &uploadsHandler{store: uploads}))
+			api.Handle("/api/uploads/", RefuseWithoutTerms(tos, &uploadsHandler{store: uploads}))
+			var signer *downloadSigner
+			if *signedUploads > 0 {
+				signer = &downloadSigner{key: []byte(*secret), lifetime: *signedUploads}
+			}
+			mux.Handle("/uploads/", &downloadHandler{store: uploads, signer: signer})
+		}
+
+		// r (Room instance) has ServeHTTP function, which creates a client and then
+		// passes it to the join channel of the room.
+		var roomHandler http.Handler = r
+		if *netpoll {
+			h, err := newPollHandler(r)
+			if err != nil {
+				log.Fatal("netpoll:", err)
+			}
+			roomHandler = h
+		}
+		if gossip != nil && *gossipHome {
+			roomHandler = gossip.homeProxy(r, roomHandler)
+		}
+		mux.Handle("/room", LimitConnections(limiter, GeoFence(geo, RefuseWithoutTerms(tos, roomHandler))))
+		if h3 != nil {
+			mux.Handle("/webtransport", LimitConnections(limiter, GeoFence(geo, RefuseWithoutTerms(tos, newWebTransportHandler(r, h3)))))
+		}
+		allRooms = append(allRooms, r)
+		return rooms
+	}
+
+	// newServerRoles gives people the roles the flags say they have on the
+	// server, and everybody else the default role.
+	newServerRoles := func() *roles {
+		rs, err := newRoles(*defaultRole)
+		if err != nil {
+			log.Fatal("-default-role: ", err)
+		}
+		rs.grant(roleOwner, splitList(*owners)...)
+		rs.grant(roleAdmin, splitList(*admins)...)
+		rs.grant(roleModerator, splitList(*moderators)...)
+		return rs
+	}
+	serverRoles := newServerRoles()
+	rooms := serveRooms(nil, *dataDir, serverRoles, http.DefaultServeMux, api, baseURL, "/room")
+	api.Handle("/api/admin/reload", &reloadHandler{config: config, roles: serverRoles})
+	fw, err := openFirewall(*dataDir, *ipAllow, *ipDeny)
+	if err != nil {
+		log.Fatal("Firewall:", err)
+	}
+	api.Handle("/api/admin/firewall", &firewallAdminHandler{firewall: fw, roles: serverRoles})
+	r := rooms["chat"]
+
+	// Host each organization's rooms, each on a mux of its own.
+	var root http.Handler = http.DefaultServeMux
+	if *orgNames != "" {
+		orgs, err := openOrgStore(*dataDir, splitList(*orgNames), splitList(*admins))
+		if err != nil {
+			log.Fatal("Failed to load organizations:", err)
+		}
+		router := &orgRouter{domain: strings.ToLower(*orgDomain), orgs: make(map[string]http.Handler), root: root}
+		for _, o := range orgs.list() {
+			mux, api := http.NewServeMux(), http.NewServeMux()
+			// signing in, and the like, are the server's.
+			mux.Handle("/", http.DefaultServeMux)
+			mux.Handle("/api/", CORS(cors, api))
+			serveAccounts(api)
+			// the server's owners own every organization, which its own
+			// admins administer.
+			rs := newServerRoles()
+			rs.grant(roleAdmin, o.Admins...)
+			api.Handle("/api/admin/members", &membersHandler{orgs: orgs, org: o, roles: rs})
+			api.Handle("/api/admin/members/", &membersHandler{orgs: orgs, org: o, roles: rs})
+			// Pages of organizations picked by subdomain are served from
+			// the subdomain, and those picked by path from under the path.
+			socketBase, socketPath := baseURL, "/o/"+o.Name+"/room"
+			if router.domain != "" {
+				socketPath = "/room"
+				if baseURL != nil {
+					u := *baseURL
+					u.Host = o.Name + "." + router.domain
+					socketBase = &u
+				}
+			}
+			serveRooms(o, orgs.dataDir(o), rs, mux, api, socketBase, socketPath)
+			router.orgs[o.Name] = OrgMembersOnly(o, mux)
+			log.Println("Hosting organization", o.Name)
+		}
+		root = router
+	}
+
+	// the busiest rooms are those of the whole server, whatever
+	// organization they are in.
+	api.Handle("/api/admin/rooms", &topRoomsHandler{rooms: allRooms, roles: serverRoles})
+
+	// webhooks post to rooms of the whole server, whatever organization
+	// they are in.
+	byKey := make(map[string]*room)
+	for _, r := range allRooms {
+		byKey[r.key()] = r
+	}
+	if *alertmanagerToken != "" {
+		ops := byKey[*alertmanagerRoom]
+		if ops == nil {
+			log.Fatal("-alertmanager-room: no room ", *alertmanagerRoom)
+		}
+		api.Handle("/api/hooks/alertmanager", &alertmanagerHandler{room: ops, token: *alertmanagerToken})
+		log.Println("Posting alerts from Alertmanager to", *alertmanagerRoom)
+	}
+	if *githubHooks != "" {
+		if *githubSecret == "" {
+			log.Fatal("-github-hooks needs -github-secret")
+		}
+		hooks := make(map[string]*room)
+		for _, pair := range splitList(*githubHooks) {
+			token, key, _ := strings.Cut(pair, "=")
+			if byKey[key] == nil || token == "" {
+				log.Fatal("-github-hooks: bad token=room pair ", pair)
+			}
+			hooks[token] = byKey[key]
+		}
+		api.Handle("/api/integrations/github/", &githubHandler{rooms: hooks, secret: []byte(*githubSecret)})
+		log.Println("Posting GitHub webhooks to", len(hooks), "rooms")
+	}
+	if twilio != nil {
+		if twilio.room = byKey[*twilioRoom]; twilio.room == nil {
+			log.Fatal("-twilio-room: no room ", *twilioRoom)
+		}
+		api.Handle("/api/integrations/twilio/sms", twilio)
+		log.Println("Bridging", *twilioRoom, "and SMS from", *twilioFrom)
+	}
+	if *mailDomain != "" {
+		if *mailgunKey == "" {
+			log.Fatal("-mail-domain needs -mailgun-key")
+		}
+		api.Handle("/api/integrations/mailgun", &mailgunHandler{rooms: byKey, domain: strings.ToLower(*mailDomain), key: []byte(*mailgunKey), users: users})
+		log.Println("Posting emails to rooms @" + *mailDomain)
+	}
+	if *hooksFile != "" {
+		hooks, err := loadHooks(*hooksFile, byKey)
+		if err != nil {
+			log.Fatal("-hooks: ", err)
+		}
+		api.Handle("/api/integrations/hooks/", &hooksHandler{hooks: hooks})
+		log.Println("Serving", len(hooks), "webhooks")
+	}
+
+	if *kafkaBrokers != "" {
+		r.events = newKafkaSink(strings.Split(*kafkaBrokers, ","), *kafkaTopic)
+	}
+
+	if *natsURL != "" {
+		bp, err := newNATSBackplane(*natsURL, *natsStream, *natsSubject, *instance, r)
+		if err != nil {
+			log.Fatal("NATS:", err)
+		}
+		r.backplane = bp
+		log.Println("Using NATS backplane", *natsURL, "as instance", *instance)
+	}
+	if gossip != nil {
+		gossip.host(allRooms...)
+	}
+	if *redisURL != "" {
+		presence, err := newRedisPresence(*redisURL, *instance)
+		if err != nil {
+			log.Fatal("Redis:", err)
+		}
+		for _, r := range allRooms {
+			r.presence = presence
+		}
+		log.Println("Keeping track of who is in each room in Redis as instance", *instance)
+	}
 
 	// Goroutine watches three channels inside r (join, leave and forward)
-	go r.run()
+	for _, r := range allRooms {
+		go r.run()
+		go r.scheduler.run()
+		if r.assistant != nil {
+			go r.assistant.run()
+		}
+	}
+	// Prune the messages rooms' retention policies no longer keep.
+	janitor := &janitor{
+		rooms:    allRooms,
+		policy:   retention{Days: *retentionDays, Messages: *retentionMessages},
+		interval: *retentionInterval,
+	}
+	go janitor.run()
+
+	// Expose the room to IRC clients as the #chat channel.
+	irc := newIRCServer("chat", rooms, tokens, users, tos)
+	if *ircAddr != "" {
+		l, err := ls.listen("irc", *ircAddr)
+		if err != nil {
+			log.Fatal("IRC Listen:", err)
+		}
+		log.Println("Starting IRC gateway on", *ircAddr)
+		go func() { serveFailed("IRC:", irc.serve(fw.listener(l))) }()
+	}
+	if *ircsAddr != "" {
+		cert, err := tls.LoadX509KeyPair(*ircCert, *ircKey)
+		if err != nil {
+			log.Fatal("IRC LoadX509KeyPair:", err)
+		}
+		l, err := ls.listen("ircs", *ircsAddr)
+		if err != nil {
+			log.Fatal("IRC Listen:", err)
+		}
+		l = tls.NewListener(fw.listener(l), &tls.Config{Certificates: []tls.Certificate{cert}})
+		log.Println("Starting IRC gateway (TLS) on", *ircsAddr)
+		go func() { serveFailed("IRC:", irc.serve(l)) }()
+	}
+
+	// Serve the gRPC API alongside HTTP, for backend services and other
+	// clients that would rather not speak websockets.
+	if *grpcAddr != "" {
+		var opts []grpc.ServerOption
+		if *grpcCert != "" {
+			creds, err := credentials.NewServerTLSFromFile(*grpcCert, *grpcKey)
+			if err != nil {
+				log.Fatal("gRPC TLS:", err)
+			}
+			opts = append(opts, grpc.Creds(creds))
+		}
+		l, err := ls.listen("grpc", *grpcAddr)
+		if err != nil {
+			log.Fatal("gRPC Listen:", err)
+		}
+		log.Println("Starting gRPC API on", *grpcAddr)
+		s := newGRPCServer(rooms, users, tokens, tos, opts...)
+		go func() { serveFailed("gRPC:", s.Serve(fw.listener(l))) }()
+		stops = append(stops, func(ctx context.Context) {
+			stopped := make(chan struct{})
+			go func() {
+				s.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				s.Stop()
+			}
+		})
+	}
+
+	// Reload the configuration when we are sent SIGHUP.
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := config.reload(); err != nil {
+				log.Println("Reload:", err)
+				continue
+			}
+			log.Println("Configuration reloaded")
+		}
+	}()
+
+	// Bridge the room with a Telegram group.
+	if *telegramToken != "" {
+		log.Println("Bridging room with Telegram chat", *telegramChat)
+		go newTelegramBridge(*telegramToken, *telegramChat, r).run()
+	}
+
+	// Bridge the room with an MQTT broker.
+	if *mqttBroker != "" {
+		var topics []string
+		if *mqttTopics != "" {
+			topics = strings.Split(*mqttTopics, ",")
+		}
+		if err := newMQTTBridge(*mqttBroker, topics, *mqttPublish, r).run(); err != nil {
+			log.Fatal("MQTT:", err)
+		}
+		log.Println("Bridging room with MQTT broker", *mqttBroker)
+	}
+
+	// Profiles and runtime statistics, for when a room stalls, are only
+	// served with -debug.
+	var debug http.Handler
+	if *debugEndpoints {
+		debug = newDebugMux(allRooms)
+	}
+	if *statsdAddr != "" {
+		statsd, err := newStatsdEmitter(*statsdAddr, *statsdPrefix, *statsdTags, allRooms)
+		if err != nil {
+			log.Fatal("StatsD:", err)
+		}
+		go statsd.run()
+		log.Println("Pushing metrics to StatsD at", *statsdAddr)
+	}
+	// A panic handling one request must not take the whole server down, and
+	// other sites' pages mustn't change things as whoever visits them.
+	var handler http.Handler = Recover(SameOriginOnly(cors, TokenAuth(tokens, users, Debug(debug, serverRoles, root))))
+	// Requests from outside the networks the server may be reached from
+	// are turned away before anything else sees them.
+	handler = Firewall(fw, handler)
+	if *accessLog {
+		handler = LogRequests(geo, handler)
+	}
+	proxies, err := parseTrustedProxies(*trustedProxyList)
+	if err != nil {
+		log.Fatal("Bad -trusted-proxies:", err)
+	}
+	// Behind a reverse proxy, make sure everything sees the address of the
+	// real client rather than the proxy's.
+	if len(proxies) > 0 {
+		handler = RealIP(proxies, handler)
+	}
+	if h3 != nil {
+		h3.H3.Handler = handler
+		log.Println("Starting HTTP/3 server on", *http3Addr)
+		go func() { serveFailed("HTTP/3:", h3.Serve(h3Conn)) }()
+		stops = append(stops, func(context.Context) { h3.Close() })
+		handler = AdvertiseHTTP3(h3, handler)
+	}
 
-	// start the web server
-	log.Println("Starting web server on", *addr)
-	if err := http.ListenAndServe(*addr, nil); err != nil {
-		log.Fatal("ListenAndServe:", err)
+	// start the web server, on the listeners a restarting server handed
+	// us, or those systemd passed us if it started us by socket activation,
+	// and otherwise on -addr. Either way, it can listen on a unix domain
+	// socket too.
+	listeners, err := ls.inherit("http")
+	if err != nil {
+		log.Fatal("Restart:", err)
+	}
+	if len(listeners) == 0 {
+		if listeners, err = systemdListeners(); err != nil {
+			log.Fatal("systemd:", err)
+		}
+		if len(listeners) == 0 && *addr != "" {
+			l, err := net.Listen("tcp", *addr)
+			if err != nil {
+				log.Fatal("Listen:", err)
+			}
+			listeners = append(listeners, l)
+		}
+		if *unixSocket != "" {
+			l, err := listenUnix(*unixSocket, os.FileMode(*unixMode))
+			if err != nil {
+				log.Fatal("Listen:", err)
+			}
+			listeners = append(listeners, l)
+		}
+		for _, l := range listeners {
+			ls.add("http", l)
+		}
 	}
+	if len(listeners) == 0 {
+		log.Fatal("Nothing to listen on: give -addr or -unix")
+	}
+	server := &http.Server{Handler: handler}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		log.Println("Starting web server on", l.Addr())
+		go func(l net.Listener) { errs <- server.Serve(l) }(l)
+	}
+	ready()
+
+	// Restart without dropping connections when we are sent SIGUSR2, once
+	// the binary has been replaced by a new release.
+	h := &handover{listeners: ls, rooms: allRooms, limiter: limiter, timeout: *restartTimeout, done: make(chan struct{})}
+	h.stops = append(stops, func(ctx context.Context) { server.Shutdown(ctx) })
+	go h.run()
+	serveFailed("Serve:", <-errs)
+	<-h.done
+	log.Println("Restarted; exiting")
 }
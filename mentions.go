@@ -0,0 +1,40 @@
+package main
+
+import "regexp"
+
+// mentionPattern matches an @mention of somebody in a message. Names with
+// spaces in can't be mentioned, beyond their first word.
+var mentionPattern = regexp.MustCompile(`@([\p{L}\p{N}_.\-]+)`)
+
+// mentions returns the accounts of everybody mentioned in text, each once.
+// People in the room are looked up by the name they go by there, and anybody
+// else by the name on their account. It is only called from the room's run
+// loop.
+func (r *room) mentions(text string) []string {
+	var accounts []string
+	seen := make(map[string]bool)
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		account := r.accountNamed(m[1])
+		if account == "" && r.users != nil {
+			if a := r.users.findByName(m[1]); a != nil {
+				account = a.ID
+			}
+		}
+		if account != "" && !seen[account] {
+			seen[account] = true
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts
+}
+
+// present reports whether the account has a connection to the room. It is
+// only called from the room's run loop.
+func (r *room) present(account string) bool {
+	for _, claim := range r.names {
+		if claim.account == account {
+			return true
+		}
+	}
+	return false
+}
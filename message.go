@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// message represents a single message sent to a room. It is the envelope
+// that gets encoded as JSON down the websocket to the browser.
+type message struct {
+	// ID identifies the message in its room. It is the sequence number of
+	// the event that recorded it.
+	ID uint64 `json:",omitempty"`
+
+	Name    string
+	Message string
+	When    time.Time
+
+	// Avatar is the URL of the picture to show the sender with: their own,
+	// or else their initials.
+	Avatar string `json:",omitempty"`
+
+	// Sender is the account that sent the message, so that people can be
+	// allowed to delete their own messages. It is kept with the room's
+	// history, but never sent down websockets: see public.
+	Sender string `json:",omitempty"`
+
+	// System is set on messages from the chat server itself, such as
+	// somebody changing their name, rather than from a user.
+	System bool `json:",omitempty"`
+
+	// Mentions are the accounts of the people @mentioned in the message,
+	// which the room works out when the message is sent.
+	Mentions []string `json:",omitempty"`
+
+	// Read, on a message from a client, marks every message up to the one
+	// with that ID as read by its user. The room passes it on to the user's
+	// other connections, so they all agree on what has been read.
+	Read uint64 `json:",omitempty"`
+
+	// Receipts, on a message from the server, are the reads since the last
+	// receipts, so clients can count how many people have seen each
+	// message.
+	Receipts []receipt `json:",omitempty"`
+
+	// Poll, on a message from the server, is how a poll stands, and Vote,
+	// on a message from a client, is its user's vote in one.
+	Poll *pollTally `json:",omitempty"`
+	Vote *pollVote  `json:",omitempty"`
+
+	// Deleted, on a message from the server, is the ID of a message that
+	// has been deleted, which clients should stop showing.
+	Deleted uint64 `json:",omitempty"`
+
+	// Hello, on a message from a client, and Welcome, on the server's reply,
+	// are the handshake in which they agree on the protocol version and
+	// capabilities.
+	Hello   *hello `json:",omitempty"`
+	Welcome *hello `json:",omitempty"`
+
+	// Typing, on a message from a client, says its user is typing, and on
+	// a message from the server, that the named user is. It is only sent to
+	// clients with the typing capability, and never recorded.
+	Typing bool `json:",omitempty"`
+
+	// Presence, on a message from the server, says the named user joined
+	// the room, if it is user_joined, or left it, if user_left. Presence
+	// messages are never recorded, and rooms can turn them off.
+	Presence string `json:",omitempty"`
+
+	// Ack, on a message from the server, is the nonce of a message the
+	// client sent, which the room has recorded with the ID given.
+	Ack string `json:",omitempty"`
+
+	// Expires, if set, is when the message disappears, after which the
+	// server deletes it.
+	Expires *time.Time `json:",omitempty"`
+
+	// Edited, if set, is when the message was last edited. A message from
+	// the server with an ID clients have already seen, and Edited set, is
+	// the message's new version.
+	Edited *time.Time `json:",omitempty"`
+
+	// Flagged is set on messages the room's moderation let through, but
+	// thought might be abusive.
+	Flagged bool `json:",omitempty"`
+
+	// Voice is set on voice messages, whose Message is their transcript,
+	// if they have one.
+	Voice *voiceNote `json:",omitempty"`
+
+	// Action is set on messages sent with /me, whose Message is what the
+	// sender did, such as "waves", to be shown as "* Name waves".
+	Action bool `json:",omitempty"`
+
+	// Alert is set on messages about alerts from Alertmanager, to the
+	// alert's severity, such as critical, or to resolved once it is.
+	Alert string `json:",omitempty"`
+
+	// Translation, on a message from the server to a single client, is
+	// another message translated for them.
+	Translation *translation `json:",omitempty"`
+
+	// nonce is the client's own ID for a message it sent, to acknowledge it
+	// by.
+	nonce string
+
+	// voiceUpload, on a message from a client, is the ID of the upload the
+	// client is sending as a voice message.
+	voiceUpload string
+
+	// to, if set, is the only client the message is delivered to, and
+	// toAccount the only account. Such messages are the server's replies to
+	// a client, such as an error from a command it ran, and are not
+	// recorded in the room.
+	to        *client
+	toAccount string
+
+	// shadow is set on messages from shadow banned users, which are only
+	// delivered back to the user's own connections.
+	shadow bool
+
+	// from is the client that sent the message, or nil if it did not come
+	// from a client of the room. It is unexported so it never ends up in the
+	// JSON, and lets gateways avoid echoing a user's own messages back.
+	from *client
+
+	// account is the account that sent the message, for messages such as
+	// scheduled ones that are sent on somebody's behalf rather than by one
+	// of their clients.
+	account string
+
+	// remote is set on messages that were sent by a client of another
+	// instance and delivered to us by the backplane, so that they are not
+	// published to the backplane again.
+	remote bool
+
+	// prepared is the message already encoded and framed for sending down a
+	// websocket. The room prepares it once, before handing the message to
+	// the fanout workers, rather than every client framing it again.
+	prepared *websocket.PreparedMessage
+
+	// frames holds the message encoded in the other wire formats the room's
+	// clients use, prepared along with the JSON. It isn't changed once the
+	// message has been handed to the fanout workers.
+	frames map[*wireFormat]*encodedFrame
+
+	// buf is the pooled buffer holding the encoded message the prepared
+	// frame is made from, and refs counts the fanout workers and clients
+	// that may still write the frame. When refs drops to zero, buf goes back
+	// to the pool.
+	buf  *bytes.Buffer
+	refs int32
+}
+
+// sender returns the account that sent the message, or the empty string if
+// it is not known.
+func (m *message) sender() string {
+	if m.from != nil {
+		return m.from.account()
+	}
+	return m.account
+}
+
+// relayable reports whether the message is one that bridges to other chat
+// systems, and gRPC clients, are sent. The notices only websocket clients
+// make use of, such as receipts, deletions, the handshake, acks and typing,
+// have no text to pass on.
+func (m *message) relayable() bool {
+	return len(m.Receipts) == 0 && m.Deleted == 0 && m.Welcome == nil && m.Ack == "" && !m.Typing
+}
+
+// private reports whether the message is only for one client or account.
+func (m *message) private() bool {
+	return m.to != nil || m.toAccount != ""
+}
+
+// decodeMessage decodes a message sent by a client. Only the fields clients
+// may set are decoded: everything else about the message is for the server
+// to say.
+func decodeMessage(data []byte) (*message, error) {
+	var in clientMessage
+	if err := json.Unmarshal(data, &in); err != nil {
+		return nil, err
+	}
+	return in.message(), nil
+}
+
+// public returns the message as it is sent down websockets, to everybody in
+// the room: without its sender's account, which only the server needs.
+func (m *message) public() *message {
+	if m.Sender == "" {
+		return m
+	}
+	p := *m
+	p.Sender = ""
+	return &p
+}
+
+// prepare encodes and frames the message for sending down websockets, and in
+// each other wire format the room's clients are using, the first time the
+// message is delivered. Every call takes a reference to the encoded message,
+// which the caller must release once the message has been handed on, so a
+// message delivered again, while the clients it was first delivered to are
+// still writing it, shares its buffer rather than resetting the count. Once
+// every reference has been released, the buffer is back in the pool, so a
+// message delivered after that is encoded afresh.
+func (m *message) prepare(wires map[*wireFormat]int) error {
+	if m.prepared != nil && m.retainHeld() {
+		return nil
+	}
+	m.prepared, m.buf, m.frames = nil, nil, nil
+	buf := getBuffer()
+	if err := json.NewEncoder(buf).Encode(m.public()); err != nil {
+		putBuffer(buf)
+		return err
+	}
+	prepared, err := websocket.NewPreparedMessage(websocket.TextMessage, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	if err != nil {
+		putBuffer(buf)
+		return err
+	}
+	m.prepared = prepared
+	m.buf = buf
+	atomic.StoreInt32(&m.refs, 1)
+	for f, n := range wires {
+		if n == 0 || f == jsonWire {
+			continue
+		}
+		frame, err := f.encodeFrame(m)
+		if err != nil {
+			log.Println("Failed to prepare message:", err)
+			continue
+		}
+		if m.frames == nil {
+			m.frames = make(map[*wireFormat]*encodedFrame)
+		}
+		m.frames[f] = frame
+	}
+	return nil
+}
+
+// frame returns the message encoded in the wire format, as the room
+// prepared it or, if it didn't, encoded afresh. The frame must be released
+// once it has been written, as it may share the message's pooled buffer.
+func (m *message) frame(f *wireFormat) (*encodedFrame, error) {
+	if frame, ok := m.frames[f]; ok {
+		return frame, nil
+	}
+	if f == jsonWire && m.buf != nil {
+		m.retain(1)
+		return &encodedFrame{data: bytes.TrimSuffix(m.buf.Bytes(), []byte("\n")), prepared: m.prepared, owner: m}, nil
+	}
+	return f.encodeFrame(m)
+}
+
+// retain adds n references to the encoded message. The caller must already
+// hold one.
+func (m *message) retain(n int) {
+	if m.buf != nil {
+		atomic.AddInt32(&m.refs, int32(n))
+	}
+}
+
+// retainHeld adds a reference to the encoded message if somebody still holds
+// one, reporting whether it did. If nobody does, its buffer may already be
+// back in the pool.
+func (m *message) retainHeld() bool {
+	for {
+		n := atomic.LoadInt32(&m.refs)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&m.refs, n, n+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference to the encoded message, returning its buffer to
+// the pool if it was the last one. Missing a release is harmless, the buffer
+// is simply garbage collected instead of reused; releasing too often is not.
+func (m *message) release() {
+	// the buffer is looked up first: once the count drops to zero the room
+	// may prepare the message afresh, with another.
+	buf := m.buf
+	if buf != nil && atomic.AddInt32(&m.refs, -1) == 0 {
+		putBuffer(buf)
+	}
+}
+
+// nickMessage is the system message telling the room about a change of name.
+func nickMessage(e *roomEvent) *message {
+	return &message{
+		ID:      e.Seq,
+		Message: e.Name + " is now known as " + e.Message,
+		When:    e.When,
+		System:  true,
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPrepareTwice checks that a message prepared again while it is still
+// being written shares its buffer, taking another reference, rather than
+// resetting the count and having the buffer go back to the pool early.
+func TestPrepareTwice(t *testing.T) {
+	msg := &message{Name: "ada", Message: "hello", When: time.Now()}
+	if err := msg.prepare(nil); err != nil {
+		t.Fatal(err)
+	}
+	buf := msg.buf
+	msg.retain(2) // two clients are writing it
+	msg.release() // and the room is done with it
+
+	if err := msg.prepare(nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg.buf != buf || msg.refs != 3 {
+		t.Fatalf("preparing again gave a new buffer (%v) or %d references, want the same buffer and 3", msg.buf != buf, msg.refs)
+	}
+	frame, err := msg.frame(jsonWire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.refs != 4 {
+		t.Fatalf("the JSON frame took the references to %d, want 4", msg.refs)
+	}
+	for i := 0; i < 3; i++ {
+		msg.release()
+	}
+	if string(frame.data) == "" || msg.refs != 1 {
+		t.Fatalf("the frame lost its buffer, or %d references are left, want 1", msg.refs)
+	}
+	frame.release()
+
+	// once nobody holds it, the buffer is back in the pool, so delivering
+	// the message again encodes it afresh.
+	if err := msg.prepare(nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg.refs != 1 {
+		t.Fatalf("preparing after the last release left %d references, want 1", msg.refs)
+	}
+	msg.release()
+}
+
+// TestDeliverTwice delivers the same messages to a room's clients over and
+// over, among others, and checks every client writes each one as it was
+// sent: a buffer that went back to the pool while somebody was still
+// writing it would be holding some other message by then. Run it with -race.
+func TestDeliverTwice(t *testing.T) {
+	r := newRoom(4)
+	go r.run()
+	r.changes <- &roomEvent{Type: eventHidePresence}
+
+	var wg sync.WaitGroup
+	const clients, rounds = 8, 50
+	got := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		c := &client{send: make(chan *message, 4*rounds), room: r, userData: map[string]interface{}{"id": "ada", "name": "ada"}, wire: jsonWire}
+		if i%2 == 1 {
+			c.wire = protoWire
+		}
+		r.join <- c
+		wg.Add(1)
+		go func(c *client) {
+			defer wg.Done()
+			n := 0
+			for msg := range c.send {
+				frame, err := msg.frame(c.wire)
+				if err != nil {
+					got <- err
+					return
+				}
+				if c.wire == jsonWire && msg.Message != "" {
+					var written message
+					if err := json.Unmarshal(frame.data, &written); err != nil || written.Message != msg.Message {
+						got <- fmt.Errorf("wrote %q for %q (%v)", frame.data, msg.Message, err)
+						return
+					}
+				}
+				frame.release()
+				msg.release()
+				if msg.Message == "again" {
+					if n++; n == rounds {
+						return
+					}
+				}
+			}
+		}(c)
+	}
+
+	again := &message{Message: "again", When: time.Now(), System: true, toAccount: "ada"}
+	for i := 0; i < rounds; i++ {
+		r.forward <- again
+		r.forward <- &message{Message: fmt.Sprint("other ", i), When: time.Now(), System: true, toAccount: "ada"}
+	}
+	wg.Wait()
+	close(got)
+	for err := range got {
+		t.Error(err)
+	}
+}
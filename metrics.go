@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// roomMetrics are a room's gauges, so that whoever runs the server can tell
+// which room is behind a spike in traffic. The room updates them once a
+// second.
+type roomMetrics struct {
+	Room string `json:"room"`
+
+	// Clients is how many connections the room has.
+	Clients int `json:"clients"`
+
+	// MessagesPerSecond is how many messages were sent to the room in the
+	// last second.
+	MessagesPerSecond int `json:"messages_per_second"`
+
+	// Queued is how many messages are waiting to be written to the room's
+	// clients, and MaxQueued how many to its slowest one.
+	Queued    int `json:"queued"`
+	MaxQueued int `json:"max_queued"`
+}
+
+// metricsInterval is how often rooms update their metrics.
+const metricsInterval = time.Second
+
+// measure updates the room's metrics, counting sent messages as the messages
+// sent since it last did. It must only be called from run.
+func (r *room) measure(sent int) {
+	m := roomMetrics{Clients: len(r.clients), MessagesPerSecond: sent}
+	for client := range r.clients {
+		n := len(client.send)
+		m.Queued += n
+		if n > m.MaxQueued {
+			m.MaxQueued = n
+		}
+	}
+	r.mu.Lock()
+	r.metrics = m
+	r.mu.Unlock()
+}
+
+// currentMetrics returns the room's metrics as of the last second.
+func (r *room) currentMetrics() roomMetrics {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m := r.metrics
+	m.Room = r.key()
+	return m
+}
+
+// topRoomsHandler serves GET /api/admin/rooms, the metrics of the busiest
+// rooms on the server, in every organization, to those who manage it. The
+// by parameter says what makes a room busy: messages, the default, clients
+// or queued; and the top parameter how many rooms to list, ten by default.
+type topRoomsHandler struct {
+	rooms []*room
+	roles *roles
+}
+
+// defaultTopRooms is how many rooms are listed unless more or fewer are asked
+// for.
+const defaultTopRooms = 10
+
+func (h *topRoomsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requirePermission(w, r, h.roles, permManageServer) == "" {
+		return
+	}
+	top := defaultTopRooms
+	if s := r.URL.Query().Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "top must be a positive number", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	var value func(m roomMetrics) int
+	switch r.URL.Query().Get("by") {
+	case "", "messages":
+		value = func(m roomMetrics) int { return m.MessagesPerSecond }
+	case "clients":
+		value = func(m roomMetrics) int { return m.Clients }
+	case "queued":
+		value = func(m roomMetrics) int { return m.Queued }
+	default:
+		http.Error(w, "by must be messages, clients or queued", http.StatusBadRequest)
+		return
+	}
+	metrics := make([]roomMetrics, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		metrics = append(metrics, room.currentMetrics())
+	}
+	sort.SliceStable(metrics, func(i, j int) bool { return value(metrics[i]) > value(metrics[j]) })
+	if len(metrics) > top {
+		metrics = metrics[:top]
+	}
+	writeJSON(w, metrics)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/stretchr/objx"
+)
+
+// newMicrosoftProvider makes a login provider for Microsoft accounts,
+// through the Microsoft identity platform (Azure AD). The tenant is the
+// directory users may sign in from: a tenant ID or domain to restrict sign
+// in to one organisation, "organizations" for any work or school account,
+// "consumers" for personal accounts, or "common" for all of them.
+func newMicrosoftProvider(tenant, clientID, clientSecret, redirectURL string) *oauthProvider {
+	base := "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0"
+	return newOAuthProvider("microsoft", "Microsoft",
+		base+"/authorize",
+		base+"/token",
+		"openid profile email User.Read",
+		"https://graph.microsoft.com/v1.0/me",
+		clientID, clientSecret, redirectURL,
+		func(profile objx.Map) *oauthUser {
+			// Azure AD lets tenant admins set any mail address they like,
+			// so it isn't treated as verified.
+			email := profile.Get("mail").Str()
+			if email == "" {
+				email = profile.Get("userPrincipalName").Str()
+			}
+			return &oauthUser{
+				id:       profile.Get("id").Str(),
+				name:     profile.Get("displayName").Str(),
+				nickname: profile.Get("givenName").Str(),
+				email:    email,
+			}
+		})
+}
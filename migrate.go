@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// migration changes how things are stored in the -data directory from one
+// version of the layout to the next. Each release adds a migration for any
+// change it makes to the layout, so data kept by an older release is brought
+// up to date when a newer one starts, and down undoes up, should a release
+// need to be rolled back.
+type migration struct {
+	version int
+	name    string
+	up      func(dir string) error
+	down    func(dir string) error
+}
+
+// migrations are every migration, in order. Versions count up from 1, and
+// migrations already released must never change.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "baseline: event log, snapshot and JSON stores",
+		up:      func(dir string) error { return nil },
+		down:    func(dir string) error { return nil },
+	},
+}
+
+// schemaFile records which version of the layout the -data directory is in.
+const schemaFile = "schema.json"
+
+// schemaVersion is what is kept in schema.json.
+type schemaVersion struct {
+	Version int       `json:"version"`
+	When    time.Time `json:"when"`
+}
+
+// latestSchema is the version of the layout this release uses.
+func latestSchema() int {
+	return migrations[len(migrations)-1].version
+}
+
+// currentSchema returns the version of the layout dir is in: 0 if it has
+// never been migrated.
+func currentSchema(dir string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, schemaFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var v schemaVersion
+	if err := json.Unmarshal(b, &v); err != nil {
+		return 0, err
+	}
+	return v.Version, nil
+}
+
+func setSchema(dir string, version int) error {
+	return saveJSON(filepath.Join(dir, schemaFile), schemaVersion{Version: version, When: time.Now()})
+}
+
+// migrateTo migrates dir up or down to the given version, one migration at
+// a time, recording each as it is done so a failure part way leaves the
+// directory at a known version.
+func migrateTo(dir string, target int, logf func(format string, args ...interface{})) error {
+	if target < 0 || target > latestSchema() {
+		return fmt.Errorf("there is no version %d; the latest is %d", target, latestSchema())
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	current, err := currentSchema(dir)
+	if err != nil {
+		return err
+	}
+	if current > latestSchema() {
+		return fmt.Errorf("%s is at version %d, newer than this release knows (%d)", dir, current, latestSchema())
+	}
+	for _, m := range migrations {
+		if m.version <= current || m.version > target {
+			continue
+		}
+		logf("Migrating up to %d: %s", m.version, m.name)
+		if err := m.up(dir); err != nil {
+			return fmt.Errorf("migration %d: %v", m.version, err)
+		}
+		if err := setSchema(dir, m.version); err != nil {
+			return err
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= target {
+			continue
+		}
+		logf("Migrating down from %d: %s", m.version, m.name)
+		if err := m.down(dir); err != nil {
+			return fmt.Errorf("migration %d: %v", m.version, err)
+		}
+		if err := setSchema(dir, m.version-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSubcommand is "chat migrate up|down|status", which migrates the
+// -data directory up to the latest version or a given one, down a version
+// or to a given one, or says which version it is at.
+func migrateSubcommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dataDir := flags.String("data", "", "The directory to migrate.")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: chat migrate -data <dir> up [version] | down [version] | status")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *dataDir == "" || flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return errors.New("-data and what to do are required")
+	}
+	current, err := currentSchema(*dataDir)
+	if err != nil {
+		return err
+	}
+	target := -1
+	if flags.NArg() == 2 {
+		if target, err = strconv.Atoi(flags.Arg(1)); err != nil {
+			return fmt.Errorf("bad version %q", flags.Arg(1))
+		}
+	}
+	logf := func(format string, args ...interface{}) { fmt.Printf(format+"\n", args...) }
+	switch flags.Arg(0) {
+	case "up":
+		if target < 0 {
+			target = latestSchema()
+		}
+		if target < current {
+			return fmt.Errorf("%s is already at version %d", *dataDir, current)
+		}
+		return migrateTo(*dataDir, target, logf)
+	case "down":
+		if target < 0 {
+			target = current - 1
+		}
+		if target > current || target < 0 {
+			return fmt.Errorf("%s is at version %d", *dataDir, current)
+		}
+		return migrateTo(*dataDir, target, logf)
+	case "status":
+		for _, m := range migrations {
+			state := "pending"
+			if m.version <= current {
+				state = "applied"
+			}
+			fmt.Printf("%3d  %-8s %s\n", m.version, state, m.name)
+		}
+		return nil
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown action %q", flags.Arg(0))
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// classifier scores how toxic a message is, from 0 (not at all) to 1 (very).
+// Any classification service can be used by implementing it.
+type classifier interface {
+	toxicity(ctx context.Context, text string) (float64, error)
+}
+
+// What is done with messages scored over the room's toxicity threshold.
+const (
+	// moderationHold holds them back until a moderator approves them.
+	moderationHold = "hold"
+	// moderationFlag sends them, flagged, and tells the moderators.
+	moderationFlag = "flag"
+	// moderationDrop doesn't send them at all.
+	moderationDrop = "drop"
+)
+
+const (
+	// classifyTimeout is how long the classification service has to answer.
+	classifyTimeout = 5 * time.Second
+
+	// maxHeld is the most messages that can be waiting for review at once.
+	maxHeld = 100
+)
+
+// moderation checks the messages sent to a room with a classifier before
+// they are sent on. It is called from each client's own reading goroutine,
+// so the room's run loop never waits on the classifier, and each client's
+// messages still arrive in the order it sent them.
+type moderation struct {
+	room       *room
+	classifier classifier
+
+	// threshold and action can be changed while messages are checked, so
+	// are guarded by mu, as are held, the messages waiting for a
+	// moderator's review, by the number moderators refer to them with.
+	mu        sync.Mutex
+	threshold float64
+	action    string
+	held      map[int]*heldMessage
+	nextHeld  int
+}
+
+// heldMessage is a message held for review, with the score that got it held.
+type heldMessage struct {
+	msg   *message
+	score float64
+}
+
+// newModeration makes moderation for r, which does action with messages the
+// classifier scores over threshold.
+func newModeration(r *room, c classifier, threshold float64, action string) (*moderation, error) {
+	if err := checkModerationAction(action); err != nil {
+		return nil, err
+	}
+	return &moderation{
+		room:       r,
+		classifier: c,
+		threshold:  threshold,
+		action:     action,
+		held:       make(map[int]*heldMessage),
+	}, nil
+}
+
+// checkModerationAction reports whether action is something moderation can
+// do with toxic messages.
+func checkModerationAction(action string) error {
+	switch action {
+	case moderationHold, moderationFlag, moderationDrop:
+		return nil
+	}
+	return fmt.Errorf("unknown moderation action %q: use hold, flag or drop", action)
+}
+
+// setPolicy changes the threshold, and what is done with messages scored
+// over it, for messages checked from now on.
+func (m *moderation) setPolicy(threshold float64, action string) error {
+	if err := checkModerationAction(action); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.threshold = threshold
+	m.action = action
+	return nil
+}
+
+// check scores a message from c, reporting whether it may be sent to the room
+// now. If the classifier fails the message is let through, so that an
+// outage of the service doesn't stop the chat.
+func (m *moderation) check(c *client, msg *message) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), classifyTimeout)
+	defer cancel()
+	score, err := m.classifier.toxicity(ctx, msg.Message)
+	if err != nil {
+		log.Println("Failed to classify message:", err)
+		return true
+	}
+	m.mu.Lock()
+	threshold, action := m.threshold, m.action
+	m.mu.Unlock()
+	if score < threshold {
+		return true
+	}
+	switch action {
+	case moderationFlag:
+		msg.Flagged = true
+		m.room.alertModerators(fmt.Sprintf("A message from %s was flagged (toxicity %.2f): %s", msg.Name, score, msg.Message))
+		return true
+	case moderationHold:
+		m.mu.Lock()
+		if len(m.held) >= maxHeld {
+			m.mu.Unlock()
+			c.reply("Your message was not sent: it needs a moderator's review, and they have too many to review")
+			return false
+		}
+		m.nextHeld++
+		n := m.nextHeld
+		m.held[n] = &heldMessage{msg: msg, score: score}
+		m.mu.Unlock()
+		c.reply("Your message has been held for a moderator to review")
+		m.room.alertModerators(fmt.Sprintf("A message from %s is held for review as #%d (toxicity %.2f): %s; use /approve %d or /reject %d",
+			msg.Name, n, score, msg.Message, n, n))
+		return false
+	default:
+		c.reply("Your message was not sent, because it looks abusive")
+		return false
+	}
+}
+
+// review takes the held message numbered n out of the queue.
+func (m *moderation) review(n int) *heldMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.held[n]
+	delete(m.held, n)
+	return h
+}
+
+// heldCommand is /held, which lists the messages held for review.
+func heldCommand(c *client, args string) error {
+	m := c.room.moderation
+	if m == nil {
+		return errors.New("messages aren't moderated here")
+	}
+	m.mu.Lock()
+	var ns []int
+	for n := range m.held {
+		ns = append(ns, n)
+	}
+	sort.Ints(ns)
+	var list strings.Builder
+	for _, n := range ns {
+		h := m.held[n]
+		fmt.Fprintf(&list, "\n#%d %s (toxicity %.2f): %s", n, h.msg.Name, h.score, h.msg.Message)
+	}
+	m.mu.Unlock()
+	if len(ns) == 0 {
+		c.reply("No messages are held for review")
+		return nil
+	}
+	c.replyf("Held for review:%s", list.String())
+	return nil
+}
+
+// reviewCommand is /approve, which sends a held message on to the room after
+// all, or /reject, which throws it away.
+func reviewCommand(approve bool) func(c *client, args string) error {
+	return func(c *client, args string) error {
+		m := c.room.moderation
+		if m == nil {
+			return errors.New("messages aren't moderated here")
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(args), "#"))
+		if err != nil {
+			return errUsage
+		}
+		h := m.review(n)
+		if h == nil {
+			return fmt.Errorf("there is no message #%d held for review", n)
+		}
+		if approve {
+			// a held edit changes the message it edits, rather than being
+			// sent as a new one.
+			if h.msg.Edited != nil {
+				c.room.changes <- editEvent(h.msg)
+			} else {
+				c.room.forward <- h.msg
+			}
+		}
+		c.reply("OK")
+		return nil
+	}
+}
+
+// perspective is a classifier using Google's Perspective API.
+type perspective struct {
+	apiKey string
+	client *http.Client
+}
+
+// newPerspective makes a classifier using the Perspective API with the given
+// key.
+func newPerspective(apiKey string) *perspective {
+	return &perspective{apiKey: apiKey, client: &http.Client{Timeout: classifyTimeout}}
+}
+
+func (p *perspective) toxicity(ctx context.Context, text string) (float64, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"comment":             map[string]string{"text": text},
+		"requestedAttributes": map[string]interface{}{"TOXICITY": struct{}{}},
+		"doNotStore":          true,
+	})
+	req, err := http.NewRequest("POST",
+		"https://commentanalyzer.googleapis.com/v1alpha1/comments:analyze?key="+p.apiKey, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		AttributeScores struct {
+			Toxicity struct {
+				SummaryScore struct {
+					Value float64 `json:"value"`
+				} `json:"summaryScore"`
+			} `json:"TOXICITY"`
+		} `json:"attributeScores"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	if result.Error != nil {
+		return 0, errors.New(result.Error.Message)
+	}
+	return result.AttributeScores.Toxicity.SummaryScore.Value, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// mongoDB keeps rooms and accounts in a MongoDB database, for teams that
+// already run one. Rooms' events are kept in the events collection, their
+// snapshots in snapshots and accounts in accounts, each document holding
+// what is kept as JSON, as it would be in the -data directory.
+//
+// The events collection can be capped, keeping only the most recent history
+// in a fixed amount of space, or have a TTL index, keeping each event for a
+// while. Either way, events are only needed to restore a room until its next
+// snapshot, so they must be kept for longer than -snapshot-interval; older
+// ones are only history for exports.
+type mongoDB struct {
+	events    *mongo.Collection
+	snapshots *mongo.Collection
+	accounts  *mongo.Collection
+}
+
+// mongoTimeout is how long a request to MongoDB may take.
+const mongoTimeout = 30 * time.Second
+
+// openMongoDB connects to the MongoDB server at uri, using the database
+// called name. If the events collection doesn't exist yet, it is created
+// capped at cappedSize bytes, unless that is 0. If retention isn't 0, events
+// expire once they are that old, which a capped collection can't do.
+func openMongoDB(uri, name string, cappedSize int64, retention time.Duration) (*mongoDB, error) {
+	if cappedSize > 0 && retention > 0 {
+		return nil, errors.New("the events collection can't be both capped and have events expire")
+	}
+	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	if err := client.Ping(ctx, nil); err != nil {
+		return nil, err
+	}
+	db := client.Database(name)
+	m := &mongoDB{events: db.Collection("events"), snapshots: db.Collection("snapshots"), accounts: db.Collection("accounts")}
+
+	if cappedSize > 0 {
+		existing, err := db.ListCollectionNames(ctx, bson.D{{Key: "name", Value: "events"}})
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) == 0 {
+			err := db.CreateCollection(ctx, "events", options.CreateCollection().SetCapped(true).SetSizeInBytes(cappedSize))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	indexes := []mongo.IndexModel{{
+		Keys:    bson.D{{Key: "room", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}}
+	if retention > 0 {
+		indexes = append(indexes, mongo.IndexModel{
+			Keys:    bson.D{{Key: "when", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(retention / time.Second)),
+		})
+	}
+	if _, err := m.events.Indexes().CreateMany(ctx, indexes); err != nil {
+		return nil, fmt.Errorf("indexing events: %v", err)
+	}
+	return m, nil
+}
+
+// mongoEvent is how an event is kept in the events collection.
+type mongoEvent struct {
+	Room  string    `bson:"room"`
+	Seq   int64     `bson:"seq"`
+	When  time.Time `bson:"when"`
+	Type  string    `bson:"type"`
+	Event string    `bson:"event"`
+}
+
+// openJournal returns the journal of the room with the given key, along with
+// the room's state restored from it.
+func (m *mongoDB) openJournal(room string) (journal, *roomState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	var snapshot struct {
+		State string `bson:"state"`
+	}
+	state := newRoomState()
+	err := m.snapshots.FindOne(ctx, bson.D{{Key: "_id", Value: room}}).Decode(&snapshot)
+	switch {
+	case err == nil:
+		if state, err = decodeSnapshot([]byte(snapshot.State)); err != nil {
+			return nil, nil, err
+		}
+	case !errors.Is(err, mongo.ErrNoDocuments):
+		return nil, nil, err
+	}
+	j := &mongoJournal{m: m, room: room}
+	if err := j.eventsAfter(state.Seq, func(e *roomEvent) error {
+		state.apply(e)
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	return j, state, nil
+}
+
+// mongoJournal is the journal of a room kept in MongoDB.
+type mongoJournal struct {
+	m    *mongoDB
+	room string
+}
+
+func (j *mongoJournal) append(e *roomEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err = j.m.events.InsertOne(ctx, &mongoEvent{Room: j.room, Seq: int64(e.Seq), When: e.When, Type: e.Type, Event: string(b)})
+	return err
+}
+
+func (j *mongoJournal) snapshot(state *roomState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err = j.m.snapshots.ReplaceOne(ctx,
+		bson.D{{Key: "_id", Value: j.room}},
+		bson.D{{Key: "_id", Value: j.room}, {Key: "state", Value: string(b)}, {Key: "taken", Value: time.Now()}},
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+func (j *mongoJournal) events(fn func(e *roomEvent) error) error {
+	return j.eventsAfter(0, fn)
+}
+
+func (j *mongoJournal) prune(before uint64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := j.m.events.DeleteMany(ctx, bson.D{
+		{Key: "room", Value: j.room},
+		{Key: "seq", Value: bson.D{{Key: "$lt", Value: int64(before)}}},
+		{Key: "type", Value: bson.D{{Key: "$in", Value: bson.A{eventMessage, eventEdit}}}},
+	})
+	return err
+}
+
+func (j *mongoJournal) forget(seqs []uint64) error {
+	in := make(bson.A, len(seqs))
+	for i, seq := range seqs {
+		in[i] = int64(seq)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := j.m.events.DeleteMany(ctx, bson.D{
+		{Key: "room", Value: j.room},
+		{Key: "seq", Value: bson.D{{Key: "$in", Value: in}}},
+		{Key: "type", Value: bson.D{{Key: "$in", Value: bson.A{eventMessage, eventEdit}}}},
+	})
+	return err
+}
+
+// eventsAfter calls fn with every event kept that was logged after the one
+// numbered seq.
+func (j *mongoJournal) eventsAfter(seq uint64, fn func(e *roomEvent) error) error {
+	// exports may take a while to stream them all.
+	ctx := context.Background()
+	cursor, err := j.m.events.Find(ctx,
+		bson.D{{Key: "room", Value: j.room}, {Key: "seq", Value: bson.D{{Key: "$gt", Value: int64(seq)}}}},
+		options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc mongoEvent
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		var e roomEvent
+		if err := json.Unmarshal([]byte(doc.Event), &e); err != nil {
+			return err
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (m *mongoDB) loadAccounts() ([]*account, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	cursor, err := m.accounts.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	var accounts []*account
+	for cursor.Next(ctx) {
+		var doc struct {
+			Account string `bson:"account"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		var a account
+		if err := json.Unmarshal([]byte(doc.Account), &a); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, &a)
+	}
+	return accounts, cursor.Err()
+}
+
+func (m *mongoDB) saveAccount(a *account) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err = m.accounts.ReplaceOne(ctx,
+		bson.D{{Key: "_id", Value: a.ID}},
+		bson.D{{Key: "_id", Value: a.ID}, {Key: "account", Value: string(b)}},
+		options.Replace().SetUpsert(true))
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttBridge connects a room to an MQTT broker. Payloads published to any
+// of the subscribed topics are posted to the room as bot messages named after
+// the topic, so devices and dashboards can feed the chat. Optionally, every
+// message posted in the room is published, as JSON, to a topic of its own.
+type mqttBridge struct {
+	// room is the room the broker is bridged with.
+	room *room
+
+	// client is the bridge's membership of the room.
+	client *client
+
+	// topics are the topics whose payloads are posted to the room.
+	topics []string
+
+	// publishTopic is where room messages are published, or empty if they
+	// should not be published.
+	publishTopic string
+
+	conn mqtt.Client
+}
+
+// newMQTTBridge makes a bridge between the MQTT broker (e.g.
+// tcp://localhost:1883) and the room r.
+func newMQTTBridge(broker string, topics []string, publishTopic string, r *room) *mqttBridge {
+	b := &mqttBridge{
+		room: r,
+		client: &client{
+			send:     make(chan *message, messageBufferSize),
+			room:     r,
+			userData: map[string]interface{}{"name": "mqtt"},
+		},
+		topics:       topics,
+		publishTopic: publishTopic,
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(fmt.Sprintf("chat-%d", os.Getpid())).
+		SetAutoReconnect(true).
+		// Subscriptions do not survive a reconnect with a clean session, so
+		// (re)subscribe every time we connect.
+		SetOnConnectHandler(b.subscribe)
+	b.conn = mqtt.NewClient(opts)
+	return b
+}
+
+// run connects to the broker and joins the room. Once connected, the MQTT
+// client reconnects by itself if the broker goes away.
+func (b *mqttBridge) run() error {
+	if token := b.conn.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	b.room.join <- b.client
+	go b.relay()
+	return nil
+}
+
+// subscribe subscribes to all of the bridge's topics.
+func (b *mqttBridge) subscribe(c mqtt.Client) {
+	for _, topic := range b.topics {
+		if token := c.Subscribe(topic, 0, b.inject); token.Wait() && token.Error() != nil {
+			log.Println("MQTT subscribe to", topic, "failed:", token.Error())
+		}
+	}
+}
+
+// inject posts an MQTT payload to the room as a message from its topic.
+func (b *mqttBridge) inject(c mqtt.Client, m mqtt.Message) {
+	b.room.forward <- &message{
+		Name:    m.Topic(),
+		Message: string(m.Payload()),
+		When:    time.Now(),
+		from:    b.client,
+	}
+}
+
+// relay publishes messages from the room to the publish topic, except the
+// ones that came from MQTT in the first place. When there is nowhere to
+// publish to, messages are simply drained so the room never has to drop us.
+func (b *mqttBridge) relay() {
+	for msg := range b.client.send {
+		// MQTT doesn't use the prepared websocket frame.
+		msg.release()
+		if b.publishTopic == "" || msg.from == b.client || !msg.relayable() {
+			continue
+		}
+		payload, err := json.Marshal(msg.public())
+		if err != nil {
+			log.Println("MQTT marshal:", err)
+			continue
+		}
+		b.conn.Publish(b.publishTopic, 0, false, payload)
+	}
+}
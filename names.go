@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// nameClaim records which account is using a display name in a room, and
+// from how many connections, since the same person may well have the chat
+// open in more than one tab.
+type nameClaim struct {
+	account string
+	name    string
+	clients int
+}
+
+// nameKey is what display names are compared by, so that "Alex" and "alex"
+// count as the same name.
+func nameKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// claimName gives the name to a connection of the account, reporting whether
+// it could: a name somebody else in the room is already using is taken. It
+// is only called from the room's run loop.
+func (r *room) claimName(name, account string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := nameKey(name)
+	claim, ok := r.names[key]
+	switch {
+	case !ok:
+		r.names[key] = &nameClaim{account: account, name: name, clients: 1}
+	case claim.account != account:
+		return false
+	default:
+		claim.clients++
+	}
+	if r.presence != nil {
+		r.presence.arrived(r.key(), account, name)
+	}
+	return true
+}
+
+// releaseName gives up a connection's claim to the name, freeing the name
+// once none of the account's connections are using it.
+func (r *room) releaseName(name, account string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := nameKey(name)
+	if claim, ok := r.names[key]; ok && claim.account == account {
+		if claim.clients--; claim.clients <= 0 {
+			delete(r.names, key)
+		}
+		if r.presence != nil {
+			r.presence.left(r.key(), account, name)
+		}
+	}
+}
+
+// accountNamed returns the account of whoever goes by name in the room, or
+// the empty string if nobody in the room does.
+func (r *room) accountNamed(name string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if claim, ok := r.names[nameKey(name)]; ok {
+		return claim.account
+	}
+	return ""
+}
+
+// maxNameLength is the longest display name, in characters, anybody may
+// pick for themselves.
+const maxNameLength = 32
+
+// validName checks that name is fit to be somebody's display name.
+func validName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("a name can't be empty")
+	case utf8.RuneCountInString(name) > maxNameLength:
+		return fmt.Errorf("a name can't be longer than %d characters", maxNameLength)
+	case strings.HasPrefix(name, "/"):
+		return errors.New("a name can't start with /")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return errors.New("a name can't contain control characters")
+		}
+	}
+	return nil
+}
+
+// renameRequest asks the room to change a client's name, and done is where
+// the room answers.
+type renameRequest struct {
+	client *client
+	name   string
+	done   chan error
+}
+
+// rename changes the name c goes by in the room, waiting for the room to do
+// so. Everyone in the room is told about the change.
+func (r *room) rename(c *client, name string) error {
+	req := &renameRequest{client: c, name: name, done: make(chan error, 1)}
+	r.renames <- req
+	return <-req.done
+}
+
+// changeName carries out a rename request. It is only called from the
+// room's run loop, which is what makes it safe to change the client's name:
+// the only other goroutine that reads it is the client's reader, which is
+// waiting for the answer.
+func (r *room) changeName(c *client, name string) error {
+	old := c.name()
+	if _, ok := r.clients[c]; !ok {
+		return errors.New("you are not in the room")
+	}
+	// bans are by account, so going by another name doesn't get around
+	// one; people who haven't signed in are known by their name, so can't
+	// take one that is banned either.
+	id, _ := c.userData["id"].(string)
+	if r.state.Banned[c.account()] || (id == "" && r.state.Banned["name:"+name]) {
+		return errors.New("you have been banned from the room")
+	}
+	if !r.claimName(name, c.account()) {
+		return fmt.Errorf("somebody is already called %s", name)
+	}
+	r.releaseName(old, c.account())
+	c.userData["name"] = name
+	if id != "" && r.users != nil {
+		// The next time they connect, they should still go by the new name.
+		if err := r.users.rename(id, name); err != nil {
+			log.Println("Failed to save new name:", err)
+		}
+	}
+	e := &roomEvent{Type: eventNick, Name: old, Message: name, When: time.Now()}
+	r.record(e)
+	r.deliver(nickMessage(e))
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestNickKeepsBan checks that /nick is no way around a ban: the banned keep
+// their ban under any name, and nobody who hasn't signed in can take a
+// banned name.
+func TestNickKeepsBan(t *testing.T) {
+	r := newRoom(1)
+	go r.run()
+	r.changes <- &roomEvent{Type: eventHidePresence}
+	join := func(userData map[string]interface{}) *client {
+		c := &client{send: make(chan *message, 64), room: r, userData: userData}
+		r.join <- c
+		return c
+	}
+	mallory := join(map[string]interface{}{"id": "github:42", "name": "mallory"})
+	guest := join(map[string]interface{}{"name": "guest"})
+	r.ban("github:42")
+	r.ban("name:eve")
+	for !r.banned("name:eve") {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := r.rename(mallory, "totally not mallory"); err == nil || !strings.Contains(err.Error(), "banned") {
+		t.Errorf("a banned account renamed itself: %v", err)
+	}
+	if err := r.rename(guest, "eve"); err == nil || !strings.Contains(err.Error(), "banned") {
+		t.Errorf("a guest took a banned name: %v", err)
+	}
+	if err := r.rename(guest, "ada"); err != nil {
+		t.Errorf("a guest couldn't take a name nobody has: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsInstanceHeader is the header carrying the instance that published a
+// message, so an instance can ignore its own messages coming back.
+const natsInstanceHeader = "Chat-Instance"
+
+// natsBackplane is a backplane that shares a room's messages between
+// instances of the chat server through a NATS JetStream stream.
+//
+// Each instance broadcasts messages from its own clients locally straight
+// away and publishes them to the stream. Each instance also reads the stream
+// through a durable consumer of its own, forwarding messages published by
+// other instances to its room. Because the consumer is durable and messages
+// are only acknowledged once they have been forwarded, an instance that
+// briefly loses its connection picks up where it left off: delivery between
+// instances is at-least-once.
+type natsBackplane struct {
+	js       nats.JetStreamContext
+	subject  string
+	instance string
+	room     *room
+
+	// seq numbers the messages we publish, giving each a unique ID that
+	// JetStream uses to discard duplicate publishes.
+	seq uint64
+}
+
+// natsStreamMaxAge is how long messages are kept in the stream, which bounds
+// how long an instance can be away and still catch up.
+const natsStreamMaxAge = time.Hour
+
+// newNATSBackplane connects to the NATS server at url, makes sure the stream
+// exists and starts consuming it on behalf of the room r. The instance name
+// must be unique to this server, and is used as the name of its durable
+// consumer.
+func newNATSBackplane(url, stream, subject, instance string, r *room) (*natsBackplane, error) {
+	nc, err := nats.Connect(url, nats.Name("chat-"+instance), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := js.StreamInfo(stream); err == nats.ErrStreamNotFound {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     stream,
+			Subjects: []string{subject},
+			MaxAge:   natsStreamMaxAge,
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	b := &natsBackplane{
+		js:       js,
+		subject:  subject,
+		instance: instance,
+		room:     r,
+	}
+	_, err = js.Subscribe(subject, b.receive,
+		// Consumer names may not contain dots, which host names often do.
+		nats.Durable(strings.ReplaceAll(instance, ".", "_")),
+		nats.ManualAck(),
+		nats.DeliverNew(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// publish sends a message from one of our clients to the other instances.
+// It is called from the room's run loop, so it publishes asynchronously.
+func (b *natsBackplane) publish(msg *message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("NATS marshal:", err)
+		return
+	}
+	m := nats.NewMsg(b.subject)
+	m.Data = data
+	m.Header.Set(natsInstanceHeader, b.instance)
+	id := fmt.Sprintf("%s-%d", b.instance, atomic.AddUint64(&b.seq, 1))
+	if _, err := b.js.PublishMsgAsync(m, nats.MsgId(id)); err != nil {
+		log.Println("NATS publish:", err)
+	}
+}
+
+// receive forwards a message published by another instance to our room.
+func (b *natsBackplane) receive(m *nats.Msg) {
+	if m.Header.Get(natsInstanceHeader) != b.instance {
+		msg := &message{}
+		if err := json.Unmarshal(m.Data, msg); err != nil {
+			log.Println("NATS unmarshal:", err)
+		} else {
+			msg.remote = true
+			b.room.forward <- msg
+		}
+	}
+	if err := m.Ack(); err != nil {
+		log.Println("NATS ack:", err)
+	}
+}
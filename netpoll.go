@@ -0,0 +1,345 @@
+//go:build linux && netpoll
+// +build linux,netpoll
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/gorilla/websocket"
+	"golang.org/x/sys/unix"
+)
+
+// netpollIOTimeout bounds how long reading or writing a single message may
+// take, so a client that stalls part way through can't hold a goroutine.
+const netpollIOTimeout = 10 * time.Second
+
+// pollHandler is an alternative to the room's own ServeHTTP, for nodes that
+// need to hold a very large number of mostly idle connections.
+//
+// The usual transport keeps two goroutines, and gorilla's read and write
+// buffers, alive for every connection. pollHandler upgrades connections with
+// gobwas/ws, which keeps no buffers of its own, and watches them with epoll
+// instead: a goroutine is only started to read a message once one arrives,
+// and to write messages once the room queues them, so an idle connection
+// costs nothing but its socket.
+type pollHandler struct {
+	room   *room
+	poller *epoller
+}
+
+// newPollHandler makes a handler serving websockets for r using epoll.
+func newPollHandler(r *room) (http.Handler, error) {
+	poller, err := newEpoller()
+	if err != nil {
+		return nil, err
+	}
+	return &pollHandler{room: r, poller: poller}, nil
+}
+
+func (h *pollHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	userData, err := h.room.userData(req)
+	if err != nil {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return
+	}
+	upgrader := ws.HTTPUpgrader{Protocol: func(p string) bool { return wireFormatFor(p).subprotocol == p }}
+	conn, _, hs, err := upgrader.Upgrade(req, w)
+	if err != nil {
+		log.Println("netpoll upgrade:", err)
+		return
+	}
+	fd, err := connFD(conn)
+	if err != nil {
+		log.Println("netpoll:", err)
+		conn.Close()
+		return
+	}
+
+	c := &pollConn{
+		conn:    conn,
+		fd:      fd,
+		poller:  h.poller,
+		release: takeConnSlot(req),
+	}
+	c.client = &client{
+		send:     make(chan *message, messageBufferSize),
+		room:     h.room,
+		userData: userData,
+		country:  requestCountry(req),
+		locale:   clientLocale(req, userData),
+		wire:     wireFormatFor(hs.Protocol),
+		wake:     c.wake,
+	}
+	h.room.join <- c.client
+	if err := h.poller.add(fd, c.readable); err != nil {
+		log.Println("netpoll:", err)
+		c.close()
+	}
+}
+
+// pollConn is a single websocket connection watched by epoll.
+type pollConn struct {
+	conn   net.Conn
+	fd     int
+	poller *epoller
+	client *client
+
+	// mu serialises writing frames, which happens both when draining the
+	// send channel and when answering control frames.
+	mu sync.Mutex
+
+	// draining is set while a goroutine is writing out the send channel, and
+	// pending is set by wake to make sure it looks again before stopping.
+	draining int32
+	pending  int32
+
+	// release gives back the connection's place in the per-IP limits once
+	// it has closed.
+	release func()
+
+	closeOnce sync.Once
+}
+
+// readable is called by the poller when the connection has something to
+// read, or has been hung up.
+func (c *pollConn) readable(events uint32) {
+	if events&(unix.EPOLLHUP|unix.EPOLLERR) != 0 {
+		go c.close()
+		return
+	}
+	go func() {
+		if err := c.readFrame(); err != nil {
+			c.close()
+			return
+		}
+		if err := c.poller.rearm(c.fd); err != nil {
+			c.close()
+		}
+	}()
+}
+
+// readFrame reads and handles the next frame from the connection. Control
+// frames are answered, and messages are sent to the room.
+func (c *pollConn) readFrame() error {
+	c.conn.SetReadDeadline(time.Now().Add(netpollIOTimeout))
+	limit := c.client.room.maxMessageSize
+	rd := &wsutil.Reader{
+		Source:       c.conn,
+		State:        ws.StateServerSide,
+		CheckUTF8:    true,
+		MaxFrameSize: limit,
+	}
+	hdr, err := rd.NextFrame()
+	if err == wsutil.ErrFrameTooLarge {
+		c.closeWith(ws.StatusMessageTooBig, closeReason{Error: "message_too_big", Limit: limit})
+		return errMessageTooBig
+	} else if err != nil {
+		return err
+	}
+	if hdr.OpCode.IsControl() {
+		// Build the reply first, so it can be written in one go.
+		reply := new(bytes.Buffer)
+		err := wsutil.ControlFrameHandler(reply, ws.StateServerSide)(hdr, rd)
+		c.mu.Lock()
+		c.conn.Write(reply.Bytes())
+		c.mu.Unlock()
+		return err
+	}
+
+	var src io.Reader = rd
+	if limit > 0 {
+		src = io.LimitReader(rd, limit+1)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(src); err != nil {
+		return err
+	}
+	if limit > 0 && int64(buf.Len()) > limit {
+		c.closeWith(ws.StatusMessageTooBig, closeReason{Error: "message_too_big", Limit: limit})
+		return errMessageTooBig
+	}
+	msg, err := c.client.wire.decode(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	c.client.receive(msg)
+	return nil
+}
+
+// wake is called whenever the room queues a message for the client or closes
+// its send channel, and makes sure a goroutine is draining the channel.
+func (c *pollConn) wake() {
+	atomic.StoreInt32(&c.pending, 1)
+	if atomic.CompareAndSwapInt32(&c.draining, 0, 1) {
+		go c.drain()
+	}
+}
+
+// drain writes out everything queued on the send channel, then stops. If the
+// channel has been closed, the connection is closed.
+func (c *pollConn) drain() {
+	for {
+		atomic.StoreInt32(&c.pending, 0)
+		for done := false; !done; {
+			select {
+			case msg, ok := <-c.client.send:
+				if !ok {
+					if c.client.rejected != nil {
+						c.closeWith(ws.StatusCode(c.client.rejected.code()), *c.client.rejected)
+					}
+					c.close()
+					return
+				}
+				err := c.write(msg)
+				msg.release()
+				if err != nil {
+					c.close()
+				}
+			default:
+				done = true
+			}
+		}
+		atomic.StoreInt32(&c.draining, 0)
+		// If wake was called since we last looked, and nobody else has
+		// started draining since, go round again.
+		if atomic.LoadInt32(&c.pending) == 0 || !atomic.CompareAndSwapInt32(&c.draining, 0, 1) {
+			return
+		}
+	}
+}
+
+// write sends a message down the connection, reusing the encoding the room
+// prepared if there is one.
+func (c *pollConn) write(msg *message) error {
+	wire := c.client.wire
+	frame, err := msg.frame(wire)
+	if err != nil {
+		return err
+	}
+	defer frame.release()
+	op := ws.OpText
+	if wire.frameType == websocket.BinaryMessage {
+		op = ws.OpBinary
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(netpollIOTimeout))
+	return wsutil.WriteServerMessage(c.conn, op, frame.data)
+}
+
+// closeWith sends a close frame with the given code and structured reason.
+func (c *pollConn) closeWith(code ws.StatusCode, reason closeReason) {
+	text, _ := json.Marshal(reason)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	ws.WriteFrame(c.conn, ws.NewCloseFrame(ws.NewCloseFrameBody(code, string(text))))
+}
+
+// close stops watching the connection, closes it and leaves the room.
+func (c *pollConn) close() {
+	c.closeOnce.Do(func() {
+		c.poller.remove(c.fd)
+		c.conn.Close()
+		c.release()
+		c.client.room.leave <- c.client
+	})
+}
+
+// connFD returns the file descriptor of conn, which must be a plain TCP
+// connection; TLS connections buffer data of their own, so readiness of the
+// socket says nothing about whether a message can be read.
+func connFD(conn net.Conn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, errors.New("connection has no file descriptor")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd int
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+// epoller watches file descriptors with epoll, calling a handler when one
+// becomes readable. Descriptors are watched one-shot: after its handler has
+// been called, a descriptor is not watched again until it is rearmed, so
+// only one goroutine ever reads from a connection at a time.
+type epoller struct {
+	fd int
+
+	mu       sync.Mutex
+	handlers map[int]func(events uint32)
+}
+
+const epollEvents = unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLONESHOT
+
+// newEpoller makes an epoller and starts it waiting for events.
+func newEpoller() (*epoller, error) {
+	fd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	e := &epoller{fd: fd, handlers: make(map[int]func(uint32))}
+	go e.wait()
+	return e, nil
+}
+
+// add starts watching fd, calling h when it becomes readable.
+func (e *epoller) add(fd int, h func(events uint32)) error {
+	e.mu.Lock()
+	e.handlers[fd] = h
+	e.mu.Unlock()
+	return unix.EpollCtl(e.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: epollEvents, Fd: int32(fd)})
+}
+
+// rearm watches fd again after its handler has been called.
+func (e *epoller) rearm(fd int) error {
+	return unix.EpollCtl(e.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Events: epollEvents, Fd: int32(fd)})
+}
+
+// remove stops watching fd.
+func (e *epoller) remove(fd int) {
+	unix.EpollCtl(e.fd, unix.EPOLL_CTL_DEL, fd, nil)
+	e.mu.Lock()
+	delete(e.handlers, fd)
+	e.mu.Unlock()
+}
+
+func (e *epoller) wait() {
+	events := make([]unix.EpollEvent, 256)
+	for {
+		n, err := unix.EpollWait(e.fd, events, -1)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			log.Fatal("epoll_wait:", err)
+		}
+		for _, ev := range events[:n] {
+			e.mu.Lock()
+			h := e.handlers[int(ev.Fd)]
+			e.mu.Unlock()
+			if h != nil {
+				h(ev.Events)
+			}
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux || !netpoll
+// +build !linux !netpoll
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// newPollHandler is only available on Linux, in binaries built with the
+// netpoll build tag.
+func newPollHandler(r *room) (http.Handler, error) {
+	return nil, errors.New("netpoll transport not available: build on linux with -tags netpoll")
+}
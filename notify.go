@@ -0,0 +1,98 @@
+package main
+
+import "time"
+
+// Kinds of notification.
+const (
+	notifyMention = "mention"
+	notifyKeyword = "keyword"
+	notifyMessage = "message"
+)
+
+// notification tells somebody about a message they may want to see, but
+// weren't in the room to see for themselves.
+type notification struct {
+	// Account is who is being notified, and Kind why.
+	Account string
+	Kind    string
+
+	// Room is the name of the room the message was sent to, and ID, Name,
+	// Message and When are those of the message.
+	Room    string
+	ID      uint64
+	Name    string
+	Message string
+	When    time.Time
+}
+
+// notifier delivers notifications, by push, email or whatever else. Like the
+// tracer and event sink, notify is called from inside the room's run loop, so
+// it must not block.
+type notifier interface {
+	notify(n *notification)
+}
+
+type nilNotifier struct{}
+
+func (nilNotifier) notify(n *notification) {}
+
+// notifyOff is a notifier that drops every notification.
+func notifyOff() notifier {
+	return nilNotifier{}
+}
+
+// notifiers delivers every notification by each of several notifiers, such as
+// by email and by text.
+type notifiers []notifier
+
+func (ns notifiers) notify(n *notification) {
+	for _, next := range ns {
+		next.notify(n)
+	}
+}
+
+// notifyAbsent notifies the people who want to hear about msg but aren't in
+// the room to see it: those it mentions, those watching for a word in it,
+// and those who want to hear about every message in the room. Nobody is
+// notified twice about one message, about their own messages, or about
+// messages from people they have blocked. It is only called from the room's
+// run loop.
+func (r *room) notifyAbsent(msg *message) {
+	sender := msg.sender()
+	notified := map[string]bool{sender: true}
+	send := func(account, kind string) {
+		if notified[account] || r.present(account) {
+			return
+		}
+		// nobody hears about rooms in organizations they aren't in.
+		if r.org != nil && !r.org.member(account) {
+			return
+		}
+		notified[account] = true
+		if r.users != nil {
+			if a := r.users.get(account); a != nil && contains(a.Blocked, sender) {
+				return
+			}
+		}
+		r.notifier.notify(&notification{
+			Account: account,
+			Kind:    kind,
+			Room:    r.key(),
+			ID:      msg.ID,
+			Name:    msg.Name,
+			Message: msg.Message,
+			When:    msg.When,
+		})
+	}
+	for _, account := range msg.Mentions {
+		send(account, notifyMention)
+	}
+	if r.users != nil {
+		for _, account := range r.users.watchers(msg.Message) {
+			send(account, notifyKeyword)
+		}
+		for _, account := range r.users.everythingIn(r.key()) {
+			send(account, notifyMessage)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/stretchr/gomniauth"
+	"github.com/stretchr/gomniauth/common"
+	"github.com/stretchr/gomniauth/oauth2"
+	"github.com/stretchr/objx"
+)
+
+// oauthProvider is a gomniauth provider for OAuth2 services gomniauth has no
+// provider of its own for. The OAuth2 dance is the same for all of them; all
+// that differs is the endpoints, and how the user's profile maps onto a
+// user.
+type oauthProvider struct {
+	name        string
+	displayName string
+	config      *common.Config
+
+	// profileURL is where the signed in user's profile is fetched from, and
+	// user turns the profile into a user.
+	profileURL string
+	user       func(profile objx.Map) *oauthUser
+
+	tripperFactory common.TripperFactory
+}
+
+// newOAuthProvider makes a provider using the given endpoints and scope.
+func newOAuthProvider(name, displayName, authURL, tokenURL, scope, profileURL string,
+	clientID, clientSecret, redirectURL string, user func(objx.Map) *oauthUser) *oauthProvider {
+	return &oauthProvider{
+		name:        name,
+		displayName: displayName,
+		config: &common.Config{Map: objx.MSI(
+			oauth2.OAuth2KeyAuthURL, authURL,
+			oauth2.OAuth2KeyTokenURL, tokenURL,
+			oauth2.OAuth2KeyClientID, clientID,
+			oauth2.OAuth2KeySecret, clientSecret,
+			oauth2.OAuth2KeyRedirectUrl, redirectURL,
+			oauth2.OAuth2KeyScope, scope,
+			oauth2.OAuth2KeyAccessType, oauth2.OAuth2AccessTypeOnline,
+			oauth2.OAuth2KeyApprovalPrompt, oauth2.OAuth2ApprovalPromptAuto,
+			oauth2.OAuth2KeyResponsetype, oauth2.OAuth2KeyCode)},
+		profileURL: profileURL,
+		user:       user,
+	}
+}
+
+func (p *oauthProvider) Name() string        { return p.name }
+func (p *oauthProvider) DisplayName() string { return p.displayName }
+
+func (p *oauthProvider) TripperFactory() common.TripperFactory {
+	if p.tripperFactory == nil {
+		p.tripperFactory = new(oauth2.OAuth2TripperFactory)
+	}
+	return p.tripperFactory
+}
+
+func (p *oauthProvider) PublicData(options map[string]interface{}) (interface{}, error) {
+	return gomniauth.ProviderPublicData(p, options)
+}
+
+func (p *oauthProvider) GetBeginAuthURL(state *common.State, options objx.Map) (string, error) {
+	return oauth2.GetBeginAuthURLWithBase(p.config.Get(oauth2.OAuth2KeyAuthURL).Str(), state, p.config)
+}
+
+func (p *oauthProvider) Get(creds *common.Credentials, endpoint string) (objx.Map, error) {
+	return oauth2.Get(p, creds, endpoint)
+}
+
+func (p *oauthProvider) GetUser(creds *common.Credentials) (common.User, error) {
+	profile, err := p.Get(creds, p.profileURL)
+	if err != nil {
+		return nil, err
+	}
+	user := p.user(profile)
+	user.provider = p.name
+	user.creds = creds
+	user.data = profile
+	return user, nil
+}
+
+func (p *oauthProvider) CompleteAuth(data objx.Map) (*common.Credentials, error) {
+	return oauth2.CompleteAuth(p.TripperFactory(), data, p.config, p)
+}
+
+func (p *oauthProvider) GetClient(creds *common.Credentials) (*http.Client, error) {
+	return oauth2.GetClient(p.TripperFactory(), creds, p)
+}
+
+// oauthUser is a user signed in through an oauthProvider.
+type oauthUser struct {
+	id        string
+	name      string
+	nickname  string
+	email     string
+	avatarURL string
+
+	// emailVerified is whether the provider has checked that the email
+	// belongs to the user.
+	emailVerified bool
+
+	provider string
+	creds    *common.Credentials
+	data     objx.Map
+}
+
+func (u *oauthUser) Email() string     { return u.email }
+func (u *oauthUser) Name() string      { return u.name }
+func (u *oauthUser) Nickname() string  { return u.nickname }
+func (u *oauthUser) AvatarURL() string { return u.avatarURL }
+func (u *oauthUser) AuthCode() string  { return "" }
+func (u *oauthUser) Data() objx.Map    { return u.data }
+
+func (u *oauthUser) IDForProvider(provider string) string {
+	if provider == u.provider {
+		return u.id
+	}
+	return ""
+}
+
+func (u *oauthUser) ProviderCredentials() map[string]*common.Credentials {
+	return map[string]*common.Credentials{u.provider: u.creds}
+}
+
+func (u *oauthUser) PublicData(options map[string]interface{}) (interface{}, error) {
+	return map[string]interface{}{
+		"name":       u.name,
+		"nickname":   u.nickname,
+		"email":      u.email,
+		"avatar_url": u.avatarURL,
+	}, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// org is an organization: a workspace of its own on a shared server, with
+// rooms, history and admins nobody outside it can see. People sign in once
+// for the whole server, and may belong to any number of organizations.
+//
+// An organization's admins moderate its rooms and manage its members. Only
+// members may use its rooms, unless it is Open to everyone who signs in.
+type org struct {
+	Name    string   `json:"name"`
+	Admins  []string `json:"admins"`
+	Members []string `json:"members,omitempty"`
+	Open    bool     `json:"open,omitempty"`
+
+	// mu guards Members, which admins change while the server runs.
+	mu sync.Mutex
+}
+
+// member reports whether the account may use the organization's rooms.
+func (o *org) member(account string) bool {
+	if o.Open || contains(o.Admins, account) {
+		return true
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return contains(o.Members, account)
+}
+
+// orgStore holds the organizations, kept in orgs.json in the data directory
+// if there is one. Each organization's own data is kept in a directory of
+// its own under orgs/.
+type orgStore struct {
+	dir  string
+	path string
+
+	mu   sync.Mutex
+	orgs map[string]*org
+}
+
+const orgsFile = "orgs.json"
+
+// openOrgStore loads the organizations kept in dir, adding any of names that
+// don't exist yet, with admins as their admins.
+func openOrgStore(dir string, names, admins []string) (*orgStore, error) {
+	s := &orgStore{dir: dir, orgs: make(map[string]*org)}
+	if dir != "" {
+		s.path = filepath.Join(dir, orgsFile)
+		b, err := ioutil.ReadFile(s.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			var orgs []*org
+			if err := json.Unmarshal(b, &orgs); err != nil {
+				return nil, err
+			}
+			for _, o := range orgs {
+				s.orgs[o.Name] = o
+			}
+		}
+	}
+	for _, name := range names {
+		if _, ok := s.orgs[name]; !ok {
+			s.orgs[name] = &org{Name: name, Admins: admins}
+		}
+	}
+	return s, s.save()
+}
+
+// list returns the organizations, by name.
+func (s *orgStore) list() []*org {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	orgs := make([]*org, 0, len(s.orgs))
+	for _, o := range s.orgs {
+		orgs = append(orgs, o)
+	}
+	sort.Slice(orgs, func(i, j int) bool { return orgs[i].Name < orgs[j].Name })
+	return orgs
+}
+
+// dataDir returns the directory the organization's data is kept in, or the
+// empty string if nothing is kept.
+func (s *orgStore) dataDir(o *org) string {
+	if s.dir == "" {
+		return ""
+	}
+	return filepath.Join(s.dir, "orgs", o.Name)
+}
+
+// setMember adds the account to the organization's members, or removes it.
+func (s *orgStore) setMember(o *org, account string, member bool) error {
+	o.mu.Lock()
+	if member && !contains(o.Members, account) {
+		o.Members = append(o.Members, account)
+	} else if !member {
+		for i, m := range o.Members {
+			if m == account {
+				o.Members = append(o.Members[:i:i], o.Members[i+1:]...)
+				break
+			}
+		}
+	}
+	o.mu.Unlock()
+	return s.save()
+}
+
+func (s *orgStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	orgs := s.list()
+	for _, o := range orgs {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+	}
+	return saveJSON(s.path, orgs)
+}
+
+// orgRouter sends each request to the organization it is for, picked by
+// subdomain, as in https://acme.chat.example.com/chat, or by path prefix, as
+// in https://chat.example.com/o/acme/chat. Requests for no organization go
+// to the server's own rooms.
+type orgRouter struct {
+	// domain, if set, is the domain organizations are subdomains of;
+	// otherwise they are picked by path prefix.
+	domain string
+	orgs   map[string]http.Handler
+	root   http.Handler
+}
+
+func (h *orgRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.domain != "" {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if name := strings.TrimSuffix(strings.ToLower(host), "."+h.domain); name != strings.ToLower(host) {
+			if o, ok := h.orgs[name]; ok {
+				o.ServeHTTP(w, r)
+			} else {
+				http.NotFound(w, r)
+			}
+			return
+		}
+	} else if strings.HasPrefix(r.URL.Path, "/o/") {
+		name := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/o/"), "/", 2)[0]
+		if o, ok := h.orgs[name]; ok {
+			http.StripPrefix("/o/"+name, o).ServeHTTP(w, r)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	h.root.ServeHTTP(w, r)
+}
+
+// orgMembersHandler keeps people out of organizations they don't belong to.
+// Requests from nobody in particular are let through, for the handlers to
+// ask them to sign in.
+type orgMembersHandler struct {
+	org  *org
+	next http.Handler
+}
+
+func (h *orgMembersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if account := currentAccountID(r); account != "" && !h.org.member(account) {
+		http.Error(w, "You are not a member of "+h.org.Name+"; ask one of its admins to add you.", http.StatusForbidden)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// OrgMembersOnly wraps the handler of an organization's rooms so that only
+// its members can use them.
+func OrgMembersOnly(o *org, handler http.Handler) http.Handler {
+	return &orgMembersHandler{org: o, next: handler}
+}
+
+// membersHandler serves those who manage an organization's rooms
+// /api/admin/members: GET
+// lists the organization's members, and PUT or DELETE
+// /api/admin/members/{account} adds or removes one.
+type membersHandler struct {
+	orgs  *orgStore
+	org   *org
+	roles *roles
+}
+
+func (h *membersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if requirePermission(w, r, h.roles, permManageRoom) == "" {
+		return
+	}
+	account := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/admin/members"), "/")
+	var err error
+	switch {
+	case r.Method == "GET" && account == "":
+		h.org.mu.Lock()
+		members := append([]string{}, h.org.Members...)
+		h.org.mu.Unlock()
+		writeJSON(w, map[string]interface{}{"admins": h.org.Admins, "members": members, "open": h.org.Open})
+		return
+	case r.Method == "PUT" && account != "":
+		err = h.orgs.setMember(h.org, account, true)
+	case r.Method == "DELETE" && account != "":
+		err = h.orgs.setMember(h.org, account, false)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to save members", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
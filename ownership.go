@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// A room can have an owner of its own, and co-owners, whatever their roles
+// on the server. In the room, they may do anything but manage the server:
+// moderate it, archive it, set its retention policy and so on. Only the
+// owner, or the server's owners, may hand the room to somebody else, or
+// choose its co-owners.
+
+// owns reports whether the account is the room's owner or a co-owner.
+func (r *room) owns(account string) bool {
+	if account == "" {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state.Owner == account || r.state.CoOwners[account]
+}
+
+// allows reports whether the account has the permission in the room, by its
+// role, or by owning the room.
+func (r *room) allows(account string, p permission) bool {
+	if p != permManageServer && r.owns(account) {
+		return true
+	}
+	return r.roles.can(account, p)
+}
+
+// mayChooseOwners reports whether the account may transfer the room, or
+// choose its co-owners.
+func (r *room) mayChooseOwners(account string) bool {
+	r.mu.RLock()
+	owner := r.state.Owner
+	r.mu.RUnlock()
+	return (owner != "" && owner == account) || r.roles.can(account, permOwnRoom)
+}
+
+// with returns the accounts with the permission in the room, by their roles
+// or by owning the room.
+func (r *room) with(p permission) []string {
+	accounts := r.roles.with(p)
+	if p == permManageServer {
+		return accounts
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.state.Owner != "" && !r.roles.can(r.state.Owner, p) {
+		accounts = append(accounts, r.state.Owner)
+	}
+	for account := range r.state.CoOwners {
+		if !r.roles.can(account, p) {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts
+}
+
+// requireRoomPermission is requirePermission for the permissions people have
+// in a room, which its owners have too.
+func requireRoomPermission(w http.ResponseWriter, r *http.Request, room *room, p permission) string {
+	account := currentAccountID(r)
+	if account == "" {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return ""
+	}
+	if !room.allows(account, p) {
+		http.Error(w, errNotAllowed(p).Error(), http.StatusForbidden)
+		return ""
+	}
+	return account
+}
+
+// roomOwners are the room's owner and co-owners, as the API shows them.
+type roomOwners struct {
+	Owner    string   `json:"owner,omitempty"`
+	CoOwners []string `json:"co_owners"`
+}
+
+// owners returns the room's owner and co-owners.
+func (r *room) owners() roomOwners {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	owners := roomOwners{Owner: r.state.Owner, CoOwners: []string{}}
+	for account := range r.state.CoOwners {
+		owners.CoOwners = append(owners.CoOwners, account)
+	}
+	sort.Strings(owners.CoOwners)
+	return owners
+}
+
+// ownerNotice is the system message telling everybody about e, a change of
+// the room's owners.
+func ownerNotice(e *roomEvent) *message {
+	var text string
+	switch e.Type {
+	case eventOwner:
+		text = fmt.Sprintf("%s now owns the room", e.Name)
+	case eventCoOwner:
+		text = fmt.Sprintf("%s is now a co-owner of the room", e.Name)
+	case eventUncoOwner:
+		text = fmt.Sprintf("%s is no longer a co-owner of the room", e.Name)
+	}
+	return &message{Message: text, When: e.When, System: true}
+}
+
+// serveOwners serves the API for the room's owners: GET
+// /api/rooms/{name}/owners returns them, PUT /api/rooms/{name}/owner, with
+// the new owner's account, transfers the room to them, and PUT and DELETE
+// /api/rooms/{name}/co-owners/{account} make the account a co-owner, or no
+// longer one.
+func serveOwners(w http.ResponseWriter, r *http.Request, room *room, what, account string) {
+	if what == "owners" {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, room.owners())
+		return
+	}
+	by := currentAccountID(r)
+	if by == "" {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return
+	}
+	if !room.mayChooseOwners(by) {
+		http.Error(w, "only the room's owner may do that", http.StatusForbidden)
+		return
+	}
+	e := &roomEvent{When: time.Now()}
+	switch {
+	case what == "owner" && account == "" && r.Method == "PUT":
+		var body struct {
+			Account string `json:"account"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&body); err != nil || body.Account == "" {
+			http.Error(w, "the new owner's account is required", http.StatusBadRequest)
+			return
+		}
+		e.Type, e.Account = eventOwner, body.Account
+	case what == "co-owners" && account != "" && r.Method == "PUT":
+		e.Type, e.Account = eventCoOwner, account
+	case what == "co-owners" && account != "" && r.Method == "DELETE":
+		e.Type, e.Account = eventUncoOwner, account
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e.Name = e.Account
+	if room.users != nil {
+		a := room.users.get(e.Account)
+		if a == nil {
+			http.Error(w, "no such account", http.StatusNotFound)
+			return
+		}
+		e.Name = a.Name
+	}
+	room.changes <- e
+	w.WriteHeader(http.StatusNoContent)
+}
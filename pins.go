@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pinMessage is the system message telling the room a message has been
+// pinned or unpinned.
+func pinMessage(e *roomEvent) *message {
+	verb := "pinned"
+	if e.Type == eventUnpin {
+		verb = "unpinned"
+	}
+	return &message{
+		Message: fmt.Sprintf("%s %s message %d", e.Name, verb, e.Target),
+		When:    e.When,
+		System:  true,
+	}
+}
+
+// pins returns the messages pinned to the room.
+func (r *room) pins() []*message {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*message(nil), r.state.Pins...)
+}
+
+// pinCommand makes the /pin and /unpin commands, with which those who manage
+// the room pin messages to the room by their ID, or unpin them.
+func pinCommand(pin bool) func(c *client, args string) error {
+	return func(c *client, args string) error {
+		id, err := strconv.ParseUint(args, 10, 64)
+		if err != nil {
+			return errUsage
+		}
+		c.room.mu.RLock()
+		found, pinned, full := c.room.state.message(id) != nil, c.room.state.pinned(id) >= 0, len(c.room.state.Pins) >= maxPins
+		c.room.mu.RUnlock()
+		switch {
+		case pin && pinned:
+			return fmt.Errorf("message %d is already pinned", id)
+		case pin && !found:
+			return fmt.Errorf("there is no recent message %d", id)
+		case pin && full:
+			return fmt.Errorf("no more than %d messages can be pinned", maxPins)
+		case !pin && !pinned:
+			return fmt.Errorf("message %d isn't pinned", id)
+		}
+		c.room.pin(c.name(), id, pin)
+		return nil
+	}
+}
+
+// deleteCommand is the /delete command, with which people delete messages
+// from the room's history by their ID. Everybody may delete their own
+// messages; deleting other people's needs permDeleteOthers.
+func deleteCommand(c *client, args string) error {
+	id, err := strconv.ParseUint(args, 10, 64)
+	if err != nil {
+		return errUsage
+	}
+	c.room.mu.RLock()
+	msg := c.room.state.message(id)
+	c.room.mu.RUnlock()
+	switch {
+	case msg == nil || msg.System:
+		return fmt.Errorf("there is no recent message %d", id)
+	case msg.Sender != c.account() && !c.room.can(c, permDeleteOthers):
+		return errNotAllowed(permDeleteOthers)
+	}
+	c.room.changes <- &roomEvent{Type: eventDelete, Name: c.name(), Account: c.account(), Target: id, When: time.Now()}
+	return nil
+}
+
+// alertModerators tells the room's moderators, and everybody else who may
+// delete others' messages, something, wherever they are connected. It must
+// not be called from run.
+func (r *room) alertModerators(text string) {
+	for _, account := range r.with(permDeleteOthers) {
+		r.forward <- &message{Message: text, When: time.Now(), System: true, toAccount: account}
+	}
+}
+
+// roomsHandler serves the API for rooms, under /api/rooms/{name}/: GET
+// /api/rooms/{name}/pins, the messages pinned to the room,
+// /api/rooms/{name}/receipts, who has seen its recent messages,
+// /api/rooms/{name}/members, who is in it,
+// /api/rooms/{name}/archive, which its owners archive and reactivate the
+// room with, and the API for its owners themselves.
+type roomsHandler struct {
+	rooms map[string]*room
+}
+
+func (h *roomsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/rooms/"), "/")
+	if len(parts) == 3 && parts[1] == "co-owners" && parts[2] != "" {
+		if room, ok := h.rooms[parts[0]]; ok {
+			serveOwners(w, r, room, parts[1], parts[2])
+			return
+		}
+	}
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	room, ok := h.rooms[parts[0]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch parts[1] {
+	case "pins":
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if requireRoomAccess(w, r, room) == "" {
+			return
+		}
+		writeJSON(w, room.pins())
+	case "receipts":
+		serveReceipts(w, r, room)
+	case "members":
+		serveMembers(w, r, room)
+	case "archive":
+		serveArchive(w, r, room)
+	case "owners", "owner":
+		serveOwners(w, r, room, parts[1], "")
+	default:
+		http.NotFound(w, r)
+	}
+}
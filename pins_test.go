@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/objx"
+)
+
+// TestRoomAPINeedsAccess checks that what is said in rooms, and by whom, is
+// only served to people signed in who may see the room.
+func TestRoomAPINeedsAccess(t *testing.T) {
+	cookieKey = []byte("test secret")
+	public, private := newRoom(1), newRoom(1)
+	public.name, private.name = "chat", "secret"
+	private.org = &org{Name: "acme", Members: []string{"member"}}
+	h := &roomsHandler{rooms: map[string]*room{"chat": public, "secret": private}}
+
+	tests := []struct {
+		room, account string
+		want          int
+	}{
+		{"chat", "", http.StatusUnauthorized},
+		{"chat", "anybody", http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "anybody", http.StatusForbidden},
+		{"secret", "member", http.StatusOK},
+	}
+	for _, path := range []string{"pins", "receipts", "members"} {
+		for _, test := range tests {
+			r := httptest.NewRequest("GET", "/api/rooms/"+test.room+"/"+path, nil)
+			if test.account != "" {
+				r.AddCookie(&http.Cookie{Name: "auth", Value: signCookie(objx.New(map[string]interface{}{"id": test.account}))})
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Errorf("%s of %s for %q: got %d, want %d", path, test.room, test.account, w.Code, test.want)
+			}
+		}
+	}
+}
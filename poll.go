@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits on polls.
+const (
+	maxPollOptions = 10
+	maxPolls       = 100
+)
+
+// poll is a question put to the room, which everybody may vote on once
+// until whoever asked it closes it.
+type poll struct {
+	ID       uint64   `json:"id"`
+	Question string   `json:"question"`
+	Options  []string `json:"options"`
+
+	// Creator is who asked the question, and Account their account.
+	Creator string `json:"creator"`
+	Account string `json:"account"`
+
+	// Votes holds the option each account voted for, counting from 1.
+	Votes  map[string]int `json:"votes"`
+	Closed bool           `json:"closed,omitempty"`
+}
+
+// pollTally is a poll as it is sent to clients: the votes are counted, so
+// nobody sees who voted for what.
+type pollTally struct {
+	ID       uint64
+	Question string
+	Options  []string
+	Counts   []int
+	Creator  string
+	Closed   bool `json:",omitempty"`
+}
+
+// pollVote is a vote sent by a client.
+type pollVote struct {
+	Poll   uint64
+	Choice int
+}
+
+// tally counts the poll's votes.
+func (p *poll) tally() *pollTally {
+	t := &pollTally{
+		ID:       p.ID,
+		Question: p.Question,
+		Options:  p.Options,
+		Counts:   make([]int, len(p.Options)),
+		Creator:  p.Creator,
+		Closed:   p.Closed,
+	}
+	for _, choice := range p.Votes {
+		t.Counts[choice-1]++
+	}
+	return t
+}
+
+// applyPoll changes the room's polls to reflect that e happened. Events that
+// make no sense, such as votes in closed polls, change nothing.
+func (s *roomState) applyPoll(e *roomEvent) {
+	switch e.Type {
+	case eventPoll:
+		s.Polls[e.Seq] = &poll{
+			ID:       e.Seq,
+			Question: e.Message,
+			Options:  e.Options,
+			Creator:  e.Name,
+			Account:  e.Account,
+			Votes:    make(map[string]int),
+		}
+		// forget the oldest poll once there are too many.
+		if len(s.Polls) > maxPolls {
+			oldest := e.Seq
+			for id := range s.Polls {
+				if id < oldest {
+					oldest = id
+				}
+			}
+			delete(s.Polls, oldest)
+		}
+		s.remember(&message{
+			ID:      e.Seq,
+			Name:    e.Name,
+			Message: "Poll: " + e.Message,
+			When:    e.When,
+		})
+	case eventVote:
+		if p, ok := s.Polls[e.Target]; ok && !p.Closed && e.Choice >= 1 && e.Choice <= len(p.Options) {
+			p.Votes[e.Account] = e.Choice
+		}
+	case eventClose:
+		if p, ok := s.Polls[e.Target]; ok {
+			p.Closed = true
+		}
+	}
+}
+
+// pollMessage is the message telling the room how a poll stands. It must be
+// made while holding the room's lock, or from its run loop.
+func (r *room) pollMessage(id uint64) *message {
+	p, ok := r.state.Polls[id]
+	if !ok {
+		return nil
+	}
+	return &message{
+		ID:      p.ID,
+		Name:    p.Creator,
+		Message: p.Question,
+		When:    time.Now(),
+		Poll:    p.tally(),
+	}
+}
+
+// vote records c's vote in a poll.
+func (c *client) vote(v *pollVote) {
+	c.room.changes <- &roomEvent{Type: eventVote, Name: c.name(), Account: c.account(),
+		Target: v.Poll, Choice: v.Choice, When: time.Now()}
+}
+
+// pollCommand is /poll, which asks the room a question:
+//
+//	/poll "Where shall we have lunch?" pizza "the noodle place" sushi
+//	/poll close <id>
+//
+// Only whoever asked a question, or somebody who may delete others'
+// messages, may close its poll.
+func pollCommand(c *client, args string) error {
+	fields := splitQuoted(args)
+	if len(fields) == 2 && fields[0] == "close" {
+		id, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return errUsage
+		}
+		c.room.mu.RLock()
+		p, ok := c.room.state.Polls[id]
+		owner := ok && p.Account == c.account()
+		c.room.mu.RUnlock()
+		if !ok {
+			return fmt.Errorf("there is no poll %d", id)
+		}
+		if !owner && !c.room.can(c, permDeleteOthers) {
+			return errors.New("only whoever asked the question can close the poll")
+		}
+		c.room.changes <- &roomEvent{Type: eventClose, Name: c.name(), Account: c.account(), Target: id, When: time.Now()}
+		return nil
+	}
+	if len(fields) < 3 {
+		return errUsage
+	}
+	if len(fields)-1 > maxPollOptions {
+		return fmt.Errorf("a poll can't have more than %d options", maxPollOptions)
+	}
+	c.room.changes <- &roomEvent{Type: eventPoll, Name: c.name(), Account: c.account(),
+		Message: fields[0], Options: fields[1:], When: time.Now()}
+	return nil
+}
+
+// splitQuoted splits s into words, keeping words in double quotes together.
+func splitQuoted(s string) []string {
+	var fields []string
+	var field strings.Builder
+	inField, quoted := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inField = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
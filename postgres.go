@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	// the pgx driver, registered as "pgx".
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgres is a PostgreSQL database that rooms and accounts are kept in,
+// instead of the -data directory, which is what to use in production: it
+// can be backed up, replicated and shared by several instances of the server
+// while they run.
+//
+// A room's events and snapshot are kept as they would be in its event log,
+// as JSON, and each account as JSON too, so that adding to what is kept
+// doesn't need the tables to change. Connections are pooled by database/sql,
+// and each statement is prepared once, up front.
+type postgres struct {
+	db    *sql.DB
+	stmts struct {
+		appendEvent, eventsAfter   *sql.Stmt
+		pruneEvents, forgetEvents  *sql.Stmt
+		saveSnapshot, loadSnapshot *sql.Stmt
+		saveAccount, loadAccounts  *sql.Stmt
+	}
+}
+
+// postgresSchema creates the tables, if they don't exist yet.
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS room_events (
+		room  text   NOT NULL,
+		seq   bigint NOT NULL,
+		event jsonb  NOT NULL,
+		PRIMARY KEY (room, seq)
+	)`,
+	`CREATE TABLE IF NOT EXISTS room_snapshots (
+		room  text        PRIMARY KEY,
+		state jsonb       NOT NULL,
+		taken timestamptz NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS accounts (
+		id      text  PRIMARY KEY,
+		account jsonb NOT NULL
+	)`,
+}
+
+// openPostgres connects to the database at url, keeping up to maxConns
+// connections open, creates the tables it needs and prepares the statements
+// it uses.
+func openPostgres(url string, maxConns int) (*postgres, error) {
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
+	db.SetConnMaxIdleTime(5 * time.Minute)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, stmt := range postgresSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	p := &postgres{db: db}
+	for _, s := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&p.stmts.appendEvent, `INSERT INTO room_events (room, seq, event) VALUES ($1, $2, $3)`},
+		{&p.stmts.eventsAfter, `SELECT event FROM room_events WHERE room = $1 AND seq > $2 ORDER BY seq`},
+		{&p.stmts.forgetEvents, `DELETE FROM room_events WHERE room = $1 AND seq = ANY($2) AND event->>'type' IN ('message', 'edit')`},
+		{&p.stmts.pruneEvents, `DELETE FROM room_events WHERE room = $1 AND seq < $2 AND event->>'type' IN ('message', 'edit')`},
+		{&p.stmts.saveSnapshot, `INSERT INTO room_snapshots (room, state, taken) VALUES ($1, $2, now())
+			ON CONFLICT (room) DO UPDATE SET state = excluded.state, taken = excluded.taken`},
+		{&p.stmts.loadSnapshot, `SELECT state FROM room_snapshots WHERE room = $1`},
+		{&p.stmts.saveAccount, `INSERT INTO accounts (id, account) VALUES ($1, $2)
+			ON CONFLICT (id) DO UPDATE SET account = excluded.account`},
+		{&p.stmts.loadAccounts, `SELECT account FROM accounts`},
+	} {
+		if *s.stmt, err = db.Prepare(s.query); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// openJournal returns the journal of the room with the given key, along with
+// the room's state restored from it.
+func (p *postgres) openJournal(room string) (journal, *roomState, error) {
+	state := newRoomState()
+	var b []byte
+	switch err := p.stmts.loadSnapshot.QueryRow(room).Scan(&b); err {
+	case nil:
+		if state, err = decodeSnapshot(b); err != nil {
+			return nil, nil, err
+		}
+	case sql.ErrNoRows:
+	default:
+		return nil, nil, err
+	}
+	j := &pgJournal{p: p, room: room}
+	if err := j.eventsAfter(state.Seq, func(e *roomEvent) error {
+		state.apply(e)
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	return j, state, nil
+}
+
+// pgJournal is the journal of a room kept in PostgreSQL.
+type pgJournal struct {
+	p    *postgres
+	room string
+}
+
+func (j *pgJournal) append(e *roomEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = j.p.stmts.appendEvent.Exec(j.room, e.Seq, string(b))
+	return err
+}
+
+func (j *pgJournal) snapshot(state *roomState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = j.p.stmts.saveSnapshot.Exec(j.room, string(b))
+	return err
+}
+
+func (j *pgJournal) events(fn func(e *roomEvent) error) error {
+	return j.eventsAfter(0, fn)
+}
+
+func (j *pgJournal) prune(before uint64) error {
+	_, err := j.p.stmts.pruneEvents.Exec(j.room, before)
+	return err
+}
+
+func (j *pgJournal) forget(seqs []uint64) error {
+	_, err := j.p.stmts.forgetEvents.Exec(j.room, seqs)
+	return err
+}
+
+// eventsAfter calls fn with every event logged after the one numbered seq.
+func (j *pgJournal) eventsAfter(seq uint64, fn func(e *roomEvent) error) error {
+	rows, err := j.p.stmts.eventsAfter.Query(j.room, seq)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return err
+		}
+		var e roomEvent
+		if err := json.Unmarshal(b, &e); err != nil {
+			return err
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (p *postgres) loadAccounts() ([]*account, error) {
+	rows, err := p.stmts.loadAccounts.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var accounts []*account
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		var a account
+		if err := json.Unmarshal(b, &a); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, &a)
+	}
+	return accounts, rows.Err()
+}
+
+func (p *postgres) saveAccount(a *account) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	_, err = p.stmts.saveAccount.Exec(a.ID, string(b))
+	return err
+}
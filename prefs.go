@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// How much somebody wants to be notified about a room.
+const (
+	// notifyAll is every message sent while they are away.
+	notifyAll = "all"
+
+	// notifyMentionsOnly is only messages that mention them or one of their
+	// keywords. It is the default.
+	notifyMentionsOnly = "mentions"
+
+	// notifyMuted is nothing at all.
+	notifyMuted = "muted"
+)
+
+// notifyPrefs are somebody's preferences about being notified, which are
+// consulted before any notification is sent to them.
+type notifyPrefs struct {
+	// Rooms holds how much the user wants to hear about each room, keyed by
+	// room name, or by org/room for rooms in an organization.
+	Rooms map[string]string `json:"rooms,omitempty"`
+
+	// QuietStart and QuietEnd are the times of day, as "15:04" in TimeZone,
+	// between which the user doesn't want to be notified about anything. If
+	// QuietStart is after QuietEnd, the quiet hours span midnight.
+	QuietStart string `json:"quiet_start,omitempty"`
+	QuietEnd   string `json:"quiet_end,omitempty"`
+	TimeZone   string `json:"time_zone,omitempty"`
+
+	// NoDigest turns off the email digest of missed messages.
+	NoDigest bool `json:"no_digest,omitempty"`
+}
+
+// level returns how much the user wants to hear about the room.
+func (p *notifyPrefs) level(room string) string {
+	if level, ok := p.Rooms[room]; ok {
+		return level
+	}
+	return notifyMentionsOnly
+}
+
+// quiet reports whether t falls in the user's quiet hours.
+func (p *notifyPrefs) quiet(t time.Time) bool {
+	if p.QuietStart == "" || p.QuietEnd == "" {
+		return false
+	}
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	now := t.In(loc).Format("15:04")
+	if p.QuietStart <= p.QuietEnd {
+		return now >= p.QuietStart && now < p.QuietEnd
+	}
+	return now >= p.QuietStart || now < p.QuietEnd
+}
+
+// wants reports whether the user wants to be sent n at all. Whether they
+// want it now, or would rather wait until their quiet hours are over, is for
+// whatever delivers it to check with quiet, since some notifiers deliver
+// notifications long after they are made.
+func (p *notifyPrefs) wants(n *notification) bool {
+	switch p.level(n.Room) {
+	case notifyMuted:
+		return false
+	case notifyMentionsOnly:
+		return n.Kind != notifyMessage
+	}
+	return true
+}
+
+// validate checks the preferences make sense.
+func (p *notifyPrefs) validate() error {
+	for room, level := range p.Rooms {
+		if level != notifyAll && level != notifyMentionsOnly && level != notifyMuted {
+			return fmt.Errorf("%s: level must be %s, %s or %s", room, notifyAll, notifyMentionsOnly, notifyMuted)
+		}
+	}
+	if (p.QuietStart == "") != (p.QuietEnd == "") {
+		return errors.New("quiet hours need both a start and an end")
+	}
+	for _, t := range []string{p.QuietStart, p.QuietEnd} {
+		if _, err := time.Parse("15:04", t); t != "" && err != nil {
+			return fmt.Errorf("%q is not a time of day, such as 22:30", t)
+		}
+	}
+	if _, err := time.LoadLocation(p.TimeZone); err != nil {
+		return fmt.Errorf("unknown time zone %q", p.TimeZone)
+	}
+	return nil
+}
+
+// prefsNotifier passes notifications on to another notifier, but only the
+// ones their recipient's preferences say they want.
+type prefsNotifier struct {
+	users *userStore
+	next  notifier
+}
+
+// withPreferences makes a notifier that consults everybody's preferences
+// before passing their notifications on to next.
+func withPreferences(users *userStore, next notifier) notifier {
+	return &prefsNotifier{users: users, next: next}
+}
+
+func (p *prefsNotifier) notify(n *notification) {
+	if a := p.users.get(n.Account); a != nil && a.Notify.wants(n) {
+		p.next.notify(n)
+	}
+}
+
+// everythingIn returns the accounts that want to hear about every message
+// in the room.
+func (s *userStore) everythingIn(room string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	accounts := make([]string, 0, len(s.everything[room]))
+	for account := range s.everything[room] {
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
+
+// notifyPrefsHandler serves /api/me/notifications: GET returns the signed
+// in user's notification preferences, and PUT replaces them.
+type notifyPrefsHandler struct {
+	users *userStore
+}
+
+func (h *notifyPrefsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := currentAccountID(r)
+	switch r.Method {
+	case "GET":
+		a := h.users.get(id)
+		if a == nil {
+			http.Error(w, "not authenticated", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, a.Notify)
+	case "PUT":
+		var prefs notifyPrefs
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&prefs); err != nil {
+			http.Error(w, "bad preferences: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := prefs.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a, err := h.users.update(id, func(a *account) { a.Notify = prefs })
+		if err == errNoAccount {
+			http.Error(w, "not authenticated", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Println("Failed to save notification preferences:", err)
+			http.Error(w, "failed to save preferences", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, a.Notify)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
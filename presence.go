@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Kinds of presence message, telling clients somebody joined or left the
+// room.
+const (
+	presenceJoined = "user_joined"
+	presenceLeft   = "user_left"
+)
+
+// presenceMessage is the message telling everybody in the room that the named
+// user joined or left it. Like typing, it is passed on but never recorded in
+// the room's history. Clients that don't know about presence messages show
+// them as any other message from the server.
+func presenceMessage(kind, name string) *message {
+	text := fmt.Sprintf("%s joined", name)
+	if kind == presenceLeft {
+		text = fmt.Sprintf("%s left", name)
+	}
+	return &message{Name: name, Message: text, Presence: kind, When: time.Now(), System: true}
+}
+
+// presenceCommand is /presence on | off, which has the room tell everybody
+// when people join and leave, as it does to begin with, or stop doing so, as
+// busy rooms may prefer.
+func presenceCommand(c *client, args string) error {
+	e := &roomEvent{Name: c.name(), Account: c.account(), When: time.Now()}
+	switch args {
+	case "on":
+		e.Type = eventShowPresence
+		c.reply("People joining and leaving the room are shown")
+	case "off":
+		e.Type = eventHidePresence
+		c.reply("People joining and leaving the room are no longer shown")
+	default:
+		return errUsage
+	}
+	c.room.changes <- e
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits on what people can write on their profile.
+const (
+	maxBioLength    = 500
+	maxStatusLength = 100
+)
+
+// profile is the part of an account anybody may see, so that names in the
+// chat can be shown with who is behind them.
+type profile struct {
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url,omitempty"`
+	Bio       string `json:"bio,omitempty"`
+	Status    string `json:"status,omitempty"`
+}
+
+// myProfile is the profile people see of themselves, which also has their
+// account ID and email.
+type myProfile struct {
+	profile
+	ID       string `json:"id"`
+	Email    string `json:"email,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+func publicProfile(a *account) profile {
+	return profile{Name: a.Name, AvatarURL: a.AvatarURL, Bio: a.Bio, Status: a.Status}
+}
+
+// currentAccountID returns the ID of the account the request was made by,
+// from its auth cookie, or the empty string if nobody is signed in, or the
+// cookie isn't one we signed.
+func currentAccountID(r *http.Request) string {
+	data, err := authCookie(r)
+	if err != nil {
+		return ""
+	}
+	return data.Get("id").Str()
+}
+
+// myProfileHandler serves /api/me/profile: GET returns the signed in user's
+// profile, and PUT changes it. Fields left out of a PUT are left as they
+// are.
+type myProfileHandler struct {
+	users *userStore
+}
+
+func (h *myProfileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := currentAccountID(r)
+	if id == "" {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		a := h.users.get(id)
+		if a == nil {
+			http.Error(w, "not authenticated", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, myProfile{publicProfile(a), a.ID, a.Email, a.Language})
+	case "PUT":
+		var change struct {
+			Name      *string `json:"name"`
+			AvatarURL *string `json:"avatar_url"`
+			Bio       *string `json:"bio"`
+			Status    *string `json:"status"`
+			Language  *string `json:"language"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&change); err != nil {
+			http.Error(w, "bad profile: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if change.Name != nil {
+			*change.Name = strings.TrimSpace(*change.Name)
+			if err := validName(*change.Name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if change.AvatarURL != nil && *change.AvatarURL != "" &&
+			!strings.HasPrefix(*change.AvatarURL, "https://") {
+			http.Error(w, "the avatar must be an https URL", http.StatusBadRequest)
+			return
+		}
+		if change.Bio != nil && utf8.RuneCountInString(*change.Bio) > maxBioLength {
+			http.Error(w, "the bio is too long", http.StatusBadRequest)
+			return
+		}
+		if change.Status != nil && utf8.RuneCountInString(*change.Status) > maxStatusLength {
+			http.Error(w, "the status is too long", http.StatusBadRequest)
+			return
+		}
+		if change.Language != nil && *change.Language != "" && !languagePattern.MatchString(*change.Language) {
+			http.Error(w, "the language must be a language code, such as en or pt-BR", http.StatusBadRequest)
+			return
+		}
+		// A new name is used the next time the user connects to a room;
+		// /nick changes it in the room straight away.
+		a, err := h.users.update(id, func(a *account) {
+			if change.Name != nil {
+				a.Name = *change.Name
+			}
+			if change.AvatarURL != nil {
+				a.AvatarURL = *change.AvatarURL
+			}
+			if change.Bio != nil {
+				a.Bio = *change.Bio
+			}
+			if change.Status != nil {
+				a.Status = *change.Status
+			}
+			if change.Language != nil {
+				a.Language = *change.Language
+			}
+		})
+		if err == errNoAccount {
+			http.Error(w, "not authenticated", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			http.Error(w, "failed to save profile", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, myProfile{publicProfile(a), a.ID, a.Email, a.Language})
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// profilesHandler serves /api/profiles/{name}, the profile of whoever goes by
+// name, for showing when somebody's name is clicked on in the chat.
+type profilesHandler struct {
+	users *userStore
+}
+
+func (h *profilesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a := h.users.findByName(strings.TrimPrefix(r.URL.Path, "/api/profiles/"))
+	if a == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, publicProfile(a))
+}
+
+// writeJSON writes v to w as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/stretchr/gomniauth/common"
+)
+
+// loginProvider is a third-party login provider that can be offered on the
+// login page, if it has been configured.
+type loginProvider struct {
+	// Name is the name of the provider in /auth/ URLs, and DisplayName the
+	// name shown to users.
+	Name        string
+	DisplayName string
+
+	key      *string
+	secret   *string
+	callback *string
+
+	// create makes the gomniauth provider from its credentials.
+	create func(key, secret, callback string) (common.Provider, error)
+}
+
+// newLoginProvider describes a login provider, registering the -<name>-key,
+// -<name>-secret and -<name>-callback flags used to configure it. The key and
+// secret default to the <NAME>_KEY and <NAME>_SECRET environment variables,
+// so they needn't appear on the command line.
+func newLoginProvider(name, displayName string, create func(key, secret, callback string) (common.Provider, error)) *loginProvider {
+	env := strings.ToUpper(name)
+	return &loginProvider{
+		Name:        name,
+		DisplayName: displayName,
+		key: flag.String(name+"-key", os.Getenv(env+"_KEY"),
+			"The "+displayName+" OAuth client ID (or $"+env+"_KEY)."),
+		secret: flag.String(name+"-secret", os.Getenv(env+"_SECRET"),
+			"The "+displayName+" OAuth client secret (or $"+env+"_SECRET)."),
+		callback: flag.String(name+"-callback", "",
+			"The "+displayName+" OAuth callback URL (default <base-url>/auth/callback/"+name+")."),
+		create: create,
+	}
+}
+
+// configured reports whether the provider has credentials.
+func (p *loginProvider) configured() bool {
+	return *p.key != "" && *p.secret != ""
+}
+
+// flagNames are the names of the flags configuring the provider.
+func (p *loginProvider) flagNames() []string {
+	return []string{p.Name + "-key", p.Name + "-secret", p.Name + "-callback"}
+}
+
+// configuredProviders returns the providers that have credentials, and the
+// gomniauth providers made from them. Providers without a callback URL of
+// their own get one under baseURL.
+func configuredProviders(all []*loginProvider, baseURL string) ([]*loginProvider, []common.Provider, error) {
+	var providers []*loginProvider
+	var gomniauthProviders []common.Provider
+	for _, p := range all {
+		if !p.configured() {
+			continue
+		}
+		callback := *p.callback
+		if callback == "" {
+			callback = strings.TrimSuffix(baseURL, "/") + "/auth/callback/" + p.Name
+		}
+		gp, err := p.create(*p.key, *p.secret, callback)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", p.DisplayName, err)
+		}
+		providers = append(providers, p)
+		gomniauthProviders = append(gomniauthProviders, gp)
+	}
+	return providers, gomniauthProviders, nil
+}
+
+// loginProviders are the login providers people may sign in with. They are
+// looked up here, rather than with gomniauth.Provider, so that they can be
+// swapped for others while people are signing in, when the configuration is
+// reloaded.
+type loginProviders struct {
+	mu        sync.RWMutex
+	list      []*loginProvider
+	providers map[string]common.Provider
+}
+
+// configure makes the providers of all that have credentials the ones people
+// may sign in with, and returns how many there are. If any of them can't be
+// made, the providers are left as they were.
+func (ps *loginProviders) configure(all []*loginProvider, baseURL string) (int, error) {
+	list, gomniauthProviders, err := configuredProviders(all, baseURL)
+	if err != nil {
+		return 0, err
+	}
+	providers := make(map[string]common.Provider)
+	for i, p := range list {
+		providers[p.Name] = gomniauthProviders[i]
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.list = list
+	ps.providers = providers
+	return len(list), nil
+}
+
+// List returns the providers, for the login page to offer.
+func (ps *loginProviders) List() []*loginProvider {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.list
+}
+
+// provider returns the gomniauth provider called name.
+func (ps *loginProviders) provider(name string) (common.Provider, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	p, ok := ps.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("no provider called %q", name)
+	}
+	return p, nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// For deployments that can't lose what is going on in a room when a server
+// crashes, rooms can be replicated across a cluster of servers, usually
+// three, with Raft. Every event in a room is committed to the cluster before
+// the room applies it, and each server keeps its own copy of every room's
+// event log. Only the cluster's leader serves the rooms: the others wait, and
+// if the leader fails, one of them takes over with everything it had
+// recorded. People connected to the old leader reconnect to the new one, so
+// the servers should sit behind a load balancer that sends people to
+// whichever is serving; the others don't listen until they lead.
+type raftCluster struct {
+	raft   *raft.Raft
+	fsm    *raftFSM
+	leader chan bool
+}
+
+// raftTimeout is how long an entry may take to be committed to the cluster,
+// and how long the servers wait for each other.
+const raftTimeout = 10 * time.Second
+
+// openRaftCluster starts this server, with the given ID, as a member of the
+// cluster made of peers, comma separated id=host:port, listening for the
+// others on bind. The cluster's log and the copies of the rooms are kept in
+// dir.
+func openRaftCluster(id, bind, peers, dir string) (*raftCluster, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	var servers []raft.Server
+	var advertise string
+	for _, peer := range strings.Split(peers, ",") {
+		peerID, addr, ok := strings.Cut(strings.TrimSpace(peer), "=")
+		if !ok {
+			return nil, fmt.Errorf("bad peer %q: want id=host:port", peer)
+		}
+		if peerID == id {
+			advertise = addr
+		}
+		servers = append(servers, raft.Server{ID: raft.ServerID(peerID), Address: raft.ServerAddress(addr)})
+	}
+	if advertise == "" {
+		return nil, fmt.Errorf("%s is not one of the peers", id)
+	}
+	addr, err := net.ResolveTCPAddr("tcp", advertise)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(bind, addr, 3, raftTimeout, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(id)
+	leader := make(chan bool, 1)
+	config.NotifyCh = leader
+	existing, err := raft.HasExistingState(store, store, snapshots)
+	if err != nil {
+		return nil, err
+	}
+	if !existing {
+		// every server is started with the same peers, so each of them
+		// bootstraps the cluster the same way.
+		err := raft.BootstrapCluster(config, store, store, snapshots, transport, raft.Configuration{Servers: servers})
+		if err != nil {
+			return nil, err
+		}
+	}
+	fsm := &raftFSM{dir: filepath.Join(dir, "rooms"), rooms: make(map[string]*raftRoom)}
+	r, err := raft.NewRaft(config, fsm, store, store, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+	return &raftCluster{raft: r, fsm: fsm, leader: leader}, nil
+}
+
+// lead waits until this server leads the cluster, and has applied everything
+// committed before it did. Should it ever stop leading, the server exits, as
+// another is now serving the rooms, and it must not carry on recording
+// events in them too.
+func (c *raftCluster) lead() error {
+	for !<-c.leader {
+	}
+	if err := c.raft.Barrier(raftTimeout).Error(); err != nil {
+		return err
+	}
+	go func() {
+		for leading := range c.leader {
+			if !leading {
+				log.Fatal("Raft: no longer leading the cluster")
+			}
+		}
+	}()
+	return nil
+}
+
+// openJournal returns the journal of the room with the given key, along with
+// the room's state restored from this server's copy of it.
+func (c *raftCluster) openJournal(room string) (journal, *roomState, error) {
+	c.fsm.mu.Lock()
+	defer c.fsm.mu.Unlock()
+	r, err := c.fsm.room(room)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the room has a copy of the state of its own, which it applies events
+	// to as they are committed, just as the FSM does.
+	b, err := json.Marshal(r.state)
+	if err != nil {
+		return nil, nil, err
+	}
+	state, err := decodeSnapshot(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &raftJournal{c: c, room: room, log: r.log}, state, nil
+}
+
+// raftEntry is an entry in the cluster's log: an event in a room, or the
+// room's messages being pruned or forgotten.
+type raftEntry struct {
+	Room   string     `json:"room"`
+	Event  *roomEvent `json:"event,omitempty"`
+	Prune  uint64     `json:"prune,omitempty"`
+	Forget []uint64   `json:"forget,omitempty"`
+}
+
+// raftJournal is the journal of a room replicated across the cluster. Events
+// are committed to the cluster, and read back from this server's copy.
+type raftJournal struct {
+	c    *raftCluster
+	room string
+	log  *eventLog
+}
+
+// commit commits entry to the cluster, returning once this server has
+// applied it.
+func (j *raftJournal) commit(entry *raftEntry) error {
+	entry.Room = j.room
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f := j.c.raft.Apply(b, raftTimeout)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (j *raftJournal) append(e *roomEvent) error {
+	return j.commit(&raftEntry{Event: e})
+}
+
+func (j *raftJournal) snapshot(state *roomState) error {
+	return j.log.snapshot(state)
+}
+
+func (j *raftJournal) events(fn func(e *roomEvent) error) error {
+	return j.log.events(fn)
+}
+
+func (j *raftJournal) prune(before uint64) error {
+	return j.commit(&raftEntry{Prune: before})
+}
+
+func (j *raftJournal) forget(seqs []uint64) error {
+	return j.commit(&raftEntry{Forget: seqs})
+}
+
+// raftFSM applies the entries committed to the cluster to this server's copy
+// of each room: its event log, kept in a directory of dir named after the
+// room's key, and its state.
+type raftFSM struct {
+	dir   string
+	mu    sync.Mutex
+	rooms map[string]*raftRoom
+}
+
+// raftRoom is this server's copy of a room.
+type raftRoom struct {
+	log   *eventLog
+	state *roomState
+}
+
+// room returns this server's copy of the room with the given key, opening it
+// if need be. It must be called holding mu.
+func (f *raftFSM) room(key string) (*raftRoom, error) {
+	if r, ok := f.rooms[key]; ok {
+		return r, nil
+	}
+	l, state, err := openEventLog(filepath.Join(f.dir, filepath.FromSlash(key)))
+	if err != nil {
+		return nil, err
+	}
+	r := &raftRoom{log: l, state: state}
+	f.rooms[key] = r
+	return r, nil
+}
+
+func (f *raftFSM) Apply(l *raft.Log) interface{} {
+	var entry raftEntry
+	if err := json.Unmarshal(l.Data, &entry); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, err := f.room(entry.Room)
+	if err != nil {
+		return err
+	}
+	switch {
+	case entry.Event != nil:
+		// when the server starts, the cluster's log is applied again from
+		// the last snapshot, but the room's copy may already have the
+		// events in it.
+		if entry.Event.Seq <= r.state.Seq {
+			return nil
+		}
+		if err := r.log.append(entry.Event); err != nil {
+			return err
+		}
+		r.state.apply(entry.Event)
+	case entry.Prune > 0:
+		if err := r.log.snapshot(r.state); err != nil {
+			return err
+		}
+		return r.log.prune(entry.Prune)
+	case entry.Forget != nil:
+		return r.log.forget(entry.Forget)
+	}
+	return nil
+}
+
+// Snapshot snapshots the state of every room, so that the cluster's log can
+// be compacted.
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	states := make(raftSnapshot, len(f.rooms))
+	for key, r := range f.rooms {
+		b, err := json.Marshal(r.state)
+		if err != nil {
+			return nil, err
+		}
+		states[key] = b
+	}
+	return states, nil
+}
+
+// Restore brings this server's copies of the rooms up to date from a
+// snapshot, such as one sent by the leader to a server that has fallen
+// behind.
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var states raftSnapshot
+	if err := json.NewDecoder(rc).Decode(&states); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, b := range states {
+		state, err := decodeSnapshot(b)
+		if err != nil {
+			return err
+		}
+		r, err := f.room(key)
+		if err != nil {
+			return err
+		}
+		if state.Seq <= r.state.Seq {
+			continue
+		}
+		// the room's log misses the events in between, but the snapshot
+		// has everything they did.
+		if err := r.log.snapshot(state); err != nil {
+			return err
+		}
+		r.state = state
+	}
+	return nil
+}
+
+// raftSnapshot is the state of every room, by key.
+type raftSnapshot map[string]json.RawMessage
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s raftSnapshot) Release() {}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Read receipts say how many people have seen each message. Telling
+// everybody in the room every time anybody reads anything would have a busy
+// room sending a message to every member for every member's read, so instead
+// the room gathers up the reads and, once a second, tells everybody what
+// changed in a single message: whose read marker moved, and from where to
+// where. Clients add one to the count of every message in between. Who read
+// a message is only said in small rooms; in bigger ones, only how many.
+
+// maxNamedReaders is the most people a room can have had read anything in it
+// for receipts to say who read each message, rather than just how many.
+const maxNamedReaders = 10
+
+// receipt says that a reader has now read up to the message with ID To,
+// having last read up to From, so every message in between has been seen by
+// one more person. Reader is the account of who read them, in small rooms.
+type receipt struct {
+	From   uint64 `json:"from"`
+	To     uint64 `json:"to"`
+	Reader string `json:"reader,omitempty"`
+}
+
+// noteRead records that the account has read up to the message with the given
+// ID, to be told to the room with the next receipts. It must only be called
+// from run.
+func (r *room) noteRead(account string, id uint64) {
+	if account == "" {
+		return
+	}
+	r.mu.Lock()
+	from := r.receipts[account]
+	if id > from {
+		r.receipts[account] = id
+	}
+	r.mu.Unlock()
+	if id <= from {
+		return
+	}
+	if p, ok := r.pendingReceipts[account]; ok {
+		p.To = id
+		return
+	}
+	r.pendingReceipts[account] = &receipt{From: from, To: id, Reader: account}
+}
+
+// sendReceipts tells everybody in the room about the reads since it last
+// did. It must only be called from run.
+func (r *room) sendReceipts() {
+	if len(r.pendingReceipts) == 0 {
+		return
+	}
+	named := len(r.receipts) <= maxNamedReaders
+	receipts := make([]receipt, 0, len(r.pendingReceipts))
+	for account, p := range r.pendingReceipts {
+		if !named {
+			p.Reader = ""
+		}
+		receipts = append(receipts, *p)
+		delete(r.pendingReceipts, account)
+	}
+	sort.Slice(receipts, func(i, j int) bool { return receipts[i].To < receipts[j].To })
+	r.deliver(&message{Receipts: receipts, System: true})
+}
+
+// seenBy says how many people have seen a message, and in small rooms who.
+type seenBy struct {
+	ID      uint64   `json:"id"`
+	Count   int      `json:"seen_by"`
+	Readers []string `json:"readers,omitempty"`
+}
+
+// seen returns who has seen each message in the room's recent history.
+func (r *room) seen() []seenBy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	named := len(r.receipts) <= maxNamedReaders
+	seen := make([]seenBy, 0, len(r.state.History))
+	for _, msg := range r.state.History {
+		if msg.System {
+			continue
+		}
+		s := seenBy{ID: msg.ID}
+		for account, id := range r.receipts {
+			if id < msg.ID {
+				continue
+			}
+			s.Count++
+			if named {
+				s.Readers = append(s.Readers, account)
+			}
+		}
+		sort.Strings(s.Readers)
+		seen = append(seen, s)
+	}
+	return seen
+}
+
+// serveReceipts serves GET /api/rooms/{name}/receipts, how many people have
+// seen each message in the room's recent history, and in small rooms who.
+func serveReceipts(w http.ResponseWriter, r *http.Request, room *room) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireRoomAccess(w, r, room) == "" {
+		return
+	}
+	writeJSON(w, room.seen())
+}
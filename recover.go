@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+type recoverHandler struct {
+	next http.Handler
+}
+
+func (h *recoverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		err := recover()
+		if err == nil {
+			return
+		}
+		if err == http.ErrAbortHandler {
+			// net/http uses this panic to abort a response on purpose.
+			panic(err)
+		}
+		log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+		// If the handler already started writing the response, or hijacked
+		// the connection, this does nothing useful, but does no harm either.
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}()
+	h.next.ServeHTTP(w, r)
+}
+
+// Recover wraps handler so that a panic while handling a request is logged,
+// along with its stack, and turned into a 500 response, rather than taking
+// down the whole server.
+func Recover(handler http.Handler) http.Handler {
+	return &recoverHandler{next: handler}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// member is somebody in a room, and the instances they are connected to it
+// on.
+type member struct {
+	Account   string   `json:"account,omitempty"`
+	Name      string   `json:"name"`
+	Instances []string `json:"instances,omitempty"`
+}
+
+// presenceStore keeps track of who is in which rooms across every instance
+// of the server, so that the member list shows everybody, wherever they are
+// connected.
+type presenceStore interface {
+	// arrived and left are told when somebody joins or leaves the room with
+	// the given key on this instance. They are called from the room's run
+	// loop, so must not block.
+	arrived(room, account, name string)
+	left(room, account, name string)
+
+	// members returns the people in the room with the given key.
+	members(room string) ([]member, error)
+}
+
+// members returns the people in the room: on every instance, if the room
+// keeps track of presence across them, or else on this one.
+func (r *room) members() ([]member, error) {
+	if r.presence != nil {
+		return r.presence.members(r.key())
+	}
+	r.mu.RLock()
+	members := make([]member, 0, len(r.names))
+	for _, claim := range r.names {
+		members = append(members, member{Account: claim.account, Name: claim.name})
+	}
+	r.mu.RUnlock()
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members, nil
+}
+
+// serveMembers serves GET /api/rooms/{name}/members, the people in the room.
+func serveMembers(w http.ResponseWriter, r *http.Request, room *room) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requireRoomAccess(w, r, room) == "" {
+		return
+	}
+	members, err := room.members()
+	if err != nil {
+		log.Println("Failed to list members:", err)
+		http.Error(w, "failed to list members", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, members)
+}
+
+// redisPresence keeps track of who is in which rooms in Redis. Each room has a
+// sorted set, chat:presence:<room>, of who is connected to it on which
+// instance, scored by when that expires. Every instance renews the entries of
+// the people connected to it every presenceHeartbeat, so an instance that
+// dies without saying who left has its people drop out of the member list
+// once their entries expire.
+type redisPresence struct {
+	client   *redis.Client
+	instance string
+
+	// here counts the connections of each person in each room on this
+	// instance.
+	mu   sync.Mutex
+	here map[presenceEntry]int
+}
+
+// presenceEntry is somebody connected to a room on an instance, as kept in
+// the room's sorted set.
+type presenceEntry struct {
+	Room     string `json:"-"`
+	Account  string `json:"account,omitempty"`
+	Name     string `json:"name"`
+	Instance string `json:"instance"`
+}
+
+const (
+	// presenceHeartbeat is how often an instance renews its people's
+	// entries, and presenceTTL how long they last without being renewed.
+	presenceHeartbeat = 10 * time.Second
+	presenceTTL       = 3 * presenceHeartbeat
+
+	// redisTimeout is how long a request to Redis may take.
+	redisTimeout = 5 * time.Second
+)
+
+// newRedisPresence connects to the Redis server at url, such as
+// redis://localhost:6379/0, as the named instance, and starts renewing its
+// entries.
+func newRedisPresence(url, instance string) (*redisPresence, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, err
+	}
+	p := &redisPresence{client: client, instance: instance, here: make(map[presenceEntry]int)}
+	go p.heartbeat()
+	return p, nil
+}
+
+// presenceKey is the key of the sorted set of who is in the room.
+func presenceKey(room string) string {
+	return "chat:presence:" + room
+}
+
+func (p *redisPresence) arrived(room, account, name string) {
+	e := presenceEntry{Room: room, Account: account, Name: name, Instance: p.instance}
+	p.mu.Lock()
+	p.here[e]++
+	first := p.here[e] == 1
+	p.mu.Unlock()
+	if first {
+		go p.renew([]presenceEntry{e})
+	}
+}
+
+func (p *redisPresence) left(room, account, name string) {
+	e := presenceEntry{Room: room, Account: account, Name: name, Instance: p.instance}
+	p.mu.Lock()
+	p.here[e]--
+	last := p.here[e] <= 0
+	if last {
+		delete(p.here, e)
+	}
+	p.mu.Unlock()
+	if last {
+		go p.remove(e)
+	}
+}
+
+// heartbeat renews the entries of everybody on this instance, and clears out
+// the expired entries of everybody else, every presenceHeartbeat.
+func (p *redisPresence) heartbeat() {
+	for range time.Tick(presenceHeartbeat) {
+		p.mu.Lock()
+		entries := make([]presenceEntry, 0, len(p.here))
+		for e := range p.here {
+			entries = append(entries, e)
+		}
+		p.mu.Unlock()
+		p.renew(entries)
+	}
+}
+
+// renew sets the entries to expire presenceTTL from now, and removes those
+// in their rooms that have already expired.
+func (p *redisPresence) renew(entries []presenceEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	now := time.Now()
+	expires := float64(now.Add(presenceTTL).Unix())
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	pipe := p.client.Pipeline()
+	rooms := make(map[string]bool)
+	for _, e := range entries {
+		b, _ := json.Marshal(e)
+		pipe.ZAdd(ctx, presenceKey(e.Room), redis.Z{Score: expires, Member: string(b)})
+		rooms[e.Room] = true
+	}
+	for room := range rooms {
+		pipe.ZRemRangeByScore(ctx, presenceKey(room), "-inf", "("+strconv.FormatInt(now.Unix(), 10))
+		pipe.Expire(ctx, presenceKey(room), presenceTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Println("Redis presence:", err)
+	}
+}
+
+// remove removes the entry, of somebody no longer in the room on this
+// instance.
+func (p *redisPresence) remove(e presenceEntry) {
+	b, _ := json.Marshal(e)
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := p.client.ZRem(ctx, presenceKey(e.Room), string(b)).Err(); err != nil {
+		log.Println("Redis presence:", err)
+	}
+}
+
+func (p *redisPresence) members(room string) ([]member, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	entries, err := p.client.ZRangeByScore(ctx, presenceKey(room), &redis.ZRangeBy{
+		Min: strconv.FormatInt(time.Now().Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	// people connected on more than one instance are listed once.
+	byName := make(map[string]*member)
+	for _, s := range entries {
+		var e presenceEntry
+		if err := json.Unmarshal([]byte(s), &e); err != nil {
+			continue
+		}
+		m, ok := byName[e.Name]
+		if !ok {
+			m = &member{Account: e.Account, Name: e.Name}
+			byName[e.Name] = m
+		}
+		m.Instances = append(m.Instances, e.Instance)
+	}
+	members := make([]member, 0, len(byName))
+	for _, m := range byName {
+		sort.Strings(m.Instances)
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// config is the configuration file given with -config, which sets flags so
+// they needn't all be on the command line. Flags on the command line take
+// precedence over it.
+//
+// Some flags, such as the providers' credentials and the rate limits, can be
+// changed without restarting the server by editing the file and reloading it,
+// with SIGHUP or POST /api/admin/reload. Reloading changes nothing else about
+// the server, so people stay connected to their rooms throughout.
+type config struct {
+	path string
+
+	// given are the flags given on the command line.
+	given map[string]bool
+
+	// mu serializes reloads, each of which sets the reloadable flags and
+	// then calls the hooks that put them into effect.
+	mu         sync.Mutex
+	reloadable map[string]bool
+	hooks      []func() error
+}
+
+// loadConfig sets the flags not given on the command line from the
+// configuration file at path, which has one flag per line, as name = value.
+// Blank lines, and lines starting with #, are ignored. If path is empty, there
+// is no file, and nothing can be reloaded.
+func loadConfig(path string) (*config, error) {
+	c := &config{path: path, given: make(map[string]bool), reloadable: make(map[string]bool)}
+	flag.Visit(func(f *flag.Flag) { c.given[f.Name] = true })
+	if path == "" {
+		return c, nil
+	}
+	values, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range values {
+		if c.given[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return nil, fmt.Errorf("%s: -%s: %v", path, name, err)
+		}
+	}
+	return c, nil
+}
+
+// read reads the flags set in the configuration file.
+func (c *config) read() (map[string]string, error) {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimLeft(strings.TrimSpace(name), "-")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: want name = value", c.path, n)
+		}
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: no flag called -%s", c.path, n, name)
+		}
+		values[name] = strings.TrimSpace(value)
+	}
+	return values, scanner.Err()
+}
+
+// onReload has hook called whenever the configuration is reloaded, to put
+// the flags named into effect. Only those flags are changed by reloading.
+func (c *config) onReload(hook func() error, flags ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range flags {
+		c.reloadable[name] = true
+	}
+	c.hooks = append(c.hooks, hook)
+}
+
+// reload reads the configuration file again, and puts the reloadable flags
+// it sets into effect. Reloadable flags it no longer sets go back to their
+// defaults. Changes to other flags are logged, and take effect on restart.
+func (c *config) reload() error {
+	if c.path == "" {
+		return errors.New("no -config file to reload")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values, err := c.read()
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		if !c.reloadable[name] && !c.given[name] && flag.Lookup(name).Value.String() != value {
+			log.Printf("Reload: -%s takes effect on restart", name)
+		}
+	}
+	for name := range c.reloadable {
+		if c.given[name] {
+			continue
+		}
+		value, ok := values[name]
+		if !ok {
+			value = flag.Lookup(name).DefValue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: -%s: %v", c.path, name, err)
+		}
+	}
+	var errs []error
+	for _, hook := range c.hooks {
+		if err := hook(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reloadHandler serves POST /api/admin/reload, which reloads the
+// configuration for those who manage the server.
+type reloadHandler struct {
+	config *config
+	roles  *roles
+}
+
+func (h *reloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	account := requirePermission(w, r, h.roles, permManageServer)
+	if account == "" {
+		return
+	}
+	if err := h.config.reload(); err != nil {
+		log.Println("Reload:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Println("Configuration reloaded by", account)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// remindCommand is /remind, the reminder bot:
+//
+//	/remind me in 2h to check the build
+//	/remind me at 2006-01-02T15:04:05Z to go home
+//	/remind list
+//	/remind cancel <id>
+//
+// When a reminder is due, the bot mentions whoever asked for it in the room,
+// so they are notified even if they aren't there.
+func remindCommand(c *client, args string) error {
+	s := c.room.scheduler
+	if s == nil {
+		return errors.New("reminders can't be set here")
+	}
+	fields := strings.Fields(args)
+	switch {
+	case len(fields) == 1 && fields[0] == "list":
+		n := 0
+		for _, m := range s.list(c.account()) {
+			if m.Reminder {
+				c.reply(fmt.Sprintf("%s: %s: %s", m.ID, m.At.Format(time.RFC1123), m.Message))
+				n++
+			}
+		}
+		if n == 0 {
+			c.reply("You have no reminders")
+		}
+		return nil
+	case len(fields) == 2 && fields[0] == "cancel":
+		if err := s.cancel(c.account(), fields[1]); err != nil {
+			return err
+		}
+		c.replyf("Cancelled %s", fields[1])
+		return nil
+	case len(fields) < 4 || fields[0] != "me" || (fields[1] != "in" && fields[1] != "at"):
+		return errUsage
+	}
+	at, err := parseWhen(fields[2], time.Now())
+	if err != nil {
+		return err
+	}
+	what := fields[3:]
+	if what[0] == "to" && len(what) > 1 {
+		what = what[1:]
+	}
+	m := &scheduledMessage{
+		Room:     c.room.name,
+		Account:  c.account(),
+		Name:     c.name(),
+		Message:  strings.Join(what, " "),
+		At:       at,
+		Reminder: true,
+	}
+	if err := s.schedule(m); err != nil {
+		return err
+	}
+	c.reply(fmt.Sprintf("Reminder %s set for %s", m.ID, at.Format(time.RFC1123)))
+	return nil
+}
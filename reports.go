@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Where a report has got to.
+const (
+	reportOpen     = "open"
+	reportResolved = "resolved"
+)
+
+const (
+	reportsFile = "reports.json"
+
+	// maxReasonLength is the longest reason somebody can give for reporting
+	// a message.
+	maxReasonLength = 500
+)
+
+// report is somebody's complaint about a message, waiting in the moderation
+// queue for a moderator to deal with. It keeps a copy of the message as it
+// was when reported, in case it is later lost from the room's history.
+type report struct {
+	ID       int       `json:"id"`
+	Room     string    `json:"room"`
+	Message  message   `json:"message"`
+	Reporter string    `json:"reporter"`
+	Reason   string    `json:"reason"`
+	When     time.Time `json:"when"`
+	Status   string    `json:"status"`
+
+	// ResolvedBy is the moderator who resolved the report, and Resolution
+	// what they had to say about it.
+	ResolvedBy string    `json:"resolved_by,omitempty"`
+	Resolution string    `json:"resolution,omitempty"`
+	Resolved   time.Time `json:"resolved,omitempty"`
+}
+
+// reportStore is the moderation queue. Reports are kept in reports.json in
+// the data directory, if there is one.
+type reportStore struct {
+	path string
+
+	mu      sync.Mutex
+	reports []*report
+	next    int
+}
+
+// openReportStore loads the moderation queue from dir, if it is not empty.
+func openReportStore(dir string) (*reportStore, error) {
+	s := &reportStore{}
+	if dir == "" {
+		return s, nil
+	}
+	s.path = filepath.Join(dir, reportsFile)
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.reports); err != nil {
+		return nil, err
+	}
+	for _, r := range s.reports {
+		if r.ID > s.next {
+			s.next = r.ID
+		}
+	}
+	return s, nil
+}
+
+// file adds a report to the queue, giving it its ID.
+func (s *reportStore) file(r *report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	r.ID = s.next
+	r.Status = reportOpen
+	s.reports = append(s.reports, r)
+	return s.save()
+}
+
+// list returns copies of the reports with the given status, or of every
+// report if status is empty, oldest first.
+func (s *reportStore) list(status string) []report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reports := []report{}
+	for _, r := range s.reports {
+		if status == "" || r.Status == status {
+			reports = append(reports, *r)
+		}
+	}
+	return reports
+}
+
+// resolve marks the report with the given ID resolved by moderator, or opens
+// it again.
+func (s *reportStore) resolve(id int, status, moderator, resolution string) (*report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.reports {
+		if r.ID != id {
+			continue
+		}
+		r.Status, r.Resolution = status, resolution
+		if status == reportResolved {
+			r.ResolvedBy, r.Resolved = moderator, time.Now()
+		} else {
+			r.ResolvedBy, r.Resolved = "", time.Time{}
+		}
+		resolved := *r
+		return &resolved, s.save()
+	}
+	return nil, fmt.Errorf("there is no report %d", id)
+}
+
+func (s *reportStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return saveJSON(s.path, s.reports)
+}
+
+// reportCommand is /report, which reports a message in the room to its
+// moderators.
+func reportCommand(c *client, args string) error {
+	if c.room.reports == nil {
+		return errors.New("messages can't be reported here")
+	}
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		return errUsage
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(fields[0], "#"), 10, 64)
+	if err != nil {
+		return errUsage
+	}
+	reason := strings.TrimSpace(strings.TrimPrefix(args, fields[0]))
+	if utf8.RuneCountInString(reason) > maxReasonLength {
+		return errors.New("that reason is too long")
+	}
+	c.room.mu.RLock()
+	var snapshot message
+	msg := c.room.state.message(id)
+	if msg != nil {
+		snapshot = message{ID: msg.ID, Name: msg.Name, Message: msg.Message, When: msg.When}
+	}
+	c.room.mu.RUnlock()
+	if msg == nil {
+		return fmt.Errorf("there is no recent message %d", id)
+	}
+	r := &report{
+		Room:     c.room.name,
+		Message:  snapshot,
+		Reporter: c.account(),
+		Reason:   reason,
+		When:     time.Now(),
+	}
+	if err := c.room.reports.file(r); err != nil {
+		return err
+	}
+	c.reply("Thank you: the moderators will look at your report")
+	c.room.alertModerators(fmt.Sprintf("%s reported a message from %s as report #%d: %s", c.name(), snapshot.Name, r.ID, reason))
+	return nil
+}
+
+// reportsHandler serves the moderation queue to those who may delete others'
+// messages, under
+// /api/admin/reports: GET lists the reports, optionally only those with the
+// ?status given, and PUT /api/admin/reports/{id} changes a report's status,
+// with a body such as {"status": "resolved", "resolution": "warned them"}.
+type reportsHandler struct {
+	reports *reportStore
+	roles   *roles
+}
+
+func (h *reportsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	moderator := requirePermission(w, r, h.roles, permDeleteOthers)
+	if moderator == "" {
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/admin/reports"), "/")
+	switch {
+	case r.Method == "GET" && id == "":
+		writeJSON(w, h.reports.list(r.URL.Query().Get("status")))
+	case r.Method == "PUT" && id != "":
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		var change struct {
+			Status     string `json:"status"`
+			Resolution string `json:"resolution"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&change); err != nil {
+			http.Error(w, "bad report: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if change.Status != reportOpen && change.Status != reportResolved {
+			http.Error(w, "the status must be open or resolved", http.StatusBadRequest)
+			return
+		}
+		report, err := h.reports.resolve(n, change.Status, moderator, change.Resolution)
+		if report == nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "failed to save report", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, report)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
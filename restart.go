@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The server restarts without anybody being unable to connect by starting a
+// new process of itself, and handing it the sockets it listens on. Once the
+// new process is serving, the old one stops accepting connections, and closes
+// the ones it has, telling clients to connect again, which they do to the new
+// one. Meanwhile, the old process records nothing, so the new one can take
+// over the rooms' data.
+//
+// These environment variables tell the new process what it has been handed.
+const (
+	// inheritEnv names what each listener handed over is for, comma
+	// separated, in the order of their file descriptors from 3.
+	inheritEnv = "CHAT_LISTENERS"
+
+	// readyEnv is the file descriptor the new process writes to once it is
+	// serving.
+	readyEnv = "CHAT_READY_FD"
+)
+
+// listeners are the sockets the server listens on, named by what they are
+// for, such as "http" or "irc", which it hands over when it restarts.
+type listeners struct {
+	mu        sync.Mutex
+	inherited map[string][]*os.File
+	open      []namedListener
+}
+
+// namedListener is a listener, or packet connection, and what it is for.
+type namedListener struct {
+	name string
+	l    fileListener
+}
+
+// fileListener is a listener, or packet connection, with a file descriptor
+// that can be handed to another process.
+type fileListener interface {
+	File() (*os.File, error)
+	Close() error
+}
+
+// inheritListeners returns the listeners handed to us, if we were started by
+// a restarting server, and otherwise none yet.
+func inheritListeners() *listeners {
+	defer os.Unsetenv(inheritEnv)
+	ls := &listeners{inherited: make(map[string][]*os.File)}
+	if names := os.Getenv(inheritEnv); names != "" {
+		for i, name := range strings.Split(names, ",") {
+			fd := listenFDsStart + i
+			ls.inherited[name] = append(ls.inherited[name], os.NewFile(uintptr(fd), name))
+		}
+	}
+	return ls
+}
+
+// inherit returns the listeners for name that were handed to us.
+func (ls *listeners) inherit(name string) ([]net.Listener, error) {
+	ls.mu.Lock()
+	files := ls.inherited[name]
+	delete(ls.inherited, name)
+	ls.mu.Unlock()
+	var inherited []net.Listener
+	for _, f := range files {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s listener handed over: %v", name, err)
+		}
+		ls.add(name, l)
+		if l.Addr().Network() == "unix" {
+			l = unixListener{l}
+		}
+		inherited = append(inherited, l)
+	}
+	return inherited, nil
+}
+
+// listen listens for name on the TCP address addr, or takes over the
+// listener for it that was handed to us.
+func (ls *listeners) listen(name, addr string) (net.Listener, error) {
+	inherited, err := ls.inherit(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(inherited) > 0 {
+		return inherited[0], nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ls.add(name, l)
+	return l, nil
+}
+
+// listenPacket listens for name on the UDP address addr, or takes over the
+// connection for it that was handed to us.
+func (ls *listeners) listenPacket(name, addr string) (net.PacketConn, error) {
+	ls.mu.Lock()
+	files := ls.inherited[name]
+	delete(ls.inherited, name)
+	ls.mu.Unlock()
+	var conn net.PacketConn
+	var err error
+	if len(files) > 0 {
+		conn, err = net.FilePacketConn(files[0])
+		files[0].Close()
+	} else {
+		conn, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ls.add(name, conn)
+	return conn, nil
+}
+
+// add has l, listening for name, handed over when we restart.
+func (ls *listeners) add(name string, l interface{}) {
+	if u, ok := l.(unixListener); ok {
+		l = u.Listener
+	}
+	fl, ok := l.(fileListener)
+	if !ok {
+		log.Printf("The %s listener can't be handed over on restart", name)
+		return
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.open = append(ls.open, namedListener{name: name, l: fl})
+}
+
+// close closes every listener. Those handed over stay open in the new
+// process.
+func (ls *listeners) close() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, nl := range ls.open {
+		nl.l.Close()
+	}
+}
+
+// handOver starts a new process of the server, with the same arguments,
+// handing it the listeners, and waits until it says it is serving. If it
+// doesn't within timeout, it is killed.
+func (ls *listeners) handOver(timeout time.Duration) error {
+	// the binary may have been replaced, which is the point.
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	ls.mu.Lock()
+	for _, nl := range ls.open {
+		// the socket file of a unix listener must outlive ours.
+		if u, ok := nl.l.(*net.UnixListener); ok {
+			u.SetUnlinkOnClose(false)
+		}
+		f, err := nl.l.File()
+		if err != nil {
+			ls.mu.Unlock()
+			return fmt.Errorf("%s listener: %v", nl.name, err)
+		}
+		names = append(names, nl.name)
+		files = append(files, f)
+	}
+	ls.mu.Unlock()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		inheritEnv+"="+strings.Join(names, ","),
+		readyEnv+"="+strconv.Itoa(listenFDsStart+len(files)))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	// the new process writes a byte once it is serving; if it exits
+	// first, the pipe is closed without one.
+	r.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process not ready: %v", err)
+	}
+	log.Println("Handed over to new process", cmd.Process.Pid)
+	return nil
+}
+
+// ready tells the server that started us, if one did when it restarted, that
+// we are serving, so that it can stop.
+func ready() {
+	defer os.Unsetenv(readyEnv)
+	fd, err := strconv.Atoi(os.Getenv(readyEnv))
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// handingOver is closed once the server has handed over to a new process,
+// after which its servers stop serving, as they are expected to.
+var handingOver = make(chan struct{})
+
+// serveFailed logs that a server stopped serving with err, and exits, unless
+// it stopped because the server has handed over.
+func serveFailed(what string, err error) {
+	select {
+	case <-handingOver:
+	default:
+		log.Fatal(what, err)
+	}
+}
+
+// handover restarts the server on SIGUSR2, handing over to a new process of
+// it, and then waits for the old process's connections to close.
+type handover struct {
+	listeners *listeners
+	rooms     []*room
+	limiter   *connLimiter
+
+	// stops are called to stop the servers, gracefully, once everybody has
+	// been told to connect again, giving up when the context is done.
+	stops []func(ctx context.Context)
+
+	// timeout is how long the new process has to start, and then how long
+	// the old one's connections have to close.
+	timeout time.Duration
+
+	// done is closed once the old process is done with.
+	done chan struct{}
+}
+
+// run hands over every time we are sent SIGUSR2, until it has done so.
+func (h *handover) run() {
+	restart := make(chan os.Signal, 1)
+	signal.Notify(restart, syscall.SIGUSR2)
+	for range restart {
+		if err := h.handOver(); err != nil {
+			log.Println("Restart:", err)
+			continue
+		}
+		close(h.done)
+		return
+	}
+}
+
+func (h *handover) handOver() error {
+	log.Println("Restarting")
+	// the new process reads the rooms' data as it starts, so they must stop
+	// recording first.
+	for _, r := range h.rooms {
+		r.freeze()
+	}
+	if err := h.listeners.handOver(h.timeout); err != nil {
+		for _, r := range h.rooms {
+			r.thaw()
+		}
+		return err
+	}
+	close(handingOver)
+	h.listeners.close()
+	for _, r := range h.rooms {
+		r.closeClients()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	for _, stop := range h.stops {
+		stop(ctx)
+	}
+	h.limiter.wait(ctx)
+	return nil
+}
+
+// restartStep is a step of restarting the server for a room to take.
+type restartStep struct {
+	// frozen is whether the room should be frozen, and closeClients whether
+	// its clients should be turned away.
+	frozen       bool
+	closeClients bool
+
+	done chan struct{}
+}
+
+// freeze stops the room recording anything, saving its state as it is, so
+// that the new process starts from it.
+func (r *room) freeze() {
+	r.step(&restartStep{frozen: true})
+}
+
+// thaw lets the room record again, if the restart failed.
+func (r *room) thaw() {
+	r.step(&restartStep{})
+}
+
+// closeClients turns every client in the room away, telling them the server
+// is restarting, so that they connect again.
+func (r *room) closeClients() {
+	r.step(&restartStep{frozen: true, closeClients: true})
+}
+
+// step has the room take a step of restarting, and waits until it has.
+func (r *room) step(step *restartStep) {
+	step.done = make(chan struct{})
+	r.restarts <- step
+	<-step.done
+}
+
+// restart takes a step of restarting. It must only be called from run.
+func (r *room) restart(step *restartStep) {
+	defer close(step.done)
+	if step.frozen && !r.frozen && r.journal != nil {
+		r.mu.RLock()
+		err := r.journal.snapshot(r.state)
+		r.mu.RUnlock()
+		if err != nil {
+			log.Println("Failed to snapshot room:", err)
+		}
+	}
+	r.frozen = step.frozen
+	if step.closeClients {
+		r.turnAwayAll(closeReason{Error: reasonRestarting})
+	}
+}
+
+// turnAwayAll turns every client in the room away for the given reason. It
+// must only be called from run.
+func (r *room) turnAwayAll(reason closeReason) {
+	for client, w := range r.clients {
+		// the client's writer only looks at why it was turned away once its
+		// worker has closed its send channel.
+		client.rejected = &reason
+		delete(r.clients, client)
+		if client.wire != nil && client.wire != jsonWire {
+			r.wires[client.wire]--
+		}
+		r.releaseName(client.name(), client.account())
+		w.ops <- fanoutOp{remove: client}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Big files can be uploaded in chunks, with the tus protocol
+// (https://tus.io/protocols/resumable-upload), so that an upload cut off by
+// a flaky connection carries on from the last chunk the server has, rather
+// than starting again. The client makes a resumable upload by POSTing to
+// /api/uploads/resumable, saying how long the file is, and PATCHes chunks of
+// it to the URL it is given, each at the offset HEAD says the server has got
+// to. Each chunk may come with its checksum, and the file with its SHA-256 in
+// its metadata, which are checked before it is accepted. Once the whole file
+// is there, it is uploaded as if it had been sent in one go, and the last
+// PATCH answers with the upload.
+
+// tusVersion is the version of the tus protocol spoken.
+const tusVersion = "1.0.0"
+
+// partialTTL is how long a resumable upload may go unfinished before it is
+// thrown away.
+const partialTTL = 24 * time.Hour
+
+// statusChecksumMismatch is the status tus answers a chunk whose checksum is
+// wrong with.
+const statusChecksumMismatch = 460
+
+// partialUpload is a resumable upload that hasn't been finished. Its chunks
+// are kept in the uploads' partial directory, alongside a JSON file
+// describing it.
+type partialUpload struct {
+	ID      string    `json:"id"`
+	Account string    `json:"account"`
+	Name    string    `json:"name"`
+	Kind    string    `json:"kind,omitempty"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Length  int64     `json:"length"`
+	Offset  int64     `json:"offset"`
+	When    time.Time `json:"when"`
+
+	// mu is held while a chunk is written, so that only one is at a time.
+	mu sync.Mutex
+}
+
+func (s *uploadStore) partialPath(id string) string {
+	return filepath.Join(s.dir, "partial", id)
+}
+
+// loadPartials loads the unfinished resumable uploads, throwing away those
+// that have been left too long.
+func (s *uploadStore) loadPartials() error {
+	s.partials = make(map[string]*partialUpload)
+	if err := os.MkdirAll(filepath.Join(s.dir, "partial"), 0700); err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(s.dir, "partial", "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		p := &partialUpload{}
+		if err := json.Unmarshal(b, p); err != nil || !uploadIDPattern.MatchString(p.ID) {
+			continue
+		}
+		if time.Since(p.When) > partialTTL {
+			s.removePartial(p)
+			continue
+		}
+		s.partials[p.ID] = p
+	}
+	return nil
+}
+
+// removePartial throws away a resumable upload. It must be called holding mu,
+// if the store is in use.
+func (s *uploadStore) removePartial(p *partialUpload) {
+	delete(s.partials, p.ID)
+	os.Remove(s.partialPath(p.ID))
+	os.Remove(s.partialPath(p.ID) + ".json")
+}
+
+// createPartial starts a resumable upload, by account, of a file of the given
+// length. Files the policy wouldn't allow, by their name and length, are
+// turned down straight away.
+func (s *uploadStore) createPartial(account, name, kind, sum string, length int64) (*partialUpload, error) {
+	if length > s.maxSize {
+		return nil, &uploadRefusal{http.StatusRequestEntityTooLarge, "the file is too big"}
+	}
+	if kind == uploadVoice && s.voice == nil {
+		return nil, errVoiceOff
+	}
+	if err := s.policy.checkName(name); err != nil {
+		return nil, err
+	}
+	if allowance := s.allowance(account); allowance >= 0 && length > allowance {
+		return nil, errDailyUploads
+	}
+	id, err := newAccountID()
+	if err != nil {
+		return nil, err
+	}
+	p := &partialUpload{ID: id, Account: account, Name: filepath.Base(name), Kind: kind, SHA256: strings.ToLower(sum), Length: length, When: time.Now()}
+	f, err := os.OpenFile(s.partialPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	if err := saveJSON(s.partialPath(id)+".json", p); err != nil {
+		os.Remove(s.partialPath(id))
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// while we're here, throw away the uploads nobody finished.
+	for _, old := range s.partials {
+		if time.Since(old.When) > partialTTL {
+			s.removePartial(old)
+		}
+	}
+	s.partials[id] = p
+	return p, nil
+}
+
+// partial returns the account's unfinished resumable upload with the given
+// ID, or nil.
+func (s *uploadStore) partial(account, id string) *partialUpload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.partials[id]
+	if p == nil || p.Account != account {
+		return nil
+	}
+	return p
+}
+
+// writeChunk writes a chunk of the upload at offset, checking it against sum,
+// if it is given, with h. A chunk that turns out to be wrong is thrown away;
+// otherwise as much of it as arrived is kept. It must be called holding p.mu.
+func (s *uploadStore) writeChunk(p *partialUpload, offset int64, chunk io.Reader, h hash.Hash, sum []byte) error {
+	if offset != p.Offset {
+		return &uploadRefusal{http.StatusConflict, "the chunk isn't at the upload's offset"}
+	}
+	f, err := os.OpenFile(s.partialPath(p.ID), os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	// a byte more than is left is read, to tell if there was more.
+	var w io.Writer = f
+	if h != nil {
+		w = io.MultiWriter(f, h)
+	}
+	n, err := io.Copy(w, io.LimitReader(chunk, p.Length-offset+1))
+	switch {
+	case offset+n > p.Length:
+		err = &uploadRefusal{http.StatusRequestEntityTooLarge, "the chunk goes past the end of the file"}
+	case err == nil && h != nil && !bytes.Equal(h.Sum(nil), sum):
+		err = &uploadRefusal{statusChecksumMismatch, "the chunk's checksum is wrong"}
+	}
+	if err != nil && (h != nil || offset+n > p.Length) {
+		f.Truncate(offset)
+		return err
+	}
+	p.Offset += n
+	if serr := saveJSON(s.partialPath(p.ID)+".json", p); serr != nil {
+		return serr
+	}
+	return err
+}
+
+// finishPartial uploads a resumable upload that has all its chunks, as if it
+// had been sent in one go, once it has checked the file's checksum. It must
+// be called holding p.mu.
+func (s *uploadStore) finishPartial(p *partialUpload) (*upload, error) {
+	defer func() {
+		s.mu.Lock()
+		s.removePartial(p)
+		s.mu.Unlock()
+	}()
+	f, err := os.Open(s.partialPath(p.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if p.SHA256 != "" {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != p.SHA256 {
+			return nil, &uploadRefusal{statusChecksumMismatch, "the file's SHA-256 is wrong"}
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	return s.create(p.Account, p.Name, p.Kind, f)
+}
+
+// tusMetadata parses a tus Upload-Metadata header: comma separated keys, each
+// followed by its value in base64.
+func tusMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if b, err := base64.StdEncoding.DecodeString(value); err == nil && key != "" {
+			meta[key] = string(b)
+		}
+	}
+	return meta
+}
+
+// tusChecksum parses a tus Upload-Checksum header, an algorithm and a sum in
+// base64, returning the hash to check a chunk with, or nil if there is no
+// checksum.
+func tusChecksum(header string) (hash.Hash, []byte, error) {
+	if header == "" {
+		return nil, nil, nil
+	}
+	algorithm, value, _ := strings.Cut(header, " ")
+	sum, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, nil, &uploadRefusal{http.StatusBadRequest, "bad Upload-Checksum"}
+	}
+	switch algorithm {
+	case "sha1":
+		return sha1.New(), sum, nil
+	case "sha256":
+		return sha256.New(), sum, nil
+	}
+	return nil, nil, &uploadRefusal{http.StatusBadRequest, "the checksum algorithm must be sha1 or sha256"}
+}
+
+// serveResumable serves /api/uploads/resumable, where resumable uploads are
+// made, and /api/uploads/resumable/{id}, where their chunks are sent.
+func (h *uploadsHandler) serveResumable(w http.ResponseWriter, r *http.Request, account, id string) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,checksum,termination")
+		w.Header().Set("Tus-Checksum-Algorithm", "sha1,sha256")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.store.maxSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+	if id == "" {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST, OPTIONS")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			http.Error(w, "bad Upload-Length", http.StatusBadRequest)
+			return
+		}
+		meta := tusMetadata(r.Header.Get("Upload-Metadata"))
+		p, err := h.store.createPartial(account, meta["filename"], meta["kind"], meta["sha256"], length)
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		w.Header().Set("Location", "/api/uploads/resumable/"+p.ID)
+		w.Header().Set("Upload-Offset", "0")
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	p := h.store.partial(account, id)
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "HEAD":
+		p.mu.Lock()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(p.Offset, 10))
+		p.mu.Unlock()
+		w.Header().Set("Upload-Length", strconv.FormatInt(p.Length, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	case "PATCH":
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			http.Error(w, "chunks must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad Upload-Offset", http.StatusBadRequest)
+			return
+		}
+		hash, sum, err := tusChecksum(r.Header.Get("Upload-Checksum"))
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if err := h.store.writeChunk(p, offset, r.Body, hash, sum); err != nil {
+			uploadError(w, err)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(p.Offset, 10))
+		if p.Offset < p.Length {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		u, err := h.store.finishPartial(p)
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		writeJSON(w, u)
+	case "DELETE":
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		h.store.mu.Lock()
+		h.store.removePartial(p)
+		h.store.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "HEAD, PATCH, DELETE, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// uploadError tells the client why its upload failed.
+func uploadError(w http.ResponseWriter, err error) {
+	var refused *uploadRefusal
+	if errors.As(err, &refused) {
+		http.Error(w, refused.reason, refused.status)
+		return
+	}
+	log.Println("Failed to save upload:", err)
+	http.Error(w, "failed to save upload", http.StatusInternalServerError)
+}
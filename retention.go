@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// retention is how long a room keeps its messages for: those older than Days
+// days, and all but the latest Messages, are pruned from its history and its
+// journal. Zero keeps them all. A room on compliance Hold keeps everything,
+// whatever the policy would otherwise be.
+type retention struct {
+	Days     int  `json:"days,omitempty"`
+	Messages int  `json:"messages,omitempty"`
+	Hold     bool `json:"hold,omitempty"`
+}
+
+// setRetention gives the room a retention policy of its own, or, if p is nil,
+// has it follow the server's.
+func (r *room) setRetention(p *retention) {
+	r.changes <- &roomEvent{Type: eventRetention, Retention: p, When: time.Now()}
+}
+
+// retention returns the room's own retention policy, or nil if it follows the
+// server's.
+func (r *room) retention() *retention {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.state.Retention == nil {
+		return nil
+	}
+	p := *r.state.Retention
+	return &p
+}
+
+// janitor prunes the messages rooms no longer keep, every interval, by their
+// own retention policies or the server's.
+type janitor struct {
+	rooms    []*room
+	policy   retention
+	interval time.Duration
+}
+
+func (j *janitor) run() {
+	for range time.Tick(j.interval) {
+		for _, r := range j.rooms {
+			j.sweep(r)
+		}
+	}
+}
+
+// sweep has the room prune the messages its policy no longer keeps, if there
+// are any.
+func (j *janitor) sweep(r *room) {
+	if r.journal == nil {
+		return
+	}
+	p := r.retention()
+	if p == nil {
+		p = &j.policy
+	}
+	if p.Hold || (p.Days == 0 && p.Messages == 0) {
+		return
+	}
+	before, err := r.pruneBefore(*p, time.Now())
+	if err != nil {
+		log.Println("Retention: failed to read journal:", err)
+		return
+	}
+	r.mu.RLock()
+	pruned := r.state.Pruned
+	r.mu.RUnlock()
+	if before > pruned {
+		r.changes <- &roomEvent{Type: eventPrune, Target: before, When: time.Now()}
+	}
+}
+
+// pruneBefore works out which messages the policy p no longer keeps, at now:
+// those numbered before the sequence number returned.
+func (r *room) pruneBefore(p retention, now time.Time) (uint64, error) {
+	cutoff := now.AddDate(0, 0, -p.Days)
+	var before uint64
+	// latest holds the latest p.Messages messages, as a ring.
+	latest := make([]uint64, p.Messages)
+	n := 0
+	err := r.journal.events(func(e *roomEvent) error {
+		if e.Type != eventMessage {
+			return nil
+		}
+		if p.Days > 0 && e.When.Before(cutoff) {
+			before = e.Seq + 1
+		}
+		if p.Messages > 0 {
+			latest[n%p.Messages] = e.Seq
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if p.Messages > 0 && n > p.Messages {
+		// the oldest message kept is the next to be overwritten.
+		if oldest := latest[n%p.Messages]; oldest > before {
+			before = oldest
+		}
+	}
+	return before, nil
+}
+
+// prune removes the messages numbered before the given sequence number from
+// the room's journal, having snapshotted its state without them, so that
+// they are gone for good. It must only be called from run.
+func (r *room) prune(before uint64) {
+	r.mu.RLock()
+	err := r.journal.snapshot(r.state)
+	r.mu.RUnlock()
+	if err != nil {
+		log.Println("Retention: failed to snapshot room:", err)
+		return
+	}
+	if err := r.journal.prune(before); err != nil {
+		log.Println("Retention: failed to prune journal:", err)
+		return
+	}
+	r.tracer.Trace("Pruned messages before ", before)
+}
+
+// serveRetention serves /api/admin/rooms/{name}/retention: GET returns the
+// room's own retention policy, PUT sets it and DELETE has the room follow the
+// server's again.
+func serveRetention(w http.ResponseWriter, r *http.Request, room *room) {
+	switch r.Method {
+	case "GET":
+		p := room.retention()
+		if p == nil {
+			http.Error(w, "the room follows the server's retention policy", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, p)
+	case "PUT":
+		var p retention
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&p); err != nil {
+			http.Error(w, "bad retention policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if p.Days < 0 || p.Messages < 0 {
+			http.Error(w, "days and messages can't be negative", http.StatusBadRequest)
+			return
+		}
+		room.setRetention(&p)
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		room.setRetention(nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The roles people can have in a room, from the most trusted down.
+const (
+	roleOwner     = "owner"
+	roleAdmin     = "admin"
+	roleModerator = "moderator"
+	roleMember    = "member"
+	roleGuest     = "guest"
+)
+
+// permission is something only some roles may do.
+type permission string
+
+const (
+	// permPost is sending messages to the room, and voting in and starting
+	// polls.
+	permPost permission = "post"
+
+	// permDeleteOthers is deleting other people's messages, and dealing with
+	// the moderation queue, reports and shadow bans.
+	permDeleteOthers permission = "delete_others"
+
+	// permManageRoom is pinning messages, setting up the room's bots, and
+	// managing who belongs to an organization.
+	permManageRoom permission = "manage_room"
+
+	// permOwnRoom is archiving a room, setting its retention policy,
+	// exporting its whole history, making it public and choosing its
+	// owners, which the server's owners may do in every room, and a room's
+	// own owners in theirs.
+	permOwnRoom permission = "own_room"
+
+	// permManageServer is what only the server's owners may do, such as
+	// reloading its configuration.
+	permManageServer permission = "manage_server"
+)
+
+// rolePermissions is the permission matrix: what each role may do. Guests
+// may only read.
+var rolePermissions = map[string][]permission{
+	roleOwner:     {permPost, permDeleteOthers, permManageRoom, permOwnRoom, permManageServer},
+	roleAdmin:     {permPost, permDeleteOthers, permManageRoom},
+	roleModerator: {permPost, permDeleteOthers},
+	roleMember:    {permPost},
+	roleGuest:     nil,
+}
+
+// roles says which role each account has in a room. It is set up when the
+// server starts, and only read after that.
+type roles struct {
+	accounts map[string]string
+
+	// fallback is the role of everybody not in accounts.
+	fallback string
+}
+
+// newRoles makes roles in which everybody has the fallback role.
+func newRoles(fallback string) (*roles, error) {
+	if _, ok := rolePermissions[fallback]; !ok {
+		return nil, fmt.Errorf("unknown role %q", fallback)
+	}
+	return &roles{accounts: make(map[string]string), fallback: fallback}, nil
+}
+
+// grant gives each of the accounts the role, unless it already has a more
+// trusted one.
+func (rs *roles) grant(role string, accounts ...string) {
+	for _, account := range accounts {
+		if current, ok := rs.accounts[account]; !ok || len(rolePermissions[role]) > len(rolePermissions[current]) {
+			rs.accounts[account] = role
+		}
+	}
+}
+
+// of returns the account's role.
+func (rs *roles) of(account string) string {
+	if role, ok := rs.accounts[account]; ok {
+		return role
+	}
+	return rs.fallback
+}
+
+// can reports whether the account has the permission.
+func (rs *roles) can(account string, p permission) bool {
+	for _, have := range rolePermissions[rs.of(account)] {
+		if have == p {
+			return true
+		}
+	}
+	return false
+}
+
+// with returns the accounts given a role with the permission.
+func (rs *roles) with(p permission) []string {
+	var accounts []string
+	for account := range rs.accounts {
+		if rs.can(account, p) {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts
+}
+
+// can reports whether c's user has the permission in the room.
+func (r *room) can(c *client, p permission) bool {
+	return r.allows(c.account(), p)
+}
+
+// errNotAllowed is returned by commands people don't have the permission to
+// run.
+func errNotAllowed(p permission) error {
+	return fmt.Errorf("you don't have permission to %s", strings.Replace(string(p), "_", " ", -1))
+}
+
+// requirePermission checks that the signed in user making an API request has
+// the permission, returning their account if so. If not, it replies saying
+// why, and returns the empty string. Who is signed in comes from an auth
+// cookie only if the server signed it, or from a personal access token, by
+// way of TokenAuth.
+func requirePermission(w http.ResponseWriter, r *http.Request, rs *roles, p permission) string {
+	account := currentAccountID(r)
+	if account == "" {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return ""
+	}
+	if !rs.can(account, p) {
+		http.Error(w, errNotAllowed(p).Error(), http.StatusForbidden)
+		return ""
+	}
+	return account
+}
+
+// requireRoomAccess checks that the user making an API request about the room
+// is signed in and may see it, so is a member of its organization if it has
+// one, returning their account if so. If not, it replies saying why, and
+// returns the empty string.
+func requireRoomAccess(w http.ResponseWriter, r *http.Request, room *room) string {
+	account := currentAccountID(r)
+	if account == "" {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return ""
+	}
+	if room.org != nil && !room.org.member(account) {
+		http.Error(w, "You are not a member of "+room.org.Name, http.StatusForbidden)
+		return ""
+	}
+	return account
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/objx"
+)
+
+// TestHandMadeCookieRefused checks that only auth cookies the server signed
+// are trusted: anybody can see an owner's account ID, and must not be able to
+// write it into a cookie of their own to act as them.
+func TestHandMadeCookieRefused(t *testing.T) {
+	cookieKey = []byte("test secret")
+	rs, err := newRoles(roleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.grant(roleOwner, "owner")
+	data := objx.New(map[string]interface{}{"id": "owner", "name": "owner"})
+
+	cookies := map[string]string{
+		"unsigned":     data.MustBase64(),
+		"badly signed": data.MustBase64() + "." + cookieSignature("something else"),
+		"signed by another key": func() string {
+			cookieKey = []byte("another secret")
+			defer func() { cookieKey = []byte("test secret") }()
+			return signCookie(data)
+		}(),
+	}
+	for name, value := range cookies {
+		r := httptest.NewRequest("POST", "/api/admin/reload", nil)
+		r.AddCookie(&http.Cookie{Name: "auth", Value: value})
+		w := httptest.NewRecorder()
+		if account := requirePermission(w, r, rs, permManageServer); account != "" || w.Code != http.StatusUnauthorized {
+			t.Errorf("%s cookie: got account %q and status %d, want it refused with %d", name, account, w.Code, http.StatusUnauthorized)
+		}
+
+		// nor does the cookie get through TokenAuth, which trusts cookies
+		// when there is no token.
+		var seen string
+		h := TokenAuth(nil, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = currentAccountID(r) }))
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if seen != "" {
+			t.Errorf("%s cookie: TokenAuth let it through as %q", name, seen)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/api/admin/reload", nil)
+	r.AddCookie(&http.Cookie{Name: "auth", Value: signCookie(data)})
+	if account := requirePermission(httptest.NewRecorder(), r, rs, permManageServer); account != "owner" {
+		t.Errorf("signed cookie: got account %q, want owner", account)
+	}
+}
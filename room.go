@@ -3,15 +3,24 @@ package main
 import (
 	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/apackeer/trace"
 	"github.com/gorilla/websocket"
 )
 
 type room struct {
+	// name is what the room is called, in URLs and the like.
+	name string
+
+	// org, if set, is the organization the room belongs to. Only its
+	// members may use the room.
+	org *org
+
 	// forward is a channel that holds incoming messages
 	// that should be forward to other clients.
-	forward chan []byte
+	forward chan *message
 
 	// The join and leave channels exist simply to allow us to safely add and
 	// remove clients from the clients map. If we were to access the map
@@ -25,22 +34,235 @@ type room struct {
 	// leave is a channel for clients wishing to leave the room.
 	leave chan *client
 
-	// clients holds all current clients in this room.
-	clients map[*client]bool
+	// changes is a channel for other changes to the room, such as setting
+	// its topic or banning a user, which are made by recording an event.
+	changes chan *roomEvent
+
+	// clients holds all current clients in this room, along with the fanout
+	// worker that delivers messages to each one.
+	clients map[*client]*fanoutWorker
+
+	// wires counts the clients using each wire format other than JSON, so
+	// that messages are only encoded in the formats somebody needs.
+	wires map[*wireFormat]int
+
+	// names holds the display names in use in the room, so that no two
+	// people in it go by the same name. Only run changes it, holding mu.
+	names map[string]*nameClaim
+
+	// receipts holds the ID of the last message each account has read in
+	// the room, and pendingReceipts the reads the room has yet to tell
+	// everybody about. Only run changes them, holding mu for receipts.
+	receipts        map[string]uint64
+	pendingReceipts map[string]*receipt
+
+	// renames is a channel for clients wishing to change their name.
+	renames chan *renameRequest
+
+	// restarts is a channel for the server to tell the room it is being
+	// restarted, and frozen is set once it has been. A frozen room records
+	// nothing, so that the new process can take over its data.
+	restarts chan *restartStep
+	frozen   bool
+
+	// users, if set, is where the accounts of people signed in are kept, so
+	// their current name can be looked up and changed.
+	users *userStore
+
+	// workers are the fanout workers messages are delivered by, and next is
+	// the one the next client to join will be given to. Clients are shared
+	// out between them in turn.
+	workers []*fanoutWorker
+	next    int
 
 	// tracer will recieve trace information of activity in the rrom.
 	tracer trace.Tracer
+
+	// events will receive a structured event for every join, leave and
+	// message in the room.
+	events eventSink
+
+	// roles says who may do what in the room.
+	roles *roles
+
+	// invites, if set, emails people invitations to the room.
+	invites *inviter
+
+	// scheduler, if set, sends messages to the room that were scheduled
+	// for later.
+	scheduler *scheduler
+
+	// translator, if set, translates messages for people who ask.
+	translator translator
+
+	// reports, if set, is the moderation queue messages reported by people
+	// in the room are filed in.
+	reports *reportStore
+
+	// moderation, if set, checks messages with a classifier before they
+	// are sent to the room.
+	moderation *moderation
+
+	// assistant, if set, is the room's assistant bot.
+	assistant *assistant
+
+	// notifier will receive notifications for people who are @mentioned, or
+	// whose keywords are said, while they are not in the room.
+	notifier notifier
+
+	// maxMessageSize is the largest message, in bytes, a client may send
+	// before its connection is closed. Zero means there is no limit.
+	maxMessageSize int64
+
+	// uploads, if set, is where files shared in the room are uploaded to,
+	// such as voice messages.
+	uploads *uploadStore
+
+	// presence, if set, keeps track of who is in the room across every
+	// instance of the server, for its member list.
+	presence presenceStore
+
+	// backplane, if set, shares messages sent by this room's clients with the
+	// same room on other instances of the server.
+	backplane backplane
+
+	// metrics are the room's gauges, which run updates every
+	// metricsInterval, holding mu, and sent counts the messages sent since
+	// it last did.
+	metrics roomMetrics
+	sent    int
+
+	// state is the room's state, built up by applying every event recorded
+	// in the room. Only run changes it, holding mu while it does so that
+	// others may safely read it.
+	mu    sync.RWMutex
+	state *roomState
+
+	// journal, if set, is where events are logged before they are applied,
+	// and where the state is snapshotted every snapshotInterval.
+	journal          journal
+	snapshotInterval time.Duration
+}
+
+// backplane is a message bus connecting the rooms of several instances of
+// the server.
+type backplane interface {
+	// publish sends a message from a local client to the other instances.
+	// It is called from the room's run loop, so it must not block.
+	publish(msg *message)
+}
+
+// newRoom makes a new room that is ready to go, delivering messages with the
+// given number of fanout workers.
+func newRoom(fanout int) *room {
+	if fanout < 1 {
+		fanout = 1
+	}
+	r := &room{
+		forward:  make(chan *message),
+		join:     make(chan *client),
+		leave:    make(chan *client),
+		changes:  make(chan *roomEvent),
+		clients:  make(map[*client]*fanoutWorker),
+		wires:    make(map[*wireFormat]int),
+		names:    make(map[string]*nameClaim),
+		renames:  make(chan *renameRequest),
+		restarts: make(chan *restartStep),
+		state:    newRoomState(),
+		tracer:   trace.Off(),
+		events:   eventsOff(),
+
+		roles:           &roles{accounts: make(map[string]string), fallback: roleMember},
+		notifier:        notifyOff(),
+		maxMessageSize:  defaultMaxMessageSize,
+		receipts:        make(map[string]uint64),
+		pendingReceipts: make(map[string]*receipt),
+	}
+	for i := 0; i < fanout; i++ {
+		r.workers = append(r.workers, newFanoutWorker(r))
+	}
+	return r
+}
+
+// key is the room's name, qualified by its organization's, as rooms are known
+// by in people's accounts: "chat" or "acme/chat".
+func (r *room) key() string {
+	if r.org != nil {
+		return r.org.Name + "/" + r.name
+	}
+	return r.name
+}
+
+// restore has the room start from state, restored from journal, and record
+// all further events there.
+func (r *room) restore(journal journal, state *roomState, snapshotInterval time.Duration) {
+	r.journal = journal
+	r.state = state
+	r.snapshotInterval = snapshotInterval
+}
+
+// record makes a change to the room by appending the event to the event log,
+// applying it to the room's state and publishing it. It must only be called
+// from run.
+func (r *room) record(e *roomEvent) {
+	if r.frozen {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.Seq = r.state.Seq + 1
+	if r.journal != nil {
+		if err := r.journal.append(e); err != nil {
+			log.Println("Failed to log event:", err)
+		}
+	}
+	r.state.apply(e)
+	r.events.publish(e)
+}
+
+// setTopic changes the topic of the room on behalf of the named user.
+func (r *room) setTopic(name, topic string) {
+	r.changes <- &roomEvent{Type: eventTopic, Name: name, Message: topic, When: time.Now()}
+}
+
+// ban stops the account from joining the room in future, whatever name it
+// goes by.
+func (r *room) ban(account string) {
+	r.changes <- &roomEvent{Type: eventBan, Account: account, When: time.Now()}
+}
+
+// banned reports whether the account has been banned from the room.
+func (r *room) banned(account string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state.Banned[account]
+}
+
+// pin pins the message with the given ID to the room on behalf of the named
+// user, or unpins it.
+func (r *room) pin(name string, id uint64, pin bool) {
+	e := &roomEvent{Type: eventPin, Name: name, Target: id, When: time.Now()}
+	if !pin {
+		e.Type = eventUnpin
+	}
+	r.changes <- e
 }
 
-// newRoom makes a new room that is ready to go.
-func newRoom() *room {
-	return &room{
-		forward: make(chan []byte),
-		join:    make(chan *client),
-		leave:   make(chan *client),
-		clients: make(map[*client]bool),
-		tracer:  trace.Off(),
+// shadowBan shadow bans the user with the given account, or lifts their
+// shadow ban.
+func (r *room) shadowBan(account string, ban bool) {
+	e := &roomEvent{Type: eventShadowBan, Account: account, When: time.Now()}
+	if !ban {
+		e.Type = eventUnshadowBan
 	}
+	r.changes <- e
+}
+
+// topic returns the room's current topic.
+func (r *room) topic() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state.Topic
 }
 
 // Keep watching the three channels inside our room: join, leave, and forward.
@@ -50,75 +272,296 @@ func newRoom() *room {
 // able to synchronize to ensure that our r.clients map is only ever modified
 // by one thing at a time.
 func (r *room) run() {
+	var snapshots <-chan time.Time
+	if r.journal != nil && r.snapshotInterval > 0 {
+		ticker := time.NewTicker(r.snapshotInterval)
+		defer ticker.Stop()
+		snapshots = ticker.C
+	}
+	// disappearing messages are deleted within a second of expiring.
+	expiries := time.NewTicker(time.Second)
+	defer expiries.Stop()
+	// reads are told to everybody at most once a second.
+	receipts := time.NewTicker(time.Second)
+	defer receipts.Stop()
+	metrics := time.NewTicker(metricsInterval)
+	defer metrics.Stop()
 	for {
 		select {
 		case client := <-r.join:
+			if r.frozen {
+				// nobody new joins a room on its way out; they will find
+				// it again on the new process.
+				client.turnAway(closeReason{Error: reasonRestarting})
+				continue
+			}
+			if r.state.Archived {
+				client.turnAway(closeReason{Error: reasonArchived})
+				continue
+			}
+			if r.state.Banned[client.account()] {
+				// banned users are turned away by closing their send channel
+				// straight away.
+				client.turnAway(closeReason{Error: "banned"})
+				r.tracer.Trace("Banned client turned away")
+				continue
+			}
+			if !r.claimName(client.name(), client.account()) {
+				// so are people using a name somebody else in the room
+				// already goes by, who are told why so they can pick another.
+				client.turnAway(closeReason{Error: "name_taken", Name: client.name()})
+				r.tracer.Trace("Client turned away, name taken")
+				continue
+			}
+			if id, _ := client.userData["id"].(string); id != "" && r.users != nil {
+				if a := r.users.get(id); a != nil {
+					client.setBlocked(a.Blocked)
+					r.noteRead(id, a.LastRead[r.key()])
+				}
+			}
 			// joining. If we receive a message on the join channel, we simply
 			// update the r.clients map to keep a reference of the client that has
-			// joined the room. Notice that we are setting the value to true. We are
-			// using the map more like a slice, but do not have to worry about
-			// shrinking the slice as clients come and go through time—setting the
-			// value to true is just a handy, low-memory way of storing the
-			// reference.
-			r.clients[client] = true
-			r.tracer.Trace("New client joined")
+			// joined the room, and hand the client to the next fanout worker.
+			// We are using the map more like a slice, but do not have to worry
+			// about shrinking the slice as clients come and go through time.
+			w := r.workers[r.next]
+			r.next = (r.next + 1) % len(r.workers)
+			r.clients[client] = w
+			if client.wire != nil && client.wire != jsonWire {
+				r.wires[client.wire]++
+			}
+			w.ops <- fanoutOp{add: client}
+			// the worker adds the client before sending it anything else,
+			// so it is greeted before it sees any other message.
+			r.greet(client)
+			if client.country != "" {
+				r.tracer.Trace("New client joined from ", client.country)
+			} else {
+				r.tracer.Trace("New client joined")
+			}
+			r.record(&roomEvent{Type: eventJoin, Name: client.name(), When: time.Now()})
+			if !r.state.HidePresence {
+				r.deliver(presenceMessage(presenceJoined, client.name()))
+			}
 		case client := <-r.leave:
 			// leaving. If we receive a message on the leave channel, we simply
-			// delete the client type from the map, and close its send channel.
-			// Closing a channel has special significance in Go, which becomes clear
-			// when we look at our final select case.
+			// delete the client type from the map, and have its fanout worker
+			// close its send channel. Closing a channel has special significance
+			// in Go, which becomes clear when we look at the fanout worker. The
+			// client may have been turned away, in which case it has no worker.
+			w, ok := r.clients[client]
+			if !ok {
+				continue
+			}
 			delete(r.clients, client)
-			close(client.send)
+			if client.wire != nil && client.wire != jsonWire {
+				r.wires[client.wire]--
+			}
+			r.releaseName(client.name(), client.account())
+			w.ops <- fanoutOp{remove: client}
 			r.tracer.Trace("Client left")
+			r.record(&roomEvent{Type: eventLeave, Name: client.name(), When: time.Now()})
+			if !r.state.HidePresence {
+				r.deliver(presenceMessage(presenceLeft, client.name()))
+			}
+		case req := <-r.renames:
+			req.done <- r.changeName(req.client, req.name)
+		case step := <-r.restarts:
+			r.restart(step)
+		case e := <-r.changes:
+			if r.frozen {
+				log.Println("Room change dropped while restarting:", e.Type)
+				continue
+			}
+			r.record(e)
+			r.tracer.Trace("Room changed: ", e.Type)
+			switch e.Type {
+			case eventPin, eventUnpin:
+				r.deliver(pinMessage(e))
+			case eventDelete:
+				r.deliver(&message{Deleted: e.Target, When: e.When, System: true})
+			case eventEdit:
+				if msg := r.editedMessage(e); msg != nil {
+					r.deliver(msg)
+				}
+			case eventPrune:
+				r.prune(e.Target)
+			case eventDisappear:
+				r.deliver(disappearNotice(e))
+			case eventOwner, eventCoOwner, eventUncoOwner:
+				r.deliver(ownerNotice(e))
+			case eventArchive, eventReactivate:
+				r.deliver(archiveNotice(e))
+				if e.Type == eventArchive {
+					r.turnAwayAll(closeReason{Error: reasonArchived})
+				}
+			case eventPoll, eventVote, eventClose:
+				id := e.Target
+				if e.Type == eventPoll {
+					id = e.Seq
+				}
+				if msg := r.pollMessage(id); msg != nil {
+					r.deliver(msg)
+				}
+			}
+		case <-receipts.C:
+			if !r.frozen {
+				r.sendReceipts()
+			}
+		case <-metrics.C:
+			r.measure(r.sent)
+			r.sent = 0
+		case now := <-expiries.C:
+			if !r.frozen {
+				r.expire(now)
+			}
+		case <-snapshots:
+			if r.frozen {
+				continue
+			}
+			r.mu.RLock()
+			err := r.journal.snapshot(r.state)
+			r.mu.RUnlock()
+			if err != nil {
+				log.Println("Failed to snapshot room:", err)
+			}
 		case msg := <-r.forward:
-			// forward message to all clients. If we receive a message on the forward
-			// channel, we iterate over all the clients and send the message down
-			// each client's send channel. Then, the write method of our client type
-			// will pick it up and send it down the socket to the browser.
-			for client := range r.clients {
-				select {
-				case client.send <- msg:
-					// send the message by putting it in clients send queue
-					r.tracer.Trace(" -- sent to client")
-				default:
-					// failed to send. ie there is no send channel on the client (closed)
-					// If the send channel is closed, then we know the client is not
-					// receiving any more messages, and this is where our second select
-					// clause (specifically the default case) takes the action of
-					// removing the client from the room and tidying things up.
-					delete(r.clients, client)
-					close(client.send)
-					r.tracer.Trace(" -- failed to send, cleaned up client")
+			// messages from shadow banned users are echoed back to them as if
+			// they had been sent, but nobody else sees them.
+			if !msg.private() && r.state.ShadowBanned[msg.sender()] {
+				msg.shadow = true
+				r.deliver(msg)
+				continue
+			}
+			// who is typing is passed on, but never recorded.
+			if msg.Typing {
+				r.deliver(msg)
+				continue
+			}
+			// while restarting, messages can't be recorded, so are sent back
+			// to be sent again once the new process has taken over.
+			if r.frozen && !msg.private() {
+				if msg.from != nil {
+					r.deliver(&message{Message: msg.from.tr("The server is restarting; please send that again in a moment"), When: time.Now(), System: true, to: msg.from})
 				}
+				continue
 			}
+			// nothing more is said in an archived room.
+			if r.state.Archived && !msg.private() {
+				if msg.from != nil {
+					r.deliver(&message{Message: msg.from.tr("This room is archived, and read only"), When: time.Now(), System: true, to: msg.from})
+				}
+				continue
+			}
+			// reads are passed on to the reader's other connections, and
+			// told to everybody else with the next receipts.
+			if msg.Read != 0 {
+				r.noteRead(msg.toAccount, msg.Read)
+			}
+			// replies to a single client are not part of the room's history.
+			if !msg.private() {
+				// messages from the server, such as reminders, say who they
+				// mention themselves.
+				if !msg.System && msg.Mentions == nil {
+					msg.Mentions = r.mentions(msg.Message)
+				}
+				msg.Sender = msg.sender()
+				if r.state.Disappear > 0 {
+					expires := msg.When.Add(r.state.Disappear)
+					msg.Expires = &expires
+				}
+				e := &roomEvent{Type: eventMessage, Name: msg.Name, Account: msg.Sender, Message: msg.Message, When: msg.When, Expires: msg.Expires, Voice: msg.Voice, Avatar: msg.Avatar, Action: msg.Action}
+				r.record(e)
+				msg.ID = e.Seq
+				r.sent++
+				if msg.from != nil && msg.nonce != "" && msg.from.has(capAck) {
+					r.deliver(&message{ID: msg.ID, Ack: msg.nonce, When: msg.When, to: msg.from})
+				}
+				if !msg.remote {
+					// the instance the message was sent to does the
+					// notifying, so people are only notified once.
+					r.notifyAbsent(msg)
+					if r.backplane != nil {
+						r.backplane.publish(msg)
+					}
+				}
+			}
+			r.deliver(msg)
+		}
+	}
+}
+
+// deliver sends msg to every client in the room, or only the client or
+// account it is addressed to. It must only be called from run.
+func (r *room) deliver(msg *message) {
+	// frame the message once here, in every wire format clients are using,
+	// rather than once per client.
+	if err := msg.prepare(r.wires); err != nil {
+		log.Println("Failed to prepare message:", err)
+	}
+	workers := r.workers
+	if msg.to != nil {
+		w, ok := r.clients[msg.to]
+		if !ok {
+			msg.release()
+			return
 		}
+		workers = []*fanoutWorker{w}
 	}
+	// forward message to all clients, by having each fanout worker deliver
+	// it to its share of them. Each worker holds a reference to the message
+	// until it is done with it.
+	msg.retain(len(workers))
+	for _, w := range workers {
+		w.ops <- fanoutOp{msg: msg}
+	}
+	msg.release()
 }
 
 const (
-	socketBufferSize  = 1024
-	messageBufferSize = 256
+	socketBufferSize      = 1024
+	messageBufferSize     = 256
+	defaultMaxMessageSize = 16 * 1024
 )
 
 var upgrader = &websocket.Upgrader{ReadBufferSize: socketBufferSize,
-	WriteBufferSize: socketBufferSize}
+	WriteBufferSize: socketBufferSize, Subprotocols: subprotocols(),
+	EnableCompression: true}
 
 func (r *room) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.archived() {
+		http.Error(w, "the room is archived", http.StatusGone)
+		return
+	}
 	socket, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
-		log.Fatal("ServeHTTP:", err)
+		// Upgrade has already replied with an error.
+		log.Println("ServeHTTP:", err)
 		return
 	}
+	// messages are only compressed for clients that ask in their hello.
+	socket.EnableWriteCompression(false)
 
 	// All being well, we then create our client and pass it into the join
 	// channel for the current room. We also defer the leaving operation for
 	// when the client is finished, which will ensure everything is tidied up
 	// after a user goes away.
 
+	userData, err := r.userData(req)
+	if err != nil {
+		log.Println("Bad auth cookie:", err)
+		socket.Close()
+		return
+	}
+
 	client := &client{
-		socket: socket,
-		send:   make(chan []byte, messageBufferSize),
-		room:   r,
+		socket:   socket,
+		send:     make(chan *message, messageBufferSize),
+		room:     r,
+		userData: userData,
+		country:  requestCountry(req),
+		locale:   clientLocale(req, userData),
+		wire:     wireFormatFor(socket.Subprotocol()),
 	}
 	r.join <- client
 	defer func() { r.leave <- client }()
@@ -130,3 +573,20 @@ func (r *room) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// operations (keeping the connection alive) until it's time to close it.
 	client.read()
 }
+
+// userData decodes the request's auth cookie into what we know about the
+// user. People with an account go by its current name, which they may have
+// changed since the cookie was made.
+func (r *room) userData(req *http.Request) (map[string]interface{}, error) {
+	data, err := authCookie(req)
+	if err != nil {
+		return nil, err
+	}
+	if id := data.Get("id").Str(); id != "" && r.users != nil {
+		if a := r.users.get(id); a != nil {
+			data["name"] = a.Name
+			data["language"] = a.Language
+		}
+	}
+	return data, nil
+}
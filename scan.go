@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// scanner looks at an upload before it can be downloaded, returning why it
+// should be quarantined, or the empty string if it is fine.
+type scanner interface {
+	scan(ctx context.Context, u *upload, f io.ReadSeeker) (string, error)
+}
+
+// scanners runs several scanners in turn, stopping at the first to flag the
+// upload.
+type scanners []scanner
+
+func (ss scanners) scan(ctx context.Context, u *upload, f io.ReadSeeker) (string, error) {
+	for _, s := range ss {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		if reason, err := s.scan(ctx, u, f); reason != "" || err != nil {
+			return reason, err
+		}
+	}
+	return "", nil
+}
+
+// clamAV scans uploads for viruses with a clamd daemon, streaming them to it
+// over TCP.
+type clamAV struct {
+	addr string
+}
+
+func (c *clamAV) scan(ctx context.Context, u *upload, f io.ReadSeeker) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// INSTREAM takes the file in chunks, each preceded by its length, and
+	// ended by a chunk of no length.
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			binary.Write(w, binary.BigEndian, uint32(n))
+			w.Write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	binary.Write(w, binary.BigEndian, uint32(0))
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	// clamd says "stream: OK" for clean files, and
+	// "stream: <signature> FOUND" for infected ones.
+	reply = strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), "\x00")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return "virus found: " + strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", errors.New("clamd: " + reply)
+	}
+}
+
+// nsfwClassifier scans uploaded images with an HTTP classification service,
+// which is POSTed the image and answers with a JSON object whose "score" is
+// how likely, from 0 to 1, the image is not safe for work. Images scoring
+// over the threshold are flagged; other files are left alone.
+type nsfwClassifier struct {
+	url       string
+	threshold float64
+	client    *http.Client
+}
+
+func newNSFWClassifier(url string, threshold float64) *nsfwClassifier {
+	return &nsfwClassifier{url: url, threshold: threshold, client: &http.Client{Timeout: scanTimeout}}
+}
+
+func (c *nsfwClassifier) scan(ctx context.Context, u *upload, f io.ReadSeeker) (string, error) {
+	if !strings.HasPrefix(u.Type, "image/") {
+		return "", nil
+	}
+	req, err := http.NewRequest("POST", c.url, f)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = u.Size
+	req.Header.Set("Content-Type", u.Type)
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("nsfw classifier: %s", resp.Status)
+	}
+	var result struct {
+		Score float64 `json:"score"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.Score > c.threshold {
+		return fmt.Sprintf("image looks not safe for work (score %.2f)", result.Score), nil
+	}
+	return "", nil
+}
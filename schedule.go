@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxScheduled is the most messages anybody may have waiting to be sent.
+const maxScheduled = 100
+
+const scheduleFile = "scheduled.json"
+
+// scheduledMessage is a message waiting to be sent to a room.
+type scheduledMessage struct {
+	ID      string    `json:"id"`
+	Room    string    `json:"room"`
+	Account string    `json:"account"`
+	Name    string    `json:"name"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+
+	// Reminder is set on reminders, which are sent back to the account by
+	// the reminder bot rather than being sent as the account.
+	Reminder bool `json:"reminder,omitempty"`
+}
+
+// reminderBot is the name reminders are sent under.
+const reminderBot = "reminders"
+
+// message is the message to send to the room when m is due.
+func (m *scheduledMessage) message() *message {
+	if m.Reminder {
+		return &message{
+			Name:     reminderBot,
+			Message:  m.Name + ", you asked me to remind you: " + m.Message,
+			When:     time.Now(),
+			Mentions: []string{m.Account},
+		}
+	}
+	return &message{Name: m.Name, Message: m.Message, When: time.Now(), account: m.Account}
+}
+
+// scheduler sends messages to rooms at the times they were scheduled for.
+// Pending messages are kept in scheduled.json in the data directory, if
+// there is one, so they are still sent if the server restarts in between.
+type scheduler struct {
+	rooms map[string]*room
+	path  string
+
+	mu      sync.Mutex
+	pending []*scheduledMessage
+
+	// wake is poked whenever a message is scheduled, in case it is due
+	// before the one run is waiting for.
+	wake chan struct{}
+}
+
+// openScheduler loads the messages waiting to be sent to rooms, from dir if
+// it is not empty.
+func openScheduler(dir string, rooms map[string]*room) (*scheduler, error) {
+	s := &scheduler{rooms: rooms, wake: make(chan struct{}, 1)}
+	if dir == "" {
+		return s, nil
+	}
+	s.path = filepath.Join(dir, scheduleFile)
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.pending); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// schedule queues a message to be sent later.
+func (s *scheduler) schedule(m *scheduledMessage) error {
+	if _, ok := s.rooms[m.Room]; !ok {
+		return fmt.Errorf("there is no room called %s", m.Room)
+	}
+	if !m.At.After(time.Now()) {
+		return errors.New("that time has already passed")
+	}
+	id, err := newAccountID()
+	if err != nil {
+		return err
+	}
+	m.ID = id[:8]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, p := range s.pending {
+		if p.Account == m.Account {
+			n++
+		}
+	}
+	if n >= maxScheduled {
+		return fmt.Errorf("you can't have more than %d messages waiting to be sent", maxScheduled)
+	}
+	s.pending = append(s.pending, m)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return s.save()
+}
+
+// list returns the account's messages waiting to be sent, soonest first.
+func (s *scheduler) list(account string) []*scheduledMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*scheduledMessage
+	for _, p := range s.pending {
+		if p.Account == account {
+			list = append(list, p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].At.Before(list[j].At) })
+	return list
+}
+
+// cancel stops the account's message with the given ID from being sent.
+func (s *scheduler) cancel(account, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.pending {
+		if p.Account == account && p.ID == id {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return s.save()
+		}
+	}
+	return fmt.Errorf("you have no message %s waiting to be sent", id)
+}
+
+// run sends messages as they fall due. It never returns.
+func (s *scheduler) run() {
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+		for _, m := range s.due(time.Now()) {
+			if r, ok := s.rooms[m.Room]; ok {
+				r.forward <- m.message()
+			}
+		}
+		timer.Reset(s.untilNext())
+	}
+}
+
+// due removes and returns the messages due to be sent by now.
+func (s *scheduler) due(now time.Time) []*scheduledMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*scheduledMessage
+	pending := s.pending[:0]
+	for _, p := range s.pending {
+		if p.At.After(now) {
+			pending = append(pending, p)
+		} else {
+			due = append(due, p)
+		}
+	}
+	s.pending = pending
+	if len(due) > 0 {
+		if err := s.save(); err != nil {
+			log.Println("Failed to save scheduled messages:", err)
+		}
+	}
+	return due
+}
+
+// untilNext returns how long it is until the next message is due.
+func (s *scheduler) untilNext() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := time.Hour
+	for _, p := range s.pending {
+		if d := time.Until(p.At); d < next {
+			next = d
+		}
+	}
+	return next
+}
+
+// save writes the pending messages to the scheduler's file. Callers must
+// hold s.mu.
+func (s *scheduler) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return saveJSON(s.path, s.pending)
+}
+
+// parseWhen parses when a message should be sent: either a duration from
+// now, such as 2h30m, or a time, such as 2006-01-02T15:04:05Z07:00.
+func parseWhen(when string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(when); err == nil {
+		return now.Add(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, when); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a duration, such as 2h30m, nor a time, such as %s", when, now.Format(time.RFC3339))
+}
+
+// scheduleCommand is /schedule, which sends a message to the room later, or
+// lists or cancels the messages waiting to be sent.
+func scheduleCommand(c *client, args string) error {
+	s := c.room.scheduler
+	if s == nil {
+		return errors.New("messages can't be scheduled here")
+	}
+	fields := strings.Fields(args)
+	switch {
+	case len(fields) == 0:
+		n := 0
+		for _, m := range s.list(c.account()) {
+			// reminders are listed by /remind list.
+			if !m.Reminder {
+				c.reply(fmt.Sprintf("%s: %s to #%s: %s", m.ID, m.At.Format(time.RFC1123), m.Room, m.Message))
+				n++
+			}
+		}
+		if n == 0 {
+			c.reply("You have no messages waiting to be sent")
+		}
+		return nil
+	case fields[0] == "cancel" && len(fields) == 2:
+		if err := s.cancel(c.account(), fields[1]); err != nil {
+			return err
+		}
+		c.replyf("Cancelled %s", fields[1])
+		return nil
+	case len(fields) < 2:
+		return errUsage
+	}
+	at, err := parseWhen(fields[0], time.Now())
+	if err != nil {
+		return err
+	}
+	m := &scheduledMessage{
+		Room:    c.room.name,
+		Account: c.account(),
+		Name:    c.name(),
+		Message: strings.TrimSpace(strings.TrimPrefix(args, fields[0])),
+		At:      at,
+	}
+	if err := s.schedule(m); err != nil {
+		return err
+	}
+	c.reply(fmt.Sprintf("Message %s will be sent at %s", m.ID, at.Format(time.RFC1123)))
+	return nil
+}
+
+// scheduleHandler serves /api/me/scheduled: GET lists the signed in user's
+// messages waiting to be sent, POST schedules another, and DELETE
+// /api/me/scheduled/{id} cancels one.
+type scheduleHandler struct {
+	users     *userStore
+	scheduler *scheduler
+}
+
+func (h *scheduleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a := h.users.get(currentAccountID(r))
+	if a == nil {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/me/scheduled"), "/")
+	switch {
+	case r.Method == "GET" && id == "":
+		writeJSON(w, h.scheduler.list(a.ID))
+	case r.Method == "POST" && id == "":
+		var m scheduledMessage
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&m); err != nil {
+			http.Error(w, "bad message: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if m.Message == "" {
+			http.Error(w, "the message is empty", http.StatusBadRequest)
+			return
+		}
+		m.Account, m.Name = a.ID, a.Name
+		if err := h.scheduler.schedule(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, &m)
+	case r.Method == "DELETE" && id != "":
+		if err := h.scheduler.cancel(a.ID, id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
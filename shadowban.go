@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// shadowBanned returns the accounts shadow banned from the room.
+func (r *room) shadowBanned() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	accounts := []string{}
+	for account := range r.state.ShadowBanned {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+	return accounts
+}
+
+// serveShadowBans serves /api/admin/rooms/{name}/shadowbans: GET lists the
+// accounts shadow banned from the room, and PUT or DELETE
+// /api/admin/rooms/{name}/shadowbans/{account} shadow bans an account or
+// lifts its ban.
+func serveShadowBans(w http.ResponseWriter, r *http.Request, room *room, account string) {
+	switch {
+	case r.Method == "GET" && account == "":
+		writeJSON(w, room.shadowBanned())
+	case r.Method == "PUT" && account != "":
+		room.shadowBan(account, true)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "DELETE" && account != "":
+		room.shadowBan(account, false)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
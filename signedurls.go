@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Uploads can be kept from anybody who comes by their links, such as files
+// shared in private rooms whose links get passed on, by only serving them at
+// signed URLs that expire soon after they are made. The links posted in rooms
+// stay as they are: when somebody signed in follows one, they are sent on to
+// a freshly signed URL for the same file, which works for a little while,
+// for anybody; a link followed by somebody who isn't signed in, or a signed
+// URL that has expired, doesn't work.
+
+// downloadSigner signs the URLs uploads are served at.
+type downloadSigner struct {
+	key      []byte
+	lifetime time.Duration
+}
+
+// sign returns the signature of the URL path, expiring at expires.
+func (s *downloadSigner) sign(path string, expires int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	fmt.Fprintf(mac, "download\n%s\n%d", path, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// query returns the query that signs the URL path for the next lifetime.
+func (s *downloadSigner) query(path string) string {
+	expires := time.Now().Add(s.lifetime).Unix()
+	return url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {s.sign(path, expires)},
+	}.Encode()
+}
+
+// signed reports whether the request is for a signed URL that hasn't expired,
+// and if so, when it does.
+func (s *downloadSigner) signed(r *http.Request) (time.Time, bool) {
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(q.Get("sig")), []byte(s.sign(r.URL.Path, expires))) {
+		return time.Time{}, false
+	}
+	return time.Unix(expires, 0), time.Now().Unix() <= expires
+}
+
+// check reports whether the upload at the request's URL may be served. If the
+// URL isn't signed, somebody signed in is redirected to a signed one, and
+// anybody else is turned away.
+func (s *downloadSigner) check(w http.ResponseWriter, r *http.Request) bool {
+	if s == nil {
+		return true
+	}
+	if expires, ok := s.signed(r); ok {
+		// browsers may keep the file until the URL expires, but nothing
+		// in between should.
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(time.Until(expires).Seconds())))
+		return true
+	}
+	if currentAccountID(r) == "" {
+		http.Error(w, "this link has expired, or you need to sign in", http.StatusForbidden)
+		return false
+	}
+	// the redirect is to the path as the client asked for it, before any
+	// prefix, such as an organization's, was stripped from it.
+	path, _, _ := strings.Cut(r.RequestURI, "?")
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, path+"?"+s.query(r.URL.Path), http.StatusFound)
+	return false
+}
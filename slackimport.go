@@ -0,0 +1,267 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// slackUser is a user, as found in users.json in a Slack export.
+type slackUser struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	RealName string `json:"real_name"`
+	Profile  struct {
+		DisplayName string `json:"display_name"`
+		Email       string `json:"email"`
+		Image72     string `json:"image_72"`
+	} `json:"profile"`
+}
+
+// slackChannel is a channel, as found in channels.json in a Slack export.
+type slackChannel struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Topic struct {
+		Value string `json:"value"`
+	} `json:"topic"`
+}
+
+// slackMessage is a message, as found in the daily files of a channel's
+// directory in a Slack export.
+type slackMessage struct {
+	Type    string `json:"type"`
+	Subtype string `json:"subtype"`
+	User    string `json:"user"`
+	Text    string `json:"text"`
+	TS      string `json:"ts"`
+}
+
+// slackMarkup matches Slack's markup for links, and mentions of people and
+// channels, such as <@U024BE7LH>, <#C024BE7LR|general> and
+// <https://example.com|example>.
+var slackMarkup = regexp.MustCompile(`<([^<>|]*)(?:\|([^<>]*))?>`)
+
+// slackImport reads a Slack export archive.
+type slackImport struct {
+	zip   *zip.ReadCloser
+	users map[string]*slackUser
+}
+
+func openSlackExport(filename string) (*slackImport, error) {
+	z, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	s := &slackImport{zip: z, users: make(map[string]*slackUser)}
+	var users []*slackUser
+	if err := s.read("users.json", &users); err != nil {
+		z.Close()
+		return nil, err
+	}
+	for _, u := range users {
+		s.users[u.ID] = u
+	}
+	return s, nil
+}
+
+// read decodes the JSON file with the given name in the archive into v.
+func (s *slackImport) read(name string, v interface{}) error {
+	for _, f := range s.zip.File {
+		if f.Name != name {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return json.NewDecoder(r).Decode(v)
+	}
+	return fmt.Errorf("%s is not in the export", name)
+}
+
+// channel returns the channel with the given name.
+func (s *slackImport) channel(name string) (*slackChannel, error) {
+	var channels []*slackChannel
+	if err := s.read("channels.json", &channels); err != nil {
+		return nil, err
+	}
+	for _, c := range channels {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("there is no channel called %s in the export", name)
+}
+
+// messages returns the messages people sent to the named channel, oldest
+// first. Joins, bot messages and the like are left out.
+func (s *slackImport) messages(channel string) ([]*slackMessage, error) {
+	var days []string
+	for _, f := range s.zip.File {
+		if path.Dir(f.Name) == channel && path.Ext(f.Name) == ".json" {
+			days = append(days, f.Name)
+		}
+	}
+	// the files are named by date, so sorting them puts them in order.
+	sort.Strings(days)
+	var messages []*slackMessage
+	for _, day := range days {
+		var ms []*slackMessage
+		if err := s.read(day, &ms); err != nil {
+			return nil, err
+		}
+		for _, m := range ms {
+			if m.Type == "message" && (m.Subtype == "" || m.Subtype == "thread_broadcast") && m.User != "" {
+				messages = append(messages, m)
+			}
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return slackTime(messages[i].TS).Before(slackTime(messages[j].TS))
+	})
+	return messages, nil
+}
+
+// name returns the name the Slack user with the given ID went by.
+func (s *slackImport) name(id string) string {
+	u := s.users[id]
+	switch {
+	case u == nil:
+		return id
+	case u.Profile.DisplayName != "":
+		return u.Profile.DisplayName
+	case u.RealName != "":
+		return u.RealName
+	default:
+		return u.Name
+	}
+}
+
+// text turns Slack's markup in a message into plain text, as it would be
+// typed in the chat.
+func (s *slackImport) text(text string) string {
+	text = slackMarkup.ReplaceAllStringFunc(text, func(m string) string {
+		parts := slackMarkup.FindStringSubmatch(m)
+		target, label := parts[1], parts[2]
+		switch {
+		case strings.HasPrefix(target, "@"):
+			return "@" + s.name(target[1:])
+		case strings.HasPrefix(target, "#"):
+			if label != "" {
+				return "#" + label
+			}
+			return target
+		case strings.HasPrefix(target, "!"):
+			// special mentions, such as <!here>.
+			return "@" + strings.TrimPrefix(target, "!")
+		case label != "" && label != target:
+			return label + " (" + target + ")"
+		default:
+			return strings.TrimPrefix(target, "mailto:")
+		}
+	})
+	// Slack escapes &, < and > in message text.
+	return html.UnescapeString(text)
+}
+
+// slackTime converts a Slack timestamp, such as 1512085950.000216, into a
+// time.
+func slackTime(ts string) time.Time {
+	secs, frac := ts, ""
+	if i := strings.IndexByte(ts, '.'); i >= 0 {
+		secs, frac = ts[:i], ts[i+1:]
+	}
+	s, _ := strconv.ParseInt(secs, 10, 64)
+	frac = (frac + "000000000")[:9]
+	ns, _ := strconv.ParseInt(frac, 10, 64)
+	return time.Unix(s, ns).UTC()
+}
+
+// importSlackSubcommand is "chat import-slack", which loads a channel from a
+// Slack export archive into the room kept in a -data directory. The people
+// who wrote the messages are given accounts, linked to their Slack identity,
+// or to the account with the same email if they already have one. The server
+// must not be running while the import is.
+func importSlackSubcommand(args []string) error {
+	flags := flag.NewFlagSet("import-slack", flag.ExitOnError)
+	dataDir := flags.String("data", "", "The directory the room's event log is kept in.")
+	archive := flags.String("zip", "", "The Slack export archive to import.")
+	channelName := flags.String("channel", "general", "The Slack channel to import into the room.")
+	flags.Parse(args)
+	if *dataDir == "" || *archive == "" {
+		return errors.New("-data and -zip are required")
+	}
+	export, err := openSlackExport(*archive)
+	if err != nil {
+		return err
+	}
+	defer export.zip.Close()
+	channel, err := export.channel(*channelName)
+	if err != nil {
+		return err
+	}
+	messages, err := export.messages(channel.Name)
+	if err != nil {
+		return err
+	}
+
+	users, err := openUserStore(*dataDir)
+	if err != nil {
+		return err
+	}
+	accounts := make(map[string]string)
+	for id, u := range export.users {
+		a, err := users.login("", "slack", id, u.Profile.Email, export.name(id), u.Profile.Image72)
+		if err != nil {
+			return err
+		}
+		accounts[id] = a.ID
+	}
+
+	journal, state, err := openEventLog(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer journal.f.Close()
+	record := func(e *roomEvent) error {
+		e.Seq = state.Seq + 1
+		if err := journal.append(e); err != nil {
+			return err
+		}
+		state.apply(e)
+		return nil
+	}
+	for _, m := range messages {
+		err := record(&roomEvent{
+			Type:    eventMessage,
+			Name:    export.name(m.User),
+			Account: accounts[m.User],
+			Message: export.text(m.Text),
+			When:    slackTime(m.TS),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if channel.Topic.Value != "" && state.Topic == "" {
+		if err := record(&roomEvent{Type: eventTopic, Message: export.text(channel.Topic.Value), When: time.Now()}); err != nil {
+			return err
+		}
+	}
+	if err := journal.snapshot(state); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d messages from #%s, by %d people\n", len(messages), channel.Name, len(export.users))
+	return nil
+}
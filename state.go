@@ -0,0 +1,255 @@
+package main
+
+import "time"
+
+// historySize is the number of recent messages kept in a room's state.
+const historySize = 100
+
+// roomState is the state of a room that outlives the connections to it. It
+// is only ever changed by applying events, in order, so it can be rebuilt at
+// any time by replaying the room's event log.
+type roomState struct {
+	// Seq is the sequence number of the last event applied.
+	Seq uint64 `json:"seq"`
+
+	// Topic is the room's current topic.
+	Topic string `json:"topic"`
+
+	// Banned holds the accounts of users that may not join the room. They
+	// are kept by account, not name, so that nobody gets back in by going
+	// by another name.
+	Banned map[string]bool `json:"banned_accounts"`
+
+	// ShadowBanned holds the accounts of users whose messages are only ever
+	// shown to themselves, so they don't know they have been banned.
+	ShadowBanned map[string]bool `json:"shadow_banned,omitempty"`
+
+	// History holds the most recent messages sent to the room, oldest first.
+	History []*message `json:"history"`
+
+	// Pins holds the messages pinned to the room, in the order they were
+	// pinned.
+	Pins []*message `json:"pins,omitempty"`
+
+	// Polls holds the room's polls, keyed by ID.
+	Polls map[uint64]*poll `json:"polls,omitempty"`
+
+	// Retention is the room's own retention policy, if it doesn't follow
+	// the server's, and Pruned the ID of the first message kept when the
+	// older ones were last pruned.
+	Retention *retention `json:"retention,omitempty"`
+	Pruned    uint64     `json:"pruned,omitempty"`
+
+	// Disappear is how long messages last for, if they disappear, and
+	// Expiring when each message yet to disappear does, keyed by ID.
+	Disappear time.Duration        `json:"disappear,omitempty"`
+	Expiring  map[uint64]time.Time `json:"expiring,omitempty"`
+
+	// Archived is set while the room is archived, and read only.
+	Archived bool `json:"archived,omitempty"`
+
+	// Owner is the account that owns the room, if any, and CoOwners the
+	// accounts that own it with them.
+	Owner    string          `json:"owner,omitempty"`
+	CoOwners map[string]bool `json:"co_owners,omitempty"`
+
+	// Edits holds the earlier versions of each edited message in the
+	// history, oldest first, keyed by ID.
+	Edits map[uint64][]*edit `json:"edits,omitempty"`
+
+	// Welcome and Rules are sent to everybody who joins the room, if set.
+	Welcome string `json:"welcome,omitempty"`
+	Rules   string `json:"rules,omitempty"`
+
+	// HidePresence is set if the room doesn't tell everybody when people
+	// join and leave.
+	HidePresence bool `json:"hide_presence,omitempty"`
+
+	// Public is set if anybody may read the room's recent messages, as a
+	// feed.
+	Public bool `json:"public,omitempty"`
+}
+
+// accountNamed returns the account of whoever went by name in the room, for
+// bans recorded by name before they were by account: whoever last said
+// something in the room by that name or, if nobody did, the account people
+// who haven't signed in have by that name.
+func (s *roomState) accountNamed(name string) string {
+	for i := len(s.History) - 1; i >= 0; i-- {
+		if msg := s.History[i]; msg.Name == name && msg.Sender != "" {
+			return msg.Sender
+		}
+	}
+	return "name:" + name
+}
+
+// maxPins is the most messages that may be pinned to a room at once.
+const maxPins = 50
+
+// newRoomState makes the state of a room that has never seen any events.
+func newRoomState() *roomState {
+	return &roomState{
+		Banned:       make(map[string]bool),
+		ShadowBanned: make(map[string]bool),
+		Polls:        make(map[uint64]*poll),
+		Expiring:     make(map[uint64]time.Time),
+		CoOwners:     make(map[string]bool),
+		Edits:        make(map[uint64][]*edit),
+	}
+}
+
+// apply changes the state to reflect that e happened.
+func (s *roomState) apply(e *roomEvent) {
+	s.Seq = e.Seq
+	switch e.Type {
+	case eventMessage:
+		s.remember(&message{
+			ID:      e.Seq,
+			Name:    e.Name,
+			Message: e.Message,
+			When:    e.When,
+			Sender:  e.Account,
+			Expires: e.Expires,
+			Voice:   e.Voice,
+			Avatar:  e.Avatar,
+			Action:  e.Action,
+		})
+		if e.Expires != nil {
+			s.Expiring[e.Seq] = *e.Expires
+		}
+	case eventEdit:
+		if msg := s.message(e.Target); msg != nil {
+			when := msg.When
+			if msg.Edited != nil {
+				when = *msg.Edited
+			}
+			s.Edits[e.Target] = append(s.Edits[e.Target], &edit{Seq: e.Seq, Message: msg.Message, When: when})
+			edited := e.When
+			msg.Message, msg.Edited = e.Message, &edited
+		}
+	case eventNick:
+		s.remember(nickMessage(e))
+	case eventTopic:
+		s.Topic = e.Message
+	case eventWelcome:
+		s.Welcome = e.Message
+	case eventRules:
+		s.Rules = e.Message
+	case eventShowPresence:
+		s.HidePresence = false
+	case eventHidePresence:
+		s.HidePresence = true
+	case eventPublic:
+		s.Public = true
+	case eventUnpublic:
+		s.Public = false
+	case eventBan:
+		account := e.Account
+		if account == "" {
+			// bans used to be by name.
+			account = s.accountNamed(e.Name)
+		}
+		s.Banned[account] = true
+	case eventShadowBan:
+		s.ShadowBanned[e.Account] = true
+	case eventUnshadowBan:
+		delete(s.ShadowBanned, e.Account)
+	case eventPin:
+		if msg := s.message(e.Target); msg != nil && s.pinned(e.Target) < 0 && len(s.Pins) < maxPins {
+			s.Pins = append(s.Pins, msg)
+		}
+	case eventUnpin:
+		if i := s.pinned(e.Target); i >= 0 {
+			s.Pins = append(s.Pins[:i:i], s.Pins[i+1:]...)
+		}
+	case eventDelete:
+		delete(s.Expiring, e.Target)
+		delete(s.Edits, e.Target)
+		if i := s.pinned(e.Target); i >= 0 {
+			s.Pins = append(s.Pins[:i:i], s.Pins[i+1:]...)
+		}
+		for i, msg := range s.History {
+			if msg.ID == e.Target {
+				s.History = append(s.History[:i:i], s.History[i+1:]...)
+				break
+			}
+		}
+	case eventPoll, eventVote, eventClose:
+		s.applyPoll(e)
+	case eventRetention:
+		s.Retention = e.Retention
+	case eventPrune:
+		s.Pruned = e.Target
+		s.History = keepFrom(s.History, e.Target)
+		s.Pins = keepFrom(s.Pins, e.Target)
+		for id := range s.Expiring {
+			if id < e.Target {
+				delete(s.Expiring, id)
+			}
+		}
+		for id := range s.Edits {
+			if id < e.Target {
+				delete(s.Edits, id)
+			}
+		}
+	case eventDisappear:
+		s.Disappear = e.Disappear
+	case eventArchive:
+		s.Archived = true
+	case eventReactivate:
+		s.Archived = false
+	case eventOwner:
+		s.Owner = e.Account
+		delete(s.CoOwners, e.Account)
+	case eventCoOwner:
+		if e.Account != s.Owner {
+			s.CoOwners[e.Account] = true
+		}
+	case eventUncoOwner:
+		delete(s.CoOwners, e.Account)
+	}
+}
+
+// keepFrom returns the messages with IDs from id on.
+func keepFrom(msgs []*message, id uint64) []*message {
+	kept := msgs[:0:0]
+	for _, msg := range msgs {
+		if msg.ID >= id {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// message returns the message in the history with the given ID, or nil.
+func (s *roomState) message(id uint64) *message {
+	for _, msg := range s.History {
+		if msg.ID == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+// pinned returns where in the pins the message with the given ID is, or -1
+// if it isn't pinned.
+func (s *roomState) pinned(id uint64) int {
+	for i, msg := range s.Pins {
+		if msg.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// remember adds msg to the history, forgetting the oldest message if the
+// history is full.
+func (s *roomState) remember(msg *message) {
+	s.History = append(s.History, msg)
+	if len(s.History) > historySize {
+		for _, forgotten := range s.History[:len(s.History)-historySize] {
+			delete(s.Edits, forgotten.ID)
+		}
+		s.History = s.History[len(s.History)-historySize:]
+	}
+}
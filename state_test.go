@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBanByAccount checks that a banned user is turned away whatever name
+// they come back by.
+func TestBanByAccount(t *testing.T) {
+	r := newRoom(1)
+	go r.run()
+	r.ban("github:42")
+	for !r.banned("github:42") {
+		time.Sleep(time.Millisecond)
+	}
+	c := &client{send: make(chan *message, 8), room: r, userData: map[string]interface{}{"id": "github:42", "name": "Somebody Else"}}
+	r.join <- c
+	for range c.send {
+	}
+	if c.rejected == nil || c.rejected.Error != "banned" {
+		t.Fatalf("a banned account under another name was turned away with %+v, want banned", c.rejected)
+	}
+}
+
+// TestBanByNameMigrated checks that bans recorded by name, before bans were
+// by account, are of the account that went by the name.
+func TestBanByNameMigrated(t *testing.T) {
+	s := newRoomState()
+	s.apply(&roomEvent{Seq: 1, Type: eventMessage, Name: "mallory", Account: "github:42", Message: "hi"})
+	s.apply(&roomEvent{Seq: 2, Type: eventBan, Name: "mallory"})
+	s.apply(&roomEvent{Seq: 3, Type: eventBan, Name: "guest"})
+	if !s.Banned["github:42"] || !s.Banned["name:guest"] || len(s.Banned) != 2 {
+		t.Errorf("replaying bans by name banned %v, want github:42 and name:guest", s.Banned)
+	}
+
+	snapshot := []byte(`{"seq": 1, "banned": {"mallory": true}, "history": [{"ID": 1, "Name": "mallory", "Message": "hi", "Sender": "github:42"}]}`)
+	s, err := decodeSnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Banned["github:42"] || len(s.Banned) != 1 {
+		t.Errorf("a snapshot with bans by name banned %v, want github:42", s.Banned)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// statsdEmitter pushes the server's metrics to a StatsD server, or Datadog's
+// agent, every statsdInterval, for monitoring that doesn't scrape servers for
+// them. Each room's metrics are tagged with the room, the way DogStatsD tags
+// them, along with any tags of the emitter's own.
+type statsdEmitter struct {
+	conn   net.Conn
+	prefix string
+	tags   []string
+	rooms  []*room
+}
+
+// statsdInterval is how often metrics are pushed.
+const statsdInterval = 10 * time.Second
+
+// statsdPacketSize is the most that is sent in a single packet, so that it
+// isn't fragmented.
+const statsdPacketSize = 1432
+
+// newStatsdEmitter makes an emitter pushing the metrics of rooms to the StatsD
+// server at addr, host:port, with every metric's name starting with prefix
+// and tagged with tags, comma separated key:value.
+func newStatsdEmitter(addr, prefix, tags string, rooms []*room) (*statsdEmitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdEmitter{conn: conn, prefix: prefix, tags: splitList(tags), rooms: rooms}, nil
+}
+
+// run pushes the metrics every statsdInterval.
+func (s *statsdEmitter) run() {
+	for range time.Tick(statsdInterval) {
+		s.emit()
+	}
+}
+
+// emit pushes the metrics as they are now.
+func (s *statsdEmitter) emit() {
+	var lines []string
+	lines = append(lines, s.gauge("goroutines", runtime.NumGoroutine()))
+	for _, r := range s.rooms {
+		m := r.currentMetrics()
+		tag := "room:" + m.Room
+		lines = append(lines,
+			s.gauge("room.clients", m.Clients, tag),
+			s.gauge("room.messages_per_second", m.MessagesPerSecond, tag),
+			s.gauge("room.queued", m.Queued, tag),
+			s.gauge("room.max_queued", m.MaxQueued, tag),
+		)
+	}
+	// lines are packed into as few packets as they fit in.
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			s.send(packet.Bytes())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		s.send(packet.Bytes())
+	}
+}
+
+// gauge is the line setting the named gauge to value, with the emitter's tags
+// and any more.
+func (s *statsdEmitter) gauge(name string, value int, tags ...string) string {
+	line := fmt.Sprintf("%s%s:%d|g", s.prefix, name, value)
+	if tags = append(append([]string(nil), s.tags...), tags...); len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+func (s *statsdEmitter) send(packet []byte) {
+	if _, err := s.conn.Write(packet); err != nil {
+		log.Println("StatsD:", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// subcommand is something the chat binary does other than serve the chat,
+// such as exporting a room's history. Subcommands are run as
+// "chat <name> [flags]", and parse their own flags from args.
+type subcommand struct {
+	usage string
+	run   func(args []string) error
+}
+
+// subcommands are the subcommands, by name.
+var subcommands = map[string]subcommand{
+	"export": {
+		usage: "export a room's history as JSON Lines, CSV or HTML",
+		run:   exportSubcommand,
+	},
+	"backup": {
+		usage: "back up the -data directory, while the server runs",
+		run:   backupSubcommand,
+	},
+	"restore": {
+		usage: "restore a backup into an empty -data directory",
+		run:   restoreSubcommand,
+	},
+	"migrate": {
+		usage: "migrate the -data directory up or down, or show its version",
+		run:   migrateSubcommand,
+	},
+	"import-slack": {
+		usage: "import a channel from a Slack export archive",
+		run:   importSlackSubcommand,
+	},
+	"loadtest": {
+		usage: "load test a server's room with simulated clients",
+		run:   loadtestSubcommand,
+	},
+}
+
+// runSubcommand runs the subcommand named by the first argument, if there is
+// one, reporting whether it did.
+func runSubcommand(args []string) bool {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return false
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "chat: unknown subcommand %q; the subcommands are:\n", args[0])
+		var names []string
+		for name := range subcommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %s\t%s\n", name, subcommands[name].usage)
+		}
+		os.Exit(2)
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "chat %s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// parseTime parses a time given to a subcommand or the API, either as
+// 2006-01-02T15:04:05Z07:00 or as a date, 2006-01-02, meaning midnight UTC.
+// The empty string is the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a time, such as 2006-01-02T15:04:05Z, nor a date, such as 2006-01-02", s)
+}
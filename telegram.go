@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// telegramBridge relays messages between a Telegram group and a room, using
+// a Telegram bot. Messages posted in the group are sent to the room under the
+// Telegram user's display name, and messages posted in the room are sent to
+// the group prefixed with the chat user's name.
+type telegramBridge struct {
+	// api is the base URL of the bot API, including the bot token.
+	api string
+
+	// chatID is the Telegram group the bridge relays to and from. Messages
+	// from any other chat the bot is in are ignored.
+	chatID int64
+
+	// room is the room the group is bridged with.
+	room *room
+
+	// client is the bridge's membership of the room.
+	client *client
+
+	httpClient *http.Client
+}
+
+// telegramPollTimeout is how long a single getUpdates long poll may wait for
+// something to happen.
+const telegramPollTimeout = 30 * time.Second
+
+// newTelegramBridge makes a bridge between the Telegram group chatID and the
+// room r, using the bot with the given token.
+func newTelegramBridge(token string, chatID int64, r *room) *telegramBridge {
+	return &telegramBridge{
+		api:    "https://api.telegram.org/bot" + token,
+		chatID: chatID,
+		room:   r,
+		client: &client{
+			send:     make(chan *message, messageBufferSize),
+			room:     r,
+			userData: map[string]interface{}{"name": "telegram"},
+		},
+		httpClient: &http.Client{Timeout: telegramPollTimeout + 10*time.Second},
+	}
+}
+
+// run joins the room and relays messages in both directions. It never
+// returns; failures talking to Telegram are logged and retried.
+func (b *telegramBridge) run() {
+	b.room.join <- b.client
+	go b.relay()
+
+	offset := int64(0)
+	for {
+		updates, err := b.getUpdates(offset)
+		if err != nil {
+			log.Println("Telegram getUpdates:", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			m := u.Message
+			if m == nil || m.Chat.ID != b.chatID || m.Text == "" {
+				continue
+			}
+			b.room.forward <- &message{
+				Name:    m.From.displayName(),
+				Message: m.Text,
+				When:    time.Unix(m.Date, 0),
+				from:    b.client,
+			}
+		}
+	}
+}
+
+// relay sends every message from the room to the Telegram group, except the
+// ones that came from Telegram in the first place, and people joining and
+// leaving, which the group has no need to hear about.
+func (b *telegramBridge) relay() {
+	for msg := range b.client.send {
+		// Telegram doesn't use the prepared websocket frame.
+		msg.release()
+		if msg.from == b.client || msg.Presence != "" || !msg.relayable() {
+			continue
+		}
+		text := msg.Name + ": " + msg.Message
+		if msg.Action {
+			text = actionText(msg.Name, msg.Message)
+		}
+		if err := b.sendMessage(text); err != nil {
+			log.Println("Telegram sendMessage:", err)
+		}
+	}
+}
+
+// telegramUpdate is the subset of the bot API Update object that we use.
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type telegramMessage struct {
+	From telegramUser `json:"from"`
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Date int64  `json:"date"`
+	Text string `json:"text"`
+}
+
+type telegramUser struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Username  string `json:"username"`
+}
+
+// displayName is the name a Telegram user is shown as in the room.
+func (u telegramUser) displayName() string {
+	if name := strings.TrimSpace(u.FirstName + " " + u.LastName); name != "" {
+		return name
+	}
+	return u.Username
+}
+
+// getUpdates long polls Telegram for updates starting at offset.
+func (b *telegramBridge) getUpdates(offset int64) ([]telegramUpdate, error) {
+	var updates []telegramUpdate
+	err := b.call("getUpdates", url.Values{
+		"offset":          {strconv.FormatInt(offset, 10)},
+		"timeout":         {strconv.Itoa(int(telegramPollTimeout.Seconds()))},
+		"allowed_updates": {`["message"]`},
+	}, &updates)
+	return updates, err
+}
+
+// sendMessage posts text to the bridged group.
+func (b *telegramBridge) sendMessage(text string) error {
+	return b.call("sendMessage", url.Values{
+		"chat_id": {strconv.FormatInt(b.chatID, 10)},
+		"text":    {text},
+	}, nil)
+}
+
+// call invokes a bot API method, decoding its result into result if it is
+// not nil.
+func (b *telegramBridge) call(method string, params url.Values, result interface{}) error {
+	resp, err := b.httpClient.PostForm(b.api+"/"+method, params)
+	if err != nil {
+		// The error includes the URL, and so the bot token; don't log it.
+		return fmt.Errorf("%s request failed", method)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	if !body.OK {
+		return errors.New(body.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(body.Result, result)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestTelegramRelaySkipsNotices checks that the bridge only passes on what
+// is said in the room, not the notices websocket clients are sent, such as
+// read receipts, which have no text.
+func TestTelegramRelaySkipsNotices(t *testing.T) {
+	sent := make(chan string, 10)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent <- r.FormValue("text")
+		w.Write([]byte(`{"ok": true, "result": {}}`))
+	}))
+	defer api.Close()
+	b := newTelegramBridge("token", 1, newRoom(1))
+	b.api = api.URL
+	go b.relay()
+	defer close(b.client.send)
+
+	b.client.send <- &message{Receipts: []receipt{{From: 1, To: 2, Reader: "ada"}}, System: true}
+	b.client.send <- &message{Deleted: 1, System: true}
+	b.client.send <- &message{Typing: true, Name: "ada"}
+	b.client.send <- &message{Name: "ada", Message: "hello"}
+	select {
+	case text := <-sent:
+		if text != "ada: hello" {
+			t.Fatalf("relayed %q before the message, want ada: hello", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message was never relayed")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"html/template"
+	"io/fs"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+// Pages share a layout, and partials, which are parsed along with each
+// page's own template. A page uses the layout by starting with
+// {{template "layout" .}}, and defining "title" and "content", and "head" and
+// "scripts" if it has anything to add to them. Partials define templates
+// any page may use, such as "user".
+const (
+	layoutFile   = "layout.html"
+	partialsGlob = "partials/*.html"
+)
+
+// templateFuncs are the helper functions every template may use.
+var templateFuncs = template.FuncMap{
+	"formatTime":  formatTime,
+	"avatarURL":   avatarURL,
+	"messageHTML": messageHTML,
+	"t":           func(lang, text string) string { return locales.translate(lang, text) },
+}
+
+// parsePage parses the page template called filename in fsys, along with the
+// layout and partials. Directories of templates from before there was a
+// layout, given with -templates-dir, have none, and their pages are parsed
+// on their own.
+func parsePage(fsys fs.FS, filename string) (*template.Template, error) {
+	var patterns []string
+	if _, err := fs.Stat(fsys, layoutFile); err == nil {
+		patterns = append(patterns, layoutFile)
+	}
+	if partials, _ := fs.Glob(fsys, partialsGlob); len(partials) > 0 {
+		patterns = append(patterns, partialsGlob)
+	}
+	patterns = append(patterns, filename)
+	return template.New(filename).Funcs(templateFuncs).ParseFS(fsys, patterns...)
+}
+
+// formatTime formats t as people read it, leaving out the date if it is
+// today, and the year if it is this year.
+func formatTime(t time.Time) string {
+	t = t.Local()
+	now := time.Now()
+	switch {
+	case t.Year() != now.Year():
+		return t.Format("2 Jan 2006 15:04")
+	case t.YearDay() != now.YearDay():
+		return t.Format("Mon 2 Jan 15:04")
+	}
+	return t.Format("15:04")
+}
+
+// avatarURL returns the URL of a user's avatar, or "" if they have none. The
+// user is the data from their auth cookie, or their account.
+func avatarURL(user interface{}) string {
+	switch u := user.(type) {
+	case objx.Map:
+		return u.Get("avatar_url").Str()
+	case map[string]interface{}:
+		url, _ := u["avatar_url"].(string)
+		return url
+	case *account:
+		return u.AvatarURL
+	}
+	return ""
+}
+
+// linkPattern matches the links in messages.
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// messageHTML renders the text of a message as HTML, escaping it, keeping
+// its line breaks, and making its links clickable.
+func messageHTML(text string) template.HTML {
+	var b strings.Builder
+	last := 0
+	for _, loc := range linkPattern.FindAllStringIndex(text, -1) {
+		b.WriteString(template.HTMLEscapeString(text[last:loc[0]]))
+		link := template.HTMLEscapeString(text[loc[0]:loc[1]])
+		b.WriteString(`<a href="` + link + `" rel="nofollow noopener" target="_blank">` + link + `</a>`)
+		last = loc[1]
+	}
+	b.WriteString(template.HTMLEscapeString(text[last:]))
+	return template.HTML(strings.ReplaceAll(b.String(), "\n", "<br>"))
+}
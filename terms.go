@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The server can have terms of service that everybody must accept before
+// they chat. The terms have a version, given with -terms-version; when it
+// changes, everybody is asked to accept the new terms, whatever they accepted
+// before. People who haven't accepted the current version are sent from /chat
+// to /terms, which links to the terms and asks them to, and each account
+// keeps when it accepted each version. Until they do, the room's websocket,
+// the API and the other ways in turn them away. People who haven't signed in with an
+// account have nowhere to keep that, so aren't asked.
+
+// termsAcceptance is somebody accepting a version of the terms.
+type termsAcceptance struct {
+	Version string    `json:"version"`
+	When    time.Time `json:"when"`
+}
+
+// accepted reports whether the account has accepted the version of the terms.
+func (a *account) accepted(version string) bool {
+	for _, t := range a.Terms {
+		if t.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// terms is the current version of the terms of service.
+type terms struct {
+	version string
+	users   *userStore
+}
+
+// accepts reports whether the request comes from somebody who needn't accept
+// the terms before going on.
+func (t *terms) accepts(r *http.Request) bool {
+	id := currentAccountID(r)
+	return id == "" || t.acceptedBy(id)
+}
+
+// acceptedBy reports whether the account with the given ID needn't accept the
+// terms before going on.
+func (t *terms) acceptedBy(id string) bool {
+	a := t.users.get(id)
+	return a == nil || a.accepted(t.version)
+}
+
+type termsGateHandler struct {
+	terms *terms
+	next  http.Handler
+
+	// refuse is set for the websocket and the API, which have no page to
+	// send people to, so turn them away instead.
+	refuse bool
+}
+
+func (h *termsGateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.terms.accepts(r) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if h.refuse {
+		http.Error(w, "the terms of service must be accepted first, at /terms", http.StatusForbidden)
+		return
+	}
+	// they come back to where they were going, before any prefix, such as
+	// an organization's, was stripped from its path, once they accept.
+	w.Header().Set("Location", "/terms?"+url.Values{"next": {r.RequestURI}}.Encode())
+	w.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+// RequireTerms wraps handler so that people who haven't accepted the current
+// version of the terms are sent to accept them first. With no terms, handler
+// is returned as it is.
+func RequireTerms(t *terms, handler http.Handler) http.Handler {
+	if t == nil {
+		return handler
+	}
+	return &termsGateHandler{terms: t, next: handler}
+}
+
+// RefuseWithoutTerms wraps handler, such as the room's websocket or part of
+// the API, so that people who haven't accepted the current version of the
+// terms are refused. With no terms, handler is returned as it is.
+func RefuseWithoutTerms(t *terms, handler http.Handler) http.Handler {
+	if t == nil {
+		return handler
+	}
+	return &termsGateHandler{terms: t, next: handler, refuse: true}
+}
+
+// termsHandler serves /terms?next={path}, where GET shows the page asking
+// people to accept the terms, and POST, from its form, records that they do
+// and sends them on to next.
+type termsHandler struct {
+	terms *terms
+	page  http.Handler
+}
+
+func (h *termsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		h.page.ServeHTTP(w, r)
+	case "POST":
+		id := currentAccountID(r)
+		if id == "" {
+			w.Header().Set("Location", "/login")
+			w.WriteHeader(http.StatusSeeOther)
+			return
+		}
+		// the page may have been showing terms that have since changed.
+		if r.FormValue("version") == h.terms.version {
+			_, err := h.terms.users.update(id, func(a *account) {
+				if !a.accepted(h.terms.version) {
+					a.Terms = append(a.Terms, termsAcceptance{Version: h.terms.version, When: time.Now()})
+				}
+			})
+			if err != nil && err != errNoAccount {
+				log.Println("Failed to record accepting the terms:", err)
+				http.Error(w, "failed to record accepting the terms", http.StatusInternalServerError)
+				return
+			}
+		}
+		next := r.FormValue("next")
+		// only ever go on to somewhere on this server.
+		if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+			next = "/chat"
+		}
+		w.Header().Set("Location", next)
+		w.WriteHeader(http.StatusSeeOther)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
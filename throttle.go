@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginThrottle slows down repeated login attempts to blunt credential
+// stuffing. It counts failed attempts against a key, such as "ip:1.2.3.4"
+// or, for password logins, "account:alice". The first few failures are
+// free; after that, each failure makes the key wait twice as long as the last
+// before it may try again, up to a maximum, at which point the key is
+// effectively locked out until that time has passed.
+type loginThrottle struct {
+	// free is the number of failures allowed before backing off starts.
+	free int
+
+	// backoff is how long to wait after the first failure beyond the free
+	// ones, and lockout the most a key is ever made to wait.
+	backoff time.Duration
+	lockout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*throttleEntry
+}
+
+// throttleEntry tracks the failures of a single key.
+type throttleEntry struct {
+	failures int
+	until    time.Time
+	last     time.Time
+}
+
+// newLoginThrottle makes a loginThrottle, and starts it forgetting keys
+// that have not failed for a while.
+func newLoginThrottle(free int, backoff, lockout time.Duration) *loginThrottle {
+	t := &loginThrottle{
+		free:    free,
+		backoff: backoff,
+		lockout: lockout,
+		entries: make(map[string]*throttleEntry),
+	}
+	go t.sweep(lockout)
+	return t
+}
+
+// setLimits changes how many failures are free, and how long keys back off
+// for after that, as newLoginThrottle's arguments do. Keys already backing off
+// wait as long as they were told to.
+func (t *loginThrottle) setLimits(free int, backoff, lockout time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.free = free
+	t.backoff = backoff
+	t.lockout = lockout
+}
+
+// allow reports whether key may attempt to log in now, and if not, how long
+// it must wait.
+func (t *loginThrottle) allow(key string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[key]
+	if !ok {
+		return 0, true
+	}
+	if wait := time.Until(e.until); wait > 0 {
+		return wait, false
+	}
+	return 0, true
+}
+
+// fail records a failed attempt by key.
+func (t *loginThrottle) fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[key]
+	if !ok {
+		e = &throttleEntry{}
+		t.entries[key] = e
+	}
+	e.failures++
+	e.last = time.Now()
+	if over := e.failures - t.free; over > 0 {
+		wait := t.lockout
+		if over < 32 {
+			if d := t.backoff << uint(over-1); d > 0 && d < wait {
+				wait = d
+			}
+		}
+		e.until = e.last.Add(wait)
+	}
+}
+
+// reset forgets key's failures, after it has logged in successfully.
+func (t *loginThrottle) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+}
+
+// sweep forgets keys that haven't failed for longer than the lockout, every
+// interval.
+func (t *loginThrottle) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		t.mu.Lock()
+		for key, e := range t.entries {
+			if time.Since(e.last) > t.lockout {
+				delete(t.entries, key)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+type throttleHandler struct {
+	throttle *loginThrottle
+	next     http.Handler
+}
+
+func (h *throttleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := "ip:" + clientIP(r)
+	if wait, ok := h.throttle.allow(key); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Too many login attempts, please try again later", http.StatusTooManyRequests)
+		return
+	}
+	rec := &statusRecorder{ResponseWriter: w}
+	h.next.ServeHTTP(rec, r)
+
+	// Starting a login counts against the IP until it completes; so does a
+	// login that fails. Completing a login clears the slate.
+	callback := strings.HasPrefix(r.URL.Path, "/auth/callback/")
+	switch {
+	case rec.status >= 400:
+		h.throttle.fail(key)
+	case callback:
+		h.throttle.reset(key)
+	default:
+		h.throttle.fail(key)
+	}
+}
+
+// ThrottleLogins wraps a login handler so that clients which keep starting
+// or failing logins are made to back off.
+func ThrottleLogins(throttle *loginThrottle, handler http.Handler) http.Handler {
+	return &throttleHandler{throttle: throttle, next: handler}
+}
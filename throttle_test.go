@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestLoginThrottleBacksOff checks that after the free failures each one
+// doubles how long the key must wait, up to the lockout, and that logging
+// in successfully clears the slate.
+func TestLoginThrottleBacksOff(t *testing.T) {
+	throttle := newLoginThrottle(2, time.Minute, 5*time.Minute)
+	const key = "ip:203.0.113.7"
+	for i := 0; i < 2; i++ {
+		throttle.fail(key)
+		if wait, ok := throttle.allow(key); !ok {
+			t.Fatalf("free failure %d has the key wait %v", i+1, wait)
+		}
+	}
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		throttle.fail(key)
+		wait, ok := throttle.allow(key)
+		if ok || wait > want || wait < want-time.Second {
+			t.Fatalf("the key may go ahead (%v) after waiting %v, want to wait %v", ok, wait, want)
+		}
+	}
+	throttle.reset(key)
+	if wait, ok := throttle.allow(key); !ok {
+		t.Fatalf("after a reset the key still waits %v", wait)
+	}
+}
+
+// TestThrottleLogins checks that starting logins over and over is turned
+// away, with how long to wait, and that completing one clears the slate.
+func TestThrottleLogins(t *testing.T) {
+	status := http.StatusTemporaryRedirect
+	h := ThrottleLogins(newLoginThrottle(2, time.Minute, time.Hour), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	do := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = "203.0.113.7:1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	do("/auth/login/github")
+	do("/auth/callback/github")
+	for i := 0; i < 3; i++ {
+		if w := do("/auth/login/github"); w.Code != status {
+			t.Fatalf("login %d after a completed one got %d, want %d", i+1, w.Code, status)
+		}
+	}
+	w := do("/auth/login/github")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("a login too many got %d, with Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// a failed callback counts too, from another address, which has its
+	// own count.
+	status = http.StatusUnauthorized
+	r := httptest.NewRequest("GET", "/auth/callback/github", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	for i := 0; i < 4; i++ {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("failing callbacks got %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
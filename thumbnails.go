@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"strconv"
+)
+
+// Uploaded images get thumbnails, in each of thumbnailSizes, so that clients
+// showing a room's history needn't download every image at full size. A
+// thumbnail's size is how long its longest side is; images already smaller
+// than a size get no thumbnail of that size, and clients show them as they
+// are.
+var thumbnailSizes = []int{160, 480}
+
+// maxThumbnailPixels is the most pixels an image may have to get thumbnails,
+// so that a small file claiming to be a huge image can't use up the memory
+// decoding it would take.
+const maxThumbnailPixels = 50 << 20
+
+// thumbnail is a smaller version of an uploaded image.
+type thumbnail struct {
+	Size   int    `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// thumbnailPath is where the upload's thumbnail of the given size is kept.
+func (s *uploadStore) thumbnailPath(id string, size int) string {
+	return s.path(id) + "." + strconv.Itoa(size) + ".jpg"
+}
+
+// makeThumbnails makes the thumbnails of an uploaded image, adding them to
+// the upload.
+func (s *uploadStore) makeThumbnails(u *upload) error {
+	f, err := os.Open(s.path(u.ID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return errors.New("the image is too big to make thumbnails of")
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+	// thumbnails are JPEGs, which can't be transparent, so images are put
+	// on white.
+	src := image.NewRGBA(img.Bounds())
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Over)
+	for _, size := range thumbnailSizes {
+		thumb := shrink(src, size)
+		if thumb == nil {
+			continue
+		}
+		if err := saveJPEG(s.thumbnailPath(u.ID, size), thumb); err != nil {
+			return err
+		}
+		u.Thumbnails = append(u.Thumbnails, thumbnail{
+			Size:   size,
+			Width:  thumb.Bounds().Dx(),
+			Height: thumb.Bounds().Dy(),
+			URL:    fmt.Sprintf("%s/thumbnails/%d", u.URL, size),
+		})
+	}
+	return nil
+}
+
+// removeThumbnails removes the upload's thumbnails.
+func (s *uploadStore) removeThumbnails(u *upload) {
+	for _, t := range u.Thumbnails {
+		os.Remove(s.thumbnailPath(u.ID, t.Size))
+	}
+	u.Thumbnails = nil
+}
+
+// shrink returns src shrunk so its longest side is size, averaging the pixels
+// that make up each of the thumbnail's, or nil if it is already no bigger.
+func shrink(src *image.RGBA, size int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return nil
+	}
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := y*h/th, (y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := x*w/tw, (x+1)*w/tw
+			var r, g, bl, n uint32
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(b.Min.X+x0, b.Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(src.Pix[i])
+					g += uint32(src.Pix[i+1])
+					bl += uint32(src.Pix[i+2])
+					n++
+					i += 4
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n), uint8(g/n), uint8(bl/n), 0xff
+		}
+	}
+	return dst
+}
+
+// saveJPEG saves img as a JPEG at path.
+func saveJPEG(path string, img image.Image) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(f, img, &jpeg.Options{Quality: 80}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+// The scopes a personal access token can be given, limiting what may be done
+// with it.
+const (
+	// scopeRead is making GET requests to the API, and fetching the debug
+	// endpoints.
+	scopeRead = "read"
+
+	// scopeWrite is making any other requests to the API.
+	scopeWrite = "write"
+
+	// scopeChat is connecting to rooms over the websocket.
+	scopeChat = "chat"
+)
+
+const (
+	tokensFile = "tokens.json"
+
+	// tokenPrefix starts every token, so that they are easy to recognise,
+	// for instance by secret scanners, when they turn up where they
+	// shouldn't.
+	tokenPrefix = "chat_"
+
+	// maxTokens is the most tokens one account may have.
+	maxTokens = 50
+)
+
+// apiToken is a personal access token, with which scripts and command line
+// tools can use the API and websocket on somebody's behalf without replaying
+// their browser's cookies. The token itself is only shown when it is made;
+// only a hash of it is kept.
+type apiToken struct {
+	ID       string    `json:"id"`
+	Account  string    `json:"account"`
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used,omitempty"`
+	Hash     string    `json:"hash,omitempty"`
+}
+
+// tokenStore holds every personal access token, by ID. If it has a
+// directory, the tokens are kept in tokens.json there.
+type tokenStore struct {
+	path string
+
+	mu     sync.Mutex
+	tokens map[string]*apiToken
+}
+
+// openTokenStore loads the tokens kept in dir, if it is not empty.
+func openTokenStore(dir string) (*tokenStore, error) {
+	s := &tokenStore{tokens: make(map[string]*apiToken)}
+	if dir == "" {
+		return s, nil
+	}
+	s.path = filepath.Join(dir, tokensFile)
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var tokens []*apiToken
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		s.tokens[t.ID] = t
+	}
+	return s, nil
+}
+
+// create makes a token for the account with the given scopes, returning it
+// along with the secret to give to the user, which looks like
+// chat_<id>_<secret>.
+func (s *tokenStore) create(account, name string, scopes []string) (*apiToken, string, error) {
+	id, secret := make([]byte, 8), make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	t := &apiToken{
+		ID:      hex.EncodeToString(id),
+		Account: account,
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now(),
+	}
+	token := tokenPrefix + t.ID + "_" + hex.EncodeToString(secret)
+	t.Hash = hashToken(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.list(account)) >= maxTokens {
+		return nil, "", errors.New("you have too many tokens; revoke some first")
+	}
+	s.tokens[t.ID] = t
+	created := *t
+	created.Hash = ""
+	return &created, token, s.save()
+}
+
+// list returns copies of the account's tokens, without their hashes, oldest
+// first. s.mu must be held.
+func (s *tokenStore) list(account string) []apiToken {
+	tokens := []apiToken{}
+	for _, t := range s.tokens {
+		if t.Account == account {
+			listed := *t
+			listed.Hash = ""
+			tokens = append(tokens, listed)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	return tokens
+}
+
+// revoke deletes the account's token with the given ID, reporting whether
+// there was one.
+func (s *tokenStore) revoke(account, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if !ok || t.Account != account {
+		return false, nil
+	}
+	delete(s.tokens, id)
+	return true, s.save()
+}
+
+// check returns a copy of the token, or nil if it isn't one of ours or has
+// been revoked.
+func (s *tokenStore) check(token string) *apiToken {
+	parts := strings.Split(strings.TrimPrefix(token, tokenPrefix), "_")
+	if !strings.HasPrefix(token, tokenPrefix) || len(parts) != 2 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[parts[0]]
+	if !ok || subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashToken(token))) != 1 {
+		return nil
+	}
+	// when a token was last used is only a guide, so it isn't saved every
+	// time.
+	t.LastUsed = time.Now()
+	found := *t
+	return &found
+}
+
+func (s *tokenStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	tokens := make([]*apiToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	return saveJSON(s.path, tokens)
+}
+
+// hashToken returns the hash of a token that is kept in place of it. Tokens
+// are long and random, so a plain SHA-256 is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// validScopes reports whether every one of scopes is a scope.
+func validScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if scope != scopeRead && scope != scopeWrite && scope != scopeChat {
+			return false
+		}
+	}
+	return len(scopes) > 0
+}
+
+// bearerToken returns the token in the request's Authorization header, or
+// the empty string if there isn't one.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+type tokenAuthHandler struct {
+	tokens *tokenStore
+	users  *userStore
+	next   http.Handler
+}
+
+func (h *tokenAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := bearerToken(r)
+	if token == "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	t := h.tokens.check(token)
+	if t == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid or revoked token", http.StatusUnauthorized)
+		return
+	}
+	a := h.users.get(t.Account)
+	if a == nil {
+		http.Error(w, "invalid or revoked token", http.StatusUnauthorized)
+		return
+	}
+	// Tokens are for the API and the websocket; making more tokens with
+	// them would let a leaked token outlive being revoked.
+	var scope string
+	switch {
+	case strings.Contains(r.URL.Path, "/api/me/tokens"):
+	case strings.HasSuffix(r.URL.Path, "/room") || strings.HasSuffix(r.URL.Path, "/webtransport"):
+		scope = scopeChat
+	case (strings.Contains(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/debug/")) && (r.Method == "GET" || r.Method == "HEAD"):
+		scope = scopeRead
+	case strings.Contains(r.URL.Path, "/api/"):
+		scope = scopeWrite
+	}
+	if scope == "" || !contains(t.Scopes, scope) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+		http.Error(w, "the token can't be used for that", http.StatusForbidden)
+		return
+	}
+	// Everything else learns who is signed in from the auth cookie, so the
+	// request is given one for the token's account in place of any cookies
+	// it came with.
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = r.Header.Clone()
+	r2.Header.Del("Cookie")
+	r2.AddCookie(&http.Cookie{Name: "auth", Value: signCookie(objx.New(map[string]interface{}{
+		"id":         a.ID,
+		"name":       a.Name,
+		"avatar_url": a.AvatarURL,
+	}))})
+	h.next.ServeHTTP(w, r2)
+}
+
+// TokenAuth wraps handler so that requests may be authenticated with a
+// personal access token, sent as "Authorization: Bearer <token>", instead of
+// the auth cookie. The token's scopes must allow the request.
+func TokenAuth(tokens *tokenStore, users *userStore, handler http.Handler) http.Handler {
+	return &tokenAuthHandler{tokens: tokens, users: users, next: handler}
+}
+
+// tokensHandler serves /api/me/tokens, the signed in user's personal access
+// tokens: GET lists them, POST makes one, with a body such as
+// {"name": "deploy script", "scopes": ["read", "chat"]}, and
+// DELETE /api/me/tokens/{id} revokes one. The token itself is only in the
+// reply to the POST.
+type tokensHandler struct {
+	tokens *tokenStore
+}
+
+func (h *tokensHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	account := currentAccountID(r)
+	if account == "" {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/me/tokens"), "/")
+	switch {
+	case r.Method == "GET" && id == "":
+		h.tokens.mu.Lock()
+		tokens := h.tokens.list(account)
+		h.tokens.mu.Unlock()
+		writeJSON(w, tokens)
+	case r.Method == "POST" && id == "":
+		var req struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&req); err != nil {
+			http.Error(w, "bad token: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" || len(req.Name) > 100 {
+			http.Error(w, "the token needs a name of up to 100 characters", http.StatusBadRequest)
+			return
+		}
+		if !validScopes(req.Scopes) {
+			http.Error(w, "the scopes must be some of read, write and chat", http.StatusBadRequest)
+			return
+		}
+		t, token, err := h.tokens.create(account, strings.TrimSpace(req.Name), req.Scopes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, struct {
+			apiToken
+			Token string `json:"token"`
+		}{*t, token})
+	case r.Method == "DELETE" && id != "":
+		ok, err := h.tokens.revoke(account, id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, "failed to save tokens", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestTokenAuth checks that personal access tokens sign requests in as
+// their account, as far as their scopes allow, until they are revoked.
+func TestTokenAuth(t *testing.T) {
+	cookieKey = []byte("test secret")
+	users, err := openUserStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := users.login("", "github", "1", "", "ada", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	tokens, err := openTokenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, readToken, err := tokens.create(a.ID, "script", []string{scopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, chatToken, err := tokens.create(a.ID, "bot", []string{scopeChat, scopeWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen string
+	h := TokenAuth(tokens, users, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = currentAccountID(r)
+	}))
+	do := func(method, path, token string) int {
+		seen = ""
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		// a cookie for somebody else is ignored in favour of the token.
+		r.AddCookie(&http.Cookie{Name: "auth", Value: "somebody else's"})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		method, path, token string
+		want                int
+	}{
+		{"GET", "/api/me/profile", readToken, http.StatusOK},
+		{"PUT", "/api/me/profile", readToken, http.StatusForbidden},
+		{"GET", "/room", readToken, http.StatusForbidden},
+		{"GET", "/room", chatToken, http.StatusOK},
+		{"PUT", "/api/me/profile", chatToken, http.StatusOK},
+		{"POST", "/api/me/tokens", chatToken, http.StatusForbidden},
+		{"GET", "/api/me/profile", readToken + "x", http.StatusUnauthorized},
+		{"GET", "/api/me/profile", "chat_nope", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		code := do(test.method, test.path, test.token)
+		if code != test.want {
+			t.Errorf("%s %s: got %d, want %d", test.method, test.path, code, test.want)
+		}
+		if code == http.StatusOK && seen != a.ID {
+			t.Errorf("%s %s: signed in as %q, want %q", test.method, test.path, seen, a.ID)
+		}
+	}
+
+	// tokens outlive restarts, hashed, until revoked.
+	if tokens, err = openTokenStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	h = TokenAuth(tokens, users, h.(*tokenAuthHandler).next)
+	if l := tokens.list(a.ID); len(l) != 2 || l[0].Hash != "" {
+		t.Fatalf("listed %+v, want two tokens without their hashes", l)
+	}
+	if code := do("GET", "/api/me/profile", readToken); code != http.StatusOK {
+		t.Errorf("after a restart the token got %d, want %d", code, http.StatusOK)
+	}
+	if ok, err := tokens.revoke(a.ID, read.ID); !ok || err != nil {
+		t.Fatalf("revoking: %v %v", ok, err)
+	}
+	if code := do("GET", "/api/me/profile", readToken); code != http.StatusUnauthorized {
+		t.Errorf("a revoked token got %d, want %d", code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// languagePattern matches the language codes translations can be asked for.
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// translator translates text into other languages. Any translation service
+// can be used by implementing it.
+type translator interface {
+	// translate translates text, whatever language it is in, into the
+	// language with the given code.
+	translate(ctx context.Context, text, language string) (string, error)
+}
+
+// translation is a message translated for somebody. Translations are only
+// ever sent to whoever asked for them, alongside the original message: the
+// message everybody else sees is left as it is.
+type translation struct {
+	// Of is the ID of the message translated.
+	Of       uint64
+	Language string
+	Text     string
+}
+
+// translateTimeout is how long the translation service has to answer.
+const translateTimeout = 10 * time.Second
+
+// libreTranslate is a translator using a LibreTranslate server, or anything
+// else with the same API.
+type libreTranslate struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+// newLibreTranslate makes a translator using the LibreTranslate server at
+// url, e.g. https://libretranslate.com.
+func newLibreTranslate(url, apiKey string) *libreTranslate {
+	return &libreTranslate{
+		url:    strings.TrimSuffix(url, "/"),
+		apiKey: apiKey,
+		client: &http.Client{Timeout: translateTimeout},
+	}
+}
+
+func (t *libreTranslate) translate(ctx context.Context, text, language string) (string, error) {
+	body, _ := json.Marshal(map[string]string{
+		"q":       text,
+		"source":  "auto",
+		"target":  language,
+		"format":  "text",
+		"api_key": t.apiKey,
+	})
+	req, err := http.NewRequest("POST", t.url+"/translate", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		TranslatedText string `json:"translatedText"`
+		Error          string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.Error != "" {
+		return "", errors.New(result.Error)
+	}
+	return result.TranslatedText, nil
+}
+
+// translateCommand is /translate, which translates a recent message for the
+// user who asks, into the language given or else their preferred one.
+func translateCommand(c *client, args string) error {
+	fields := strings.Fields(args)
+	if len(fields) < 1 || len(fields) > 2 {
+		return errUsage
+	}
+	id, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return errUsage
+	}
+	if c.room.translator == nil {
+		return errors.New("translation isn't set up")
+	}
+	language := ""
+	if len(fields) == 2 {
+		language = fields[1]
+	} else if accountID, _ := c.userData["id"].(string); accountID != "" && c.room.users != nil {
+		if a := c.room.users.get(accountID); a != nil {
+			language = a.Language
+		}
+	}
+	if language == "" {
+		return errors.New("say which language to translate into, or set your language on your profile")
+	}
+	if !languagePattern.MatchString(language) {
+		return fmt.Errorf("%q is not a language code, such as en or pt-BR", language)
+	}
+	c.room.mu.RLock()
+	msg := c.room.state.message(id)
+	c.room.mu.RUnlock()
+	if msg == nil {
+		return fmt.Errorf("there is no recent message %d", id)
+	}
+
+	// Translating takes a while; don't hold up the client's other messages.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), translateTimeout)
+		defer cancel()
+		text, err := c.room.translator.translate(ctx, msg.Message, language)
+		if err != nil {
+			log.Println("Failed to translate:", err)
+			c.reply("/translate: the message couldn't be translated")
+			return
+		}
+		c.room.forward <- &message{
+			When:        time.Now(),
+			System:      true,
+			to:          c,
+			Translation: &translation{Of: id, Language: language, Text: text},
+		}
+	}()
+	return nil
+}
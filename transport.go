@@ -0,0 +1,52 @@
+package main
+
+import "net/http"
+
+// transport carries messages between a room and one of its clients, however
+// they are connected. Transports that have one goroutine reading from the
+// connection and another writing to it implement it, and leave the rest to
+// serveTransport.
+type transport interface {
+	// read returns the next message from the client.
+	read() (*message, error)
+
+	// write sends msg to the client.
+	write(msg *message) error
+
+	// close closes the connection. If the room turned the client away,
+	// reason says why.
+	close(reason *closeReason)
+}
+
+// serveTransport has the user join the room over t, having connected with
+// req, and chat in it until the connection is lost.
+func serveTransport(r *room, req *http.Request, userData map[string]interface{}, wire *wireFormat, t transport) {
+	client := &client{
+		send:     make(chan *message, messageBufferSize),
+		room:     r,
+		userData: userData,
+		country:  requestCountry(req),
+		locale:   clientLocale(req, userData),
+		wire:     wire,
+	}
+	r.join <- client
+	defer func() { r.leave <- client }()
+	go func() {
+		for msg := range client.send {
+			err := t.write(msg)
+			msg.release()
+			if err != nil {
+				break
+			}
+		}
+		t.close(client.rejected)
+	}()
+	for {
+		msg, err := t.read()
+		if err != nil {
+			break
+		}
+		client.receive(msg)
+	}
+	t.close(nil)
+}
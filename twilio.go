@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// twilioGateway bridges a room and SMS, through Twilio: texts from the
+// registered phone numbers are posted to the room as their accounts, and
+// people with a registered number are texted when they are @mentioned while
+// they aren't in the room, which suits a room people are escalated to when
+// on call.
+type twilioGateway struct {
+	sid, token string
+
+	// from is the Twilio number texts are sent from.
+	from string
+
+	// numbers maps each registered phone number to its account, and phones
+	// each account to its number.
+	numbers map[string]string
+	phones  map[string]string
+
+	users   *userStore
+	baseURL *url.URL
+	client  *http.Client
+
+	// room is where texts are posted; it is set once the rooms are made.
+	room *room
+
+	// outgoing holds the texts waiting to be sent.
+	outgoing chan url.Values
+}
+
+// twilioAPI is where Twilio's REST API is.
+var twilioAPI = "https://api.twilio.com/2010-04-01"
+
+// twilioTimeout is how long a request to Twilio may take.
+const twilioTimeout = 10 * time.Second
+
+// maxTextLength is the most of a message a text has, so that it fits in a
+// few SMS segments.
+const maxTextLength = 300
+
+// newTwilioGateway makes a gateway for the Twilio account sid, with its auth
+// token, texting from the number from. numbers are the registered phone
+// numbers, comma separated phone=account, such as +15551234567=github:42.
+// The token is what Twilio signs its webhooks with, so it mustn't be empty:
+// anybody could sign a text with an empty key.
+func newTwilioGateway(sid, token, from, numbers string, users *userStore, baseURL *url.URL) (*twilioGateway, error) {
+	g := &twilioGateway{
+		sid:      sid,
+		token:    token,
+		from:     from,
+		numbers:  make(map[string]string),
+		phones:   make(map[string]string),
+		users:    users,
+		baseURL:  baseURL,
+		client:   &http.Client{Timeout: twilioTimeout},
+		outgoing: make(chan url.Values, messageBufferSize),
+	}
+	for _, pair := range splitList(numbers) {
+		phone, account, ok := strings.Cut(pair, "=")
+		if !ok || !strings.HasPrefix(phone, "+") || account == "" {
+			return nil, fmt.Errorf("bad phone=account pair %q: phones are like +15551234567", pair)
+		}
+		g.numbers[phone] = account
+		g.phones[account] = phone
+	}
+	go g.send()
+	return g, nil
+}
+
+// notify texts people with a registered number about messages that mention
+// them.
+func (g *twilioGateway) notify(n *notification) {
+	phone, ok := g.phones[n.Account]
+	if !ok || n.Kind != notifyMention {
+		return
+	}
+	text := fmt.Sprintf("%s in %s: %s", n.Name, n.Room, n.Message)
+	if r := []rune(text); len(r) > maxTextLength {
+		text = string(r[:maxTextLength]) + "…"
+	}
+	select {
+	case g.outgoing <- url.Values{"From": {g.from}, "To": {phone}, "Body": {text}}:
+	default:
+		log.Println("Twilio: too many texts waiting to be sent; dropped one")
+	}
+}
+
+// send sends the outgoing texts, one at a time.
+func (g *twilioGateway) send() {
+	for form := range g.outgoing {
+		req, err := http.NewRequest("POST", twilioAPI+"/Accounts/"+g.sid+"/Messages.json", strings.NewReader(form.Encode()))
+		if err != nil {
+			log.Println("Twilio:", err)
+			continue
+		}
+		req.SetBasicAuth(g.sid, g.token)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := g.client.Do(req)
+		if err != nil {
+			log.Println("Twilio:", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Println("Twilio: failed to text", form.Get("To")+":", resp.Status)
+		}
+	}
+}
+
+// ServeHTTP serves POST /api/integrations/twilio/sms, the webhook Twilio
+// sends texts to the gateway's number to, posting those from registered
+// numbers to the room.
+func (g *twilioGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad text: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	u := requestBaseURL(r, g.baseURL).String() + r.URL.RequestURI()
+	if !twilioSigned(u, r.PostForm, r.Header.Get("X-Twilio-Signature"), g.token) {
+		http.Error(w, "bad signature", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	account, ok := g.numbers[r.PostForm.Get("From")]
+	body := strings.TrimSpace(r.PostForm.Get("Body"))
+	if !ok || body == "" {
+		// texts from anybody else are ignored.
+		fmt.Fprint(w, "<Response/>")
+		return
+	}
+	userData := map[string]interface{}{"id": account, "name": account}
+	if a := g.users.get(account); a != nil {
+		userData["name"] = a.Name
+		if a.AvatarURL != "" {
+			userData["avatar_url"] = a.AvatarURL
+		}
+	}
+	// The text is posted as the websocket would post it, by a client that
+	// never joins the room: the account must be allowed to post, and the
+	// room's moderation, if any, sees it first.
+	client := &client{room: g.room, userData: userData}
+	if !g.room.can(client, permPost) || g.room.banned(account) {
+		log.Println("Twilio: ignored a text from", account+": not allowed to post")
+		fmt.Fprint(w, "<Response/>")
+		return
+	}
+	client.post(&message{Message: body})
+	fmt.Fprint(w, "<Response/>")
+}
+
+// twilioSigned reports whether signature is Twilio's signature of a request
+// to u with the form: the HMAC-SHA1, with the auth token, of the URL followed
+// by each of the form's parameters and its value, in order of name.
+func twilioSigned(u string, form url.Values, signature, token string) bool {
+	names := make([]string, 0, len(form))
+	for name := range form {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(u)
+	for _, name := range names {
+		for _, v := range form[name] {
+			b.WriteString(name + v)
+		}
+	}
+	mac := hmac.New(sha1.New, []byte(token))
+	mac.Write([]byte(b.String()))
+	want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(signature), []byte(want))
+}
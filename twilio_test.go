@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTwilioTexts checks that texts are only posted when Twilio signed them
+// with the account's auth token, and the account texting may post.
+func TestTwilioTexts(t *testing.T) {
+	users, err := openUserStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := newTwilioGateway("AC1", "token", "+15550000000", "+15551111111=member,+15552222222=guest", users, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.room = newRoom(1)
+	g.room.roles.grant(roleGuest, "guest")
+	posted := make(chan *message, 1)
+	go func() {
+		for msg := range g.room.forward {
+			posted <- msg
+		}
+	}()
+
+	const u = "http://example.com/api/integrations/twilio/sms"
+	text := func(from, signedWith string) int {
+		form := url.Values{"From": {from}, "Body": {"on it"}}
+		var b strings.Builder
+		b.WriteString(u)
+		b.WriteString("Body" + "on it")
+		b.WriteString("From" + from)
+		mac := hmac.New(sha1.New, []byte(signedWith))
+		mac.Write([]byte(b.String()))
+		r := httptest.NewRequest("POST", u, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Twilio-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := text("+15551111111", ""); code != http.StatusForbidden {
+		t.Errorf("a text signed with an empty token got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := text("+15552222222", "token"); code != http.StatusOK {
+		t.Errorf("a guest's text got %d, want %d", code, http.StatusOK)
+	}
+	select {
+	case msg := <-posted:
+		t.Fatalf("a guest, who may only read, posted %q", msg.Message)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if code := text("+15551111111", "token"); code != http.StatusOK {
+		t.Errorf("a member's text got %d, want %d", code, http.StatusOK)
+	}
+	select {
+	case msg := <-posted:
+		if msg.Message != "on it" || msg.sender() != "member" {
+			t.Errorf("posted %q from %q, want %q from member", msg.Message, msg.sender(), "on it")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the member's text was never posted")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// markRead records that the client's user has read every message in the
+// room up to the one with the given ID, and tells the user's other
+// connections, so they can clear their unread markers too. Markers only ever
+// move forward: reading an old message on one device doesn't mark newer
+// ones unread again.
+func (c *client) markRead(id uint64) {
+	if accountID, _ := c.userData["id"].(string); accountID != "" && c.room.users != nil {
+		a, err := c.room.users.update(accountID, func(a *account) {
+			if a.LastRead == nil {
+				a.LastRead = make(map[string]uint64)
+			}
+			if id > a.LastRead[c.room.key()] {
+				a.LastRead[c.room.key()] = id
+			}
+		})
+		if err != nil && err != errNoAccount {
+			log.Println("Failed to save read marker:", err)
+		}
+		if a != nil {
+			id = a.LastRead[c.room.key()]
+		}
+	}
+	c.room.forward <- &message{Read: id, toAccount: c.account()}
+}
+
+// unread returns how many messages in the room come after the one with the
+// given ID. Only the room's recent history is counted, so the count never
+// goes above historySize.
+func (r *room) unread(after uint64) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n := 0
+	for _, msg := range r.state.History {
+		if msg.ID > after && !msg.System {
+			n++
+		}
+	}
+	return n
+}
+
+// unreadHandler serves /api/me/unread, the number of messages the signed in
+// user hasn't read in each room.
+type unreadHandler struct {
+	users *userStore
+	rooms map[string]*room
+}
+
+func (h *unreadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a := h.users.get(currentAccountID(r))
+	if a == nil {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return
+	}
+	unread := make(map[string]int, len(h.rooms))
+	for name, room := range h.rooms {
+		unread[name] = room.unread(a.LastRead[room.key()])
+	}
+	writeJSON(w, unread)
+}
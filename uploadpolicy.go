@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadPolicy says what may be uploaded, beyond the size of any one file:
+// which types of file, judged by what they are rather than what the browser
+// says, which file extensions, and how much each person may upload in a day.
+type uploadPolicy struct {
+	// allow are the types that may be uploaded, such as image/* or
+	// application/pdf, or empty to allow any but those in deny.
+	allow []string
+	deny  []string
+
+	// denyExtensions are the extensions, such as .exe, of files that may
+	// not be uploaded whatever they turn out to be.
+	denyExtensions []string
+
+	// daily is how many bytes each person may upload in a day, or zero if
+	// there is no limit.
+	daily int64
+}
+
+// uploadRefusal is why an upload was turned down, and the HTTP status to say
+// so with.
+type uploadRefusal struct {
+	status int
+	reason string
+}
+
+func (e *uploadRefusal) Error() string {
+	return e.reason
+}
+
+// errDailyUploads is returned when somebody has uploaded as much as they may
+// today.
+var errDailyUploads = &uploadRefusal{http.StatusTooManyRequests, "you have uploaded as much as you may today"}
+
+// matchType reports whether contentType, without any parameters, is one of
+// types, where image/* is any image.
+func matchType(contentType string, types []string) bool {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	contentType = strings.TrimSpace(contentType)
+	for _, t := range types {
+		if t == contentType || strings.HasSuffix(t, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns why a file with the given name and sniffed type may not be
+// uploaded, or nil if it may.
+func (p *uploadPolicy) check(name, contentType string) error {
+	if err := p.checkName(name); err != nil || p == nil {
+		return err
+	}
+	if matchType(contentType, p.deny) || len(p.allow) > 0 && !matchType(contentType, p.allow) {
+		return &uploadRefusal{http.StatusUnsupportedMediaType, fmt.Sprintf("files of type %s may not be uploaded", contentType)}
+	}
+	return nil
+}
+
+// checkName returns why a file with the given name may not be uploaded,
+// whatever it turns out to be, or nil if it may.
+func (p *uploadPolicy) checkName(name string) error {
+	if p == nil {
+		return nil
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, denied := range p.denyExtensions {
+		if ext != "" && ext == strings.ToLower(denied) {
+			return &uploadRefusal{http.StatusUnsupportedMediaType, fmt.Sprintf("%s files may not be uploaded", ext)}
+		}
+	}
+	return nil
+}
+
+// uploadDay is the day an upload counts towards the daily limit of.
+func uploadDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// uploadUsage is how much somebody has uploaded on a day.
+type uploadUsage struct {
+	day   string
+	bytes int64
+}
+
+// allowance returns how many more bytes the account may upload today, or -1
+// if there is no limit.
+func (s *uploadStore) allowance(account string) int64 {
+	if s.policy == nil || s.policy.daily <= 0 {
+		return -1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used := s.used[account]
+	if used == nil || used.day != uploadDay(time.Now()) {
+		return s.policy.daily
+	}
+	if left := s.policy.daily - used.bytes; left > 0 {
+		return left
+	}
+	return 0
+}
+
+// count adds an upload to how much its account has uploaded on its day.
+func (s *uploadStore) count(u *upload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	day := uploadDay(u.When)
+	used := s.used[u.Account]
+	if used == nil || used.day < day {
+		used = &uploadUsage{day: day}
+		s.used[u.Account] = used
+	}
+	if used.day == day {
+		used.bytes += u.Size
+	}
+}
+
+// countToday counts the uploads already made today, so that restarting the
+// server doesn't let people upload as much again.
+func (s *uploadStore) countToday() error {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	today := uploadDay(time.Now())
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		var u upload
+		if json.Unmarshal(b, &u) == nil && uploadDay(u.When) == today {
+			s.count(&u)
+		}
+	}
+	return nil
+}
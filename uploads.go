@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What has become of an upload.
+const (
+	// uploadPending uploads are still being scanned, and can't be downloaded
+	// yet.
+	uploadPending = "pending"
+	// uploadReady uploads can be downloaded.
+	uploadReady = "ready"
+	// uploadQuarantined uploads were flagged by a scanner, and are kept aside
+	// where nobody can download them.
+	uploadQuarantined = "quarantined"
+	// uploadFailed uploads couldn't be processed, such as voice messages
+	// that are too long, and can't be downloaded.
+	uploadFailed = "failed"
+)
+
+// scanTimeout is how long the scanners have to look at an upload.
+const scanTimeout = time.Minute
+
+// upload is a file somebody has uploaded, to share in the chat by posting its
+// URL.
+type upload struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Account string    `json:"account"`
+	When    time.Time `json:"when"`
+	Status  string    `json:"status"`
+	Reason  string    `json:"reason,omitempty"`
+	URL     string    `json:"url"`
+
+	// Kind is what the upload is for, if anything in particular: voice
+	// messages are uploadVoice, and have a Duration, in seconds, and a
+	// Transcript if they could be transcribed.
+	Kind       string  `json:"kind,omitempty"`
+	Duration   float64 `json:"duration,omitempty"`
+	Transcript string  `json:"transcript,omitempty"`
+
+	// Thumbnails are smaller versions of an uploaded image, smallest first.
+	Thumbnails []thumbnail `json:"thumbnails,omitempty"`
+}
+
+// uploadIDPattern matches upload IDs, so that IDs from URLs can be trusted
+// in file names.
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// uploadStore keeps uploaded files in a directory, each alongside a JSON
+// file describing it. Files are only served once they have been scanned and
+// found clean; files a scanner flags are moved to the quarantine directory
+// within.
+type uploadStore struct {
+	dir     string
+	maxSize int64
+
+	// scanner, if set, looks at every upload before it can be downloaded.
+	scanner scanner
+
+	// alert tells the moderators about uploads put in quarantine.
+	alert func(text string)
+
+	// voice, if set, processes voice messages, which are turned down if it
+	// isn't.
+	voice *voiceProcessor
+
+	// policy, if set, says what may be uploaded, and used holds how much
+	// each account has uploaded today.
+	policy *uploadPolicy
+	mu     sync.Mutex
+	used   map[string]*uploadUsage
+
+	// partials holds the unfinished resumable uploads, by ID.
+	partials map[string]*partialUpload
+}
+
+// openUploadStore opens the uploads kept in dir, making it if need be, which
+// may only have uploads the policy allows.
+func openUploadStore(dir string, maxSize int64, policy *uploadPolicy) (*uploadStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "quarantine"), 0700); err != nil {
+		return nil, err
+	}
+	s := &uploadStore{dir: dir, maxSize: maxSize, alert: func(string) {}, policy: policy, used: make(map[string]*uploadUsage)}
+	if err := s.countToday(); err != nil {
+		return nil, err
+	}
+	if err := s.loadPartials(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *uploadStore) path(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+// get returns the upload with the given ID, or nil if there isn't one.
+func (s *uploadStore) get(id string) *upload {
+	if !uploadIDPattern.MatchString(id) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(s.path(id) + ".json")
+	if err != nil {
+		return nil
+	}
+	var u upload
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil
+	}
+	return &u
+}
+
+// errVoiceOff is returned when a voice message is uploaded to a store that
+// can't process them.
+var errVoiceOff = &uploadRefusal{http.StatusBadRequest, "voice messages are off"}
+
+// create saves an upload from account, of the given kind, and starts
+// processing and scanning it. Uploads the policy doesn't allow are turned
+// down before anything is written.
+func (s *uploadStore) create(account, name, kind string, src io.Reader) (*upload, error) {
+	if kind != uploadVoice {
+		kind = ""
+	} else if s.voice == nil {
+		return nil, errVoiceOff
+	}
+	allowance := s.allowance(account)
+	if allowance == 0 {
+		return nil, errDailyUploads
+	}
+	// sniff the type from the file itself, rather than trusting what the
+	// browser says it is.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	contentType := http.DetectContentType(head[:n])
+	if kind == uploadVoice && !isAudio(contentType) {
+		return nil, errNotAudio
+	}
+	if err := s.policy.check(name, contentType); err != nil {
+		return nil, err
+	}
+	id, err := newAccountID()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.path(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	body := io.MultiReader(bytes.NewReader(head[:n]), src)
+	if allowance > 0 {
+		// a byte more than is allowed is read, to tell if there was more.
+		body = io.LimitReader(body, allowance+1)
+	}
+	size, err := io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && allowance > 0 && size > allowance {
+		err = errDailyUploads
+	}
+	if err != nil {
+		os.Remove(s.path(id))
+		return nil, err
+	}
+	u := &upload{
+		ID:      id,
+		Name:    filepath.Base(name),
+		Type:    contentType,
+		Size:    size,
+		Account: account,
+		When:    time.Now(),
+		Status:  uploadPending,
+		URL:     "/uploads/" + id,
+		Kind:    kind,
+	}
+	s.count(u)
+	processing := s.scanner != nil || kind == uploadVoice || strings.HasPrefix(u.Type, "image/")
+	if !processing {
+		u.Status = uploadReady
+	}
+	if err := saveJSON(s.path(id)+".json", u); err != nil {
+		os.Remove(s.path(id))
+		return nil, err
+	}
+	if processing {
+		go s.scan(u)
+	}
+	return u, nil
+}
+
+// scan processes an upload, if it is a voice message, makes thumbnails of
+// it, if it is an image, and runs the scanner over it, making it ready to
+// download if it is clean, and quarantining it if not. Uploads that can't be
+// scanned are quarantined too, to be safe.
+func (s *uploadStore) scan(u *upload) {
+	if u.Kind == uploadVoice {
+		reason, err := s.processVoice(context.Background(), u)
+		if err != nil {
+			log.Println("Failed to process voice message:", err)
+			if reason == "" {
+				reason = "it could not be processed"
+			}
+		}
+		if reason != "" {
+			u.Status, u.Reason = uploadFailed, reason
+			if err := saveJSON(s.path(u.ID)+".json", u); err != nil {
+				log.Println("Failed to save upload:", err)
+			}
+			return
+		}
+	}
+	if strings.HasPrefix(u.Type, "image/") {
+		// an image that can't be shrunk is still shared, at full size.
+		if err := s.makeThumbnails(u); err != nil {
+			log.Println("Failed to make thumbnails:", err)
+			s.removeThumbnails(u)
+		}
+	}
+	if s.scanner == nil {
+		u.Status = uploadReady
+		if err := saveJSON(s.path(u.ID)+".json", u); err != nil {
+			log.Println("Failed to save upload:", err)
+		}
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout)
+	defer cancel()
+	reason, err := s.scanFile(ctx, u)
+	if err != nil {
+		log.Println("Failed to scan upload:", err)
+		reason = "it could not be scanned"
+	}
+	if reason == "" {
+		u.Status = uploadReady
+	} else {
+		u.Status, u.Reason = uploadQuarantined, reason
+		if err := os.Rename(s.path(u.ID), filepath.Join(s.dir, "quarantine", u.ID)); err != nil {
+			log.Println("Failed to quarantine upload:", err)
+		}
+		s.removeThumbnails(u)
+		s.alert(fmt.Sprintf("The upload %s (%s) was quarantined: %s", u.ID, u.Name, reason))
+	}
+	if err := saveJSON(s.path(u.ID)+".json", u); err != nil {
+		log.Println("Failed to save upload:", err)
+	}
+}
+
+func (s *uploadStore) scanFile(ctx context.Context, u *upload) (string, error) {
+	f, err := os.Open(s.path(u.ID))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return s.scanner.scan(ctx, u, f)
+}
+
+// uploadsHandler serves /api/uploads, where signed in users POST files to
+// upload, as the multipart form field "file", along with the field "kind" set
+// to voice for voice messages, and /api/uploads/{id}, which says how an
+// upload is getting on. Big files can instead be uploaded in chunks, at
+// /api/uploads/resumable.
+type uploadsHandler struct {
+	store *uploadStore
+}
+
+func (h *uploadsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	account := currentAccountID(r)
+	if account == "" {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/api/uploads/resumable" || strings.HasPrefix(r.URL.Path, "/api/uploads/resumable/") {
+		h.serveResumable(w, r, account, strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/uploads/resumable"), "/"))
+		return
+	}
+	if id := strings.TrimPrefix(r.URL.Path, "/api/uploads/"); id != r.URL.Path {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		u := h.store.get(id)
+		if u == nil || u.Account != account {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, u)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, h.store.maxSize+64*1024)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "bad upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > h.store.maxSize {
+		http.Error(w, "the file is too big", http.StatusRequestEntityTooLarge)
+		return
+	}
+	u, err := h.store.create(account, header.Filename, r.FormValue("kind"), file)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, u)
+}
+
+// downloadHandler serves /uploads/{id}, the uploaded files themselves, once
+// they are ready, and /uploads/{id}/thumbnails/{size}, the thumbnails of
+// images. With a signer, they are only served at signed URLs.
+type downloadHandler struct {
+	store  *uploadStore
+	signer *downloadSigner
+}
+
+func (h *downloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.signer.check(w, r) {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/uploads/"), "/")
+	u := h.store.get(parts[0])
+	if u == nil || u.Status != uploadReady {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 3 && parts[1] == "thumbnails" {
+		h.serveThumbnail(w, r, u, parts[2])
+		return
+	}
+	if len(parts) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(h.store.path(u.ID))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", u.Type)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// only images and audio are shown in the browser; anything else is
+	// downloaded, so an uploaded page can't run scripts on our origin.
+	disposition := "attachment"
+	if strings.HasPrefix(u.Type, "image/") || strings.HasPrefix(u.Type, "audio/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, u.Name))
+	http.ServeContent(w, r, "", u.When, f)
+}
+
+// serveThumbnail serves the upload's thumbnail of the given size.
+func (h *downloadHandler) serveThumbnail(w http.ResponseWriter, r *http.Request, u *upload, size string) {
+	for _, t := range u.Thumbnails {
+		if strconv.Itoa(t.Size) != size {
+			continue
+		}
+		f, err := os.Open(h.store.thumbnailPath(u.ID, t.Size))
+		if err != nil {
+			break
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, "", u.When, f)
+		return
+	}
+	http.NotFound(w, r)
+}
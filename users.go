@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/stretchr/gomniauth/common"
+)
+
+// account is a person using the chat, however many providers they sign in
+// with. Each provider identity they have used is linked to the one account,
+// so whichever they pick they keep the same name in the room.
+type account struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Email     string `json:"email,omitempty"`
+	AvatarURL string `json:"avatar_url,omitempty"`
+
+	// Bio and Status are what people say about themselves on their profile;
+	// the status is for things like "away at lunch".
+	Bio    string `json:"bio,omitempty"`
+	Status string `json:"status,omitempty"`
+
+	// Language is the language the user would like messages translated
+	// into, as a code such as en or pt-BR.
+	Language string `json:"language,omitempty"`
+
+	// Blocked are the accounts whose messages the user doesn't want to see.
+	Blocked []string `json:"blocked,omitempty"`
+
+	// Keywords are the words the user wants to be alerted to whenever
+	// anybody says them.
+	Keywords []string `json:"keywords,omitempty"`
+
+	// Notify is when the user wants to be notified about things they missed.
+	Notify notifyPrefs `json:"notify"`
+
+	// LastRead holds the ID of the last message the user has read in each
+	// room, keyed by room name.
+	LastRead map[string]uint64 `json:"last_read,omitempty"`
+
+	// Identities are the provider identities linked to the account, as
+	// "<provider>:<id>".
+	Identities []string `json:"identities"`
+
+	// Terms are the versions of the terms of service the user has accepted,
+	// and when.
+	Terms []termsAcceptance `json:"terms,omitempty"`
+}
+
+// userStore holds every account, looked up by ID, by linked identity and by
+// verified email. If it has a directory, it is kept in users.json there, and
+// if it has a database, each account is kept in that.
+type userStore struct {
+	mu         sync.Mutex
+	path       string
+	db         accountDB
+	accounts   map[string]*account
+	identities map[string]*account
+	emails     map[string]*account
+
+	// keywords holds the accounts watching for each keyword, and everything
+	// the accounts that want to hear about every message in each room.
+	keywords   map[string]map[string]bool
+	everything map[string]map[string]bool
+}
+
+// accountDB is a database accounts are kept in, instead of users.json.
+type accountDB interface {
+	// loadAccounts returns every account.
+	loadAccounts() ([]*account, error)
+
+	// saveAccount saves a, creating or replacing it.
+	saveAccount(a *account) error
+}
+
+const usersFile = "users.json"
+
+// newUserStore makes a store with no accounts, kept only in memory.
+func newUserStore() *userStore {
+	return &userStore{
+		accounts:   make(map[string]*account),
+		identities: make(map[string]*account),
+		emails:     make(map[string]*account),
+		keywords:   make(map[string]map[string]bool),
+		everything: make(map[string]map[string]bool),
+	}
+}
+
+// openUserDB loads the accounts kept in db.
+func openUserDB(db accountDB) (*userStore, error) {
+	accounts, err := db.loadAccounts()
+	if err != nil {
+		return nil, err
+	}
+	s := newUserStore()
+	s.db = db
+	for _, a := range accounts {
+		s.index(a)
+	}
+	return s, nil
+}
+
+// openUserStore loads the accounts kept in dir. If dir is empty, accounts
+// are only kept in memory.
+func openUserStore(dir string) (*userStore, error) {
+	s := newUserStore()
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s.path = filepath.Join(dir, usersFile)
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var accounts []*account
+	if err := json.Unmarshal(b, &accounts); err != nil {
+		return nil, err
+	}
+	for _, a := range accounts {
+		s.index(a)
+	}
+	return s, nil
+}
+
+// index makes a findable by its ID, identities and email.
+func (s *userStore) index(a *account) {
+	s.accounts[a.ID] = a
+	for _, id := range a.Identities {
+		s.identities[id] = a
+	}
+	if a.Email != "" {
+		s.emails[strings.ToLower(a.Email)] = a
+	}
+	for _, k := range a.Keywords {
+		if s.keywords[k] == nil {
+			s.keywords[k] = make(map[string]bool)
+		}
+		s.keywords[k][a.ID] = true
+	}
+	for room, level := range a.Notify.Rooms {
+		if level == notifyAll {
+			if s.everything[room] == nil {
+				s.everything[room] = make(map[string]bool)
+			}
+			s.everything[room][a.ID] = true
+		}
+	}
+}
+
+// unindexPrefs stops a being found by its keywords and notification
+// preferences, which are about to change.
+func (s *userStore) unindexPrefs(a *account) {
+	for _, k := range a.Keywords {
+		delete(s.keywords[k], a.ID)
+		if len(s.keywords[k]) == 0 {
+			delete(s.keywords, k)
+		}
+	}
+	for room := range a.Notify.Rooms {
+		delete(s.everything[room], a.ID)
+		if len(s.everything[room]) == 0 {
+			delete(s.everything, room)
+		}
+	}
+}
+
+// get returns a copy of the account with the given ID, or nil.
+func (s *userStore) get(id string) *account {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accounts[id].copy()
+}
+
+// copy returns a copy of a, which can be read while the store changes a.
+func (a *account) copy() *account {
+	if a == nil {
+		return nil
+	}
+	c := *a
+	c.Identities = append([]string(nil), a.Identities...)
+	c.Blocked = append([]string(nil), a.Blocked...)
+	c.Keywords = append([]string(nil), a.Keywords...)
+	c.Terms = append([]termsAcceptance(nil), a.Terms...)
+	c.Notify.Rooms = make(map[string]string, len(a.Notify.Rooms))
+	for room, level := range a.Notify.Rooms {
+		c.Notify.Rooms[room] = level
+	}
+	c.LastRead = make(map[string]uint64, len(a.LastRead))
+	for room, id := range a.LastRead {
+		c.LastRead[room] = id
+	}
+	return &c
+}
+
+// findByName returns an account going by the given name, or nil. Names are
+// only unique within a room, so if several accounts share a name, any one of
+// them may be returned.
+func (s *userStore) findByName(name string) *account {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := nameKey(name)
+	for _, a := range s.accounts {
+		if nameKey(a.Name) == key {
+			return a.copy()
+		}
+	}
+	return nil
+}
+
+// findByEmail returns the account with the given verified email, or nil.
+func (s *userStore) findByEmail(email string) *account {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.emails[strings.ToLower(email)].copy()
+}
+
+// update changes the account with the given ID by calling change with it,
+// and saves the result. The account must not be changed other than by update.
+func (s *userStore) update(id string, change func(a *account)) (*account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[id]
+	if !ok {
+		return nil, errNoAccount
+	}
+	s.unindexPrefs(a)
+	change(a)
+	s.index(a)
+	return a.copy(), s.save(a)
+}
+
+// errNoAccount is returned when there is no account with a given ID.
+var errNoAccount = errors.New("no such account")
+
+// rename changes the name of the account with the given ID.
+func (s *userStore) rename(id, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[id]
+	if !ok {
+		return nil
+	}
+	a.Name = name
+	return s.save(a)
+}
+
+// login finds the account for somebody who has just signed in with a
+// provider, creating or linking one as needed:
+//
+//   - an identity that has signed in before belongs to the same account as
+//     last time;
+//   - if currentID is the account of whoever is already signed in, the new
+//     identity is linked to it, which is how people link providers
+//     explicitly: by signing in with one while signed in with another;
+//   - an identity with a verified email that an account already has is
+//     linked to that account;
+//   - anyone else gets a new account.
+//
+// email must be empty unless the provider has verified it, as verifiedEmail
+// checks, or anybody could take over an account by claiming its email
+// somewhere that doesn't check.
+func (s *userStore) login(currentID, provider, providerID, email, name, avatarURL string) (*account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	identity := provider + ":" + providerID
+	if a, ok := s.identities[identity]; ok {
+		return a.copy(), nil
+	}
+	a := s.accounts[currentID]
+	if a == nil && email != "" {
+		a = s.emails[strings.ToLower(email)]
+	}
+	if a == nil {
+		id, err := newAccountID()
+		if err != nil {
+			return nil, err
+		}
+		a = &account{ID: id, Name: name, Email: email, AvatarURL: avatarURL}
+	}
+	if a.Email == "" {
+		a.Email = email
+	}
+	if a.AvatarURL == "" {
+		a.AvatarURL = avatarURL
+	}
+	a.Identities = append(a.Identities, identity)
+	s.index(a)
+	return a.copy(), s.save(a)
+}
+
+// save saves changed, the account that has just been changed, to the store's
+// database, or writes every account to its file. Callers must hold s.mu.
+func (s *userStore) save(changed *account) error {
+	if s.db != nil {
+		return s.db.saveAccount(changed)
+	}
+	if s.path == "" {
+		return nil
+	}
+	accounts := make([]*account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		accounts = append(accounts, a)
+	}
+	return saveJSON(s.path, accounts)
+}
+
+// saveJSON writes v to the named file as JSON, by way of a temporary file so
+// a crash part way through leaves the previous version intact.
+func saveJSON(filename string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// newAccountID makes a random account ID.
+func newAccountID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// emailVerifiers are the providers that say whether they have checked the
+// emails they hand out belong to the user. Nobody else's emails are trusted
+// to link accounts: Facebook, GitHub and Microsoft can hand out addresses
+// nobody checked, so anybody could register somebody else's email with one,
+// sign in, and be given that person's account. People signed in with those
+// link them by signing in with them while signed in.
+var emailVerifiers = map[string]bool{"apple": true, "discord": true, "google": true}
+
+// verifiedEmail returns the email of the user signed in with the named
+// provider if the provider has verified it, and is empty otherwise.
+func verifiedEmail(provider string, user common.User) string {
+	if !emailVerifiers[provider] {
+		return ""
+	}
+	if u, ok := user.(*oauthUser); ok {
+		if !u.emailVerified {
+			return ""
+		}
+		return u.Email()
+	}
+	// gomniauth's Google provider hands out the profile as Google sent it,
+	// which says email_verified, or verified_email in older versions of its
+	// API, either of which may arrive as a string.
+	data := user.Data()
+	for _, field := range []string{"email_verified", "verified_email"} {
+		if v := data.Get(field); v.Bool() || v.Str() == "true" {
+			return user.Email()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/gomniauth/common"
+	"github.com/stretchr/objx"
+)
+
+// profileUser is a user of one of gomniauth's own providers, which hand out
+// the profile as the provider sent it.
+type profileUser struct {
+	common.User
+	email string
+	data  objx.Map
+}
+
+func (u *profileUser) Email() string  { return u.email }
+func (u *profileUser) Data() objx.Map { return u.data }
+
+// TestEmailLinksOnlyVerified checks that signing in with an email an account
+// already has only links to that account when the provider is one that
+// verifies emails, and has.
+func TestEmailLinksOnlyVerified(t *testing.T) {
+	users, err := openUserStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const email = "ada@example.com"
+	ada, err := users.login("", "google", "1", verifiedEmail("google", &profileUser{email: email, data: objx.New(map[string]interface{}{"email_verified": true})}), "Ada", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ada.Email != email {
+		t.Fatalf("Google's verified email wasn't kept: got %q", ada.Email)
+	}
+
+	tests := []struct {
+		provider string
+		user     common.User
+		links    bool
+	}{
+		// GitHub and Facebook don't say whether emails are verified.
+		{"github", &profileUser{email: email, data: objx.New(map[string]interface{}{"email_verified": true})}, false},
+		{"facebook", &profileUser{email: email, data: objx.New(map[string]interface{}{})}, false},
+		{"microsoft", &oauthUser{id: "m", email: email, emailVerified: true}, false},
+		{"google", &profileUser{email: email, data: objx.New(map[string]interface{}{"email_verified": "false"})}, false},
+		{"discord", &oauthUser{id: "d1", email: email}, false},
+		{"google", &profileUser{email: email, data: objx.New(map[string]interface{}{"verified_email": "true"})}, true},
+		{"discord", &oauthUser{id: "d2", email: email, emailVerified: true}, true},
+	}
+	for i, test := range tests {
+		a, err := users.login("", test.provider, string(rune('a'+i)), verifiedEmail(test.provider, test.user), "Somebody", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if links := a.ID == ada.ID; links != test.links {
+			t.Errorf("%s user %d: linked to the account with the email is %v, want %v", test.provider, i, links, test.links)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Voice messages are short recordings, uploaded like any other file but
+// with the kind "voice". The server transcodes them with ffmpeg into AAC, in
+// an MP4 container, which every browser can play, works out how long they
+// are, and, if there is a speech to text API, transcribes them, so that they
+// can be searched for and read by those who can't listen. Once the upload is
+// ready, the client sends a message with Voice set to the upload's ID.
+
+// uploadVoice is the kind of upload that is a voice message.
+const uploadVoice = "voice"
+
+// voiceNote is the voice message a message is, as clients are told it.
+type voiceNote struct {
+	URL        string  `json:"url"`
+	Duration   float64 `json:"duration"`
+	Transcript string  `json:"transcript,omitempty"`
+}
+
+// voiceProcessor transcodes and transcribes voice messages.
+type voiceProcessor struct {
+	// ffmpeg is the ffmpeg binary voice messages are transcoded with, and
+	// maxDuration the longest a voice message may be.
+	ffmpeg      string
+	maxDuration time.Duration
+
+	// transcriber, if set, transcribes voice messages.
+	transcriber transcriber
+}
+
+// voiceTimeout is how long transcoding or transcribing a voice message may
+// take.
+const voiceTimeout = time.Minute
+
+// errNotAudio is returned when a voice message that isn't audio is uploaded.
+var errNotAudio = &uploadRefusal{http.StatusBadRequest, "voice messages must be audio"}
+
+// isAudio reports whether an upload of the sniffed type could be a recording.
+// Browsers record WebM, which sniffs as video whether it has any or not.
+func isAudio(contentType string) bool {
+	return strings.HasPrefix(contentType, "audio/") || contentType == "application/ogg" || contentType == "video/webm"
+}
+
+// ffmpegDuration matches where ffmpeg says how long its input is.
+var ffmpegDuration = regexp.MustCompile(`Duration: (\d+):(\d+):(\d+(?:\.\d+)?)`)
+
+// transcode transcodes the recording at src into dst, returning how long it
+// is.
+func (p *voiceProcessor) transcode(ctx context.Context, src, dst string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, voiceTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.ffmpeg, "-hide_banner", "-nostdin", "-y", "-i", src,
+		"-vn", "-ac", "1", "-c:a", "aac", "-b:a", "64k", "-movflags", "+faststart", "-f", "mp4", dst)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("ffmpeg: %v: %s", err, lastLine(stderr.String()))
+	}
+	m := ffmpegDuration.FindStringSubmatch(stderr.String())
+	if m == nil {
+		return 0, errors.New("ffmpeg didn't say how long the recording is")
+	}
+	h, _ := strconv.Atoi(m[1])
+	min, _ := strconv.Atoi(m[2])
+	sec, _ := strconv.ParseFloat(m[3], 64)
+	return time.Duration(h)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec*float64(time.Second)), nil
+}
+
+// lastLine is the last line of s, which is where ffmpeg says what went
+// wrong.
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	return s[strings.LastIndex(s, "\n")+1:]
+}
+
+// processVoice transcodes a voice message, and transcribes it if it can,
+// before it is scanned. It returns why the upload failed, if it did.
+func (s *uploadStore) processVoice(ctx context.Context, u *upload) (string, error) {
+	path := s.path(u.ID)
+	duration, err := s.voice.transcode(ctx, path, path+".m4a")
+	if err != nil {
+		os.Remove(path + ".m4a")
+		return "it could not be transcoded", err
+	}
+	if duration > s.voice.maxDuration {
+		os.Remove(path + ".m4a")
+		return fmt.Sprintf("it is longer than %v", s.voice.maxDuration), nil
+	}
+	if err := os.Rename(path+".m4a", path); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	u.Type, u.Size, u.Duration = "audio/mp4", info.Size(), duration.Seconds()
+	u.Name = strings.TrimSuffix(u.Name, extension(u.Name)) + ".m4a"
+	if s.voice.transcriber != nil {
+		// a voice message that can't be transcribed can still be
+		// listened to.
+		if u.Transcript, err = s.voice.transcriber.transcribe(ctx, path); err != nil {
+			u.Transcript = ""
+			log.Println("Failed to transcribe voice message:", err)
+		}
+	}
+	return "", nil
+}
+
+// extension is the file name's extension, such as .webm.
+func extension(name string) string {
+	if i := strings.LastIndex(name, "."); i > 0 {
+		return name[i:]
+	}
+	return ""
+}
+
+// attachVoice makes msg the voice message uploaded as id, by the client's
+// user.
+func (c *client) attachVoice(msg *message, id string) error {
+	uploads := c.room.uploads
+	if uploads == nil || uploads.voice == nil {
+		return errors.New("voice messages are off")
+	}
+	u := uploads.get(id)
+	switch {
+	case u == nil || u.Account != c.account() || u.Kind != uploadVoice:
+		return fmt.Errorf("there is no voice message %s", id)
+	case u.Status == uploadPending:
+		return errors.New("the voice message isn't ready yet")
+	case u.Status != uploadReady:
+		return fmt.Errorf("the voice message can't be sent: %s", u.Reason)
+	}
+	msg.Voice = &voiceNote{URL: u.URL, Duration: u.Duration, Transcript: u.Transcript}
+	// clients that don't know about voice messages show the transcript.
+	msg.Message = u.Transcript
+	if msg.Message == "" {
+		msg.Message = fmt.Sprintf("Voice message (%v)", time.Duration(u.Duration)*time.Second)
+	}
+	return nil
+}
+
+// transcriber turns speech into text.
+type transcriber interface {
+	transcribe(ctx context.Context, path string) (string, error)
+}
+
+// whisper transcribes with an OpenAI compatible speech to text API.
+type whisper struct {
+	url, apiKey, model string
+	http               *http.Client
+}
+
+func newWhisper(url, apiKey, model string) *whisper {
+	return &whisper{url: strings.TrimSuffix(url, "/"), apiKey: apiKey, model: model, http: &http.Client{Timeout: voiceTimeout}}
+}
+
+func (t *whisper) transcribe(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("model", t.model)
+	part, err := form.CreateFormFile("file", "voice.m4a")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return "", err
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", t.url+"/audio/transcriptions", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if t.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	}
+	resp, err := t.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Text  string `json:"text"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.Error != nil {
+		return "", errors.New(result.Error.Message)
+	}
+	return strings.TrimSpace(result.Text), nil
+}
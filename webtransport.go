@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// newHTTP3Server makes a server for HTTP/3, over QUIC, serving handler at
+// addr with the given certificate. It also takes WebTransport sessions, for
+// the handlers made by newWebTransportHandler.
+func newHTTP3Server(addr string, cert tls.Certificate, handler http.Handler) *webtransport.Server {
+	h3 := &http3.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	}
+	webtransport.ConfigureHTTP3Server(h3)
+	return &webtransport.Server{
+		H3:                   h3,
+		ApplicationProtocols: subprotocols(),
+	}
+}
+
+type altSvcHandler struct {
+	h3   *http3.Server
+	next http.Handler
+}
+
+func (h *altSvcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.h3.SetQUICHeaders(w.Header())
+	h.next.ServeHTTP(w, r)
+}
+
+// AdvertiseHTTP3 wraps handler so that its responses tell browsers, with an
+// Alt-Svc header, that they can use HTTP/3 instead.
+func AdvertiseHTTP3(s *webtransport.Server, handler http.Handler) http.Handler {
+	return &altSvcHandler{h3: s.H3, next: handler}
+}
+
+// webTransportHandler is an alternative to the websocket at /room, over
+// WebTransport, which copes better with lossy mobile networks. The client
+// opens one bidirectional stream, over which messages go both ways, each
+// preceded by its length as four bytes, big endian. Messages are in the wire
+// format picked by the application protocol the session agreed on, or JSON.
+type webTransportHandler struct {
+	room   *room
+	server *webtransport.Server
+}
+
+// newWebTransportHandler makes a handler for WebTransport sessions with r.
+func newWebTransportHandler(r *room, s *webtransport.Server) http.Handler {
+	return &webTransportHandler{room: r, server: s}
+}
+
+func (h *webTransportHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	userData, err := h.room.userData(req)
+	if err != nil {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return
+	}
+	session, err := h.server.Upgrade(w, req)
+	if err != nil {
+		log.Println("WebTransport upgrade:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	stream, err := session.AcceptStream(req.Context())
+	if err != nil {
+		session.CloseWithError(0, "")
+		return
+	}
+	t := &webTransportConn{
+		session: session,
+		stream:  stream,
+		reader:  bufio.NewReader(stream),
+		limit:   h.room.maxMessageSize,
+		wire:    wireFormatFor(session.SessionState().ApplicationProtocol),
+	}
+	serveTransport(h.room, req, userData, t.wire, t)
+}
+
+// webTransportConn is the transport for a WebTransport session.
+type webTransportConn struct {
+	session *webtransport.Session
+	stream  *webtransport.Stream
+	reader  *bufio.Reader
+	limit   int64
+	wire    *wireFormat
+
+	closeOnce sync.Once
+}
+
+// WebTransport session error codes we close sessions with.
+const (
+	webTransportTurnedAway webtransport.SessionErrorCode = 1
+	webTransportTooBig     webtransport.SessionErrorCode = 2
+)
+
+func (c *webTransportConn) read() (*message, error) {
+	var size uint32
+	if err := binary.Read(c.reader, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if c.limit > 0 && int64(size) > c.limit {
+		text, _ := json.Marshal(closeReason{Error: "message_too_big", Limit: c.limit})
+		c.session.CloseWithError(webTransportTooBig, string(text))
+		return nil, errMessageTooBig
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := io.CopyN(buf, c.reader, int64(size)); err != nil {
+		return nil, err
+	}
+	return c.wire.decode(buf.Bytes())
+}
+
+func (c *webTransportConn) write(msg *message) error {
+	frame, err := msg.frame(c.wire)
+	if err != nil {
+		return err
+	}
+	defer frame.release()
+	b := make([]byte, 4, 4+len(frame.data))
+	binary.BigEndian.PutUint32(b, uint32(len(frame.data)))
+	_, err = c.stream.Write(append(b, frame.data...))
+	return err
+}
+
+func (c *webTransportConn) close(reason *closeReason) {
+	c.closeOnce.Do(func() {
+		if reason != nil {
+			text, _ := json.Marshal(reason)
+			c.session.CloseWithError(webTransportTurnedAway, string(text))
+			return
+		}
+		c.session.CloseWithError(0, "")
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// A room's moderators can have it greet everybody who joins with a welcome
+// message and the room's rules, sent to them alone as soon as they join.
+
+// welcomeCommand makes the command that sets the room's welcome message, or
+// its rules if rules is set: /welcome <text> | off or /rules <text> | off.
+func welcomeCommand(rules bool) func(c *client, args string) error {
+	return func(c *client, args string) error {
+		if args == "" {
+			return errUsage
+		}
+		text := args
+		if args == "off" {
+			text = ""
+		}
+		e := &roomEvent{Type: eventWelcome, Name: c.name(), Account: c.account(), Message: text, When: time.Now()}
+		what := "welcome message"
+		if rules {
+			e.Type, what = eventRules, "rules"
+		}
+		c.room.changes <- e
+		if text == "" {
+			c.reply(fmt.Sprintf("The room's %s is cleared", what))
+		} else {
+			c.reply(fmt.Sprintf("The room's %s is set", what))
+		}
+		return nil
+	}
+}
+
+// greet sends the room's welcome message and rules, if it has them, to the
+// client that has just joined. It must only be called from run.
+func (r *room) greet(client *client) {
+	now := time.Now()
+	if r.state.Welcome != "" {
+		r.deliver(&message{Message: r.state.Welcome, When: now, System: true, to: client})
+	}
+	if r.state.Rules != "" {
+		r.deliver(&message{Message: locales.sprintf(client.locale, "Room rules: %s", r.state.Rules), When: now, System: true, to: client})
+	}
+}
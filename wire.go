@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// wireFormat is a way of encoding messages down a websocket. Clients pick
+// one by asking for its subprotocol when they connect; those that don't ask
+// for any are sent JSON.
+type wireFormat struct {
+	// subprotocol is the websocket subprotocol that picks the format.
+	subprotocol string
+
+	// frameType is the type of websocket message the format is sent in.
+	frameType int
+
+	encode func(msg *message) ([]byte, error)
+
+	// decode decodes a message sent by a client, keeping only the fields
+	// clients may set.
+	decode func(data []byte) (*message, error)
+}
+
+// encodedFrame is a message encoded in one wire format, both as it is and
+// framed for gorilla/websocket.
+type encodedFrame struct {
+	data     []byte
+	prepared *websocket.PreparedMessage
+
+	// owner is the message whose pooled buffer data is in, if it is, which
+	// the frame holds a reference to.
+	owner *message
+}
+
+// release drops the frame's reference to the buffer it is in, if any.
+func (f *encodedFrame) release() {
+	if f.owner != nil {
+		f.owner.release()
+	}
+}
+
+var (
+	// jsonWire is the JSON the browser is sent. The room always prepares
+	// messages in it, in pooled buffers.
+	jsonWire = &wireFormat{
+		subprotocol: "chat.v1.json",
+		frameType:   websocket.TextMessage,
+		encode: func(msg *message) ([]byte, error) {
+			return json.Marshal(msg)
+		},
+		decode: decodeMessage,
+	}
+
+	// protoWire is the Envelope from chat.proto, which is smaller and
+	// quicker to parse than JSON, for busy rooms.
+	protoWire = &wireFormat{
+		subprotocol: "chat.v1.proto",
+		frameType:   websocket.BinaryMessage,
+		encode: func(msg *message) ([]byte, error) {
+			return proto.Marshal(envelope(msg))
+		},
+		decode: decodeEnvelope,
+	}
+
+	// msgpackWire is the JSON envelope, with the same field names, encoded
+	// as MessagePack: smaller than JSON, without needing protobuf.
+	msgpackWire = &wireFormat{
+		subprotocol: "chat.v1.msgpack",
+		frameType:   websocket.BinaryMessage,
+		encode: func(msg *message) ([]byte, error) {
+			var buf bytes.Buffer
+			enc := msgpack.NewEncoder(&buf)
+			enc.SetCustomStructTag("json")
+			enc.UseCompactInts(true)
+			if err := enc.Encode(msg); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		decode: decodeMsgpack,
+	}
+)
+
+// wireFormats are the wire formats clients may ask for. If a client asks for
+// several, it gets the first of them we know.
+var wireFormats = []*wireFormat{jsonWire, protoWire, msgpackWire}
+
+// subprotocols are the subprotocols of every wire format.
+func subprotocols() []string {
+	var names []string
+	for _, f := range wireFormats {
+		names = append(names, f.subprotocol)
+	}
+	return names
+}
+
+// wireFormatFor returns the wire format picked by the subprotocol agreed on
+// when the websocket was opened, which is JSON if none was.
+func wireFormatFor(subprotocol string) *wireFormat {
+	for _, f := range wireFormats {
+		if f.subprotocol == subprotocol {
+			return f
+		}
+	}
+	return jsonWire
+}
+
+// encodeFrame encodes and frames msg in the wire format, as clients are sent
+// it.
+func (f *wireFormat) encodeFrame(msg *message) (*encodedFrame, error) {
+	data, err := f.encode(msg.public())
+	if err != nil {
+		return nil, err
+	}
+	prepared, err := websocket.NewPreparedMessage(f.frameType, data)
+	if err != nil {
+		return nil, err
+	}
+	return &encodedFrame{data: data, prepared: prepared}, nil
+}
+
+// envelope converts msg to its protobuf form.
+func envelope(msg *message) *Envelope {
+	e := &Envelope{
+		Id:       msg.ID,
+		Name:     msg.Name,
+		Text:     msg.Message,
+		Sender:   msg.Sender,
+		System:   msg.System,
+		Mentions: msg.Mentions,
+		Flagged:  msg.Flagged,
+		Deleted:  msg.Deleted,
+		Read:     msg.Read,
+		Typing:   msg.Typing,
+		Ack:      msg.Ack,
+		Presence: msg.Presence,
+		Edited:   timestamp(msg.Edited),
+		Expires:  timestamp(msg.Expires),
+		Voice:    voiceProto(msg.Voice),
+		Action:   msg.Action,
+	}
+	if !msg.When.IsZero() {
+		e.When = timestamppb.New(msg.When)
+	}
+	for _, r := range msg.Receipts {
+		e.Receipts = append(e.Receipts, &Receipt{From: r.From, To: r.To, Reader: r.Reader})
+	}
+	if p := msg.Poll; p != nil {
+		e.Poll = &Poll{Id: p.ID, Question: p.Question, Options: p.Options, Creator: p.Creator, Closed: p.Closed}
+		for _, n := range p.Counts {
+			e.Poll.Counts = append(e.Poll.Counts, int64(n))
+		}
+	}
+	if w := msg.Welcome; w != nil {
+		e.Welcome = &Hello{Version: uint32(w.Version), Capabilities: w.Capabilities}
+	}
+	if t := msg.Translation; t != nil {
+		e.Translation = &Translation{Of: t.Of, Language: t.Language, Text: t.Text}
+	}
+	return e
+}
+
+// timestamp converts an optional time to its protobuf form.
+func timestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+// voiceProto converts a voice message's recording to its protobuf form.
+func voiceProto(v *voiceNote) *VoiceNote {
+	if v == nil {
+		return nil
+	}
+	return &VoiceNote{Url: v.URL, Duration: v.Duration, Transcript: v.Transcript}
+}
+
+// decodeEnvelope decodes an Envelope sent by a client, keeping only the
+// fields clients may set, just as decodeMessage does for JSON.
+func decodeEnvelope(data []byte) (*message, error) {
+	var e Envelope
+	if err := proto.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	in := clientMessage{Message: e.Text, Read: e.Read, Typing: e.Typing, Nonce: e.Nonce}
+	if e.Vote != nil {
+		in.Vote = &pollVote{Poll: e.Vote.Poll, Choice: int(e.Vote.Choice)}
+	}
+	if e.Hello != nil {
+		in.Hello = &hello{Version: int(e.Hello.Version), Capabilities: e.Hello.Capabilities}
+	}
+	return in.message(), nil
+}
+
+// decodeMsgpack decodes a MessagePack message sent by a client, keeping only
+// the fields clients may set.
+func decodeMsgpack(data []byte) (*message, error) {
+	var in clientMessage
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(&in); err != nil {
+		return nil, err
+	}
+	return in.message(), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// wireTestMessage is a message with every field clients are sent set, at
+// least the ones that were added after the wire formats.
+func wireTestMessage() *message {
+	when := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	edited, expires := when.Add(time.Minute), when.Add(time.Hour)
+	return &message{
+		ID:       7,
+		Name:     "ada",
+		Message:  "waves",
+		When:     when,
+		Action:   true,
+		Presence: presenceJoined,
+		Receipts: []receipt{{From: 3, To: 7, Reader: "ada"}},
+		Edited:   &edited,
+		Expires:  &expires,
+		Voice:    &voiceNote{URL: "/uploads/1", Duration: 2.5, Transcript: "waves"},
+	}
+}
+
+// TestWireRoundTrip checks that each wire format carries every field of a
+// message, decoded as clients decode them.
+func TestWireRoundTrip(t *testing.T) {
+	want := wireTestMessage()
+
+	for _, f := range []*wireFormat{jsonWire, msgpackWire} {
+		b, err := f.encode(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got message
+		if f == jsonWire {
+			err = json.Unmarshal(b, &got)
+		} else {
+			dec := msgpack.NewDecoder(bytes.NewReader(b))
+			dec.SetCustomStructTag("json")
+			err = dec.Decode(&got)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", f.subprotocol, err)
+		}
+		if got.Action != want.Action || got.Presence != want.Presence ||
+			!reflect.DeepEqual(got.Receipts, want.Receipts) || !reflect.DeepEqual(got.Voice, want.Voice) ||
+			got.Edited == nil || !got.Edited.Equal(*want.Edited) || got.Expires == nil || !got.Expires.Equal(*want.Expires) {
+			t.Errorf("%s: got %+v, want %+v", f.subprotocol, got, *want)
+		}
+	}
+
+	b, err := protoWire.encode(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Envelope
+	if err := proto.Unmarshal(b, &e); err != nil {
+		t.Fatal(err)
+	}
+	if !e.Action || e.Presence != want.Presence || len(e.Receipts) != 1 || e.Receipts[0].To != 7 || e.Receipts[0].Reader != "ada" ||
+		!e.Edited.AsTime().Equal(*want.Edited) || !e.Expires.AsTime().Equal(*want.Expires) ||
+		e.Voice.GetUrl() != want.Voice.URL || e.Voice.GetDuration() != want.Voice.Duration || e.Voice.GetTranscript() != want.Voice.Transcript {
+		t.Errorf("%s: got %v", protoWire.subprotocol, &e)
+	}
+
+	b, err = proto.Marshal(chatMessage(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m ChatMessage
+	if err := proto.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Action || m.Presence != want.Presence ||
+		!m.Edited.AsTime().Equal(*want.Edited) || !m.Expires.AsTime().Equal(*want.Expires) ||
+		m.Voice.GetUrl() != want.Voice.URL || m.Voice.GetTranscript() != want.Voice.Transcript {
+		t.Errorf("gRPC: got %v", &m)
+	}
+}